@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/nvcontainer"
+)
+
+// The device request of the allocation files of the Kubernetes device plugin.
+const requestSourceAllocations = "device-plugin-allocations"
+
+// Annotations of the name of a container in its pod, set by containerd and CRI-O.
+var containerNameAnnotations = nvcontainer.ContainerNameAnnotations
+
+// getAllocatedDevices returns the GPUs the device plugin allocated to a container of a pod, none if the pod has no
+// allocation file: unlike the environment, the containers can't change it.
+func getAllocatedDevices(dir string, pod string, annotations map[string]string) (string, error) {
+	name := nvcontainer.ContainerName(annotations)
+	if len(name) == 0 {
+		return "", &hookError{exitCodeBadSpec, fmt.Errorf("the name of the container in pod %s isn't annotated", pod)}
+	}
+	return nvcontainer.AllocatedDevices(dir, pod, name)
+}
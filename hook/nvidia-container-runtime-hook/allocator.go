@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/allocator"
+)
+
+const defaultAllocatorSocket = "/run/nvidia-container-runtime/allocator.sock"
+
+// allocatorServer is the node-local allocation service, agents reserve GPUs in the ledger and the hook enforces
+// the reservations. It's served with gRPC, see pkg/allocator/allocator.proto.
+type allocatorServer struct {
+	allocator.UnimplementedAllocatorServer
+	ledger string
+}
+
+func newAllocatorServer(ledger string) *grpc.Server {
+	s := grpc.NewServer()
+	allocator.RegisterAllocatorServer(s, &allocatorServer{ledger: ledger})
+	return s
+}
+
+func ledgerEntries(l *ledger) []*allocator.Entry {
+	entries := make([]*allocator.Entry, 0, len(l.Entries))
+	for _, e := range l.Entries {
+		entries = append(entries, &allocator.Entry{
+			Uuid:   e.UUID,
+			Owner:  e.Owner,
+			Since:  timestamppb.New(e.Since),
+			Shared: e.Shared,
+			Pid:    int32(e.Pid),
+		})
+	}
+	return entries
+}
+
+func (a *allocatorServer) Allocate(ctx context.Context, req *allocator.AllocateRequest) (*allocator.AllocateResponse, error) {
+	if len(req.Owner) == 0 || len(req.Uuids) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "an owner and GPUs are required")
+	}
+	l, err := openLedger(a.ledger)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer l.close()
+
+	if err := l.allocate(req.Owner, req.Uuids); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err := l.save(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &allocator.AllocateResponse{Entries: ledgerEntries(l)}, nil
+}
+
+func (a *allocatorServer) Release(ctx context.Context, req *allocator.ReleaseRequest) (*allocator.ReleaseResponse, error) {
+	if len(req.Owner) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "an owner is required")
+	}
+	l, err := openLedger(a.ledger)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer l.close()
+
+	l.release(req.Owner)
+	if err := l.save(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &allocator.ReleaseResponse{Entries: ledgerEntries(l)}, nil
+}
+
+func (a *allocatorServer) List(ctx context.Context, req *allocator.ListRequest) (*allocator.ListResponse, error) {
+	l, err := openLedger(a.ledger)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer l.close()
+
+	return &allocator.ListResponse{Entries: ledgerEntries(l)}, nil
+}
+
+func doServe(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	socket := flags.String("socket", defaultAllocatorSocket, "unix socket of the allocation service")
+	flags.Parse(args)
+
+	defer exit()
+
+	hook := getHookConfig()
+	if hook.Ledger == nil {
+		log.Panicln("the ledger option isn't set")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*socket), 0755); err != nil {
+		log.Panicln(err)
+	}
+	os.Remove(*socket)
+	listener, err := net.Listen("unix", *socket)
+	if err != nil {
+		log.Panicln("couldn't listen on", *socket, ":", err)
+	}
+	infof("serving GPU allocations on %s", *socket)
+	if err := newAllocatorServer(*hook.Ledger).Serve(listener); err != nil {
+		log.Panicln(err)
+	}
+}
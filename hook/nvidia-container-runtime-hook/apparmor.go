@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const (
+	appArmorEnabledPath = "/sys/module/apparmor/parameters/enabled"
+
+	// Rules of the driver access from the containers, for the profiles denying files by default.
+	appArmorRules = `  # NVIDIA driver access of the containers, from nvidia-container-runtime-hook apparmor-rules.
+  /dev/nvidia* rwm,
+  /dev/nvidia-caps/* rwm,
+  /dev/nvidia-caps-imex-channels/* rwm,
+  /proc/driver/nvidia/** r,
+  /sys/bus/pci/devices/ r,
+  /sys/devices/** r,
+  /run/nvidia-persistenced/socket rw,
+  /run/nvidia-fabricmanager/** r,
+`
+)
+
+func isAppArmorEnabled() bool {
+	b, err := ioutil.ReadFile(appArmorEnabledPath)
+	return err == nil && strings.TrimSpace(string(b)) == "Y"
+}
+
+// execWithAppArmorProfile runs the hook again with arguments, confined by an AppArmor profile from the exec.
+func execWithAppArmorProfile(profile string, args []string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	attr := "/proc/self/attr/apparmor/exec"
+	if _, err := os.Stat(attr); err != nil {
+		// Before Linux 5.8 and the stacking of the LSMs.
+		attr = "/proc/self/attr/exec"
+	}
+	if err := ioutil.WriteFile(attr, []byte("exec "+profile), 0); err != nil {
+		return fmt.Errorf("couldn't change to the AppArmor profile %s: %v", profile, err)
+	}
+	return syscall.Exec(self, append([]string{self}, args...), os.Environ())
+}
+
+// checkAppArmorProfile warns when the AppArmor profile of the container keeps it from opening its NVIDIA devices.
+// They're opened by a child of the hook confined by the profile, at their path in the container.
+func checkAppArmorProfile(container containerConfig) {
+	profile := container.AppArmorProfile
+	if len(profile) == 0 || profile == "unconfined" || !isAppArmorEnabled() {
+		return
+	}
+	var nodes []string
+	root := containerPath(container, "/")
+	for _, n := range getContainerDeviceNodes(container) {
+		// The profiles match the paths seen by the container, the devices are the ones of the host.
+		p := "/" + strings.TrimLeft(strings.TrimPrefix(n, root), "/")
+		if sameDevice(n, p) {
+			nodes = append(nodes, p)
+		}
+	}
+	if len(nodes) == 0 {
+		return
+	}
+	if err := checkDeviceAccess(nodes, "", profile); err != nil {
+		warnf("the AppArmor profile %s keeps the container from opening its NVIDIA devices (%v), "+
+			"add the rules printed by nvidia-container-runtime-hook apparmor-rules to it", profile, err)
+		return
+	}
+	debugf("the AppArmor profile %s allows the NVIDIA devices", profile)
+}
+
+// sameDevice tells whether two paths are the same device node.
+func sameDevice(a string, b string) bool {
+	ma, mia, err := deviceNumbers(a)
+	if err != nil {
+		return false
+	}
+	mb, mib, err := deviceNumbers(b)
+	return err == nil && ma == mb && mia == mib
+}
+
+// doAppArmorRules prints the rules to add to the AppArmor profiles of the GPU containers.
+func doAppArmorRules() {
+	fmt.Print(appArmorRules)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"debug/elf"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/policy"
+)
+
+// Apptainer binds the driver libraries of --nv in this directory, which is in the LD_LIBRARY_PATH of its containers.
+const apptainerLibDir = "/.singularity.d/libs"
+
+type apptainerBind struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+// apptainerManifest is what an HPC launcher binds and sets in the container instead of the hook configuring it.
+type apptainerManifest struct {
+	Binds   []apptainerBind   `json:"binds"`
+	Devices []string          `json:"devices"`
+	Env     map[string]string `json:"env"`
+}
+
+// getSoname returns the soname of a library, the name the programs load it by, or its file name.
+func getSoname(lib string) string {
+	if f, err := elf.Open(lib); err == nil {
+		defer f.Close()
+		if names, err := f.DynString(elf.DT_SONAME); err == nil && len(names) > 0 {
+			return names[0]
+		}
+	}
+	return filepath.Base(lib)
+}
+
+// getApptainerManifest sorts the files of nvidia-container-cli list: the device nodes, the libraries bound by soname
+// like --nv does, and the binaries, IPC sockets and firmware bound on their host path.
+func getApptainerManifest(files []string, nvidia *nvidiaConfig) apptainerManifest {
+	m := apptainerManifest{Env: map[string]string{envNVGPU: nvidia.Devices, envNVDriverCapabilities: nvidia.Capabilities}}
+	for _, f := range files {
+		switch {
+		case len(f) == 0:
+		case strings.HasPrefix(f, "/dev/"):
+			m.Devices = append(m.Devices, f)
+		case strings.Contains(filepath.Base(f), ".so"):
+			m.Binds = append(m.Binds, apptainerBind{f, filepath.Join(apptainerLibDir, getSoname(f))})
+		default:
+			m.Binds = append(m.Binds, apptainerBind{f, f})
+		}
+	}
+	return m
+}
+
+// doApptainer prints the binds, devices and environment of the GPU request of the environment of the command, under
+// the policy of the hook, for Apptainer and Singularity: apptainer exec $(nvidia-container-runtime-hook apptainer) ...
+func doApptainer(args []string) {
+	flags := flag.NewFlagSet("apptainer", flag.ExitOnError)
+	format := flags.String("format", "apptainer", "output format: apptainer (options of apptainer exec) or json")
+	flags.Parse(args)
+
+	defer exit()
+	log.SetFlags(0)
+
+	hook := getHookConfig()
+	setupLogger(hook)
+	cli := hook.NvidiaContainerCLI
+	if *format != "apptainer" && *format != "json" {
+		fail(exitCodeUsage, fmt.Errorf("unknown format: %s", *format))
+	}
+	env, err := getEnvMap(os.Environ(), hook.MountGPUOnlyByUUID)
+	if err != nil {
+		fail(exitCodeBadSpec, err)
+	}
+	nvidia, err := getNvidiaConfig(env, hook.MountGPUOnlyByUUID)
+	if err != nil {
+		fail(exitCodeBadSpec, err)
+	}
+	if nvidia == nil {
+		// No GPU requested, nothing to bind.
+		return
+	}
+
+	if len(nvidia.Devices) > 0 && (len(hook.AllowedDevices) > 0 || len(hook.DeniedDevices) > 0) {
+		info, err := getDriverInfo(cli)
+		if err != nil {
+			fail(exitCodeCLIFailure, err)
+		}
+		if err := policy.CheckDevices(hook, info, nvidia.Devices); err != nil {
+			fail(exitCodePolicy, err)
+		}
+	}
+	if policy := getRequirePolicy(hook, nvidia); policy != requirePolicyIgnore && len(nvidia.Requirements) > 0 {
+		checkRequirements(cli, nvidia, policy)
+	}
+
+	listArgs := []string{}
+	if cli.Root != nil {
+		listArgs = append(listArgs, fmt.Sprintf("--root=%s", *cli.Root))
+	}
+	listArgs = append(listArgs, "list")
+	if len(nvidia.Devices) > 0 {
+		listArgs = append(listArgs, fmt.Sprintf("--device=%s", nvidia.Devices))
+	}
+	out, err := queryDriver(cli, getCLIPath(cli), listArgs...)
+	if err != nil {
+		fail(exitCodeCLIFailure, fmt.Errorf("nvidia-container-cli list failed: %v", err))
+	}
+	m := getApptainerManifest(strings.Split(strings.TrimSpace(string(out)), "\n"), nvidia)
+
+	if *format == "json" {
+		b, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			log.Panicln(err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	// The devices are bound too, for the containers run with --contain which have a minimal /dev.
+	for _, d := range m.Devices {
+		fmt.Printf("--bind %s\n", d)
+	}
+	for _, b := range m.Binds {
+		fmt.Printf("--bind %s:%s:ro\n", b.Source, b.Destination)
+	}
+	for _, k := range []string{envNVGPU, envNVDriverCapabilities} {
+		fmt.Printf("--env %s=%s\n", k, m.Env[k])
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	auditGranted = "granted"
+	auditDenied  = "denied"
+	// granted while the container disabled the checks of its requirements with NVIDIA_DISABLE_REQUIRE.
+	auditPolicyOverridden = "policy-overridden"
+
+	defaultAuditMaxSize  = 100 // MiB
+	defaultAuditMaxFiles = 5
+)
+
+type auditEntry struct {
+	Time      string `json:"time"`
+	Container string `json:"container"`
+	Bundle    string `json:"bundle"`
+	podMetadata
+	Devices      string   `json:"devices"`
+	UUIDs        []string `json:"uuids,omitempty"`
+	Capabilities string   `json:"capabilities"`
+	Policy       string   `json:"policyVersion,omitempty"`
+	Decision     string   `json:"decision"`
+	Reason       string   `json:"reason,omitempty"`
+}
+
+// pendingAudit is the GPU request of the current invocation, logged with the decision when the hook exits.
+type pendingAudit struct {
+	config   AuditConfig
+	cli      CLIConfig
+	entry    auditEntry
+	override bool
+}
+
+// audit of the current invocation, nil when the audit log is disabled or the container requests no GPU.
+var audit *pendingAudit
+
+func startAudit(hook HookConfig, container containerConfig) {
+	if len(hook.Audit.Path) == 0 || container.Nvidia == nil {
+		return
+	}
+	audit = &pendingAudit{
+		config: hook.Audit,
+		cli:    hook.NvidiaContainerCLI,
+		entry: auditEntry{
+			Container:    container.ID,
+			Bundle:       container.Bundle,
+			podMetadata:  container.PodMetadata,
+			Devices:      container.Nvidia.Devices,
+			Capabilities: container.Nvidia.Capabilities,
+			Policy:       hook.PolicyVersion,
+		},
+		override: container.Nvidia.DisableRequire && !hook.DisableRequire && len(hook.RequirePolicy) == 0 && len(container.Nvidia.Requirements) > 0,
+	}
+}
+
+// openAuditLog opens and locks the audit log, opening it again if it was rotated in the meantime.
+func openAuditLog(path string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if current, err := os.Stat(path); err == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+		unlockFile(f)
+		f.Close()
+	}
+}
+
+// rotateAuditLog shifts the rotated files, dropping the oldest, the lock on the log must be held.
+func rotateAuditLog(config AuditConfig) error {
+	files := config.MaxFiles
+	if files < 1 {
+		files = 1
+	}
+	for i := files - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", config.Path, i), fmt.Sprintf("%s.%d", config.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(config.Path, config.Path+".1")
+}
+
+func writeAuditEntry(config AuditConfig, e auditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0755); err != nil {
+		return err
+	}
+	for {
+		f, err := openAuditLog(config.Path)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err == nil && config.MaxSize > 0 && info.Size() > 0 && info.Size()+int64(len(b)) > int64(config.MaxSize)<<20 {
+			err = rotateAuditLog(config)
+			unlockFile(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err == nil {
+			_, err = f.Write(b)
+		}
+		unlockFile(f)
+		f.Close()
+		return err
+	}
+}
+
+// recordAudit logs the decision on the GPU request: denied when the hook exits with an error.
+// A failure to log is reported but doesn't change the exit code of the hook.
+func recordAudit(code int, reason string) {
+	if audit == nil {
+		return
+	}
+	a := *audit
+	audit = nil
+
+	e := a.entry
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	switch {
+	case code != 0:
+		e.Decision, e.Reason = auditDenied, reason
+	case a.override:
+		e.Decision, e.Reason = auditPolicyOverridden, envNVDisableRequire+" is set"
+	default:
+		e.Decision = auditGranted
+	}
+	if len(e.Devices) > 0 {
+		if info, err := getDriverInfo(a.cli); err == nil {
+			e.UUIDs = info.RequestedUUIDs(e.Devices)
+		}
+	}
+	if err := writeAuditEntry(a.config, e); err != nil {
+		warnf("couldn't write the audit log: %v", err)
+	}
+}
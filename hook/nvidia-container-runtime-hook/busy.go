@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/devices"
+)
+
+const computeModeExclusiveProcess = "Exclusive_Process"
+
+// isRequested matches a GPU against a device request: "all", indexes or UUIDs.
+// A MIG device requests the GPU it belongs to.
+func isRequested(request string, index string, uuid string) bool {
+	return devices.IsRequested(request, index, uuid)
+}
+
+// getBusyDevices returns the requested GPUs in exclusive process mode which already run a compute process.
+func getBusyDevices(config CLIConfig, devices string, parallelism int) ([]string, error) {
+	var gpus, apps [][]string
+	errs := make([]error, 2)
+	parallelDo(parallelism, 2, func(i int) {
+		if i == 0 {
+			gpus, errs[i] = queryGPUs(config, "index", "uuid", "compute_mode")
+		} else {
+			apps, errs[i] = queryComputeApps(config, "gpu_uuid")
+		}
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	held := make(map[string]bool)
+	for _, app := range apps {
+		held[app[0]] = true
+	}
+
+	var busy []string
+	for _, gpu := range gpus {
+		if isRequested(devices, gpu[0], gpu[1]) && gpu[2] == computeModeExclusiveProcess && held[gpu[1]] {
+			busy = append(busy, gpu[1])
+		}
+	}
+	return busy, nil
+}
+
+// waitForDevices retries until the requested GPUs are released or the timeout expires.
+func waitForDevices(hook HookConfig, devices string) {
+	deadline := time.Now().Add(hook.BusyTimeout.Duration)
+	for {
+		busy, err := getBusyDevices(hook.NvidiaContainerCLI, devices, hook.Parallelism)
+		if err != nil {
+			fail(exitCodeCLIFailure, fmt.Errorf("couldn't check whether the GPUs are busy: %v", err))
+		}
+		if len(busy) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			fail(exitCodePolicy, fmt.Errorf("GPUs still busy after %v: %s", hook.BusyTimeout.Duration, strings.Join(busy, ",")))
+		}
+		infof("GPUs busy, retrying in %v: %s", hook.BusyRetryInterval.Duration, strings.Join(busy, ","))
+		time.Sleep(hook.BusyRetryInterval.Duration)
+	}
+}
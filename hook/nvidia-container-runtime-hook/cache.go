@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The results of the driver queries are valid until the driver is upgraded or the device nodes change:
+// the key of the cache hashes the driver version with the modification times of the device directories,
+// which change when udev or nvidia-modprobe create or remove nodes. Removing the file invalidates it too.
+var discoveryCacheDirs = []string{"/dev", "/dev/nvidia-caps"}
+
+// discoveryCache holds the outputs of the driver queries, by query and driver root.
+type discoveryCache struct {
+	file    *os.File
+	Key     string                     `json:"key"`
+	Entries map[string]json.RawMessage `json:"entries"`
+}
+
+func getDiscoveryCacheKey() string {
+	h := sha256.New()
+	version, _ := ioutil.ReadFile(procDriverVersionPath)
+	h.Write(version)
+	for _, dir := range discoveryCacheDirs {
+		if info, err := os.Stat(dir); err == nil {
+			fmt.Fprintf(h, "\n%s %d", dir, info.ModTime().UnixNano())
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// openDiscoveryCache opens and locks the cache, dropping its entries if the key changed.
+func openDiscoveryCache(path string) (*discoveryCache, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	c := &discoveryCache{file: f}
+	b, err := ioutil.ReadAll(f)
+	if err == nil && len(b) > 0 && json.Unmarshal(b, c) != nil {
+		debugf("discarding the invalid discovery cache %s", path)
+		c.Key, c.Entries = "", nil
+	} else if err != nil {
+		c.close()
+		return nil, err
+	}
+	if key := getDiscoveryCacheKey(); c.Key != key {
+		c.Key = key
+		c.Entries = nil
+	}
+	if c.Entries == nil {
+		c.Entries = make(map[string]json.RawMessage)
+	}
+	return c, nil
+}
+
+func (c *discoveryCache) save() error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := c.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = c.file.WriteAt(b, 0)
+	return err
+}
+
+func (c *discoveryCache) close() {
+	unlockFile(c.file)
+	c.file.Close()
+}
+
+func discoveryCacheEntry(config CLIConfig, query string) string {
+	root := "/"
+	if config.Root != nil {
+		root = *config.Root
+	}
+	return query + ":" + root
+}
+
+// withDiscoveryCache decodes the cached result of a query in v, or runs the query filling v and caches it.
+// The lock is held while the query runs, the containers starting together wait for a single query.
+// The cache is best effort, the query runs uncached when it is unusable.
+func withDiscoveryCache(config CLIConfig, query string, v interface{}, run func() error) error {
+	if len(config.DiscoveryCache) == 0 {
+		return run()
+	}
+	c, err := openDiscoveryCache(config.DiscoveryCache)
+	if err != nil {
+		warnf("couldn't open the discovery cache: %v", err)
+		return run()
+	}
+	defer c.close()
+
+	entry := discoveryCacheEntry(config, query)
+	if b, ok := c.Entries[entry]; ok && json.Unmarshal(b, v) == nil {
+		debugf("using the cached %s", entry)
+		return nil
+	}
+	if err := run(); err != nil {
+		return err
+	}
+	if b, err := json.Marshal(v); err == nil {
+		c.Entries[entry] = b
+		if err := c.save(); err != nil {
+			warnf("couldn't update the discovery cache: %v", err)
+		}
+	}
+	return nil
+}
+
+// invalidateDiscoveryCache drops the cached results, e.g. after a change of the MIG layout.
+func invalidateDiscoveryCache(config CLIConfig) {
+	if len(config.DiscoveryCache) == 0 {
+		return
+	}
+	if err := os.Remove(config.DiscoveryCache); err != nil && !os.IsNotExist(err) {
+		warnf("couldn't invalidate the discovery cache: %v", err)
+	}
+}
@@ -1,25 +1,158 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"strings"
 )
 
-func capabilityToCLI(cap string) string {
-	switch cap {
-	case "compute":
-		return "--compute"
-	case "compat32":
-		return "--compat32"
-	case "graphics":
-		return "--graphics"
-	case "utility":
-		return "--utility"
-	case "video":
-		return "--video"
-	case "display":
-		return "--display"
+var builtinCapabilities = []DriverCapability{
+	{Name: "compute", CLIOption: "--compute"},
+	{Name: "compat32", CLIOption: "--compat32"},
+	{Name: "graphics", CLIOption: "--graphics"},
+	{Name: "utility", CLIOption: "--utility"},
+	{Name: "video", CLIOption: "--video"},
+	{Name: "display", CLIOption: "--display"},
+	// Parts of video, the hook removes the libraries of the other parts.
+	{Name: nvencCapability, CLIOption: "--video"},
+	{Name: nvdecCapability, CLIOption: "--video"},
+	{Name: nvjpegCapability, CLIOption: "--video"},
+	// vGPU guests only, the hook injects its libraries: no option of nvidia-container-cli.
+	{Name: vgpuCapability, CLIOption: ""},
+	// NVSwitch systems only, the hook injects the switches and the NSCQ library.
+	{Name: nvswitchCapability, CLIOption: ""},
+}
+
+// The capabilities of the node, the built-in ones unless set from the configuration by setDriverCapabilities.
+var (
+	driverCapabilities        = builtinCapabilities
+	defaultDriverCapabilities = defaultCapability
+)
+
+// getDriverCapabilities returns the built-in capabilities with the ones of the configuration, which may
+// add capabilities (e.g. ngx) or change their option, minus the disabled ones.
+func getDriverCapabilities(hook HookConfig) ([]DriverCapability, error) {
+	caps := append([]DriverCapability{}, builtinCapabilities...)
+	for _, c := range hook.DriverCapabilities {
+		if len(c.Name) == 0 || len(c.CLIOption) == 0 || c.Name == "all" || strings.Contains(c.Name, ",") {
+			return nil, fmt.Errorf("invalid driver capability %q: a name and a cli-option are required", c.Name)
+		}
+		replaced := false
+		for i := range caps {
+			if caps[i].Name == c.Name {
+				caps[i], replaced = c, true
+			}
+		}
+		if !replaced {
+			caps = append(caps, c)
+		}
+	}
+
+	var enabled []DriverCapability
+	for _, c := range caps {
+		disabled := false
+		for _, d := range hook.DisabledDriverCapabilities {
+			disabled = disabled || d == c.Name
+		}
+		if !disabled {
+			enabled = append(enabled, c)
+		}
+	}
+	for _, d := range strings.Split(hook.DefaultDriverCapabilities, ",") {
+		if _, ok := findCapability(enabled, d); !ok {
+			return nil, fmt.Errorf("unknown or disabled default driver capability: %s", d)
+		}
+	}
+	for _, s := range hook.SupportedDriverCapabilities {
+		if _, ok := findCapability(caps, s); !ok {
+			return nil, fmt.Errorf("unknown supported driver capability: %s", s)
+		}
+	}
+	if p := hook.UnsupportedCapabilities; len(p) > 0 && p != unsupportedCapabilitiesStrip && p != unsupportedCapabilitiesFail {
+		return nil, fmt.Errorf("unknown unsupported-capabilities policy %q: strip or fail", p)
+	}
+	return enabled, nil
+}
+
+// setDriverCapabilities sets the capabilities of the node from the configuration.
+func setDriverCapabilities(hook HookConfig) {
+	caps, err := getDriverCapabilities(hook)
+	if err != nil {
+		fail(exitCodeBadConfig, err)
+	}
+	driverCapabilities = caps
+	defaultDriverCapabilities = hook.DefaultDriverCapabilities
+}
+
+func findCapability(caps []DriverCapability, name string) (DriverCapability, bool) {
+	for _, c := range caps {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return DriverCapability{}, false
+}
+
+// getAllCapabilities returns the value of "all": every capability of the node, but vgpu and nvswitch which are
+// requested by name, and the parts of video.
+func getAllCapabilities() string {
+	var names []string
+	for _, c := range driverCapabilities {
+		if c.Name == vgpuCapability || c.Name == nvswitchCapability || isVideoCapability(c.Name) {
+			continue
+		}
+		names = append(names, c.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// Policies of the capabilities requested by name outside of supported-driver-capabilities.
+const (
+	unsupportedCapabilitiesStrip = "strip"
+	unsupportedCapabilitiesFail  = "fail"
+)
+
+// filterCapabilities keeps the requested capabilities which are supported, all of them if none is listed.
+// The capabilities requested by name are stripped or rejected per the policy, the ones of "all" and
+// of the default capabilities are stripped quietly.
+func filterCapabilities(requested string, supported []string, explicit bool, policy string) (string, error) {
+	if len(supported) == 0 {
+		return requested, nil
+	}
+	var kept, unsupported []string
+	for _, c := range strings.Split(requested, ",") {
+		if len(c) == 0 {
+			continue
+		}
+		ok := false
+		for _, s := range supported {
+			ok = ok || s == c
+		}
+		if ok {
+			kept = append(kept, c)
+		} else {
+			unsupported = append(unsupported, c)
+		}
+	}
+	if len(unsupported) == 0 {
+		return requested, nil
+	}
+
+	switch {
+	case !explicit:
+		debugf("skipping the unsupported driver capabilities %s", strings.Join(unsupported, ","))
+	case policy == unsupportedCapabilitiesFail:
+		return "", fmt.Errorf("driver capabilities not supported on this node: %s", strings.Join(unsupported, ","))
 	default:
+		warnf("stripping the driver capabilities not supported on this node: %s", strings.Join(unsupported, ","))
+	}
+	return strings.Join(kept, ","), nil
+}
+
+func capabilityToCLI(cap string) string {
+	c, ok := findCapability(driverCapabilities, cap)
+	if !ok {
 		log.Panicln("unknown driver capability:", cap)
 	}
-	return ""
+	return c.CLIOption
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/nvcontainer"
+)
+
+const (
+	modeLegacy = "legacy"
+	modeCDI    = "cdi"
+)
+
+var defaultCDISpecDirs = []string{"/etc/cdi", "/var/run/cdi"}
+
+// The CDI types are shared with the plugins through nvcontainer.
+type (
+	cdiSpec           = nvcontainer.CDISpec
+	cdiDevice         = nvcontainer.CDIDevice
+	cdiContainerEdits = nvcontainer.ContainerEdits
+	cdiDeviceNode     = nvcontainer.DeviceNode
+	cdiMount          = nvcontainer.Mount
+	cdiHook           = nvcontainer.Hook
+)
+
+// loadCDISpecs reads the JSON and YAML spec files of the directories, later directories have higher precedence.
+func loadCDISpecs(dirs []string) []cdiSpec {
+	specs, err := nvcontainer.LoadCDISpecs(dirs)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return specs
+}
+
+// resolveCDIDevices returns the edits of the devices, the value of NVIDIA_VISIBLE_DEVICES is a list
+// of fully-qualified CDI names (nvidia.com/gpu=0) or of names of the nvidia.com/gpu kind (0, GPU-<uuid>, all).
+func resolveCDIDevices(specs []cdiSpec, devices string) ([]cdiContainerEdits, error) {
+	return nvcontainer.ResolveCDIDevices(specs, devices)
+}
+
+// bindContainerMount bind mounts a host file or directory in the container, the mount point is created
+// through /proc/<pid>/root and the mount itself is done in the mount namespace of the container.
+func bindContainerMount(config CLIConfig, container containerConfig, m cdiMount) {
+	info, err := os.Stat(m.HostPath)
+	if err != nil {
+		log.Panicln("could not stat CDI mount:", err)
+	}
+	target, err := resolveContainerPath(container, m.ContainerPath)
+	if err != nil {
+		log.Panicln("could not resolve mount point", m.ContainerPath, "in container:", err)
+	}
+	// A symlink of the image at the mount point would take the mount out of the rootfs.
+	if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(target); err != nil {
+			log.Panicln("could not replace the symlink", m.ContainerPath, "in container:", err)
+		}
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else if err = os.MkdirAll(path.Dir(target), 0755); err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644); err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		log.Panicln("could not create mount point", m.ContainerPath, "in container:", err)
+	}
+	recordBoundPath(target)
+
+	nsenter := lookPath(config, "nsenter")
+	pid := strconv.Itoa(container.Pid)
+	dst := path.Join(container.Rootfs, getRootfsRelPath(container, target))
+	mounts := [][]string{{"--bind", m.HostPath, dst}}
+	for _, o := range m.Options {
+		if o == "ro" {
+			// Bind mounts ignore the read-only flag, it takes a remount.
+			mounts = append(mounts, []string{"-o", "remount,bind,ro", dst})
+			break
+		}
+	}
+	for _, args := range mounts {
+		args = append([]string{"--target", pid, "--mount", "mount"}, args...)
+		if out, err := exec.Command(nsenter, args...).CombinedOutput(); err != nil {
+			log.Panicf("couldn't mount %s in the container: %v: %s", m.ContainerPath, err, strings.TrimSpace(string(out)))
+		}
+	}
+}
+
+// runCDIHook runs a hook of a CDI spec with the container state on stdin, as the runtime would.
+func runCDIHook(container containerConfig, h cdiHook) {
+	state, err := json.Marshal(HookState{ID: container.ID, Pid: container.Pid, Status: "created", Bundle: container.Bundle})
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	var args []string
+	if len(h.Args) > 1 {
+		args = h.Args[1:]
+	}
+	cmd := exec.Command(h.Path, args...)
+	cmd.Env = h.Env
+	cmd.Stdin = strings.NewReader(string(state))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Panicf("CDI hook %s failed: %v", h.Path, err)
+	}
+}
+
+// configureCDI applies the CDI edits of the requested devices to the container, instead of nvidia-container-cli.
+// The runtime already read config.json, the edits are applied to the container being created.
+func configureCDI(hook HookConfig, container containerConfig) {
+	edits, err := resolveCDIDevices(loadCDISpecs(hook.CDISpecDirs), container.Nvidia.Devices)
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	var nodes []deviceNode
+	var mounts []cdiMount
+	var hooks []cdiHook
+	for _, e := range edits {
+		if len(e.Env) > 0 {
+			warnf("the environment of the process can't be changed from a hook, ignoring %v", e.Env)
+		}
+		for _, d := range e.DeviceNodes {
+			node := deviceNode{Path: d.Path, Major: d.Major, Minor: d.Minor}
+			if node.Major == 0 {
+				host := d.HostPath
+				if len(host) == 0 {
+					host = d.Path
+				}
+				if node.Major, node.Minor, err = deviceNumbers(host); err != nil {
+					log.Panicln("could not get the device numbers of", host, ":", err)
+				}
+			}
+			nodes = append(nodes, node)
+		}
+		mounts = append(mounts, e.Mounts...)
+		hooks = append(hooks, e.Hooks...)
+	}
+	// Dozens of MIG devices take as many device nodes and mounts, each mount runs nsenter.
+	injectContainerDevices(container, nodes, hook.Parallelism)
+	bindContainerMounts(hook.NvidiaContainerCLI, container, mounts, hook.Parallelism)
+
+	// The mounts are in place, which is when the runtime would run the hooks of these stages.
+	for _, h := range hooks {
+		switch h.HookName {
+		case stageCreateRuntime, stageCreateContainer:
+			infof("running CDI hook %s", h.Path)
+			runCDIHook(container, h)
+		default:
+			warnf("skipping CDI hook %s for the %s stage", h.Path, h.HookName)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	cgroupRoot = "/sys/fs/cgroup"
+	// nvidia-container-cli attaches the eBPF device filters of cgroup v2 since 1.8.0.
+	cgroupV2MinCLIVersion = "1.8.0"
+)
+
+var cliVersionExp = regexp.MustCompile(`(?m)^cli-version:\s*([0-9]+\.[0-9]+\.[0-9]+)`)
+
+// isCgroupV2 tells the nodes with the unified hierarchy only: the device access of the containers is an eBPF
+// program attached to their cgroup, there is no devices controller.
+func isCgroupV2() bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// getCgroupV2Path returns the path of the cgroup of a process in the unified hierarchy, empty if there is none.
+func getCgroupV2Path(pid int) string {
+	f, err := os.Open(fmt.Sprintf(procCgroupPath, pid))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "0::") {
+			return filepath.Join(cgroupRoot, strings.TrimPrefix(s.Text(), "0::"))
+		}
+	}
+	return ""
+}
+
+// getCLIVersion returns the version of nvidia-container-cli.
+func getCLIVersion(config CLIConfig) (string, error) {
+	out, err := queryDriver(config, getCLIPath(config), "--version")
+	if err != nil {
+		return "", fmt.Errorf("nvidia-container-cli --version failed: %v", err)
+	}
+	m := cliVersionExp.FindStringSubmatch(string(out))
+	if m == nil {
+		return "", fmt.Errorf("no version in the nvidia-container-cli --version output")
+	}
+	return m[1], nil
+}
+
+// checkCgroupV2Support explains a failure of nvidia-container-cli on a cgroup v2 node when it's too old to grant
+// the devices, it only reports that it found no devices cgroup. It's checked on failures only, to spare a run.
+func checkCgroupV2Support(config CLIConfig) error {
+	if config.NoCgroups || !isCgroupV2() {
+		return nil
+	}
+	version, err := getCLIVersion(config)
+	if err != nil {
+		warnf("couldn't check the cgroup v2 support of nvidia-container-cli: %v", err)
+		return nil
+	}
+	if compareVersions(version, cgroupV2MinCLIVersion) < 0 {
+		return fmt.Errorf("nvidia-container-cli %s doesn't support cgroup v2, the only hierarchy of this node: "+
+			"upgrade it to %s or later, or set no-cgroups and allow the NVIDIA devices in the OCI spec of the containers",
+			version, cgroupV2MinCLIVersion)
+	}
+	return nil
+}
+
+// getContainerDeviceNodes returns the NVIDIA device nodes of the container.
+func getContainerDeviceNodes(container containerConfig) []string {
+	var nodes []string
+	for _, pattern := range []string{"/dev/nvidia*", filepath.Join(nvidiaCapsDir, "*"), filepath.Join(imexChannelsDir, "*")} {
+		matches, _ := filepath.Glob(containerPath(container, pattern))
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+				nodes = append(nodes, m)
+			}
+		}
+	}
+	return nodes
+}
+
+// verifyDeviceAccess checks that the processes of the container can open its NVIDIA device nodes, from a child
+// of the hook in the cgroup of the container: the devices cgroup of v1 and the eBPF device filter of v2 are
+// both checked at open time.
+func verifyDeviceAccess(container containerConfig) {
+	cgroup := getDevicesCgroup(container.Pid)
+	if isCgroupV2() {
+		cgroup = getCgroupV2Path(container.Pid)
+	}
+	if len(cgroup) == 0 {
+		warnf("no cgroup found for pid %d, skipping the verification of the device access", container.Pid)
+		return
+	}
+	nodes := getContainerDeviceNodes(container)
+	if len(nodes) == 0 {
+		return
+	}
+	if err := checkDeviceAccess(nodes, cgroup, ""); err != nil {
+		hint := "check the device rules of the runtime"
+		if isCgroupV2() {
+			hint = "the device filter of cgroup v2 denies them: upgrade nvidia-container-cli to " + cgroupV2MinCLIVersion +
+				" or later, or allow the NVIDIA devices in the OCI spec of the containers"
+		}
+		fail(exitCodeError, fmt.Errorf("the container can't open its devices (%v): %s", err, hint))
+	}
+}
+
+// checkDeviceAccess opens device nodes from a child of the hook, moved to a cgroup and confined by an AppArmor
+// profile when they're set. The error lists the devices the child couldn't open.
+func checkDeviceAccess(nodes []string, cgroup string, profile string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{"check-device-access"}
+	if len(profile) > 0 {
+		args = append(args, "-apparmor-profile", profile)
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(self, append(args, nodes...)...)
+	cmd.Stdout = &out
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("couldn't check the device access: %v", err)
+	}
+	// The child waits for its move to the cgroup before opening the devices.
+	if len(cgroup) > 0 {
+		err = ioutil.WriteFile(filepath.Join(cgroup, "cgroup.procs"), []byte(strconv.Itoa(cmd.Process.Pid)), 0)
+	}
+	stdin.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("couldn't join the cgroup %s to check the device access: %v", cgroup, err)
+	}
+	if err := cmd.Wait(); err != nil {
+		if out.Len() == 0 {
+			return err
+		}
+		return fmt.Errorf("%s", strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// doCheckDeviceAccess opens the devices once its stdin is closed, the hook moves it to the cgroup of the container
+// meanwhile. With an AppArmor profile, it runs itself again confined by the profile.
+func doCheckDeviceAccess(args []string) {
+	flags := flag.NewFlagSet("check-device-access", flag.ExitOnError)
+	profile := flags.String("apparmor-profile", "", "AppArmor profile to open the devices with")
+	flags.Parse(args)
+
+	ioutil.ReadAll(os.Stdin)
+	if len(*profile) > 0 {
+		if err := execWithAppArmorProfile(*profile, append([]string{"check-device-access"}, flags.Args()...)); err != nil {
+			fmt.Print(err)
+			os.Exit(exitCodeError)
+		}
+	}
+	var denied []string
+	for _, p := range flags.Args() {
+		f, err := os.OpenFile(p, os.O_RDWR, 0)
+		if err != nil {
+			denied = append(denied, fmt.Sprintf("%s: %v", filepath.Base(p), err))
+			continue
+		}
+		f.Close()
+	}
+	if len(denied) > 0 {
+		fmt.Print(strings.Join(denied, ", "))
+		os.Exit(exitCodeError)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+const containerStateDir = "/run/nvidia-container-runtime/containers"
+
+// postConfigureState is passed as JSON on the stdin of the post-configure and post-stop executables.
+type postConfigureState struct {
+	ID     string        `json:"id"`
+	Pid    int           `json:"pid"`
+	Bundle string        `json:"bundle"`
+	Rootfs string        `json:"rootfs"`
+	Nvidia *nvidiaConfig `json:"nvidia"`
+}
+
+// runPostConfigure runs the site specific executables once the GPUs are configured,
+// the state is also available in the environment for simple scripts.
+func runPostConfigure(hook HookConfig, container containerConfig, rootfs string) {
+	state := postConfigureState{
+		ID:     container.ID,
+		Pid:    container.Pid,
+		Bundle: container.Bundle,
+		Rootfs: rootfs,
+		Nvidia: container.Nvidia,
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	env := append(os.Environ(),
+		"NVIDIA_CONTAINER_PID="+strconv.Itoa(container.Pid),
+		"NVIDIA_CONTAINER_BUNDLE="+container.Bundle,
+		"NVIDIA_CONTAINER_ROOTFS="+rootfs,
+		fmt.Sprintf("%s=%s", envNVGPU, container.Nvidia.Devices),
+		fmt.Sprintf("%s=%s", envNVDriverCapabilities, container.Nvidia.Capabilities))
+
+	for _, path := range hook.PostConfigure {
+		infof("running post-configure %s", path)
+		cmd := exec.Command(path)
+		cmd.Env = env
+		cmd.Stdin = bytes.NewReader(b)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Panicf("post-configure %s failed: %v", path, err)
+		}
+	}
+}
+
+func containerStatePath(id string) string {
+	return filepath.Join(containerStateDir, id+".json")
+}
+
+// recordContainerState keeps the configuration of the container for the post-stop executables,
+// the requested devices can't be computed again once the resolver or the MIG provisioning are done.
+func recordContainerState(container containerConfig, rootfs string) {
+	b, err := json.Marshal(postConfigureState{container.ID, container.Pid, container.Bundle, rootfs, container.Nvidia})
+	if err == nil {
+		if err = os.MkdirAll(containerStateDir, 0755); err == nil {
+			err = ioutil.WriteFile(containerStatePath(container.ID), b, 0644)
+		}
+	}
+	if err != nil {
+		log.Panicln("couldn't record the container state:", err)
+	}
+}
+
+// runPostStop runs the site specific executables undoing the node state set up by post-configure,
+// e.g. MPS client registrations or persistence mode. It is a no-op for containers the hook didn't configure.
+func runPostStop(hook HookConfig, id string) {
+	b, err := ioutil.ReadFile(containerStatePath(id))
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Panicln("couldn't read the container state:", err)
+	}
+	var state postConfigureState
+	if err := json.Unmarshal(b, &state); err != nil {
+		log.Panicln("invalid container state:", err)
+	}
+
+	env := append(os.Environ(),
+		"NVIDIA_CONTAINER_ID="+state.ID,
+		"NVIDIA_CONTAINER_BUNDLE="+state.Bundle,
+		"NVIDIA_CONTAINER_ROOTFS="+state.Rootfs)
+	if state.Nvidia != nil {
+		env = append(env, fmt.Sprintf("%s=%s", envNVGPU, state.Nvidia.Devices))
+	}
+
+	// Run every executable even if one fails, the state is kept to retry the cleanup.
+	var failed []string
+	for _, path := range hook.PostStop {
+		infof("running post-stop %s", path)
+		cmd := exec.Command(path)
+		cmd.Env = env
+		cmd.Stdin = bytes.NewReader(b)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			warnf("post-stop %s failed: %v", path, err)
+			failed = append(failed, path)
+		}
+	}
+	if len(failed) > 0 {
+		log.Panicf("post-stop failed: %v", failed)
+	}
+	if err := os.Remove(containerStatePath(id)); err != nil && !os.IsNotExist(err) {
+		log.Panicln("couldn't remove the container state:", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/oci"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/devices"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/policy"
+)
+
+const (
+	// Set by the previous versions of nvidia-container-runtime on the spec of the containers it restored from a
+	// checkpoint, the restores are now told by the -restore flag of the hook.
+	restoreAnnotation = "com.nvidia.restore"
+	// UUIDs of the GPUs of a container, recorded in its spec which is checkpointed with it.
+	grantedDevicesAnnotation = "com.nvidia.granted-devices"
+)
+
+// isRestore tells if the container is restored from a checkpoint: nvidia-container-runtime runs the hook with
+// -restore for runc restore. The annotations of the spec are set by the users, a restore annotation of a container
+// which isn't restored is rejected.
+func isRestore(hook HookConfig, container containerConfig) bool {
+	annotated, _ := strconv.ParseBool(container.Annotations[restoreAnnotation])
+	if !*restoreflag {
+		if annotated {
+			fail(exitCodePolicy, fmt.Errorf("%s is only set by nvidia-container-runtime when it restores a container", restoreAnnotation))
+		}
+		return false
+	}
+	if !hook.CheckpointRestore {
+		fail(exitCodeBadConfig, fmt.Errorf("the containers restored from a checkpoint get their GPUs back with checkpoint-restore only"))
+	}
+	return true
+}
+
+// recordGrantedDevices records the UUIDs of the GPUs of a container, its restore gets the same GPUs.
+func recordGrantedDevices(cli CLIConfig, container containerConfig) {
+	info, err := getDriverInfo(cli)
+	if err != nil {
+		log.Panicln(err)
+	}
+	uuids := strings.Join(info.RequestedUUIDs(container.Nvidia.Devices), ",")
+	err = oci.UpdateSpec(path.Join(container.Bundle, "config.json"), func(spec map[string]interface{}) {
+		annotations, _ := spec["annotations"].(map[string]interface{})
+		if annotations == nil {
+			annotations = make(map[string]interface{})
+		}
+		annotations[grantedDevicesAnnotation] = uuids
+		spec["annotations"] = annotations
+	})
+	if err != nil {
+		log.Panicln("couldn't record the granted devices:", err)
+	}
+}
+
+// restoreContainerDevices checks that the GPUs granted to a container before its checkpoint are still there, and
+// injects their device nodes again if they're missing. The GPU state isn't checkpointed, the mounts of the
+// container are restored with it: nvidia-container-cli doesn't run again.
+// The GPUs recorded in the spec are checked like a request: they must be requested by the container, allowed on
+// the node and not held by another owner in the ledger.
+func restoreContainerDevices(hook HookConfig, cli CLIConfig, container containerConfig) {
+	granted, ok := container.Annotations[grantedDevicesAnnotation]
+	if !ok {
+		fail(exitCodeBadSpec, fmt.Errorf("no GPUs recorded before the checkpoint of the container, enable checkpoint-restore"))
+	}
+	info, err := getDriverInfo(cli)
+	if err != nil {
+		fail(exitCodeCLIFailure, err)
+	}
+	var minors []uint32
+	var uuids, missing, unrequested []string
+	for _, uuid := range strings.Split(granted, ",") {
+		if len(uuid) == 0 {
+			continue
+		}
+		uuids = append(uuids, uuid)
+		found := false
+		for _, d := range info.Devices {
+			if d.UUID != uuid {
+				continue
+			}
+			if !isRequested(container.Nvidia.Devices, d.Index, d.UUID) {
+				unrequested = append(unrequested, uuid)
+			}
+			minor, err := strconv.ParseUint(d.Minor, 10, 32)
+			if err != nil {
+				log.Panicf("invalid device minor %s of GPU %s", d.Minor, uuid)
+			}
+			minors, found = append(minors, uint32(minor)), true
+		}
+		if !found {
+			missing = append(missing, uuid)
+		}
+	}
+	if len(missing) > 0 {
+		fail(exitCodeError, fmt.Errorf("the GPUs %s of the container before its checkpoint are gone from this node", strings.Join(missing, ",")))
+	}
+	if len(unrequested) > 0 {
+		fail(exitCodePolicy, fmt.Errorf("the GPUs %s recorded in the spec aren't requested by the container", strings.Join(unrequested, ",")))
+	}
+	if err := policy.CheckDevices(hook, info, granted); err != nil {
+		fail(exitCodePolicy, err)
+	}
+	if hook.Ledger != nil {
+		claimLedgerGPUs(hook, container, uuids)
+	}
+
+	for _, node := range devices.Nodes(getDeviceMajors(procDevicesPath), minors) {
+		// Only nvidia-container-cli injects them for the display capability, and configureDeviceNodes on request.
+		if node.Path == "/dev/nvidia-modeset" || node.Path == "/dev/nvidia-uvm-tools" {
+			continue
+		}
+		injectContainerDevice(container, node)
+	}
+	configureDeviceNodes(hook, container)
+	infof("restored the devices of the GPUs %s", granted)
+}
@@ -0,0 +1,574 @@
+// hook-e2e runs the nvidia-container-runtime-hook binary against OCI bundles shaped like the ones
+// of docker, containerd and CRI-O, with a stub nvidia-container-cli recording its arguments.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/template"
+)
+
+const (
+	gpuUUID = "GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785"
+
+	stubCLI = `#!/bin/sh
+echo "$@" >> "{{.Log}}"
+case " $* " in
+*" info "*)
+	printf 'NVRM version,CUDA version\n460.32.03,11.2\n\n'
+	printf 'Device Index,Device Minor,Model,Brand,GPU UUID,Bus Location,Architecture\n'
+	printf '0,0,Tesla T4,Tesla,{{.UUID}},00000000:00:1e.0,7.5\n'
+	;;
+esac
+`
+)
+
+var (
+	hookflag = flag.String("hook", "nvidia-container-runtime-hook", "path of the hook binary")
+	keepflag = flag.Bool("keep", false, "keep the bundles of the scenarios")
+	runflag  = flag.String("run", "", "only run the scenarios containing this string")
+)
+
+type scenario struct {
+	Name        string
+	Env         []string
+	Annotations map[string]string
+	// Destinations of /dev/null mounts in the container.
+	NullMounts []string
+	// Configuration of the hook, {{.Dir}} is replaced by the directory of the scenario.
+	Config string
+	Ledger string
+	// Cgroup path of the container, e.g. of a Kubernetes pod.
+	CgroupsPath string
+	// Extra files of the scenario, relative to its directory.
+	Files map[string]string
+	// Stage the hook is invoked for, prestart by default.
+	Stage string
+
+	ExpectFailure bool
+	// Exit code of the failure, any non-zero code if unset.
+	ExpectExitCode int
+	// nil when nvidia-container-cli configure must not be called.
+	ExpectArgs   []string
+	UnexpectArgs []string
+	ExpectFiles  []string
+	// Strings the output of the hook must contain.
+	ExpectOutput []string
+}
+
+var scenarios = []scenario{
+	{
+		Name:       "docker_cpu_image",
+		Env:        []string{"PATH=/usr/bin"},
+		ExpectArgs: nil,
+	},
+	{
+		Name:       "docker_cuda_image_all",
+		Env:        []string{"NVIDIA_VISIBLE_DEVICES=all", "NVIDIA_DRIVER_CAPABILITIES=compute,utility", "NVIDIA_REQUIRE_CUDA=cuda>=9.0"},
+		ExpectArgs: []string{"--load-kmods", "configure", "--device=all", "--compute", "--utility", "--require=cuda>=9.0"},
+	},
+	{
+		Name:       "docker_legacy_cuda_image",
+		Env:        []string{"CUDA_VERSION=8.0.61"},
+		ExpectArgs: []string{"--device=all", "--compute", "--video", "--require=cuda>=8.0"},
+	},
+	{
+		Name:         "containerd_all_with_uuid_only",
+		Env:          []string{"NVIDIA_VISIBLE_DEVICES=all"},
+		Annotations:  map[string]string{"io.kubernetes.cri.container-type": "container"},
+		Config:       "mount-gpu-only-by-uuid = true\n",
+		ExpectArgs:   []string{"configure", "--utility"},
+		UnexpectArgs: []string{"--device=all"},
+	},
+	{
+		Name:        "crio_uuid_with_uuid_only",
+		Env:         []string{"NVIDIA_VISIBLE_DEVICES=" + gpuUUID, "NVIDIA_DRIVER_CAPABILITIES=compute"},
+		Annotations: map[string]string{"io.kubernetes.cri-o.ContainerType": "container"},
+		Config:      "mount-gpu-only-by-uuid = true\n",
+		ExpectArgs:  []string{"--device=" + gpuUUID, "--compute"},
+	},
+	{
+		Name:        "containerd_mig_with_uuid_only",
+		Env:         []string{"NVIDIA_VISIBLE_DEVICES=MIG-" + gpuUUID + "/1/0"},
+		Annotations: map[string]string{"io.kubernetes.cri.container-type": "container"},
+		Config:      "mount-gpu-only-by-uuid = true\n",
+		ExpectArgs:  []string{"--device=MIG-" + gpuUUID + "/1/0"},
+	},
+	{
+		Name:        "crio_annotations_request",
+		Env:         []string{"NVIDIA_VISIBLE_DEVICES=all"},
+		Annotations: map[string]string{"io.kubernetes.cri-o.ContainerType": "container", "com.nvidia.devices": gpuUUID, "com.nvidia.capabilities": "compute"},
+		Config:      "request-sources = [\"annotations\"]\nmount-gpu-only-by-uuid = true\n",
+		ExpectArgs:  []string{"--device=" + gpuUUID, "--compute"},
+	},
+	{
+		Name:           "denied_device",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=all"},
+		Config:         "denied-devices = [\"GPU-83d7ced8-*\"]\n",
+		ExpectFailure:  true,
+		ExpectExitCode: 6,
+	},
+	{
+		Name:           "forged_restore_rejected",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=all"},
+		Annotations:    map[string]string{"com.nvidia.restore": "true", "com.nvidia.granted-devices": gpuUUID},
+		Config:         "checkpoint-restore = true\n",
+		ExpectFailure:  true,
+		ExpectExitCode: 6,
+	},
+	{
+		Name:           "unprivileged_envvar_rejected",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		Config:         "accept-nvidia-visible-devices-envvar-when-unprivileged = false\n",
+		ExpectFailure:  true,
+		ExpectExitCode: 6,
+	},
+	{
+		Name:         "volume_mounts_request",
+		Env:          []string{"NVIDIA_VISIBLE_DEVICES=all"},
+		NullMounts:   []string{"/var/run/nvidia-container-devices/" + gpuUUID},
+		Config:       "request-sources = [\"volume-mounts\"]\naccept-nvidia-visible-devices-envvar-when-unprivileged = false\n",
+		ExpectArgs:   []string{"--device=" + gpuUUID},
+		UnexpectArgs: []string{"--device=all"},
+	},
+	{
+		Name:           "validate_unknown_uuid",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=GPU-5e2c1a77-3821-a34c-ce5d-e9264cfa8786"},
+		Config:         "validate-devices = true\n",
+		ExpectFailure:  true,
+		ExpectExitCode: 3,
+	},
+	{
+		Name:           "validate_requirements",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_REQUIRE_CUDA=cuda>=12.0 brand=geforce,cuda>=11.0"},
+		Config:         "validate-requirements = true\n",
+		ExpectFailure:  true,
+		ExpectExitCode: 5,
+		ExpectOutput:   []string{"cuda>=12.0 (the driver supports CUDA 11.2)", "brand=geforce (GPU 0 is a Tesla)"},
+	},
+	{
+		Name:           "pod_quota_exceeded",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		CgroupsPath:    "/kubepods/besteffort/pod8dbc5577-d0e2-4706-8787-57d52c03ddf2/e2e",
+		Config:         "[pod-quota]\nmax-gpus = 1\nstate = \"{{.Dir}}/pod-gpus.json\"\n",
+		Files:          map[string]string{"pod-gpus.json": `{"pods": {"8dbc5577-d0e2-4706-8787-57d52c03ddf2": {"sidecar": ["GPU-1ef"]}}}`},
+		ExpectFailure:  true,
+		ExpectExitCode: 6,
+		ExpectOutput:   []string{"more than the maximum of 1"},
+	},
+	{
+		Name:         "driver_root",
+		Env:          []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		Config:       "[nvidia-container-cli]\nroot = \"{{.Dir}}/driver\"\nload-kmods = false\n",
+		ExpectArgs:   []string{"--root={{.Dir}}/driver", "--device=0"},
+		UnexpectArgs: []string{"--load-kmods"},
+	},
+	{
+		Name:         "disable_require",
+		Env:          []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_REQUIRE_CUDA=cuda>=9.0"},
+		Config:       "disable-require = true\n",
+		ExpectArgs:   []string{"--device=0"},
+		UnexpectArgs: []string{"--require=cuda>=9.0"},
+	},
+	{
+		Name:           "ledger_reserved_by_other",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		Config:         "ledger = \"{{.Dir}}/ledger.json\"\n",
+		Ledger:         `{"entries": [{"uuid": "` + gpuUUID + `", "owner": "ci-runner"}]}`,
+		ExpectFailure:  true,
+		ExpectExitCode: 6,
+	},
+	{
+		Name:         "unknown_option_ignored",
+		Env:          []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		Config:       "mount-gpu-only-by-uid = true\n",
+		ExpectArgs:   []string{"--device=0"},
+		ExpectOutput: []string{"ignoring unknown option", "mount-gpu-only-by-uid"},
+	},
+	{
+		Name:           "unknown_option_strict",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		Config:         "strict-config = true\nmount-gpu-only-by-uid = true\n",
+		ExpectFailure:  true,
+		ExpectExitCode: 4,
+	},
+	{
+		Name:           "invalid_cuda_version",
+		Env:            []string{"CUDA_VERSION=latest"},
+		ExpectFailure:  true,
+		ExpectExitCode: 3,
+	},
+	{
+		Name:           "exclusive_gpu_held",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_GPU_SHARED=true"},
+		Config:         "ledger = \"{{.Dir}}/ledger.json\"\nexclusive-gpus = true\n",
+		Ledger:         `{"entries": [{"uuid": "` + gpuUUID + `", "owner": "other"}]}`,
+		ExpectFailure:  true,
+		ExpectExitCode: 6,
+	},
+	{
+		Name:       "shared_gpu_held",
+		Env:        []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_GPU_SHARED=true"},
+		Config:     "ledger = \"{{.Dir}}/ledger.json\"\nexclusive-gpus = true\n",
+		Ledger:     `{"entries": [{"uuid": "` + gpuUUID + `", "owner": "other", "shared": true}]}`,
+		ExpectArgs: []string{"--device=0"},
+	},
+	{
+		Name:       "ledger_reservation_claimed",
+		Env:        []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_GPU_RESERVATION=ci-runner"},
+		Config:     "ledger = \"{{.Dir}}/ledger.json\"\n",
+		Ledger:     `{"entries": [{"uuid": "` + gpuUUID + `", "owner": "ci-runner"}]}`,
+		ExpectArgs: []string{"--device=0"},
+	},
+	{
+		Name:       "oci_1_1_create_runtime",
+		Env:        []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		Config:     "stage = \"createRuntime\"\n",
+		Stage:      "createRuntime",
+		ExpectArgs: []string{"--device=0"},
+	},
+	{
+		Name:       "oci_1_1_prestart_skipped",
+		Env:        []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		Config:     "stage = \"createRuntime\"\n",
+		ExpectArgs: nil,
+	},
+	{
+		Name:        "cdi_mode",
+		Env:         []string{"NVIDIA_VISIBLE_DEVICES=nvidia.com/gpu=0"},
+		Config:      "mode = \"cdi\"\ncdi-spec-dirs = [\"{{.Dir}}/cdi\"]\n",
+		Files:       map[string]string{"cdi/nvidia.json": `{"cdiVersion": "0.5.0", "kind": "nvidia.com/gpu", "devices": [{"name": "0", "containerEdits": {"hooks": [{"hookName": "createContainer", "path": "/bin/sh", "args": ["sh", "-c", "touch {{.Dir}}/cdi-hook"]}]}}]}`},
+		ExpectArgs:  nil,
+		ExpectFiles: []string{"cdi-hook"},
+	},
+	{
+		Name:        "json_log_file",
+		Env:         []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		Config:      "log-format = \"json\"\nlog-file = \"{{.Dir}}/hook.log\"\n",
+		ExpectArgs:  []string{"--device=0"},
+		ExpectFiles: []string{"hook.log"},
+	},
+	{
+		Name:         "dry_run",
+		Env:          []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_DRIVER_CAPABILITIES=compute"},
+		Config:       "dry-run = true\n",
+		ExpectArgs:   nil,
+		ExpectOutput: []string{`"--device=0"`, `"--compute"`, `"capabilities": "compute"`},
+	},
+	{
+		Name:         "auto_mode_cdi",
+		Env:          []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		Config:       "dry-run = true\nmode = \"auto\"\ncdi-spec-dirs = [\"{{.Dir}}/cdi\"]\n",
+		Files:        map[string]string{"cdi/nvidia.json": `{"cdiVersion": "0.5.0", "kind": "nvidia.com/gpu", "devices": [{"name": "0", "containerEdits": {}}]}`},
+		ExpectArgs:   nil,
+		ExpectOutput: []string{"using the cdi mode", `"mode": "cdi"`},
+	},
+	{
+		Name:         "dry_run_csv",
+		Env:          []string{"NVIDIA_VISIBLE_DEVICES=all"},
+		Config:       "dry-run = true\nmode = \"csv\"\ncsv-dirs = [\"{{.Dir}}/csv\"]\n",
+		Files:        map[string]string{"csv/l4t.csv": "dev, /dev/nvhost-ctrl\nlib, /usr/lib/aarch64-linux-gnu/tegra/libcuda.so.1.1\nsym, /usr/lib/aarch64-linux-gnu/libcuda.so\n"},
+		ExpectArgs:   nil,
+		ExpectOutput: []string{`"mode": "csv"`, `"/dev/nvhost-ctrl"`, `"/usr/lib/aarch64-linux-gnu/libcuda.so"`},
+	},
+	{
+		Name:        "record_versions",
+		Env:         []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		Config:      "record-versions = true\n",
+		ExpectArgs:  []string{"--device=0"},
+		ExpectFiles: []string{"bundle/nvidia-versions.json"},
+	},
+	{
+		Name:         "gds_disabled",
+		Env:          []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_GDS=enabled"},
+		ExpectArgs:   []string{"--device=0"},
+		ExpectOutput: []string{"GPUDirect Storage is disabled by the gds option"},
+	},
+	{
+		Name:          "gds_without_nvidia_fs",
+		Env:           []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_GDS=enabled"},
+		Config:        "gds = true\n",
+		ExpectArgs:    []string{"--device=0"},
+		ExpectFailure: true,
+		ExpectOutput:  []string{"is nvidia-fs loaded?"},
+	},
+	{
+		Name:           "imex_channel_denied",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_IMEX_CHANNELS=1"},
+		Config:         "allowed-imex-channels = [\"0\"]\n",
+		ExpectFailure:  true,
+		ExpectExitCode: 6,
+		ExpectOutput:   []string{"IMEX channel 1 is not allowed"},
+	},
+	{
+		Name:         "extra_driver_capability",
+		Env:          []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_DRIVER_CAPABILITIES=compute,ngx"},
+		Config:       "[[driver-capabilities]]\nname = \"ngx\"\ncli-option = \"--ngx\"\n",
+		ExpectArgs:   []string{"--compute", "--ngx"},
+		UnexpectArgs: []string{"--utility"},
+	},
+	{
+		Name:           "mig_config_not_allowed",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_MIG_CONFIG_DEVICES=all"},
+		ExpectFailure:  true,
+		ExpectExitCode: 6,
+	},
+	{
+		Name:           "mig_monitor_unprivileged",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_MIG_MONITOR_DEVICES=all"},
+		Config:         "allow-mig-management = true\n",
+		ExpectFailure:  true,
+		ExpectExitCode: 6,
+	},
+	{
+		Name:       "pci_bus_id",
+		Env:        []string{"NVIDIA_VISIBLE_DEVICES=0000:00:1E.0"},
+		ExpectArgs: []string{"--device=" + gpuUUID},
+	},
+	{
+		Name:           "malformed_pci_bus_id",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=0000:00:1e"},
+		ExpectFailure:  true,
+		ExpectExitCode: 3,
+	},
+	{
+		Name:         "unsupported_capability_stripped",
+		Env:          []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_DRIVER_CAPABILITIES=compute,graphics"},
+		Config:       "supported-driver-capabilities = [\"compute\", \"utility\"]\n",
+		ExpectArgs:   []string{"--compute"},
+		UnexpectArgs: []string{"--graphics"},
+	},
+	{
+		Name:           "unsupported_capability_rejected",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_DRIVER_CAPABILITIES=compute,graphics"},
+		Config:         "supported-driver-capabilities = [\"compute\", \"utility\"]\nunsupported-capabilities = \"fail\"\n",
+		ExpectFailure:  true,
+		ExpectExitCode: 6,
+	},
+	{
+		Name:           "audit_denied",
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_IMEX_CHANNELS=1"},
+		Config:         "allowed-imex-channels = [\"0\"]\n[audit]\npath = \"{{.Dir}}/audit/audit.log\"\n",
+		ExpectFailure:  true,
+		ExpectExitCode: 6,
+		ExpectFiles:    []string{"audit/audit.log"},
+	},
+	{
+		Name:        "metrics_textfile",
+		Env:         []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		Config:      "[metrics]\ntextfile = \"{{.Dir}}/hook.prom\"\nstate = \"{{.Dir}}/metrics.json\"\n",
+		ExpectArgs:  []string{"--device=0"},
+		ExpectFiles: []string{"hook.prom", "metrics.json"},
+	},
+	{
+		Name:         "shared_gpu_replica",
+		Env:          []string{"NVIDIA_VISIBLE_DEVICES=nvidia.com/gpu.shared::1"},
+		Config:       "sharing-state = \"{{.Dir}}/shared-gpus.json\"\n[[shared-devices]]\nname = \"nvidia.com/gpu.shared\"\ngpu = \"0\"\nreplicas = 2\n",
+		ExpectArgs:   []string{"--device=0"},
+		ExpectFiles:  []string{"shared-gpus.json"},
+		ExpectOutput: []string{"is replica 1 of GPU " + gpuUUID},
+	},
+}
+
+func expand(s string, dir string) string {
+	return strings.Replace(s, "{{.Dir}}", dir, -1)
+}
+
+func writeFile(path string, content string, perm os.FileMode) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), perm); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// setup creates the bundle, the stub nvidia-container-cli and the configuration of a scenario.
+func setup(s scenario, dir string) {
+	var stub bytes.Buffer
+	template.Must(template.New("stub").Parse(stubCLI)).Execute(&stub, map[string]string{
+		"Log":  filepath.Join(dir, "cli.log"),
+		"UUID": gpuUUID,
+	})
+	writeFile(filepath.Join(dir, "nvidia-container-cli"), stub.String(), 0755)
+
+	config := fmt.Sprintf("%s\n", expand(s.Config, dir))
+	if !strings.Contains(config, "[nvidia-container-cli]") {
+		config += "[nvidia-container-cli]\n"
+	}
+	config += fmt.Sprintf("path = %q\n", filepath.Join(dir, "nvidia-container-cli"))
+	writeFile(filepath.Join(dir, "config.toml"), config, 0644)
+
+	if len(s.Ledger) > 0 {
+		writeFile(filepath.Join(dir, "ledger.json"), s.Ledger, 0644)
+	}
+	for name, content := range s.Files {
+		writeFile(filepath.Join(dir, name), expand(content, dir), 0644)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "bundle", "rootfs"), 0755); err != nil {
+		log.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "driver"), 0755)
+	var mounts []map[string]string
+	for _, m := range s.NullMounts {
+		mounts = append(mounts, map[string]string{"destination": m, "source": "/dev/null", "type": "bind"})
+	}
+	spec := map[string]interface{}{
+		"mounts":      mounts,
+		"ociVersion":  "1.0.0",
+		"process":     map[string]interface{}{"args": []string{"sh"}, "env": s.Env, "cwd": "/"},
+		"root":        map[string]interface{}{"path": "rootfs"},
+		"annotations": s.Annotations,
+		"linux":       map[string]interface{}{"cgroupsPath": s.CgroupsPath},
+	}
+	b, _ := json.Marshal(spec)
+	writeFile(filepath.Join(dir, "bundle", "config.json"), string(b), 0644)
+}
+
+func runHook(dir string, stage string) error {
+	// The hook adjusts the container through /proc/<pid>/root, the harness stands in for the container process.
+	state := fmt.Sprintf(`{"ociVersion": "1.0.0", "id": "e2e", "pid": %d, "bundle": %q}`, os.Getpid(), filepath.Join(dir, "bundle"))
+	cmd := exec.Command(*hookflag, "-config", filepath.Join(dir, "config.toml"), stage)
+	cmd.Stdin = strings.NewReader(state)
+	out, err := cmd.CombinedOutput()
+	ioutil.WriteFile(filepath.Join(dir, stage+".log"), out, 0644)
+	return err
+}
+
+func getConfigureArgs(dir string) []string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cli.log"))
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.Contains(line, " configure ") || strings.HasPrefix(line, "configure ") {
+			return strings.Fields(line)
+		}
+	}
+	return nil
+}
+
+func exitCode(err error) int {
+	if e, ok := err.(*exec.ExitError); ok {
+		if status, ok := e.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
+
+func contains(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
+
+// check runs a scenario and returns the failed expectations.
+func check(s scenario, dir string) []string {
+	var failures []string
+	stage := s.Stage
+	if len(stage) == 0 {
+		stage = "prestart"
+	}
+	err := runHook(dir, stage)
+	if s.ExpectFailure {
+		if err == nil {
+			failures = append(failures, stage+" succeeded, expected a failure")
+		} else if code := exitCode(err); s.ExpectExitCode != 0 && code != s.ExpectExitCode {
+			failures = append(failures, fmt.Sprintf("%s exited with %d, expected %d", stage, code, s.ExpectExitCode))
+		}
+		return failures
+	}
+	if err != nil {
+		return append(failures, fmt.Sprintf("%s failed: %v (see %s)", stage, err, filepath.Join(dir, stage+".log")))
+	}
+
+	args := getConfigureArgs(dir)
+	if s.ExpectArgs == nil && args != nil {
+		failures = append(failures, fmt.Sprintf("nvidia-container-cli configure called: %v", args))
+	}
+	if s.ExpectArgs != nil && args == nil {
+		failures = append(failures, "nvidia-container-cli configure not called")
+	}
+	for _, a := range s.ExpectArgs {
+		if args != nil && !contains(args, expand(a, dir)) {
+			failures = append(failures, fmt.Sprintf("missing argument %s in %v", expand(a, dir), args))
+		}
+	}
+	for _, a := range s.UnexpectArgs {
+		if contains(args, expand(a, dir)) {
+			failures = append(failures, fmt.Sprintf("unexpected argument %s in %v", expand(a, dir), args))
+		}
+	}
+	if len(s.ExpectOutput) > 0 {
+		out, _ := ioutil.ReadFile(filepath.Join(dir, stage+".log"))
+		for _, o := range s.ExpectOutput {
+			if !strings.Contains(string(out), o) {
+				failures = append(failures, fmt.Sprintf("missing %s in the output", o))
+			}
+		}
+	}
+	for _, f := range s.ExpectFiles {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			failures = append(failures, fmt.Sprintf("missing file %s", f))
+		}
+	}
+
+	if err := runHook(dir, "poststop"); err != nil {
+		failures = append(failures, fmt.Sprintf("poststop failed: %v (see %s)", err, filepath.Join(dir, "poststop.log")))
+	}
+	return failures
+}
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+
+	hook, err := exec.LookPath(*hookflag)
+	if err != nil {
+		log.Fatalln("couldn't find the hook binary:", err)
+	}
+	*hookflag, _ = filepath.Abs(hook)
+
+	failed := 0
+	for _, s := range scenarios {
+		if !strings.Contains(s.Name, *runflag) {
+			continue
+		}
+		dir, err := ioutil.TempDir("", "hook-e2e-"+s.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		setup(s, dir)
+		if failures := check(s, dir); len(failures) > 0 {
+			failed++
+			fmt.Printf("FAIL %s\n", s.Name)
+			for _, f := range failures {
+				fmt.Printf("     %s\n", f)
+			}
+			// Keep the bundle for debugging.
+			continue
+		}
+		fmt.Printf("ok   %s\n", s.Name)
+		if !*keepflag {
+			os.RemoveAll(dir)
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
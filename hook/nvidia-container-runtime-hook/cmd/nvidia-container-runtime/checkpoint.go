@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runtimeState returns the pid and the status of a container, from the state command of the runtime.
+func runtimeState(runtime string, global []string, id string) (int, string, error) {
+	out, err := exec.Command(runtime, append(append(append([]string{}, global...), "state"), id)...).Output()
+	if err != nil {
+		return 0, "", fmt.Errorf("couldn't get the state of %s: %v", id, err)
+	}
+	var state struct {
+		Pid    int    `json:"pid"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(out, &state); err != nil {
+		return 0, "", fmt.Errorf("invalid state of %s: %v", id, err)
+	}
+	return state.Pid, state.Status, nil
+}
+
+// toggleCUDA moves the CUDA state of the processes of a container between the GPUs and the host memory.
+func toggleCUDA(c *config, pid int) error {
+	log.Printf("running %s --toggle --pid %d", *c.Runtime.CUDACheckpoint, pid)
+	out, err := exec.Command(*c.Runtime.CUDACheckpoint, "--toggle", "--pid", strconv.Itoa(pid)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cuda-checkpoint failed for pid %d: %v: %s", pid, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func runRuntime(runtime string, args []string) *exec.Cmd {
+	log.Printf("running %s %s", runtime, strings.Join(args, " "))
+	cmd := exec.Command(runtime, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd
+}
+
+// checkpointWithCUDA moves the CUDA state of the container to the host memory, where CRIU checkpoints it, and
+// back to the GPUs if the container keeps running.
+func checkpointWithCUDA(c *config, runtime string, args []string, global []string, cmdArgs []string) error {
+	id := getContainerID(cmdArgs)
+	pid, _, err := runtimeState(runtime, global, id)
+	if err != nil {
+		return err
+	}
+	if err := toggleCUDA(c, pid); err != nil {
+		return err
+	}
+	err = runRuntime(runtime, args).Run()
+	leaveRunning := false
+	for _, arg := range cmdArgs {
+		name, _ := flagName(arg)
+		leaveRunning = leaveRunning || (strings.HasPrefix(arg, "-") && name == "leave-running")
+	}
+	if err != nil || leaveRunning {
+		if e := toggleCUDA(c, pid); e != nil {
+			log.Println(e)
+			if err == nil {
+				return e
+			}
+		}
+	}
+	return err
+}
+
+// restoreWithCUDA moves the CUDA state of the restored container back to the GPUs once it runs, the runtime
+// returns then when detached.
+func restoreWithCUDA(c *config, runtime string, args []string, global []string, id string) error {
+	cmd := runRuntime(runtime, args)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+			// Detached, unless the container already exited.
+			pid, status, err := runtimeState(runtime, global, id)
+			if err != nil || status != "running" {
+				return nil
+			}
+			return toggleCUDA(c, pid)
+		case <-time.After(100 * time.Millisecond):
+			if pid, status, err := runtimeState(runtime, global, id); err == nil && status == "running" {
+				if err := toggleCUDA(c, pid); err != nil {
+					log.Println(err)
+				}
+				return <-done
+			}
+		}
+	}
+}
@@ -0,0 +1,432 @@
+// nvidia-container-runtime wraps runc, or another OCI runtime like crun: it adds nvidia-container-runtime-hook
+// to the OCI spec of the containers requesting GPUs, then execs the runtime with the same arguments.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/configfile"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/oci"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/nvcontainer"
+)
+
+const (
+	envRuntimeConfigPrefix = "NVIDIA_CONTAINER_RUNTIME_"
+	envNVGPU               = "NVIDIA_VISIBLE_DEVICES"
+	kataAnnotationPrefix   = "io.katacontainers."
+	// Set on restore by the previous versions of the wrapper, and the GPUs recorded by the hook for the restore:
+	// they're removed from the specs of the users.
+	restoreAnnotation        = "com.nvidia.restore"
+	grantedDevicesAnnotation = "com.nvidia.granted-devices"
+
+	defaultStage = "prestart"
+)
+
+// Global flags of runc taking a value, to find the command among the arguments.
+var runcValueFlags = map[string]bool{
+	"root":       true,
+	"log":        true,
+	"log-format": true,
+	"criu":       true,
+	"rootless":   true,
+}
+
+// Flags of runc create, run, checkpoint and restore taking a value, to find the container ID among the arguments.
+var createValueFlags = map[string]bool{
+	"bundle":              true,
+	"b":                   true,
+	"console-socket":      true,
+	"pid-file":            true,
+	"preserve-fds":        true,
+	"image-path":          true,
+	"work-path":           true,
+	"parent-path":         true,
+	"page-server":         true,
+	"manage-cgroups-mode": true,
+	"empty-ns":            true,
+	"status-fd":           true,
+	"lsm-profile":         true,
+	"lsm-mount-context":   true,
+}
+
+// config is the subset of the configuration file used by the runtime, the stage is the one of the hook.
+type config struct {
+	Stage             string                   `toml:"stage"`
+	TopologySelection bool                     `toml:"topology-selection"`
+	ExportDevices     bool                     `toml:"export-devices"`
+	ContainerEnv      []string                 `toml:"container-env"`
+	Runtime           configfile.RuntimeConfig `toml:"nvidia-container-runtime"`
+	MPS               configfile.MPSConfig     `toml:"mps"`
+
+	// The request sources of the hook, to find the containers requesting GPUs.
+	RequestSources          []string `toml:"request-sources"`
+	DeviceListMountsRoot    string   `toml:"device-list-volume-mounts-root"`
+	SwarmResource           string   `toml:"swarm-resource"`
+	DevicePluginAllocations string   `toml:"device-plugin-allocations"`
+	MountGPUOnlyByUUID      bool     `toml:"mount-gpu-only-by-uuid"`
+
+	path string
+}
+
+func getConfig() (*config, error) {
+	c := &config{
+		Stage:   defaultStage,
+		Runtime: configfile.DefaultRuntimeConfig(),
+		MPS:     configfile.DefaultMPSConfig(),
+		path:    configfile.Find(),
+	}
+	if p, ok := os.LookupEnv(envRuntimeConfigPrefix + "CONFIG"); ok {
+		c.path = p
+	}
+	// The other keys are options of the hook.
+	if _, err := configfile.Load(c.path, c); err != nil {
+		return nil, fmt.Errorf("couldn't open configuration file: %v", err)
+	}
+	if err := configfile.ApplyEnvOverrides(&c.Runtime, envRuntimeConfigPrefix); err != nil {
+		return nil, err
+	}
+	if err := configfile.CheckContainerEnv(c.ContainerEnv); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// flagName returns the name of a command line flag and whether its value is part of the argument.
+func flagName(arg string) (string, bool) {
+	name := strings.TrimLeft(arg, "-")
+	if i := strings.Index(name, "="); i >= 0 {
+		return name[:i], true
+	}
+	return name, false
+}
+
+// getCommand returns the runc command and its arguments.
+func getCommand(args []string) (string, []string) {
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			return args[i], args[i+1:]
+		}
+		if name, inline := flagName(args[i]); runcValueFlags[name] && !inline {
+			i++
+		}
+	}
+	return "", nil
+}
+
+// getBundle returns the bundle of the create and run commands, the working directory by default.
+func getBundle(args []string) string {
+	for i, arg := range args {
+		name, inline := flagName(arg)
+		if name != "bundle" && name != "b" {
+			continue
+		}
+		if inline {
+			return arg[strings.Index(arg, "=")+1:]
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return "."
+}
+
+// getContainerID returns the container ID of the create and run commands.
+func getContainerID(args []string) string {
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			return args[i]
+		}
+		if name, inline := flagName(args[i]); createValueFlags[name] && !inline {
+			i++
+		}
+	}
+	return ""
+}
+
+// isGPURequested tells if a container requests GPUs from the request sources of the hook configuration.
+func isGPURequested(c *config, spec *oci.Spec) (bool, error) {
+	return nvcontainer.IsGPURequested(spec, nvcontainer.RequestOptions{
+		Sources:                 c.RequestSources,
+		DeviceListMountsRoot:    c.DeviceListMountsRoot,
+		SwarmResource:           c.SwarmResource,
+		DevicePluginAllocations: c.DevicePluginAllocations,
+		MountGPUOnlyByUUID:      c.MountGPUOnlyByUUID,
+	})
+}
+
+// isVMRuntime mirrors the containers the hook leaves to VFIO: the ones run in a VM by Kata Containers.
+func isVMRuntime(spec *oci.Spec) bool {
+	for k := range spec.Annotations {
+		if strings.HasPrefix(k, kataAnnotationPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// addHooks adds the hook to the stage it configures containers at and to poststop, unless already there.
+// The hook of a restored container runs with -restore, the spec of a checkpoint has the hook already.
+func addHooks(spec map[string]interface{}, path string, c *config, restore bool) {
+	hooks, _ := spec["hooks"].(map[string]interface{})
+	if hooks == nil {
+		hooks = make(map[string]interface{})
+	}
+stages:
+	for _, s := range []string{c.Stage, "poststop"} {
+		list, _ := hooks[s].([]interface{})
+		for _, h := range list {
+			if h, ok := h.(map[string]interface{}); ok && h["path"] == path {
+				if args, ok := h["args"].([]interface{}); ok && s == c.Stage {
+					h["args"] = setRestoreArg(args, restore)
+				}
+				continue stages
+			}
+		}
+		args := []string{filepath.Base(path)}
+		if c.path != configfile.DefaultPath {
+			args = append(args, "-config", c.path)
+		}
+		if restore && s == c.Stage {
+			args = append(args, "-restore")
+		}
+		hook := map[string]interface{}{
+			"path": path,
+			"args": append(args, s),
+		}
+		if env := tracingEnv(); len(env) > 0 {
+			hook["env"] = env
+		}
+		hooks[s] = append(list, hook)
+	}
+	spec["hooks"] = hooks
+}
+
+// setRestoreArg adds the -restore flag to the arguments of a hook, before its stage, or removes it.
+func setRestoreArg(list []interface{}, restore bool) []interface{} {
+	var args []interface{}
+	for _, a := range list {
+		if a != "-restore" {
+			args = append(args, a)
+		}
+	}
+	if restore && len(args) > 0 {
+		stage := args[len(args)-1]
+		args = append(append(args[:len(args)-1], "-restore"), stage)
+	}
+	return args
+}
+
+// tracingEnv returns the OpenTelemetry variables of the wrapper, the runtimes run the hooks with the env of their entry only.
+func tracingEnv() []string {
+	var env []string
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, "OTEL_") || strings.HasPrefix(e, "TRACEPARENT=") {
+			env = append(env, e)
+		}
+	}
+	return env
+}
+
+// addEnv sets the variables of the process not already set by the container.
+func addEnv(spec map[string]interface{}, env []string) {
+	process, _ := spec["process"].(map[string]interface{})
+	if process == nil {
+		return
+	}
+	list, _ := process["env"].([]interface{})
+vars:
+	for _, e := range env {
+		name := e[:strings.Index(e, "=")+1]
+		for _, v := range list {
+			if v, ok := v.(string); ok && strings.HasPrefix(v, name) {
+				continue vars
+			}
+		}
+		list = append(list, e)
+	}
+	process["env"] = list
+}
+
+// isTopologyRequest mirrors the requests of GPUs the hook picks by topology, e.g. count:4,policy:nvlink.
+func isTopologyRequest(spec *oci.Spec) bool {
+	devices, _ := spec.Getenv(envNVGPU)
+	return strings.HasPrefix(devices, "count:") || strings.HasPrefix(devices, "policy:")
+}
+
+// resolveDevices runs the hook to resolve the GPUs of the container, e.g. pick them by topology, and write them
+// into its environment: the hook itself runs once the environment of the container process is set.
+func resolveDevices(c *config, path string, bundle string, id string) error {
+	if err := runHookCommand(c, path, "resolve-devices", bundle, id); err != nil {
+		return fmt.Errorf("couldn't resolve the devices: %v", err)
+	}
+	return nil
+}
+
+// assignVFIO runs the hook to add the VFIO devices of the GPUs of the container to its spec.
+func assignVFIO(c *config, path string, bundle string, id string) error {
+	if err := runHookCommand(c, path, "assign-vfio", bundle, id); err != nil {
+		return fmt.Errorf("couldn't pass the GPUs through: %v", err)
+	}
+	return nil
+}
+
+// runHookCommand runs a command of the hook updating the spec of the container in its bundle.
+func runHookCommand(c *config, path string, command string, bundle string, id string) error {
+	args := []string{}
+	if c.path != configfile.DefaultPath {
+		args = append(args, "-config", c.path)
+	}
+	args = append(args, command, "-bundle", bundle, "-id", id)
+	log.Printf("running %s %s", path, strings.Join(args, " "))
+	if out, err := exec.Command(path, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func injectHook(c *config, bundle string, id string, restore bool) error {
+	spec, err := oci.LoadSpec(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return err
+	}
+	if requested, err := isGPURequested(c, spec); err != nil || !requested {
+		return err
+	}
+
+	path, err := exec.LookPath(c.Runtime.HookPath)
+	if err != nil {
+		return fmt.Errorf("couldn't find the hook: %v", err)
+	}
+	if isVMRuntime(spec) {
+		// The hooks would run on the host, the GPUs are plugged into the VM instead.
+		return assignVFIO(c, path, bundle, id)
+	}
+	var env []string
+	if c.MPS.Enabled {
+		if env, err = c.MPS.Environment(spec.Annotations); err != nil {
+			return err
+		}
+	}
+	env = append(env, c.ContainerEnv...)
+	if c.ExportDevices || (c.TopologySelection && isTopologyRequest(spec)) {
+		if err := resolveDevices(c, path, bundle, id); err != nil {
+			return err
+		}
+	}
+	log.Printf("adding %s to the %s hooks of %s", path, c.Stage, bundle)
+	return oci.UpdateSpec(filepath.Join(bundle, "config.json"), func(spec map[string]interface{}) {
+		addHooks(spec, path, c, restore)
+		addEnv(spec, env)
+		// Only the hook records the GPUs of a container, for its restore.
+		if annotations, ok := spec["annotations"].(map[string]interface{}); ok {
+			delete(annotations, restoreAnnotation)
+			if !restore {
+				delete(annotations, grantedDevicesAnnotation)
+			}
+		}
+	})
+}
+
+// lookPathAll returns the executables of a name in the directories of PATH, or the path itself if it has a slash.
+func lookPathAll(name string) []string {
+	if strings.Contains(name, "/") {
+		if _, err := exec.LookPath(name); err != nil {
+			return nil
+		}
+		return []string{name}
+	}
+	var paths []string
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if path, err := exec.LookPath(filepath.Join(dir, name)); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// findRuntime returns the first of the runtimes found, names are looked up in PATH.
+// The wrapper itself is skipped, it may be installed as runc in a directory of PATH.
+func findRuntime(runtimes []string) (string, error) {
+	self, _ := os.Executable()
+	for _, r := range runtimes {
+		for _, path := range lookPathAll(r) {
+			if len(self) > 0 && sameFile(path, self) {
+				log.Printf("skipping runtime %s: it is the wrapper", path)
+				continue
+			}
+			return path, nil
+		}
+		log.Printf("runtime %s not found", r)
+	}
+	return "", fmt.Errorf("none of the runtimes %v was found", runtimes)
+}
+
+func sameFile(a string, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
+
+func run() error {
+	c, err := getConfig()
+	if err != nil {
+		return err
+	}
+	log.SetOutput(ioutil.Discard)
+	if c.Runtime.Debug != nil {
+		f, err := os.OpenFile(*c.Runtime.Debug, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("couldn't open log file: %v", err)
+		}
+		defer f.Close()
+		log.SetOutput(f)
+	}
+
+	args := os.Args[1:]
+	cmd, cmdArgs := getCommand(args)
+	if cmd == "create" || cmd == "run" || cmd == "restore" {
+		if err := injectHook(c, getBundle(cmdArgs), getContainerID(cmdArgs), cmd == "restore"); err != nil {
+			return err
+		}
+	}
+
+	runtime, err := findRuntime(c.Runtime.Runtimes)
+	if err != nil {
+		return err
+	}
+	if (cmd == "checkpoint" || cmd == "restore") && c.Runtime.CUDACheckpoint != nil {
+		global := args[:len(args)-len(cmdArgs)-1]
+		if cmd == "checkpoint" {
+			return checkpointWithCUDA(c, runtime, args, global, cmdArgs)
+		}
+		return restoreWithCUDA(c, runtime, args, global, getContainerID(cmdArgs))
+	}
+	log.Printf("running %s %s", runtime, strings.Join(args, " "))
+	return syscall.Exec(runtime, append([]string{runtime}, args...), os.Environ())
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags)
+	log.SetPrefix("nvidia-container-runtime: ")
+	if err := run(); err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			// The runtime run as a child failed, it said why.
+			if status, ok := e.Sys().(syscall.WaitStatus); ok {
+				os.Exit(status.ExitStatus())
+			}
+		}
+		fmt.Fprintln(os.Stderr, "nvidia-container-runtime:", err)
+		log.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/configfile"
+)
+
+func TestGetCommand(t *testing.T) {
+	var tests = []struct {
+		args        []string
+		command     string
+		bundle      string
+		containerID string
+	}{
+		{[]string{"create", "--bundle", "/b", "ctr"}, "create", "/b", "ctr"},
+		{[]string{"--root", "/run/runc", "--log=/log", "run", "-b=/b", "--pid-file", "/pid", "ctr"}, "run", "/b", "ctr"},
+		{[]string{"--debug", "restore", "--image-path", "/img", "ctr"}, "restore", ".", "ctr"},
+		{[]string{"--root", "/run/runc", "state", "ctr"}, "state", ".", "ctr"},
+		{[]string{"--version"}, "", ".", ""},
+	}
+	for _, tc := range tests {
+		command, args := getCommand(tc.args)
+		if command != tc.command || getBundle(args) != tc.bundle || getContainerID(args) != tc.containerID {
+			t.Errorf("%v: expected %s %s %s, got %s %s %s", tc.args, tc.command, tc.bundle, tc.containerID,
+				command, getBundle(args), getContainerID(args))
+		}
+	}
+}
+
+func TestFindRuntime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runtimes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+
+	// runc is in both directories of PATH, crun in the second one only. The first wrapper is the test itself,
+	// like the wrapper installed as runc.
+	first, second := path.Join(dir, "first"), path.Join(dir, "second")
+	os.MkdirAll(first, 0755)
+	os.MkdirAll(second, 0755)
+	for _, p := range []string{path.Join(first, "runc"), path.Join(second, "runc"), path.Join(second, "crun"), path.Join(second, "wrapper")} {
+		ioutil.WriteFile(p, []byte("#!/bin/sh\n"), 0755)
+	}
+	ioutil.WriteFile(path.Join(first, "notexec"), []byte("#!/bin/sh\n"), 0644)
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(self, path.Join(first, "wrapper")); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("PATH", first+":"+second)
+
+	var tests = []struct {
+		runtimes []string
+		expected string
+	}{
+		{[]string{"runc"}, path.Join(first, "runc")},
+		{[]string{"crun", "runc"}, path.Join(second, "crun")},
+		{[]string{"missing", "crun"}, path.Join(second, "crun")},
+		{[]string{path.Join(second, "runc")}, path.Join(second, "runc")},
+		{[]string{path.Join(first, "crun"), "crun"}, path.Join(second, "crun")},
+		{[]string{"notexec", "crun"}, path.Join(second, "crun")},
+		{[]string{"wrapper"}, path.Join(second, "wrapper")},
+		{[]string{path.Join(first, "wrapper")}, ""},
+		{[]string{"missing"}, ""},
+		{nil, ""},
+	}
+	for _, tc := range tests {
+		runtime, err := findRuntime(tc.runtimes)
+		if runtime != tc.expected || (err == nil) != (len(tc.expected) > 0) {
+			t.Errorf("%v: expected %q, got %q (%v)", tc.runtimes, tc.expected, runtime, err)
+		}
+	}
+}
+
+func TestInjectHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hookPath := path.Join(dir, "nvidia-container-runtime-hook")
+	ioutil.WriteFile(hookPath, []byte("#!/bin/sh\n"), 0755)
+	prestart := map[string]interface{}{"path": hookPath, "args": []interface{}{"nvidia-container-runtime-hook", "prestart"}}
+	restore := map[string]interface{}{"path": hookPath, "args": []interface{}{"nvidia-container-runtime-hook", "-restore", "prestart"}}
+	poststop := map[string]interface{}{"path": hookPath, "args": []interface{}{"nvidia-container-runtime-hook", "poststop"}}
+
+	var tests = []struct {
+		description string
+		env         []interface{}
+		hooks       map[string]interface{}
+		restore     bool
+		expected    map[string]interface{}
+	}{
+		{"no GPU", []interface{}{"PATH=/bin"}, nil, false, nil},
+		{"GPUs", []interface{}{"NVIDIA_VISIBLE_DEVICES=0"}, nil, false,
+			map[string]interface{}{"prestart": []interface{}{prestart}, "poststop": []interface{}{poststop}}},
+		{"legacy CUDA image", []interface{}{"CUDA_VERSION=9.0"}, nil, false,
+			map[string]interface{}{"prestart": []interface{}{prestart}, "poststop": []interface{}{poststop}}},
+		{"hooks already there", []interface{}{"NVIDIA_VISIBLE_DEVICES=0"},
+			map[string]interface{}{"prestart": []interface{}{prestart}, "poststop": []interface{}{poststop}}, false,
+			map[string]interface{}{"prestart": []interface{}{prestart}, "poststop": []interface{}{poststop}}},
+		{"restore", []interface{}{"NVIDIA_VISIBLE_DEVICES=0"}, nil, true,
+			map[string]interface{}{"prestart": []interface{}{restore}, "poststop": []interface{}{poststop}}},
+		{"restore of a checkpoint", []interface{}{"NVIDIA_VISIBLE_DEVICES=0"},
+			map[string]interface{}{"prestart": []interface{}{prestart}, "poststop": []interface{}{poststop}}, true,
+			map[string]interface{}{"prestart": []interface{}{restore}, "poststop": []interface{}{poststop}}},
+	}
+	for _, tc := range tests {
+		spec := map[string]interface{}{
+			"ociVersion": "1.0.0",
+			"root":       map[string]interface{}{"path": "rootfs"},
+			"process":    map[string]interface{}{"env": tc.env},
+		}
+		if tc.hooks != nil {
+			spec["hooks"] = tc.hooks
+		}
+		b, _ := json.Marshal(spec)
+		ioutil.WriteFile(path.Join(dir, "config.json"), b, 0644)
+
+		runtime := configfile.DefaultRuntimeConfig()
+		runtime.HookPath = hookPath
+		c := &config{Stage: defaultStage, Runtime: runtime, path: configfile.DefaultPath}
+		if err := injectHook(c, dir, "ctr", tc.restore); err != nil {
+			t.Fatalf("%s: %v", tc.description, err)
+		}
+
+		b, _ = ioutil.ReadFile(path.Join(dir, "config.json"))
+		var updated map[string]interface{}
+		if err := json.Unmarshal(b, &updated); err != nil {
+			t.Fatal(err)
+		}
+		hooks, _ := updated["hooks"].(map[string]interface{})
+		if !reflect.DeepEqual(hooks, tc.expected) {
+			t.Errorf("%s: expected the hooks %v, got %v", tc.description, tc.expected, hooks)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Brands of the GPUs supporting CUDA forward compatibility (cuda-compat package).
+var forwardCompatBrands = []string{"Tesla", "Quadro", "NVIDIA RTX"}
+
+// dockerInspect is the subset of the docker inspect output we need, for both images and containers.
+type dockerInspect struct {
+	Id       string
+	RepoTags []string
+	Name     string
+	Config   struct {
+		Env []string
+	}
+}
+
+// compareVersions compares two CUDA versions in the form major[.minor[.patch]].
+func compareVersions(a, b string) int {
+	amaj, amin, apatch, err := parseCudaVersion(a)
+	if err != nil {
+		log.Panicln(err)
+	}
+	bmaj, bmin, bpatch, err := parseCudaVersion(b)
+	if err != nil {
+		log.Panicln(err)
+	}
+	for _, d := range [][2]uint32{{amaj, bmaj}, {amin, bmin}, {apatch, bpatch}} {
+		if d[0] < d[1] {
+			return -1
+		}
+		if d[0] > d[1] {
+			return 1
+		}
+	}
+	return 0
+}
+
+func hasForwardCompatGPU(info *driverInfo) bool {
+	for _, d := range info.Devices {
+		for _, brand := range forwardCompatBrands {
+			if strings.EqualFold(d.Brand, brand) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkCompat returns the unsatisfied requirements of a container environment for the given driver.
+// The GPUs of the container aren't known, their constraints are assumed to hold.
+func checkCompat(env []string, info *driverInfo) ([]string, error) {
+	m, err := getEnvMap(env, false)
+	if err != nil {
+		return nil, err
+	}
+	nvidia, err := getNvidiaConfig(m, false)
+	if err != nil || nvidia == nil || nvidia.DisableRequire {
+		return nil, err
+	}
+
+	var failed []string
+	for _, req := range nvidia.Requirements {
+		unsatisfied, err := checkRequirement(req, info, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(unsatisfied) > 0 {
+			failed = append(failed, req)
+		}
+	}
+	return failed, nil
+}
+
+func doCheckCompat(args []string) {
+	flags := flag.NewFlagSet("check-compat", flag.ExitOnError)
+	cudaVersion := flags.String("cuda-version", "", "CUDA version supported by the driver, queried from the node if unset")
+	require := flags.String("require", "", "requirement to check, e.g. cuda>=11.0, instead of reading docker inspect output from stdin")
+	flags.Parse(args)
+
+	defer exit()
+	log.SetFlags(0)
+
+	var info *driverInfo
+	if len(*cudaVersion) > 0 {
+		info = &driverInfo{CUDAVersion: *cudaVersion}
+	} else {
+		var err error
+		if info, err = getDriverInfo(getHookConfig().NvidiaContainerCLI); err != nil {
+			log.Panicln(err)
+		}
+	}
+
+	var inspects []dockerInspect
+	if len(*require) > 0 {
+		inspects = []dockerInspect{{Name: *require}}
+		inspects[0].Config.Env = []string{envNVRequireCUDA + "=" + *require, envNVGPU + "=all"}
+	} else if err := json.NewDecoder(os.Stdin).Decode(&inspects); err != nil {
+		log.Panicln("could not decode docker inspect output:", err)
+	}
+
+	failed := false
+	for _, i := range inspects {
+		name := i.Name
+		if len(i.RepoTags) > 0 {
+			name = i.RepoTags[0]
+		} else if len(name) == 0 {
+			name = i.Id
+		}
+
+		unsatisfied, err := checkCompat(i.Config.Env, info)
+		if err != nil {
+			log.Panicf("%s: %v", name, err)
+		}
+		if len(unsatisfied) == 0 {
+			fmt.Printf("%s: OK (driver supports CUDA %s)\n", name, info.CUDAVersion)
+			continue
+		}
+
+		failed = true
+		fmt.Printf("%s: FAIL: %s not satisfied by CUDA %s\n", name, strings.Join(unsatisfied, ", "), info.CUDAVersion)
+		if hasForwardCompatGPU(info) {
+			fmt.Printf("%s: the image can still run if it ships the cuda-compat package of its CUDA version\n", name)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/configfile"
+)
+
+// configDoc documents an option of the configuration file, the example is the value of the unset options.
+type configDoc struct {
+	doc     string
+	example string
+}
+
+var configDocs = map[string]configDoc{
+	"require-policy":                 {"enforce, warn about (start the container and log the unsatisfied constraints) or ignore the NVIDIA_REQUIRE_* constraints of all the containers, overriding NVIDIA_DISABLE_REQUIRE and disable-require", `"warn"`},
+	"disable-require":                {"ignore the NVIDIA_REQUIRE_* constraints of all the containers", ""},
+	"swarm-resource":                 {"comma-separated environment variables of the GPUs allocated by Docker Swarm, their devices and those of their numbered variables (NAME_1, NAME_2...) are merged with precedence over NVIDIA_VISIBLE_DEVICES", `"DOCKER_RESOURCE_GPU,DOCKER_RESOURCE_NVIDIA-GPU"`},
+	"stage":                          {"OCI hook stage configuring the container: prestart, createRuntime or createContainer", ""},
+	"mode":                           {`how the container is configured: "legacy" runs nvidia-container-cli, "cdi" applies the CDI specs of the devices, "csv" injects the files listed by the CSV files of Jetson systems, "wsl" /dev/dxg and the driver of the WSL2 host, "auto" picks one from the node`, ""},
+	"cdi-spec-dirs":                  {"directories of the CDI specs, later directories have higher precedence", ""},
+	"csv-dirs":                       {"directories of the CSV files of the csv mode, lines of <dev|lib|dir|sym>, <path>", ""},
+	"profiles":                       {"named profiles of options set over the configuration for the containers requesting them (com.nvidia.profile annotation or NVIDIA_PROFILE)", "[profiles.inference]\ndefault-driver-capabilities = \"compute,utility\"\nallowed-devices = [\"GPU-83d7ced8-*\"]"},
+	"mounts":                         {"host paths bind-mounted in the containers requesting a driver capability, host[:container][:ro|rw], read-only by default", "[mounts]\ncompute = [\"/etc/nvidia/licensing\"]"},
+	"devices":                        {"device nodes injected in the containers requesting a driver capability", "[devices]\ncompute = [\"/dev/nvidia-licensing\"]"},
+	"default-profile":                {"profile of the containers requesting none", `"inference"`},
+	"policy-version":                 {"version of the configuration set by the administrator, logged by each invocation and in the audit log", `"2024-05-01"`},
+	"strict-config":                  {"fail on unknown options of the configuration files instead of ignoring them with a warning", ""},
+	"dry-run":                        {"print how the containers would be configured instead of configuring them", ""},
+	"log-level":                      {"minimum level of the messages: debug, info, warning or error", ""},
+	"log-file":                       {"file of the messages, stderr if unset", `"/var/log/nvidia-container-runtime.log"`},
+	"log-format":                     {"format of the messages: text or json", ""},
+	"request-sources":                {"where the devices are requested, by precedence: env, annotations and volume-mounts", ""},
+	"device-list-volume-mounts-root": {"volume-mounts requests are mounts of /dev/null on <root>/<device>", ""},
+	"device-plugin-allocations":      {"directory of the <pod UID>.json allocation files of the Kubernetes device plugin, the only device requests of the pods with mount-gpu-only-by-uuid; disabled if unset", `"/var/lib/kubelet/device-plugins/nvidia-allocations"`},
+	"accept-nvidia-visible-devices-envvar-when-unprivileged": {"allow unprivileged containers to request devices with NVIDIA_VISIBLE_DEVICES", ""},
+	"allowed-devices":               {"GPUs the containers may use, UUIDs or indexes, a trailing '*' matches a prefix; all if empty", ""},
+	"denied-devices":                {"GPUs the containers may not use", ""},
+	"validate-devices":              {"check that the requested GPUs and MIG devices exist before configuring the container", ""},
+	"validate-requirements":         {"evaluate the NVIDIA_REQUIRE_* constraints in the hook, reporting each failed one with the values of the node", ""},
+	"mount-gpu-only-by-uuid":        {"only mount the GPUs requested by UUID, ignoring indexes and all", ""},
+	"raw-device-mounts":             {"reject or allow the unprivileged containers mounting the NVIDIA device nodes or /dev from the host; reject by default with mount-gpu-only-by-uuid", `"reject"`},
+	"create-device-nodes":           {"create the missing /dev/nvidia* device nodes on the host", ""},
+	"load-kernel-modules":           {"load the kernel modules from the hook instead of nvidia-container-cli", ""},
+	"kernel-modules":                {"kernel modules loaded by load-kernel-modules", ""},
+	"inject-uvm-tools":              {"include or exclude /dev/nvidia-uvm-tools regardless of the capabilities", "false"},
+	"inject-modeset":                {"include or exclude /dev/nvidia-modeset regardless of the capabilities", "false"},
+	"display-forwarding":            {"mount the X11 socket of DISPLAY, the Wayland socket of WAYLAND_DISPLAY and XAUTHORITY in the containers requesting the display capability", "true"},
+	"inject-drm":                    {"include or exclude the /dev/dri nodes of the GPUs regardless of the capabilities, injected with graphics or display if unset", "false"},
+	"musl-linker":                   {"how to expose the driver libraries to musl based images: path-file or none", ""},
+	"detect-vgpu":                   {"detect vGPU guests and provide the license client configuration to the container", ""},
+	"vgpu-libraries":                {"libraries of the vGPU guest driver mounted in the containers requesting the vgpu driver capability", ""},
+	"checkpoint-restore":            {"record the UUIDs of the GPUs of the containers in their spec: restored from a checkpoint, they get the same GPUs or fail", ""},
+	"record-versions":               {"write the injected driver versions in the bundle", ""},
+	"record-versions-annotation":    {"also record the driver versions as an annotation of config.json", ""},
+	"post-configure":                {"executables run after the GPUs are configured, with the container state as JSON on stdin", `["/usr/local/libexec/register-gpu-container"]`},
+	"post-stop":                     {"executables run by the poststop hook to undo what post-configure set up", `["/usr/local/libexec/unregister-gpu-container"]`},
+	"topology-selection":            {"pick the GPUs of the count:<n>[,policy:nvlink|pcie] requests by NVLink/PCIe topology", ""},
+	"allow-mig-management":          {"let the privileged containers manage or monitor MIG instances with NVIDIA_MIG_CONFIG_DEVICES/NVIDIA_MIG_MONITOR_DEVICES", ""},
+	"selinux-relabel":               {"relabel the NVIDIA device nodes of the containers (devices), and the bind mounts of the hook (all), with selinux-type", `"devices"`},
+	"selinux-type":                  {"SELinux type of the relabeled files, container_file_t by default", ""},
+	"verify-device-access":          {"check that the processes of the containers can open their NVIDIA devices, e.g. through the cgroup v2 device filter", ""},
+	"apparmor-check":                {"warn when the AppArmor profile of a container denies its NVIDIA devices, see the apparmor-rules command", ""},
+	"export-devices":                {"write the resolved GPU UUIDs and capabilities into the environment of the containers, with the wrapper", ""},
+	"nccl-topo-file":                {"NCCL topology file mounted in the multi-GPU containers where NCCL looks for it, \"auto\" the one of the node (/etc/nccl/topo.xml, Azure ND images) or one generated from sysfs", `"auto"`},
+	"container-env":                 {"variables set in the environment of the GPU containers not setting them, with the wrapper", `["NCCL_SOCKET_IFNAME=eth1", "CUDA_CACHE_PATH=/scratch"]`},
+	"device-resolver":               {"executable or unix socket (unix:///path) resolving the requested devices to GPU UUIDs, killed past cli-timeout (10s if 0s)", `"unix:///run/gpu-allocator.sock"`},
+	"disabled-driver-capabilities":  {"driver capabilities removed from the node, requesting them fails and all excludes them", `["display"]`},
+	"default-driver-capabilities":   {"capabilities of the containers not setting NVIDIA_DRIVER_CAPABILITIES, comma-separated", ""},
+	"supported-driver-capabilities": {"driver capabilities the containers may use, all if empty", ""},
+	"unsupported-capabilities":      {"containers requesting by name a capability outside of supported-driver-capabilities: strip or fail", ""},
+	"parallelism":                   {"concurrent driver queries, device nodes and mounts of a container, 1 to do them one by one", ""},
+	"cli-timeout":                   {"kill nvidia-container-cli configure and its children past this timeout, 0s waits forever", ""},
+	"busy-timeout":                  {"wait for GPUs held by another container in exclusive mode, 0s fails right away", ""},
+	"busy-retry-interval":           {"interval between the checks of busy-timeout", ""},
+	"exclusive-gpus":                {"hold the GPUs of the containers in the ledger until they stop, a second request is rejected unless both set NVIDIA_GPU_SHARED=true", ""},
+	"ledger":                        {"ledger of the GPUs reserved through the allocation service", `"/run/nvidia-container-runtime/ledger.json"`},
+	"sharing-state":                 {"record of the replicas of the shared GPUs used by the containers, requested as <gpu>::<replica> or by virtual name", ""},
+	"utility-files":                 {"files of the utility capability: all, libraries or nvidia-smi", ""},
+	"exclude-libraries":             {"glob patterns of the libraries removed from the injected files", `["libnvidia-opticalflow*", "libnvidia-fbc*"]`},
+	"include-libraries":             {"glob patterns of extra host libraries to inject", `["/usr/lib/x86_64-linux-gnu/libnvidia-extra.so*"]`},
+	"rdma-libraries":                {"host libraries mounted in the containers enabling NVIDIA_MOFED or NVIDIA_GDRCOPY, with their InfiniBand and gdrdrv devices", ""},
+	"rdma-files":                    {"host files mounted at the same path in these containers: verbs providers and their configuration", ""},
+	"allowed-imex-channels":         {"IMEX channels of multi-node NVLink the containers may request with NVIDIA_IMEX_CHANNELS, numbers or \"all\"; none if empty", `["0"]`},
+	"gds":                           {"allow the containers to enable GPUDirect Storage with NVIDIA_GDS: the nvidia-fs devices, cufile.json and libcufile", ""},
+	"gds-libraries":                 {"host libraries mounted in the containers enabling NVIDIA_GDS", ""},
+	"gds-files":                     {"host files mounted at the same path in these containers", ""},
+	"nvswitch-libraries":            {"host libraries, relative to the driver root, mounted in the containers requesting the nvswitch driver capability or enabling NVIDIA_NVSWITCH", ""},
+	"video-libraries":               {"[video-libraries] table of the libraries of --video kept by the nvenc, nvdec and nvjpeg capabilities, the other parts' ones are removed", "[video-libraries]\nnvjpeg = [\"libnvcuvid.so*\"]"},
+	"fabric-manager-check":          {"on NVSwitch systems, fail the GPU containers until the fabric manager has set up the fabric of the GPUs", ""},
+
+	"mig":                  {"on-demand provisioning of the MIG instances requested with the nvidia.com/mig-profile annotation", ""},
+	"mig.provisioning":     {"create and destroy the MIG instances", ""},
+	"mig.allowed-profiles": {"MIG profiles the containers may request", `["1g.5gb", "3g.20gb"]`},
+
+	"mps":                          {"sharing of the GPUs through the MPS control daemon of the node: the hook mounts its directories, nvidia-container-runtime sets the environment", ""},
+	"mps.enabled":                  {"make the MPS control daemon available to the GPU containers", ""},
+	"mps.pipe-directory":           {"CUDA_MPS_PIPE_DIRECTORY of nvidia-cuda-mps-control, mounted at the same path", ""},
+	"mps.log-directory":            {"CUDA_MPS_LOG_DIRECTORY of nvidia-cuda-mps-control, mounted at the same path", ""},
+	"mps.active-thread-percentage": {"CUDA_MPS_ACTIVE_THREAD_PERCENTAGE of the containers, 0 leaves it unset; the nvidia.com/mps-active-thread-percentage annotation overrides it", ""},
+
+	"pod-quota":          {"limit of the distinct GPUs mounted in the containers of a Kubernetes pod, found from the cgroup path", ""},
+	"pod-quota.max-gpus": {"maximum of distinct GPUs per pod, 0 for no limit", ""},
+	"pod-quota.state":    {"GPUs recorded for each pod and container, released at poststop", ""},
+
+	"gpu-modes":                        {"compute and persistence modes, power limit and locked clocks set on the GPUs of the containers requesting them with the nvidia.com/compute-mode and nvidia.com/persistence-mode annotations, or NVIDIA_COMPUTE_MODE and NVIDIA_PERSISTENCE_MODE, and the limit annotations", ""},
+	"gpu-modes.allowed-compute-modes":  {"compute modes the containers may request: DEFAULT, EXCLUSIVE_PROCESS, PROHIBITED", `["EXCLUSIVE_PROCESS", "DEFAULT"]`},
+	"gpu-modes.allow-persistence-mode": {"let the containers enable or disable the persistence mode", ""},
+	"gpu-modes.allowed-power-limit":    {"[min, max] power limits in W the containers may set with the com.nvidia.power-limit annotation, e.g. 250W", `[100, 300]`},
+	"gpu-modes.allowed-gpu-clocks":     {"[min, max] GPU clocks in MHz the containers may lock with the com.nvidia.gpu-clocks annotation, e.g. 1200,1400MHz", `[210, 1410]`},
+	"gpu-modes.state":                  {"modes and limits of the GPUs before the containers set them, restored at poststop", ""},
+
+	"health":            {"health of the requested GPUs checked before they're injected: lost, uncorrectable ECC errors, pages pending retirement, fatal XIDs", ""},
+	"health.action":     {"fail refuses the unhealthy GPUs, warn only logs them, unchecked if unset", `"fail"`},
+	"health.xids":       {"XIDs of the kernel log making a GPU unhealthy", ""},
+	"health.xid-window": {"how far back the kernel log is searched for XIDs", ""},
+
+	"metrics":             {"Prometheus metrics of the hook activity: invocations, failures by reason, mounts per GPU, nvidia-container-cli latency", ""},
+	"metrics.textfile":    {"file written for the textfile collector of node_exporter", `"/var/lib/node_exporter/textfile/nvidia-container-runtime-hook.prom"`},
+	"metrics.pushgateway": {"URL of a Prometheus Pushgateway the metrics are pushed to", `"http://pushgateway:9091"`},
+	"metrics.state":       {"counters of the hook invocations, the hook doesn't live long enough to be scraped", ""},
+
+	"audit":           {"JSON lines log of every GPU request: container, bundle, devices, UUIDs, capabilities and decision (granted, denied, policy-overridden)", ""},
+	"audit.path":      {"append-only log file, disabled if unset", `"/var/log/nvidia-container-runtime/audit.log"`},
+	"audit.max-size":  {"size in MiB rotating the log, 0 to never rotate", ""},
+	"audit.max-files": {"rotated files kept, <path>.1 being the most recent", ""},
+
+	"nvidia-container-runtime":                 {"options of the nvidia-container-runtime wrapper", ""},
+	"nvidia-container-runtime.debug":           {"log file of the wrapper", `"/var/log/nvidia-container-runtime.log"`},
+	"nvidia-container-runtime.hook-path":       {"path of the hook, looked up in PATH", ""},
+	"nvidia-container-runtime.runtimes":        {"low-level runtimes by preference, the first one found runs the container", ""},
+	"nvidia-container-runtime.cuda-checkpoint": {"cuda-checkpoint utility toggling the CUDA state of the containers around runc checkpoint and restore", `"/usr/bin/cuda-checkpoint"`},
+
+	"nvidia-container-cli":                     {"options of nvidia-container-cli", ""},
+	"nvidia-container-cli.root":                {"root of the driver installation, \"auto\" probes the driver container, GKE and host ones on each run", `"/run/nvidia/driver"`},
+	"nvidia-container-cli.path":                {"path of nvidia-container-cli, looked up in PATH if unset", `"/usr/bin/nvidia-container-cli"`},
+	"nvidia-container-cli.environment":         {"environment of nvidia-container-cli", ""},
+	"nvidia-container-cli.debug":               {"log file of nvidia-container-cli", `"/var/log/nvidia-container-runtime-hook.log"`},
+	"nvidia-container-cli.ldcache":             {"path of the ld.so cache of the host", `"/etc/ld.so.cache"`},
+	"nvidia-container-cli.load-kmods":          {"load the kernel modules", ""},
+	"nvidia-container-cli.ldconfig":            {"ldconfig run in the container, @ for a host path, \"auto\" the one of the driver root or of the host", `"@/sbin/ldconfig"`},
+	"nvidia-container-cli.builtin-ldconfig":    {"write the ld.so cache of the containers in the hook instead of running ldconfig, e.g. the one of an untrusted image", ""},
+	"nvidia-container-cli.retries":             {"retries of nvidia-container-cli and nvidia-smi failing with a transient error, 0 to fail right away", ""},
+	"nvidia-container-cli.retry-backoff":       {"wait before the first retry, doubled after each one", ""},
+	"nvidia-container-cli.transient-errors":    {"messages of the driver errors retried, case-insensitive", ""},
+	"nvidia-container-cli.no-cgroups":          {"leave the devices cgroup to the runtime (--no-cgroups), e.g. with the device rules of the OCI spec on cgroup v2", ""},
+	"nvidia-container-cli.discovery-cache":     {"cache of the GPUs and MIG devices of the node, invalidated when the driver version or the device nodes change; disabled if unset", `"/run/nvidia-container-runtime/cache.json"`},
+	"nvidia-container-cli.open-kernel-modules": {"inject the GSP firmware and the nvidia-caps devices of the open kernel modules, detected if unset", "true"},
+
+	"driver-capabilities":            {"driver capabilities added to the built-in ones (compute, compat32, graphics, utility, video, display) or changing their option", ""},
+	"driver-capabilities.name":       {"value of NVIDIA_DRIVER_CAPABILITIES", `"ngx"`},
+	"driver-capabilities.cli-option": {"option of nvidia-container-cli configure injecting it", `"--ngx"`},
+
+	"shared-devices":          {"virtual device names of GPUs shared by several containers, e.g. with time-slicing", ""},
+	"shared-devices.name":     {"name requested in NVIDIA_VISIBLE_DEVICES, optionally with a ::<replica> suffix", `"nvidia.com/gpu.shared"`},
+	"shared-devices.gpu":      {"UUID or index of the physical GPU", `"GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785"`},
+	"shared-devices.replicas": {"replicas of the GPU, any replica if 0", "4"},
+
+	"driver-roots":         {"per-GPU driver roots, overriding the root of nvidia-container-cli for these devices: the GPUs of a container, requested by UUID, index or all, must share a root", ""},
+	"driver-roots.root":    {"root of the driver installation", `"/opt/nvidia/legacy-driver"`},
+	"driver-roots.devices": {"GPU UUIDs using this root, a trailing '*' matches a prefix", `["GPU-83d7ced8-*"]`},
+}
+
+// tomlValue encodes a value as TOML.
+func tomlValue(v reflect.Value) string {
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(map[string]interface{}{"v": v.Interface()}); err != nil {
+		log.Panicln(err)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(b.String(), "v = "))
+}
+
+func isTable(t reflect.Type) bool {
+	if reflect.PtrTo(t).Implements(reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()) {
+		return false
+	}
+	return t.Kind() == reflect.Struct || t.Kind() == reflect.Map || (t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct)
+}
+
+// writeOptions writes the documented options of a table, then its subtables.
+func writeOptions(w io.Writer, v reflect.Value, table string) {
+	prefix := ""
+	if len(table) > 0 {
+		prefix = table + "."
+	}
+
+	var tables []int
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("toml")
+		if len(key) == 0 {
+			continue
+		}
+		if isTable(v.Field(i).Type()) {
+			tables = append(tables, i)
+			continue
+		}
+
+		field := v.Field(i)
+		doc := configDocs[prefix+key]
+		fmt.Fprintf(w, "# %s\n", doc.doc)
+		switch {
+		case field.Kind() == reflect.Ptr && field.IsNil():
+			fmt.Fprintf(w, "#%s = %s\n", key, doc.example)
+		case field.Kind() == reflect.Ptr:
+			fmt.Fprintf(w, "%s = %s\n", key, tomlValue(field.Elem()))
+		case (field.Kind() == reflect.Slice || field.Kind() == reflect.String) && field.Len() == 0 && len(doc.example) > 0:
+			fmt.Fprintf(w, "#%s = %s\n", key, doc.example)
+		case field.Kind() == reflect.Slice && field.Len() == 0:
+			fmt.Fprintf(w, "%s = []\n", key)
+		default:
+			fmt.Fprintf(w, "%s = %s\n", key, tomlValue(field))
+		}
+	}
+
+	for _, i := range tables {
+		key := prefix + v.Type().Field(i).Tag.Get("toml")
+		field := v.Field(i)
+		fmt.Fprintf(w, "\n# %s\n", configDocs[key].doc)
+		if field.Kind() == reflect.Struct {
+			fmt.Fprintf(w, "[%s]\n", key)
+			writeOptions(w, field, key)
+			continue
+		}
+		if field.Kind() == reflect.Map {
+			// Free-form tables, commented out example if empty.
+			if field.Len() == 0 {
+				for _, line := range strings.Split(configDocs[key].example, "\n") {
+					fmt.Fprintln(w, "#"+line)
+				}
+				continue
+			}
+			if err := toml.NewEncoder(w).Encode(map[string]interface{}{key: field.Interface()}); err != nil {
+				log.Panicln(err)
+			}
+			continue
+		}
+		for j := 0; j < field.Len(); j++ {
+			fmt.Fprintf(w, "[[%s]]\n", key)
+			writeOptions(w, field.Index(j), key)
+		}
+		if field.Len() == 0 {
+			// Commented out example of the array of tables.
+			var b bytes.Buffer
+			fmt.Fprintf(&b, "[[%s]]\n", key)
+			writeOptions(&b, reflect.New(field.Type().Elem()).Elem(), key)
+			for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+				if !strings.HasPrefix(line, "#") {
+					line = "#" + line
+				}
+				fmt.Fprintln(w, line)
+			}
+		}
+	}
+}
+
+// writeConfig writes the configuration as TOML, each option documented.
+func writeConfig(w io.Writer, config HookConfig) {
+	writeOptions(w, reflect.ValueOf(config), "")
+}
+
+type setFlags []string
+
+func (s *setFlags) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *setFlags) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// validateConfig returns the problems of the configuration file and its drop-in files.
+func validateConfig(path string) []string {
+	config := getDefaultHookConfig()
+	unknown, err := configfile.Load(path, &config)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var problems []string
+	for _, key := range unknown {
+		problems = append(problems, "unknown option "+key)
+	}
+	if err := configfile.CheckContainerEnv(config.ContainerEnv); err != nil {
+		problems = append(problems, err.Error())
+	}
+	switch config.RequirePolicy {
+	case "", requirePolicyEnforce, requirePolicyWarn, requirePolicyIgnore:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown require-policy %q: enforce, warn or ignore", config.RequirePolicy))
+	}
+	var names []string
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		profile := getDefaultHookConfig()
+		profile.Profiles = config.Profiles
+		unknown, err := applyProfile(&profile, name)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		for _, key := range unknown {
+			problems = append(problems, "unknown option "+key)
+		}
+	}
+	if _, ok := config.Profiles[config.DefaultProfile]; len(config.DefaultProfile) > 0 && !ok {
+		problems = append(problems, "unknown default-profile "+config.DefaultProfile)
+	}
+	return problems
+}
+
+func doConfig(args []string) {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	in := flags.String("in", "", "configuration file to edit, the defaults if unset")
+	out := flags.String("o", "", "file the configuration is written to, stdout if unset")
+	validate := flags.Bool("validate", false, "check the configuration file and its drop-in files instead: unknown options and invalid values")
+	var sets setFlags
+	flags.Var(&sets, "set", "set an option, e.g. nvidia-container-cli.root=/run/nvidia/driver (repeatable)")
+	flags.Parse(args)
+
+	defer exit()
+	log.SetFlags(0)
+
+	if *validate {
+		problems := validateConfig(*configflag)
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) > 0 {
+			fail(exitCodeBadConfig, fmt.Errorf("invalid configuration %s", *configflag))
+		}
+		fmt.Printf("%s: OK\n", *configflag)
+		return
+	}
+
+	config := getDefaultHookConfig()
+	if len(*in) > 0 {
+		b, err := ioutil.ReadFile(*in)
+		if err != nil {
+			fail(exitCodeBadConfig, err)
+		}
+		if _, err := toml.Decode(string(b), &config); err != nil {
+			fail(exitCodeBadConfig, fmt.Errorf("%s: %v", *in, err))
+		}
+	}
+	for _, s := range sets {
+		p := strings.SplitN(s, "=", 2)
+		if len(p) != 2 {
+			fail(exitCodeUsage, fmt.Errorf("invalid -set %q, expected key=value", s))
+		}
+		if err := configfile.Set(&config, p[0], p[1]); err != nil {
+			fail(exitCodeUsage, err)
+		}
+	}
+
+	var b bytes.Buffer
+	writeConfig(&b, config)
+	if len(*out) == 0 {
+		os.Stdout.Write(b.Bytes())
+	} else if err := configfile.WriteAtomic(*out, b.Bytes(), 0644); err != nil {
+		fail(exitCodeError, err)
+	}
+}
@@ -0,0 +1,335 @@
+// Package configfile loads the TOML configuration shared by the hook and the runtime.
+package configfile
+
+import (
+	"encoding"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	DefaultPath = "/etc/nvidia-container-runtime/config.toml"
+	// configuration shipped by the packages, under the one of the administrator.
+	VendorPath = "/usr/share/nvidia-container-runtime/config.toml"
+)
+
+// SearchPaths returns the configuration files by precedence: the one of the administrator, of the packages, then
+// of the user for the rootless runtimes in $XDG_CONFIG_HOME (~/.config if unset).
+func SearchPaths() []string {
+	paths := []string{DefaultPath, VendorPath}
+	home := os.Getenv("XDG_CONFIG_HOME")
+	if len(home) == 0 && len(os.Getenv("HOME")) > 0 {
+		home = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	if len(home) > 0 {
+		paths = append(paths, filepath.Join(home, "nvidia-container-runtime", "config.toml"))
+	}
+	return paths
+}
+
+// Find returns the first configuration file of SearchPaths which exists, with or without drop-in files,
+// DefaultPath if there is none.
+func Find() string {
+	for _, path := range SearchPaths() {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		if files, _ := DropInFiles(path); len(files) > 0 {
+			return path
+		}
+	}
+	return DefaultPath
+}
+
+// RuntimeConfig: options of nvidia-container-runtime, the [nvidia-container-runtime] table.
+type RuntimeConfig struct {
+	// log file of the runtime, messages are discarded if unset.
+	Debug *string `toml:"debug"`
+	// path of the hook, looked up in PATH by default.
+	HookPath string `toml:"hook-path"`
+	// low-level runtimes by preference, the first one found is executed with the arguments of the wrapper.
+	Runtimes []string `toml:"runtimes"`
+	// cuda-checkpoint utility moving the CUDA state of the containers to the host memory around their checkpoint
+	// and restore, unused if unset.
+	CUDACheckpoint *string `toml:"cuda-checkpoint"`
+}
+
+func DefaultRuntimeConfig() RuntimeConfig {
+	return RuntimeConfig{
+		HookPath: "nvidia-container-runtime-hook",
+		Runtimes: []string{"runc"},
+	}
+}
+
+// MPSConfig: sharing of the GPUs through the MPS control daemon of the node, the [mps] table.
+// The hook mounts its directories in the containers, the runtime sets their environment.
+type MPSConfig struct {
+	Enabled bool `toml:"enabled"`
+	// directories of the pipes and the logs of nvidia-cuda-mps-control, CUDA_MPS_PIPE_DIRECTORY and CUDA_MPS_LOG_DIRECTORY.
+	PipeDirectory string `toml:"pipe-directory"`
+	LogDirectory  string `toml:"log-directory"`
+	// CUDA_MPS_ACTIVE_THREAD_PERCENTAGE of the containers, 0 leaves it unset.
+	ActiveThreadPercentage int `toml:"active-thread-percentage"`
+}
+
+// Environment of the MPS clients, and the annotation setting the active thread percentage of a container.
+const (
+	EnvMPSPipeDirectory          = "CUDA_MPS_PIPE_DIRECTORY"
+	EnvMPSLogDirectory           = "CUDA_MPS_LOG_DIRECTORY"
+	EnvMPSActiveThreadPercentage = "CUDA_MPS_ACTIVE_THREAD_PERCENTAGE"
+
+	MPSActiveThreadPercentageAnnotation = "nvidia.com/mps-active-thread-percentage"
+)
+
+func DefaultMPSConfig() MPSConfig {
+	return MPSConfig{
+		PipeDirectory: "/tmp/nvidia-mps",
+		LogDirectory:  "/var/log/nvidia-mps",
+	}
+}
+
+// Environment returns the variables of a container using MPS, the annotations may set its active thread percentage.
+func (c MPSConfig) Environment(annotations map[string]string) ([]string, error) {
+	env := []string{EnvMPSPipeDirectory + "=" + c.PipeDirectory, EnvMPSLogDirectory + "=" + c.LogDirectory}
+	percentage := c.ActiveThreadPercentage
+	if a, ok := annotations[MPSActiveThreadPercentageAnnotation]; ok {
+		p, err := strconv.Atoi(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %v", MPSActiveThreadPercentageAnnotation, err)
+		}
+		percentage = p
+	}
+	if percentage < 0 || percentage > 100 {
+		return nil, fmt.Errorf("invalid MPS active thread percentage %d, expected 1 to 100", percentage)
+	}
+	if percentage > 0 {
+		env = append(env, fmt.Sprintf("%s=%d", EnvMPSActiveThreadPercentage, percentage))
+	}
+	return env, nil
+}
+
+// CheckContainerEnv checks the variables of the container-env option, NAME=value each.
+func CheckContainerEnv(env []string) error {
+	for _, e := range env {
+		if i := strings.Index(e, "="); i <= 0 {
+			return fmt.Errorf("invalid container-env entry %q, expected NAME=value", e)
+		}
+	}
+	return nil
+}
+
+// DropInFiles returns the drop-in files of a configuration file, <path>.d/*.toml in lexical order.
+func DropInFiles(path string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(path+".d", "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readStable reads a file which may be replaced or rewritten meanwhile, e.g. by a reload of the configuration:
+// it reads it again until it's the same file before and after the read. A file removed meanwhile reads as missing.
+func readStable(path string) ([]byte, error) {
+	for i := 0; ; i++ {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		before, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		after, err := os.Stat(path)
+		if err == nil && os.SameFile(before, after) && after.Size() == int64(len(b)) && after.ModTime().Equal(before.ModTime()) {
+			return b, nil
+		}
+		if i == 10 {
+			return nil, fmt.Errorf("%s keeps changing", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Load decodes the configuration file then its drop-in files into v, a missing configuration file is not an error.
+// The keys unknown to v are returned as <file>: <key>.
+// The files are read whole and checked unchanged afterwards, an update must still replace them atomically
+// (write then rename) for the set of files to be consistent.
+func Load(path string, v interface{}) ([]string, error) {
+	files, err := DropInFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		files = append([]string{path}, files...)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var unknown []string
+	for _, file := range files {
+		b, err := readStable(file)
+		if os.IsNotExist(err) {
+			// A drop-in file removed since the glob.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		md, err := toml.Decode(string(b), v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		for _, key := range md.Undecoded() {
+			unknown = append(unknown, fmt.Sprintf("%s: %s", file, key))
+		}
+	}
+	return unknown, nil
+}
+
+// WriteAtomic replaces a configuration file by renaming a temporary file over it, the hooks running meanwhile
+// read either version.
+func WriteAtomic(path string, b []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// setFromEnv parses the value of an environment variable into an option: booleans, integers, strings,
+// comma-separated lists of strings, and types decoding text like durations.
+func setFromEnv(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		if err := setFromEnv(p.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported option type %s", v.Type())
+		}
+		l := []string{}
+		if len(s) > 0 {
+			l = strings.Split(s, ",")
+		}
+		v.Set(reflect.ValueOf(l))
+	default:
+		return fmt.Errorf("unsupported option type %s", v.Type())
+	}
+	return nil
+}
+
+func applyEnvOverrides(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("toml")
+		if len(key) == 0 {
+			continue
+		}
+		name := prefix + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+		field := v.Field(i)
+		if _, ok := field.Addr().Interface().(encoding.TextUnmarshaler); !ok && field.Kind() == reflect.Struct {
+			if err := applyEnvOverrides(field, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(field, value); err != nil {
+			return fmt.Errorf("invalid value of %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// ApplyEnvOverrides sets the options of the struct pointed to by v from the environment, the variable of an option
+// is its TOML key prefixed by its tables, e.g. NVIDIA_CONTAINER_RUNTIME_HOOK_NVIDIA_CONTAINER_CLI_ROOT.
+func ApplyEnvOverrides(v interface{}, prefix string) error {
+	return applyEnvOverrides(reflect.ValueOf(v).Elem(), prefix)
+}
+
+// Set sets the option of the struct pointed to by v at a dotted key, e.g. nvidia-container-cli.root,
+// the value is parsed as in the environment.
+func Set(v interface{}, key string, value string) error {
+	field := reflect.ValueOf(v).Elem()
+	for _, k := range strings.Split(key, ".") {
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("unknown option %s", key)
+		}
+		found := false
+		for i := 0; i < field.NumField(); i++ {
+			if field.Type().Field(i).Tag.Get("toml") == k {
+				field, found = field.Field(i), true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown option %s", key)
+		}
+	}
+	if err := setFromEnv(field, value); err != nil {
+		return fmt.Errorf("couldn't set %s: %v", key, err)
+	}
+	return nil
+}
@@ -3,12 +3,16 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/oci"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/devices"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/nvcontainer"
 )
 
 var envSwarmGPU *string
@@ -22,12 +26,22 @@ const (
 	defaultCapability       = "utility"
 	allCapabilities         = "compute,compat32,graphics,utility,video,display"
 	envNVDisableRequire     = "NVIDIA_DISABLE_REQUIRE"
+	envCUDAVisibleDevices   = "CUDA_VISIBLE_DEVICES"
+	// GPUs whose MIG instances the container manages, or monitors, e.g. the MIG manager of the GPU operator.
+	envNVMIGConfigDevices  = "NVIDIA_MIG_CONFIG_DEVICES"
+	envNVMIGMonitorDevices = "NVIDIA_MIG_MONITOR_DEVICES"
 
 	// Please referer to these docs:
 	// https://docs.nvidia.com/deploy/nvml-api/group__nvmlDeviceQueries.html#group__nvmlDeviceQueries_1g84dca2d06974131ccec1651428596191
 	// https://github.com/NVIDIA/libnvidia-container/blob/master/src/cli/common.c#L11
-	// If GPU UUID is wrong or doesn't exist, nvidia-container-cli which is called by this hook will report with failure
-	nvidiaGPUUUIDListFmt = `^[gG][pP][uU]-([0-9a-fA-F-]){1,75}(,|,[gG][pP][uU]-([0-9a-fA-F-]){1,75})*$`
+	// If GPU UUID is wrong or doesn't exist, nvidia-container-cli which is called by this hook will report with failure,
+	// the validate-devices option checks them beforehand.
+	nvidiaGPUUUIDFmt = devices.GPUUUIDFmt
+	// MIG devices are MIG-GPU-<GPU UUID>/<GI>/<CI> before driver R470, MIG-<UUID> since.
+	nvidiaMIGDeviceFmt   = devices.MIGDeviceFmt
+	nvidiaPCIBusIDFmt    = `([0-9a-fA-F]{4}|[0-9a-fA-F]{8}):([0-9a-fA-F]{2}):([0-9a-fA-F]{2})\.([0-7])`
+	nvidiaDeviceFmt      = `(` + nvidiaGPUUUIDFmt + `|` + nvidiaMIGDeviceFmt + `|` + nvidiaPCIBusIDFmt + `)`
+	nvidiaGPUUUIDListFmt = `^` + nvidiaDeviceFmt + `(,|,` + nvidiaDeviceFmt + `)*$`
 
 	errGPUCanOnlyBeUsedByUUID = "Wrong way to use GPUs! " +
 		"If you dont't need GPU, use an image without CUDA, or build images with env " + envNVGPU + "=none. " +
@@ -39,38 +53,47 @@ var nvidiaGPUUUIDListExp = regexp.MustCompile(nvidiaGPUUUIDListFmt)
 var noneGPU = "none"
 
 type nvidiaConfig struct {
-	Devices        string
-	Capabilities   string
-	Requirements   []string
-	DisableRequire bool
+	Devices      string   `json:"devices"`
+	Capabilities string   `json:"capabilities"`
+	Requirements []string `json:"requirements"`
+	// requirements checked by the hook only, variable -> value.
+	NodeRequirements map[string]string `json:"node_requirements,omitempty"`
+	DisableRequire   bool              `json:"disable_require"`
+	// MIG management capabilities, privileged.
+	MIGConfigDevices  string `json:"mig_config_devices,omitempty"`
+	MIGMonitorDevices string `json:"mig_monitor_devices,omitempty"`
+	// modes set on the GPUs while the container runs, upper case.
+	ComputeMode     string `json:"compute_mode,omitempty"`
+	PersistenceMode string `json:"persistence_mode,omitempty"`
+	// power limit in W and locked GPU clocks min,max in MHz, from the annotations.
+	PowerLimit int    `json:"power_limit,omitempty"`
+	GPUClocks  string `json:"gpu_clocks,omitempty"`
 }
 
 type containerConfig struct {
-	Pid    int
-	Rootfs string
-	Env    map[string]string
-	Nvidia *nvidiaConfig
-}
-
-// github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L94-L100
-type Root struct {
-	Path string `json:"path"`
-}
-
-// github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L30-L57
-type Process struct {
-	Env []string `json:"env,omitempty"`
-}
-
-// We use pointers to structs, similarly to the latest version of runtime-spec:
-// https://github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L5-L28
-type Spec struct {
-	Process *Process `json:"process,omitempty"`
-	Root    *Root    `json:"root,omitempty"`
+	ID          string
+	Pid         int
+	Bundle      string
+	Rootfs      string
+	Env         map[string]string
+	Annotations map[string]string
+	// UID of the Kubernetes pod of the container, from its cgroup path.
+	Pod string
+	// namespace, name, UID and container name of the pod, for the logs.
+	PodMetadata podMetadata
+	// shared GPUs requested by replica or virtual name.
+	Replicas []sharedReplica
+	Nvidia   *nvidiaConfig
+	// AppArmor profile of the process of the container, empty for the default of the runtime.
+	AppArmorProfile string
+	// UID of the process of the container.
+	UID uint32
 }
 
 type HookState struct {
-	Pid int `json:"pid,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Pid    int    `json:"pid,omitempty"`
+	Status string `json:"status,omitempty"`
 	// After 17.06, runc is using the runtime spec:
 	// github.com/docker/runc/blob/17.06/libcontainer/configs/config.go#L262-L263
 	// github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/state.go#L3-L17
@@ -80,13 +103,13 @@ type HookState struct {
 	BundlePath string `json:"bundlePath"`
 }
 
-func parseCudaVersion(cudaVersion string) (vmaj, vmin, vpatch uint32) {
+func parseCudaVersion(cudaVersion string) (vmaj, vmin, vpatch uint32, err error) {
 	if _, err := fmt.Sscanf(cudaVersion, "%d.%d.%d\n", &vmaj, &vmin, &vpatch); err != nil {
 		vpatch = 0
 		if _, err := fmt.Sscanf(cudaVersion, "%d.%d\n", &vmaj, &vmin); err != nil {
 			vmin = 0
 			if _, err := fmt.Sscanf(cudaVersion, "%d\n", &vmaj); err != nil {
-				log.Panicln("invalid CUDA version:", cudaVersion)
+				return 0, 0, 0, fmt.Errorf("invalid CUDA version: %s", cudaVersion)
 			}
 		}
 	}
@@ -94,12 +117,12 @@ func parseCudaVersion(cudaVersion string) (vmaj, vmin, vpatch uint32) {
 	return
 }
 
-func getEnvMap(e []string, mountGPUOnlyByUUID bool) (m map[string]string) {
+func getEnvMap(e []string, mountGPUOnlyByUUID bool) (m map[string]string, err error) {
 	m = make(map[string]string)
 	for _, s := range e {
 		p := strings.SplitN(s, "=", 2)
 		if len(p) != 2 {
-			log.Panicln("environment error")
+			return nil, fmt.Errorf("environment error: %q is not a NAME=value pair", s)
 		}
 
 		if mountGPUOnlyByUUID && p[0] == envNVGPU {
@@ -114,58 +137,51 @@ func getEnvMap(e []string, mountGPUOnlyByUUID bool) (m map[string]string) {
 	return
 }
 
-func loadSpec(path string) (spec *Spec) {
-	f, err := os.Open(path)
-	if err != nil {
-		log.Panicln("could not open OCI spec:", err)
+func getDevices(env map[string]string, mountGPUOnlyByUUID bool) (*string, error) {
+	// The Swarm resources have higher precedence.
+	ret := getSwarmDevices(env)
+	if devices, ok := env[envNVGPU]; ok && ret == nil {
+		ret = &devices
 	}
-	defer f.Close()
 
-	if err = json.NewDecoder(f).Decode(&spec); err != nil {
-		log.Panicln("could not decode OCI spec:", err)
-	}
-	if spec.Process == nil {
-		log.Panicln("Process is empty in OCI spec")
-	}
-	if spec.Root == nil {
-		log.Panicln("Root is empty in OCI spec")
-	}
-	return
-}
-
-func getDevices(env map[string]string, mountGPUOnlyByUUID bool) *string {
-	gpuVars := []string{envNVGPU}
-	if envSwarmGPU != nil {
-		// The Swarm resource has higher precedence.
-		gpuVars = append([]string{*envSwarmGPU}, gpuVars...)
-	}
-
-	var ret *string
-	for _, gpuVar := range gpuVars {
-		if devices, ok := env[gpuVar]; ok {
-			ret = &devices
+	if ret != nil {
+		if err := devices.ValidateMIGDevices(*ret); err != nil {
+			return nil, err
+		}
+		if err := validatePCIBusIDs(*ret); err != nil {
+			return nil, err
 		}
 	}
 
 	if !mountGPUOnlyByUUID { // old way
-		return ret
+		return ret, nil
 	}
 
 	if ret == nil || *ret == "" || *ret == "void" || *ret == "none" {
 		// handle empty, 'void', 'none' first, cause different logic between old and new CUDA images
 		// new cuda image: unset and empty equals void
 		// old cuda image: unset means all, empty equals void
-		return ret
+		return ret, nil
 	}
 
-	// disable use GPU on value: all or 0,1,2,3, only GPU UUID list seperated by ',' is supported,
+	// disable use GPU on value: all or 0,1,2,3, only GPU UUID (or PCI bus ID) list seperated by ',' is supported,
 	// so that in k8s no GPU will be mounted in multi containers (allocated by scheduler and set by device plugin)
-	if nvidiaGPUUUIDListExp.MatchString(*ret) {
-		return ret
+	if nvidiaGPUUUIDListExp.MatchString(*ret) || isTopologyRequest(*ret) {
+		return ret, nil
 	}
 
-	log.Println(errGPUCanOnlyBeUsedByUUID)
-	return &noneGPU // should not execute this
+	warnf("%s", errGPUCanOnlyBeUsedByUUID)
+	return &noneGPU, nil // should not execute this
+}
+
+// getSwarmDevices merges the devices of the Swarm resources set, in the order of the swarm-resource option:
+// generic resources may be advertised under several names, e.g. DOCKER_RESOURCE_GPU and DOCKER_RESOURCE_NVIDIA-GPU,
+// and a service reserving several of them gets numbered variables.
+func getSwarmDevices(env map[string]string) *string {
+	if envSwarmGPU == nil {
+		return nil
+	}
+	return nvcontainer.SwarmDevices(env, *envSwarmGPU)
 }
 
 func getCapabilities(env map[string]string) *string {
@@ -176,9 +192,12 @@ func getCapabilities(env map[string]string) *string {
 }
 
 func getRequirements(env map[string]string) []string {
-	// All variables with the "NVIDIA_REQUIRE_" prefix are passed to nvidia-container-cli
+	// All variables with the "NVIDIA_REQUIRE_" prefix are passed to nvidia-container-cli, but the ones of the hook
 	var requirements []string
 	for name, value := range env {
+		if _, ok := nodeRequirements[name]; ok {
+			continue
+		}
 		if strings.HasPrefix(name, envNVRequirePrefix) {
 			requirements = append(requirements, value)
 		}
@@ -187,19 +206,24 @@ func getRequirements(env map[string]string) []string {
 }
 
 // Mimic the new CUDA images if no capabilities or devices are specified.
-func getNvidiaConfigLegacy(env map[string]string, mountGPUOnlyByUUID bool) *nvidiaConfig {
+func getNvidiaConfigLegacy(env map[string]string, mountGPUOnlyByUUID bool) (*nvidiaConfig, error) {
+	d, err := getDevices(env, mountGPUOnlyByUUID)
+	if err != nil {
+		return nil, err
+	}
+
 	var devices string
-	if d := getDevices(env, mountGPUOnlyByUUID); d == nil {
+	if d == nil {
 		if !mountGPUOnlyByUUID {
 			// Environment variable unset: default to "all".
 			devices = "all"
 		} else {
 			devices = "none"
-			log.Println(errGPUCanOnlyBeUsedByUUID)
+			warnf("%s", errGPUCanOnlyBeUsedByUUID)
 		}
 	} else if len(*d) == 0 || *d == "void" {
 		// Environment variable empty or "void": not a GPU container.
-		return nil
+		return nil, nil
 	} else {
 		// Environment variable non-empty and not "void".
 		devices = *d
@@ -211,21 +235,24 @@ func getNvidiaConfigLegacy(env map[string]string, mountGPUOnlyByUUID bool) *nvid
 	var capabilities string
 	if c := getCapabilities(env); c == nil {
 		// Environment variable unset: default to "all".
-		capabilities = allCapabilities
+		capabilities = getAllCapabilities()
 	} else if len(*c) == 0 {
 		// Environment variable empty: use default capability.
-		capabilities = defaultCapability
+		capabilities = defaultDriverCapabilities
 	} else {
 		// Environment variable non-empty.
 		capabilities = *c
 	}
 	if capabilities == "all" {
-		capabilities = allCapabilities
+		capabilities = getAllCapabilities()
 	}
 
 	requirements := getRequirements(env)
 
-	vmaj, vmin, _ := parseCudaVersion(env[envLegacyCUDAVersion])
+	vmaj, vmin, _, err := parseCudaVersion(env[envLegacyCUDAVersion])
+	if err != nil {
+		return nil, err
+	}
 	cudaRequire := fmt.Sprintf("cuda>=%d.%d", vmaj, vmin)
 	requirements = append(requirements, cudaRequire)
 
@@ -233,14 +260,15 @@ func getNvidiaConfigLegacy(env map[string]string, mountGPUOnlyByUUID bool) *nvid
 	disableRequire, _ := strconv.ParseBool(env[envNVDisableRequire])
 
 	return &nvidiaConfig{
-		Devices:        devices,
-		Capabilities:   capabilities,
-		Requirements:   requirements,
-		DisableRequire: disableRequire,
-	}
+		Devices:          devices,
+		Capabilities:     capabilities,
+		Requirements:     requirements,
+		NodeRequirements: getNodeRequirements(env),
+		DisableRequire:   disableRequire,
+	}, nil
 }
 
-func getNvidiaConfig(env map[string]string, mountGPUOnlyByUUID bool) *nvidiaConfig {
+func getNvidiaConfig(env map[string]string, mountGPUOnlyByUUID bool) (*nvidiaConfig, error) {
 	legacyCudaVersion := env[envLegacyCUDAVersion]
 	cudaRequire := env[envNVRequireCUDA]
 	if len(legacyCudaVersion) > 0 && len(cudaRequire) == 0 {
@@ -248,10 +276,15 @@ func getNvidiaConfig(env map[string]string, mountGPUOnlyByUUID bool) *nvidiaConf
 		return getNvidiaConfigLegacy(env, mountGPUOnlyByUUID)
 	}
 
+	d, err := getDevices(env, mountGPUOnlyByUUID)
+	if err != nil {
+		return nil, err
+	}
+
 	var devices string
-	if d := getDevices(env, mountGPUOnlyByUUID); d == nil || len(*d) == 0 || *d == "void" {
+	if d == nil || len(*d) == 0 || *d == "void" {
 		// Environment variable unset or empty or "void": not a GPU container.
-		return nil
+		return nil, nil
 	} else {
 		// Environment variable non-empty and not "void".
 		devices = *d
@@ -263,13 +296,13 @@ func getNvidiaConfig(env map[string]string, mountGPUOnlyByUUID bool) *nvidiaConf
 	var capabilities string
 	if c := getCapabilities(env); c == nil || len(*c) == 0 {
 		// Environment variable unset or set but empty: use default capability.
-		capabilities = defaultCapability
+		capabilities = defaultDriverCapabilities
 	} else {
 		// Environment variable set and non-empty.
 		capabilities = *c
 	}
 	if capabilities == "all" {
-		capabilities = allCapabilities
+		capabilities = getAllCapabilities()
 	}
 
 	requirements := getRequirements(env)
@@ -278,33 +311,221 @@ func getNvidiaConfig(env map[string]string, mountGPUOnlyByUUID bool) *nvidiaConf
 	disableRequire, _ := strconv.ParseBool(env[envNVDisableRequire])
 
 	return &nvidiaConfig{
-		Devices:        devices,
-		Capabilities:   capabilities,
-		Requirements:   requirements,
-		DisableRequire: disableRequire,
+		Devices:          devices,
+		Capabilities:     capabilities,
+		Requirements:     requirements,
+		NodeRequirements: getNodeRequirements(env),
+		DisableRequire:   disableRequire,
+	}, nil
+}
+
+// isPrivileged checks for CAP_SYS_ADMIN in the bounding set of the container.
+func isPrivileged(s *oci.Spec) bool {
+	if s.Process.Capabilities == nil {
+		return false
 	}
+
+	var caps []string
+	// Before v1.0.0-rc5 the capabilities were a single list:
+	// github.com/opencontainers/runtime-spec/blob/v1.0.0-rc1/specs-go/config.go#L30-L54
+	if err := json.Unmarshal(*s.Process.Capabilities, &caps); err != nil {
+		var lc oci.LinuxCapabilities
+		if err := json.Unmarshal(*s.Process.Capabilities, &lc); err != nil {
+			return false
+		}
+		caps = lc.Bounding
+	}
+	for _, c := range caps {
+		if c == "CAP_SYS_ADMIN" {
+			return true
+		}
+	}
+	return false
+}
+
+// getHookState decodes the state of the container from stdin, or from the file of --state for the callers which can't
+// pipe it. --bundle sets the bundle of the container, the state isn't read if it's alone.
+func getHookState() (h HookState, err error) {
+	if len(*stateflag) > 0 {
+		var f *os.File
+		if f, err = os.Open(*stateflag); err != nil {
+			return h, fmt.Errorf("could not open container state: %v", err)
+		}
+		defer f.Close()
+		h, err = decodeHookState(f)
+	} else if len(*bundleflag) == 0 {
+		h, err = decodeHookState(os.Stdin)
+	}
+	if len(*bundleflag) > 0 {
+		h.Bundle = *bundleflag
+	}
+	return
 }
 
-func getContainerConfig(hook HookConfig) (config containerConfig) {
-	var h HookState
-	d := json.NewDecoder(os.Stdin)
+func decodeHookState(r io.Reader) (h HookState, err error) {
+	d := json.NewDecoder(r)
 	if err := d.Decode(&h); err != nil {
-		log.Panicln("could not decode container state:", err)
+		return h, fmt.Errorf("could not decode container state: %v", err)
 	}
 
-	b := h.Bundle
-	if len(b) == 0 {
-		b = h.BundlePath
+	if len(h.Bundle) == 0 {
+		h.Bundle = h.BundlePath
+	}
+	return
+}
+
+func getContainerConfig(hook *HookConfig) (config containerConfig, err error) {
+	specSpan := startSpan("load spec")
+	h, err := getHookState()
+	if err != nil {
+		return config, err
 	}
+	return loadContainerConfig(hook, h, specSpan)
+}
+
+// loadContainerConfig reads the spec of the container and resolves its device request,
+// the profile of the container is applied to the configuration of the hook.
+func loadContainerConfig(hook *HookConfig, h HookState, specSpan *traceSpan) (config containerConfig, err error) {
+	setLogContext(h.ID, h.Bundle)
 
-	s := loadSpec(path.Join(b, "config.json"))
+	s, err := oci.LoadSpec(path.Join(h.Bundle, "config.json"))
+	if err != nil {
+		return config, err
+	}
+	specSpan.end()
+	return getSpecConfig(hook, h, s)
+}
 
-	env := getEnvMap(s.Process.Env, hook.MountGPUOnlyByUUID)
+// getSpecConfig resolves the request of a container from its spec under the policies of the configuration:
+// the hook and the NRI plugin, which gets the spec before the creation of the container, share it.
+func getSpecConfig(hook *HookConfig, h HookState, s *oci.Spec) (config containerConfig, err error) {
+	b := h.Bundle
+	var cgroupsPath string
+	if s.Linux != nil {
+		cgroupsPath = s.Linux.CgroupsPath
+	}
+	podMeta := getPodMetadata(s.Annotations, cgroupsPath)
+	setLogPod(podMeta)
+	if isVMRuntime(s.Annotations) {
+		infof("the container runs in a VM, its GPUs are passed through with VFIO by nvidia-container-runtime")
+		return containerConfig{ID: h.ID, Pid: h.Pid, Bundle: b, Rootfs: s.Root.Path, Env: map[string]string{}, Annotations: s.Annotations}, nil
+	}
+	if err := setContainerProfile(hook, s); err != nil {
+		return config, err
+	}
+	if err := checkRawDeviceMounts(*hook, s); err != nil {
+		return config, err
+	}
+
+	envSpan := startSpan("parse environment")
+	env, err := getEnvMap(s.Process.Env, hook.MountGPUOnlyByUUID)
+	if err != nil {
+		return config, err
+	}
+	devicesSource, err := applyRequestSources(env, s, hook.RequestSources, hook.DeviceListMountsRoot)
+	if err != nil {
+		return config, &hookError{exitCodeBadConfig, err}
+	}
+	if hook.DevicePluginAllocations != nil && hook.MountGPUOnlyByUUID && s.Linux != nil {
+		if pod := getPodUID(s.Linux.CgroupsPath); len(pod) > 0 {
+			devices, err := getAllocatedDevices(*hook.DevicePluginAllocations, pod, s.Annotations)
+			if err != nil {
+				return config, err
+			}
+			if len(devices) == 0 {
+				// Nothing allocated, whatever the environment requests.
+				devices = "void"
+			}
+			env[envNVGPU], devicesSource = devices, requestSourceAllocations
+		}
+	}
+	if hook.TopologySelection && isTopologyRequest(env[envNVGPU]) {
+		devices, err := selectTopologyDevices(*hook, h.ID, env[envNVGPU], !hook.DryRun && !*dryrunflag)
+		if err != nil {
+			return config, err
+		}
+		infof("selected %s for %s=%s", devices, envNVGPU, env[envNVGPU])
+		env[envNVGPU] = devices
+	} else if hook.DeviceResolver != nil && needsResolution(env[envNVGPU]) {
+		devices, err := resolveDevices(*hook.DeviceResolver, resolverRequest{env[envNVGPU], b, h.Pid}, hook.CLITimeout.Duration)
+		if err != nil {
+			return config, &hookError{exitCodeError, err}
+		}
+		infof("resolved %s=%s to %s", envNVGPU, env[envNVGPU], devices)
+		env[envNVGPU] = devices
+	}
+	var replicas []sharedReplica
+	if devices, ok := env[envNVGPU]; ok && (len(hook.SharedDevices) > 0 || strings.Contains(devices, replicaSeparator)) {
+		physical, r, err := expandSharedDevices(devices, hook.SharedDevices)
+		if err != nil {
+			return config, err
+		}
+		if len(r) > 0 {
+			infof("expanded the shared devices %s to %s", devices, physical)
+			env[envNVGPU] = physical
+		}
+		replicas = r
+	}
 	envSwarmGPU = hook.SwarmResource
-	return containerConfig{
-		Pid:    h.Pid,
-		Rootfs: s.Root.Path,
-		Env:    env,
-		Nvidia: getNvidiaConfig(env, hook.MountGPUOnlyByUUID),
+	setDriverCapabilities(*hook)
+	nvidia, err := getNvidiaConfig(env, hook.MountGPUOnlyByUUID)
+	if err != nil {
+		return config, err
+	}
+	if nvidia != nil {
+		if nvidia.Devices, err = resolvePCIBusIDs(hook.NvidiaContainerCLI, nvidia.Devices); err != nil {
+			return config, err
+		}
+		requested := env[envNVDriverCapabilities]
+		explicit := len(requested) > 0 && requested != "all"
+		if nvidia.Capabilities, err = filterCapabilities(nvidia.Capabilities, hook.SupportedDriverCapabilities, explicit, hook.UnsupportedCapabilities); err != nil {
+			return config, &hookError{exitCodePolicy, err}
+		}
 	}
+	if nvidia != nil {
+		nvidia.MIGConfigDevices, nvidia.MIGMonitorDevices = env[envNVMIGConfigDevices], env[envNVMIGMonitorDevices]
+		if err := checkMIGManagement(*hook, nvidia, isPrivileged(s)); err != nil {
+			return config, &hookError{exitCodePolicy, err}
+		}
+		// Like the devices, the environment only counts when the container could request them from it.
+		modesEnv := env
+		if !hook.AcceptEnvvarUnprivileged && !isPrivileged(s) {
+			modesEnv = nil
+		}
+		if nvidia.ComputeMode, err = getRequestedMode(s.Annotations, modesEnv, computeModeAnnotation, envNVComputeMode, computeModes); err != nil {
+			return config, err
+		}
+		if nvidia.PersistenceMode, err = getRequestedMode(s.Annotations, modesEnv, persistenceModeAnnotation, envNVPersistenceMode, persistenceModes); err != nil {
+			return config, err
+		}
+		if nvidia.PowerLimit, nvidia.GPUClocks, err = getRequestedLimits(s.Annotations); err != nil {
+			return config, err
+		}
+		if err := checkGPUModes(hook.GPUModes, nvidia); err != nil {
+			return config, &hookError{exitCodePolicy, err}
+		}
+	}
+	// Legacy CUDA images request all the GPUs without the variable.
+	fromEnv := devicesSource == requestSourceEnv || len(devicesSource) == 0
+	if nvidia != nil && len(nvidia.Devices) > 0 && fromEnv &&
+		!hook.AcceptEnvvarUnprivileged && !isPrivileged(s) {
+		return config, &hookError{exitCodePolicy, fmt.Errorf("insufficient privileges to request devices with %s", envNVGPU)}
+	}
+	envSpan.end()
+	pod := getPodUID(cgroupsPath)
+	return containerConfig{
+		ID:          h.ID,
+		Pid:         h.Pid,
+		Bundle:      b,
+		Rootfs:      s.Root.Path,
+		Env:         env,
+		Annotations: s.Annotations,
+		Pod:         pod,
+		PodMetadata: podMeta,
+		Replicas:    replicas,
+		Nvidia:      nvidia,
+
+		AppArmorProfile: s.Process.ApparmorProfile,
+		UID:             s.Process.User.UID,
+	}, nil
 }
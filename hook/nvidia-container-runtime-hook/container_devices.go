@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/devices"
+)
+
+var (
+	cgroupDevicesRoot = "/sys/fs/cgroup/devices"
+	// The cgroups of a process, by pid.
+	procCgroupPath = "/proc/%d/cgroup"
+)
+
+// containerPath returns the host path of a file of the container, through its mount namespace.
+// The hook runs before pivot_root: the rootfs is still mounted at its path in the namespace.
+func containerPath(container containerConfig, p string) string {
+	return path.Join(fmt.Sprintf("/proc/%d/root", container.Pid), container.Rootfs, p)
+}
+
+// resolveContainerPath returns the host path of a file of the container, the symlinks of its directory resolved in
+// the rootfs: the hook runs as root, the image mustn't lead it to the files of the host. The file itself isn't
+// followed, it's created, replaced or removed.
+func resolveContainerPath(container containerConfig, p string) (string, error) {
+	p = path.Clean("/" + p)
+	dir, err := rootfsPath(containerPath(container, "/"), path.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path.Base(p)), nil
+}
+
+// getDevicesCgroup returns the path of the devices cgroup (v1) of a process, empty if there is none.
+func getDevicesCgroup(pid int) string {
+	f, err := os.Open(fmt.Sprintf(procCgroupPath, pid))
+	if err != nil {
+		log.Panicln("could not open cgroup file:", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		p := strings.SplitN(s.Text(), ":", 3)
+		if len(p) != 3 {
+			continue
+		}
+		for _, c := range strings.Split(p[1], ",") {
+			if c == "devices" {
+				return filepath.Join(cgroupDevicesRoot, p[2])
+			}
+		}
+	}
+	return ""
+}
+
+func updateDevicesCgroup(pid int, node deviceNode, allow bool) {
+	cgroup := getDevicesCgroup(pid)
+	if len(cgroup) == 0 && isCgroupV2() {
+		// The eBPF device filter is the runtime's, its devices come from the OCI spec.
+		debugf("cgroup v2: %s must be allowed by the device rules of the container", node.Path)
+		return
+	}
+	if len(cgroup) == 0 {
+		warnf("no devices cgroup found for pid %d, skipping %s", pid, node.Path)
+		return
+	}
+
+	file := "devices.deny"
+	if allow {
+		file = "devices.allow"
+	}
+	rule := fmt.Sprintf("c %d:%d rw", node.Major, node.Minor)
+	if err := ioutil.WriteFile(filepath.Join(cgroup, file), []byte(rule), 0); err != nil {
+		log.Panicln("could not update devices cgroup:", err)
+	}
+}
+
+func injectContainerDevice(container containerConfig, node deviceNode) {
+	p, err := resolveContainerPath(container, node.Path)
+	if err != nil {
+		log.Panicln("could not resolve", node.Path, "in container:", err)
+	}
+	if _, err := os.Lstat(p); err != nil {
+		if err := devices.Mknod(p, node.Major, node.Minor); err != nil {
+			log.Panicln("could not create device node", node.Path, "in container:", err)
+		}
+		if err := os.Chmod(p, 0666); err != nil {
+			log.Panicln("could not change permissions of", node.Path, "in container:", err)
+		}
+	}
+	updateDevicesCgroup(container.Pid, node, true)
+}
+
+// injectHostDevice injects a device node of the host at the same path in the container.
+func injectHostDevice(container containerConfig, path string) {
+	major, minor, err := deviceNumbers(path)
+	if err != nil {
+		log.Panicln("could not get the device numbers of", path, ":", err)
+	}
+	dir, err := resolveContainerPath(container, filepath.Dir(path))
+	if err == nil {
+		err = os.MkdirAll(dir, 0755)
+	}
+	if err != nil {
+		log.Panicln("could not create", filepath.Dir(path), "in the container:", err)
+	}
+	injectContainerDevice(container, deviceNode{Path: path, Major: major, Minor: minor})
+}
+
+// removeContainerDevice removes a device node from the container. nvidia-container-cli bind mounts the device nodes:
+// it's unmounted first, like the other injected files.
+func removeContainerDevice(config CLIConfig, container containerConfig, node deviceNode) {
+	removeContainerFile(config, container, node.Path)
+	updateDevicesCgroup(container.Pid, node, false)
+}
+
+func toggleContainerDevice(config CLIConfig, container containerConfig, node deviceNode, inject bool) {
+	if inject {
+		injectContainerDevice(container, node)
+	} else {
+		removeContainerDevice(config, container, node)
+	}
+}
+
+// configureDeviceNodes applies the per-device-node toggles on top of what nvidia-container-cli
+// injected for the requested capabilities.
+func configureDeviceNodes(hook HookConfig, container containerConfig) {
+	if hook.InjectUVMTools != nil {
+		uvm, ok := getDeviceMajors(procDevicesPath)[nvidiaUVMDeviceName]
+		if !ok {
+			log.Panicln("nvidia-uvm is not loaded, can't configure /dev/nvidia-uvm-tools")
+		}
+		toggleContainerDevice(hook.NvidiaContainerCLI, container, deviceNode{Path: "/dev/nvidia-uvm-tools", Major: uvm, Minor: nvidiaUVMToolsMinor}, *hook.InjectUVMTools)
+	}
+	if hook.InjectModeset != nil {
+		toggleContainerDevice(hook.NvidiaContainerCLI, container, deviceNode{Path: "/dev/nvidia-modeset", Major: nvidiaMajor, Minor: nvidiaModesetMinor}, *hook.InjectModeset)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var procMountInfoPath = "/proc/%d/mountinfo"
+
+// unescapeMountPath decodes the octal escapes of the spaces, tabs, newlines and backslashes of the mountinfo paths.
+func unescapeMountPath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' && i+3 < len(p) {
+			if n, err := strconv.ParseUint(p[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
+
+// getContainerMountPoints returns the mount points under the rootfs of the container, relative to it.
+func getContainerMountPoints(container containerConfig) (map[string]bool, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf(procMountInfoPath, container.Pid))
+	if err != nil {
+		return nil, err
+	}
+	mounts := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		rel, err := filepath.Rel(container.Rootfs, unescapeMountPath(fields[4]))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		mounts[path.Join("/", rel)] = true
+	}
+	return mounts, nil
+}
+
+// getRootfsRelPath returns the path in the container of a path resolved by resolveContainerPath.
+func getRootfsRelPath(container containerConfig, resolved string) string {
+	return path.Join("/", strings.TrimPrefix(resolved, containerPath(container, "/")))
+}
+
+// removeContainerFiles removes the files nvidia-container-cli or the hook mounted in the container, the files of
+// the image at these paths are kept.
+func removeContainerFiles(config CLIConfig, container containerConfig, files []string) {
+	if len(files) == 0 {
+		return
+	}
+	mounts, err := getContainerMountPoints(container)
+	if err != nil {
+		log.Panicln("couldn't read the mounts of the container:", err)
+	}
+	for _, p := range files {
+		target, err := resolveContainerPath(container, p)
+		if err != nil {
+			log.Panicln("couldn't resolve", p, "in the container:", err)
+		}
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			continue
+		}
+		if !mounts[getRootfsRelPath(container, target)] {
+			debugf("keeping %s, the file of the image", p)
+			continue
+		}
+		removeContainerFile(config, container, p)
+	}
+}
+
+// removeContainerFile removes a file injected by nvidia-container-cli. The file is bind mounted
+// in the mount namespace of the container, nsenter is used to unmount it before removing the mount point.
+func removeContainerFile(config CLIConfig, container containerConfig, p string) {
+	target, err := resolveContainerPath(container, p)
+	if err != nil {
+		log.Panicln("couldn't resolve", p, "in the container:", err)
+	}
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		return
+	}
+
+	infof("removing %s from the container", p)
+	nsenter := lookPath(config, "nsenter")
+	dst := path.Join(container.Rootfs, getRootfsRelPath(container, target))
+	out, err := exec.Command(nsenter, "--target", strconv.Itoa(container.Pid), "--mount", "umount", dst).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "not mounted") {
+		log.Panicf("couldn't unmount %s from the container: %v: %s", p, err, strings.TrimSpace(string(out)))
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		log.Panicln("couldn't remove", p, "from the container:", err)
+	}
+}
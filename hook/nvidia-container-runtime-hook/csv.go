@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// On Jetson (iGPU) systems the driver files aren't discovered by nvidia-container-cli,
+// they are listed by the CSV files of the L4T packages.
+const modeCSV = "csv"
+
+var defaultCSVDirs = []string{"/etc/nvidia-container-runtime/host-files-for-container.d"}
+
+// csvFiles are the host files of the CSV files, injected at the same paths in the containers.
+type csvFiles struct {
+	Devices     []string `json:"devices,omitempty"`
+	Libraries   []string `json:"libraries,omitempty"`
+	Directories []string `json:"directories,omitempty"`
+	Symlinks    []string `json:"symlinks,omitempty"`
+}
+
+// parseCSV reads the lines of a CSV file: "<type>, <path>" with the types dev, lib, dir and sym.
+func parseCSV(r io.Reader, files *csvFiles) error {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := strings.SplitN(line, ",", 2)
+		if len(p) != 2 || len(strings.TrimSpace(p[1])) == 0 {
+			return fmt.Errorf("invalid line %q, expected <type>, <path>", line)
+		}
+		path := strings.TrimSpace(p[1])
+		switch strings.TrimSpace(p[0]) {
+		case "dev":
+			files.Devices = append(files.Devices, path)
+		case "lib":
+			files.Libraries = append(files.Libraries, path)
+		case "dir":
+			files.Directories = append(files.Directories, path)
+		case "sym":
+			files.Symlinks = append(files.Symlinks, path)
+		default:
+			return fmt.Errorf("invalid line %q, unknown type %s", line, p[0])
+		}
+	}
+	return s.Err()
+}
+
+// loadCSVFiles reads the *.csv files of the directories.
+func loadCSVFiles(dirs []string) csvFiles {
+	var files csvFiles
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			log.Panicln("could not read CSV directory:", err)
+		}
+		for _, e := range entries {
+			if filepath.Ext(e.Name()) != ".csv" {
+				continue
+			}
+			p := filepath.Join(dir, e.Name())
+			f, err := os.Open(p)
+			if err != nil {
+				log.Panicln("could not open CSV file:", err)
+			}
+			err = parseCSV(f, &files)
+			f.Close()
+			if err != nil {
+				log.Panicf("%s: %v", p, err)
+			}
+		}
+	}
+	return files
+}
+
+// configureCSV injects the files listed by the CSV files instead of nvidia-container-cli.
+// The lists cover several Jetson models, the files missing on the host are skipped.
+func configureCSV(hook HookConfig, container containerConfig) {
+	files := loadCSVFiles(hook.CSVDirs)
+	exists := func(p string) bool {
+		if _, err := os.Lstat(p); err != nil {
+			debugf("skipping %s: %v", p, err)
+			return false
+		}
+		return true
+	}
+
+	for _, d := range files.Devices {
+		if exists(d) {
+			infof("injecting device %s", d)
+			injectHostDevice(container, d)
+		}
+	}
+	var mounts []cdiMount
+	for _, p := range append(files.Libraries, files.Directories...) {
+		if exists(p) {
+			mounts = append(mounts, cdiMount{HostPath: p, ContainerPath: p, Options: []string{"ro"}})
+		}
+	}
+	bindContainerMounts(hook.NvidiaContainerCLI, container, mounts, hook.Parallelism)
+	for _, s := range files.Symlinks {
+		if !exists(s) {
+			continue
+		}
+		target, err := os.Readlink(s)
+		if err != nil {
+			log.Panicln("could not read symlink:", err)
+		}
+		dst := containerPath(container, s)
+		if _, err := os.Lstat(dst); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			log.Panicln("could not create", filepath.Dir(s), "in the container:", err)
+		}
+		infof("creating symlink %s -> %s", s, target)
+		if err := os.Symlink(target, dst); err != nil {
+			log.Panicln("could not create symlink in the container:", err)
+		}
+	}
+
+	if len(files.Libraries) > 0 && len(getMuslArch(container.Rootfs)) == 0 {
+		updateLdCache(hook.NvidiaContainerCLI, container)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/devices"
+)
+
+// The device nodes of the driver are discovered by the devices package, shared with the tooling.
+const (
+	procDevicesPath = devices.ProcDevicesPath
+
+	nvidiaMajor         = devices.NvidiaMajor
+	nvidiaModesetMinor  = devices.NvidiaModesetMinor
+	nvidiaUVMToolsMinor = devices.NvidiaUVMToolsMinor
+	nvidiaUVMDeviceName = devices.NvidiaUVMDeviceName
+)
+
+type deviceNode = devices.Node
+
+// deviceNumbers returns the major and minor numbers of a device node.
+func deviceNumbers(path string) (major, minor uint32, err error) {
+	return devices.Numbers(path)
+}
+
+// getDeviceMajors parses the "Character devices" section of /proc/devices.
+func getDeviceMajors(path string) map[string]uint32 {
+	majors, err := devices.Majors(path)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return majors
+}
+
+func createDeviceNode(node deviceNode) {
+	if _, err := os.Stat(node.Path); err == nil {
+		return
+	}
+
+	infof("creating device node %s (%d:%d)", node.Path, node.Major, node.Minor)
+	if err := devices.Mknod(node.Path, node.Major, node.Minor); err != nil && !os.IsExist(err) {
+		log.Panicln("could not create device node", node.Path, ":", err)
+	}
+	// mknod is subject to the umask.
+	if err := os.Chmod(node.Path, 0666); err != nil {
+		log.Panicln("could not change permissions of", node.Path, ":", err)
+	}
+}
+
+// createDeviceNodes creates the NVIDIA device nodes missing on the host,
+// e.g. when neither nvidia-persistenced nor udev rules are installed.
+func createDeviceNodes() {
+	gpus, err := devices.GPUMinors(devices.ProcGPUsPath)
+	if err != nil {
+		log.Panicln(err)
+	}
+	for _, node := range devices.Nodes(getDeviceMajors(procDevicesPath), gpus) {
+		createDeviceNode(node)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	nvidiaDriverVersionPath = "/proc/driver/nvidia/version"
+	appArmorProfilesPath    = "/sys/kernel/security/apparmor/profiles"
+	dockerDefaultProfile    = "docker-default"
+)
+
+// diagnostics are the checks of diagnose run after the ones of validate, for the usual misconfigurations of a node.
+var diagnostics = []check{
+	{"driver", func(hook HookConfig) error {
+		b, err := ioutil.ReadFile(nvidiaDriverVersionPath)
+		if err != nil {
+			return fmt.Errorf("no NVIDIA driver loaded: %v", err)
+		}
+		debugf("driver: %s", strings.SplitN(string(b), "\n", 2)[0])
+		return nil
+	}},
+	{"device-nodes", func(hook HookConfig) error { return checkHostDeviceNodes() }},
+	{"nvml", func(hook HookConfig) error {
+		cli := hook.NvidiaContainerCLI
+		// The cache would hide a broken driver.
+		cli.DiscoveryCache = ""
+		info, err := queryDriverInfo(cli)
+		if err != nil {
+			return err
+		}
+		if len(info.Devices) == 0 {
+			return fmt.Errorf("NVML found no GPU, driver %s", info.DriverVersion)
+		}
+		return nil
+	}},
+	{"nvidia-container-cli", func(hook HookConfig) error {
+		version, err := getCLIVersion(hook.NvidiaContainerCLI)
+		if err != nil {
+			return err
+		}
+		if compareVersions(version, minCLIVersion) < 0 || compareVersions(version, nextCLIVersion) >= 0 {
+			return fmt.Errorf("version %s, the hook supports >= %s, < %s", version, minCLIVersion, nextCLIVersion)
+		}
+		return checkCgroupV2Support(hook.NvidiaContainerCLI)
+	}},
+	{"ldconfig", func(hook HookConfig) error { return checkLdconfig(hook.NvidiaContainerCLI) }},
+	{"apparmor", func(hook HookConfig) error { return checkDefaultAppArmorProfile() }},
+}
+
+// runCheck returns the failure of a check, the helpers of the hook panic on errors.
+func runCheck(c check, hook HookConfig) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s", strings.TrimSpace(fmt.Sprint(r)))
+		}
+	}()
+	return c.Run(hook)
+}
+
+// checkHostDeviceNodes checks the NVIDIA device nodes of the node: nvidia-container-cli bind mounts them, and the
+// processes of the containers open them with the permissions of the host.
+func checkHostDeviceNodes() error {
+	gpus, _ := filepath.Glob("/dev/nvidia[0-9]*")
+	if len(gpus) == 0 {
+		return fmt.Errorf("no /dev/nvidia<N> device node, is nvidia-persistenced or nvidia-modprobe running?")
+	}
+	var problems []string
+	for _, p := range append([]string{"/dev/nvidiactl", "/dev/nvidia-uvm"}, gpus...) {
+		info, err := os.Stat(p)
+		switch {
+		case err != nil:
+			problems = append(problems, err.Error())
+		case info.Mode()&os.ModeCharDevice == 0:
+			problems = append(problems, p+" is not a character device")
+		case info.Mode().Perm()&0666 != 0666:
+			problems = append(problems, fmt.Sprintf("%s has mode %v, the containers need 0666", p, info.Mode().Perm()))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkDefaultAppArmorProfile opens the device nodes of the node confined by docker-default when it's loaded,
+// as the processes of the containers run with it.
+func checkDefaultAppArmorProfile() error {
+	if !isAppArmorEnabled() {
+		return nil
+	}
+	b, err := ioutil.ReadFile(appArmorProfilesPath)
+	if err != nil || !strings.Contains(string(b), dockerDefaultProfile+" (") {
+		return nil
+	}
+	nodes, _ := filepath.Glob("/dev/nvidia*")
+	var devices []string
+	for _, n := range nodes {
+		if info, err := os.Stat(n); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			devices = append(devices, n)
+		}
+	}
+	if len(devices) == 0 {
+		return nil
+	}
+	if err := checkDeviceAccess(devices, "", dockerDefaultProfile); err != nil {
+		return fmt.Errorf("%s denies the NVIDIA devices (%v), add the rules of apparmor-rules to the profiles of the GPU containers",
+			dockerDefaultProfile, err)
+	}
+	return nil
+}
+
+// doDiagnose prints a report of the checks of the node, it exits with 1 if one of them failed.
+func doDiagnose() {
+	if !*debugflag {
+		// The failures are in the report, log.Panic would print them twice.
+		log.SetOutput(ioutil.Discard)
+	}
+	failed := false
+	hook, err := loadHookConfig()
+	if err != nil {
+		fmt.Printf("%-24s FAIL: %v, checking with the defaults\n", "config-file", err)
+		failed = true
+	}
+
+	for _, c := range append(checks, diagnostics...) {
+		if err := runCheck(c, hook); err != nil {
+			fmt.Printf("%-24s FAIL: %v\n", c.Name, err)
+			failed = true
+		} else {
+			fmt.Printf("%-24s OK\n", c.Name)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
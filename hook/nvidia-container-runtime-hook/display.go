@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// The sockets of the local X servers, X<display>.
+	x11SocketDir = "/tmp/.X11-unix"
+	// The XDG_RUNTIME_DIR of the users, /run/user/<uid>, holding their Wayland sockets.
+	userRuntimeDir = "/run/user"
+)
+
+// The local displays, :0 or unix:0.0, the remote ones go through the network of the container.
+var localDisplayExp = regexp.MustCompile(`^(unix)?:([0-9]+)(\.[0-9]+)?$`)
+
+// isXauthorityName tells the names of the authority files of the X servers and of Xwayland.
+func isXauthorityName(name string) bool {
+	for _, prefix := range []string{".Xauthority", "xauth", ".xauth", ".mutter-Xwaylandauth"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// getDisplayMounts returns the mounts forwarding the display of the environment of the container: the socket of
+// DISPLAY, the one of WAYLAND_DISPLAY in the runtime directory of the user, and XAUTHORITY on the same paths. The
+// Wayland socket and the authority file have to belong to the user of the container.
+func getDisplayMounts(env map[string]string, uid uint32) []cdiMount {
+	var mounts []cdiMount
+	if m := localDisplayExp.FindStringSubmatch(env["DISPLAY"]); m != nil {
+		socket := filepath.Join(x11SocketDir, "X"+m[2])
+		if info, err := os.Stat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			mounts = append(mounts, cdiMount{HostPath: socket, ContainerPath: socket})
+		} else {
+			warnf("no socket %s for DISPLAY=%s, not forwarding it", socket, env["DISPLAY"])
+		}
+	}
+
+	if display := env["WAYLAND_DISPLAY"]; len(display) > 0 {
+		runtimeDir := filepath.Join(userRuntimeDir, strconv.FormatUint(uint64(uid), 10))
+		socket := display
+		if !path.IsAbs(socket) {
+			dir := env["XDG_RUNTIME_DIR"]
+			if len(dir) == 0 {
+				dir = runtimeDir
+			}
+			socket = filepath.Join(dir, display)
+		}
+		socket = filepath.Clean(socket)
+		info, err := os.Lstat(socket)
+		switch {
+		case !strings.HasPrefix(socket, runtimeDir+"/"):
+			warnf("the Wayland socket %s isn't in %s, not forwarding it", socket, runtimeDir)
+		case err != nil || info.Mode()&os.ModeSocket == 0 || !isOwnedBy(info, uid):
+			warnf("no Wayland socket %s of uid %d, not forwarding it", socket, uid)
+		default:
+			mounts = append(mounts, cdiMount{HostPath: socket, ContainerPath: socket})
+		}
+	}
+
+	if xauth := env["XAUTHORITY"]; len(mounts) > 0 && len(xauth) > 0 {
+		xauth = filepath.Clean(xauth)
+		info, err := os.Lstat(xauth)
+		if path.IsAbs(xauth) && isXauthorityName(filepath.Base(xauth)) && err == nil && info.Mode().IsRegular() && isOwnedBy(info, uid) {
+			mounts = append(mounts, cdiMount{HostPath: xauth, ContainerPath: xauth, Options: []string{"ro"}})
+		} else {
+			warnf("no X authority file %s of uid %d, not forwarding it", xauth, uid)
+		}
+	}
+	return mounts
+}
+
+// configureDisplay forwards the X11 and Wayland displays of the containers requesting the display capability with
+// display-forwarding: their environment names the display, the hook mounts its socket.
+func configureDisplay(hook HookConfig, container containerConfig) {
+	if !hook.DisplayForwarding || !hasCapability(container.Nvidia.Capabilities, "display") {
+		return
+	}
+	for _, m := range getDisplayMounts(container.Env, container.UID) {
+		infof("forwarding the display %s", m.HostPath)
+		bindContainerMount(hook.NvidiaContainerCLI, container, m)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/devices"
+)
+
+// The GPUs of the driver and the requests matching them are shared with the tooling through the devices package.
+type (
+	deviceInfo = devices.DeviceInfo
+	driverInfo = devices.DriverInfo
+)
+
+// getDriverInfo runs nvidia-container-cli info, which queries the driver through NVML, unless cached.
+func getDriverInfo(config CLIConfig) (*driverInfo, error) {
+	var info *driverInfo
+	err := withDiscoveryCache(config, "info", &info, func() (err error) {
+		info, err = queryDriverInfo(config)
+		return err
+	})
+	return info, err
+}
+
+func queryDriverInfo(config CLIConfig) (*driverInfo, error) {
+	args := []string{}
+	if config.Root != nil {
+		args = append(args, fmt.Sprintf("--root=%s", *config.Root))
+	}
+	args = append(args, "info", "--csv")
+
+	out, err := queryDriver(config, getCLIPath(config), args...)
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-container-cli info failed: %v", err)
+	}
+	return devices.ParseDriverInfo(string(out))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// The root and ldconfig options of nvidia-container-cli probed each time the hook runs.
+const autoDriverValue = "auto"
+
+// isUUIDRequest tells the device requests naming their GPUs by UUID only, their driver root is known without
+// querying the driver.
+func isUUIDRequest(devices string) bool {
+	for _, d := range strings.Split(devices, ",") {
+		if parent, ok := getMIGParent(d); ok {
+			d = parent
+		}
+		if d != noneGPU && !nvidiaGPUUUIDListExp.MatchString(d) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectDriverRoot returns the driver root of the requested devices, nil if the global root applies. The indexes
+// and "all" are mapped to UUIDs with the GPUs of info, nil for the requests by UUID.
+// All devices of a container must use the same root, nvidia-container-cli supports a single one.
+func selectDriverRoot(roots []DriverRoot, devices string, info *driverInfo) (*string, error) {
+	if len(roots) == 0 {
+		return nil, nil
+	}
+	var uuids []string
+	for _, d := range strings.Split(devices, ",") {
+		if parent, ok := getMIGParent(d); ok {
+			d = parent
+		}
+		switch {
+		case d == noneGPU || len(d) == 0:
+		case nvidiaGPUUUIDListExp.MatchString(d):
+			uuids = append(uuids, d)
+		case info == nil:
+			return nil, fmt.Errorf("can't select the driver root of device %s without the GPUs of the node", d)
+		default:
+			requested := info.RequestedUUIDs(d)
+			if len(requested) == 0 {
+				return nil, fmt.Errorf("unknown device %s, can't select its driver root", d)
+			}
+			uuids = append(uuids, requested...)
+		}
+	}
+
+	var selected *string
+	for _, uuid := range uuids {
+		root := ""
+		for i := range roots {
+			if roots[i].Matches(uuid) {
+				root = roots[i].Root
+				break
+			}
+		}
+		if selected != nil && *selected != root {
+			name := func(r string) string {
+				if len(r) == 0 {
+					return "the global root"
+				}
+				return r
+			}
+			return nil, fmt.Errorf("requested devices use different driver roots: %s and %s", name(*selected), name(root))
+		}
+		selected = &root
+	}
+	if selected == nil || len(*selected) == 0 {
+		return nil, nil
+	}
+	return selected, nil
+}
+
+// getDriverRoot returns the driver root of the requested devices, nil for the global root. The GPUs of the node are
+// queried to map the requests by index, "all" included.
+func getDriverRoot(hook HookConfig, devices string) *string {
+	if len(hook.DriverRoots) == 0 {
+		return nil
+	}
+	var info *driverInfo
+	if !isUUIDRequest(devices) {
+		var err error
+		if info, err = getDriverInfo(hook.NvidiaContainerCLI); err != nil {
+			fail(exitCodeCLIFailure, err)
+		}
+	}
+	root, err := selectDriverRoot(hook.DriverRoots, devices, info)
+	if err != nil {
+		fail(exitCodeBadConfig, err)
+	}
+	return root
+}
+
+// resolveAutoDriver probes the auto root and ldconfig of the configuration from the node seen from host, on each run
+// so that a driver container restarted or moved is followed. The ldconfig of a driver container is preferred, the
+// host may not have one; the ld.so cache is read by nvidia-container-cli in the root. An unresolved root is the host.
+func resolveAutoDriver(cli *CLIConfig, host string) error {
+	var err error
+	if cli.Root != nil && *cli.Root == autoDriverValue {
+		var root string
+		cli.Root = nil
+		if root, err = probeDriverRoot(host); err == nil && root != "/" {
+			cli.Root = &root
+		}
+	}
+	if cli.Ldconfig != nil && *cli.Ldconfig == autoDriverValue {
+		cli.Ldconfig = nil
+		if cli.Root != nil {
+			if ldconfig, err := probeLdconfig(path.Join(host, *cli.Root)); err == nil {
+				ldconfig = "@" + path.Join(*cli.Root, strings.TrimPrefix(ldconfig, "@"))
+				cli.Ldconfig = &ldconfig
+			}
+		}
+		if cli.Ldconfig == nil {
+			ldconfig, lerr := probeLdconfig(host)
+			if lerr != nil {
+				return lerr
+			}
+			cli.Ldconfig = &ldconfig
+		}
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const drmDir = "/dev/dri"
+
+// sysfsBusID formats a bus ID like sysfs: 4 digits domain, lower case.
+func sysfsBusID(id string) string {
+	id = normalizePCIBusID(id)
+	if len(id) == len("00000000:00:00.0") && strings.HasPrefix(id, "0000") {
+		return id[4:]
+	}
+	return id
+}
+
+// getDRMNodes returns the DRM card and render nodes of a GPU, from the drm directory of its PCI device.
+func getDRMNodes(sysfs string, busID string) []string {
+	entries, err := ioutil.ReadDir(filepath.Join(sysfs, sysfsBusID(busID), "drm"))
+	if err != nil {
+		return nil
+	}
+	var nodes []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "card") || strings.HasPrefix(e.Name(), "renderD") {
+			nodes = append(nodes, path.Join(drmDir, e.Name()))
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// getDRMByPathLink returns the link of /dev/dri/by-path udev creates for a DRM node, e.g. pci-0000:07:00.0-render.
+func getDRMByPathLink(busID string, node string) string {
+	kind := "card"
+	if strings.HasPrefix(path.Base(node), "renderD") {
+		kind = "render"
+	}
+	return path.Join(drmDir, "by-path", "pci-"+sysfsBusID(busID)+"-"+kind)
+}
+
+// configureDRM injects the DRM nodes of the GPUs of the containers requesting graphics or display, which Vulkan
+// and EGL look up, with their by-path links: the ones of the requested GPUs only, unlike --device /dev/dri.
+func configureDRM(hook HookConfig, container containerConfig) {
+	if hook.InjectDRM != nil && !*hook.InjectDRM {
+		return
+	}
+	caps := container.Nvidia.Capabilities
+	if hook.InjectDRM == nil && !hasCapability(caps, "graphics") && !hasCapability(caps, "display") {
+		return
+	}
+	if len(container.Nvidia.Devices) == 0 {
+		return
+	}
+	info, err := getDriverInfo(hook.NvidiaContainerCLI)
+	if err != nil {
+		log.Panicln("could not query the GPUs:", err)
+	}
+	for _, d := range info.Devices {
+		if !isRequested(container.Nvidia.Devices, d.Index, d.UUID) {
+			continue
+		}
+		for _, node := range getDRMNodes(pciDevicesDir, d.BusID) {
+			infof("injecting DRM device %s of GPU %s", node, d.UUID)
+			injectHostDevice(container, node)
+			// The by-path directory of the image may be a symlink, the link is created in the rootfs only.
+			link, err := resolveContainerPath(container, getDRMByPathLink(d.BusID, node))
+			if err != nil {
+				log.Panicln("could not resolve", path.Join(drmDir, "by-path"), "in the container:", err)
+			}
+			if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+				log.Panicln("could not create", path.Join(drmDir, "by-path"), "in the container:", err)
+			}
+			os.Remove(link)
+			if err := os.Symlink(path.Join("..", path.Base(node)), link); err != nil {
+				log.Panicln("could not link", node, "in the container:", err)
+			}
+		}
+	}
+}
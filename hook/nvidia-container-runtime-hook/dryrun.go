@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// dryRunReport is printed by the dry-run mode instead of configuring the container.
+type dryRunReport struct {
+	ID       string              `json:"id"`
+	Mode     string              `json:"mode"`
+	Nvidia   *nvidiaConfig       `json:"nvidia"`
+	Args     []string            `json:"args,omitempty"`
+	CDIEdits []cdiContainerEdits `json:"cdi_edits,omitempty"`
+	CSVFiles *csvFiles           `json:"csv_files,omitempty"`
+	Mounts   []string            `json:"mounts,omitempty"`
+	// capabilities of the node and their option of nvidia-container-cli.
+	Capabilities []DriverCapability `json:"capabilities"`
+}
+
+func printDryRun(hook HookConfig, cli CLIConfig, container containerConfig) {
+	report := dryRunReport{
+		ID:           container.ID,
+		Mode:         hook.Mode,
+		Nvidia:       container.Nvidia,
+		Capabilities: driverCapabilities,
+	}
+	switch {
+	case container.Nvidia == nil:
+		// Not a GPU container.
+	case hook.Mode == modeLegacy:
+		report.Args = getCLIArgs(hook, cli, container, getMuslArch(container.Rootfs))
+	case hook.Mode == modeCDI:
+		edits, err := resolveCDIDevices(loadCDISpecs(hook.CDISpecDirs), container.Nvidia.Devices)
+		if err != nil {
+			fail(exitCodeBadSpec, err)
+		}
+		report.CDIEdits = edits
+	case hook.Mode == modeCSV:
+		files := loadCSVFiles(hook.CSVDirs)
+		report.CSVFiles = &files
+	case hook.Mode == modeWSL:
+		report.Mounts = getWSLMounts(wslLibDir, wslDriversDir)
+	default:
+		fail(exitCodeBadConfig, fmt.Errorf("unknown mode: %s", hook.Mode))
+	}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fail(exitCodeError, err)
+	}
+	fmt.Fprintln(os.Stdout, string(b))
+}
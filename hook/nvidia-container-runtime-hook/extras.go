@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// parseExtraMount parses a mount of the [mounts] table: host[:container][:ro|rw], on the host path and read-only
+// by default.
+func parseExtraMount(s string) (cdiMount, error) {
+	p := strings.Split(s, ":")
+	m := cdiMount{HostPath: p[0], ContainerPath: p[0], Options: []string{"ro"}}
+	if len(p) > 1 && (p[len(p)-1] == "ro" || p[len(p)-1] == "rw") {
+		if p[len(p)-1] == "rw" {
+			m.Options = nil
+		}
+		p = p[:len(p)-1]
+	}
+	if len(p) == 2 {
+		m.ContainerPath = p[1]
+	}
+	if len(p) > 2 || !path.IsAbs(m.HostPath) || !path.IsAbs(m.ContainerPath) {
+		return cdiMount{}, fmt.Errorf("invalid mount %q: host[:container][:ro|rw] with absolute paths", s)
+	}
+	return m, nil
+}
+
+// getCapabilityExtras returns the mounts and device nodes of the [mounts] and [devices] tables of the requested
+// capabilities, once each.
+func getCapabilityExtras(hook HookConfig, capabilities string) ([]cdiMount, []string, error) {
+	for _, table := range []map[string][]string{hook.ExtraMounts, hook.ExtraDevices} {
+		var names []string
+		for name := range table {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, ok := findCapability(driverCapabilities, name); !ok {
+				return nil, nil, fmt.Errorf("extra mounts or devices of an unknown driver capability: %s", name)
+			}
+		}
+	}
+
+	var mounts []cdiMount
+	var devices []string
+	seen := make(map[string]bool)
+	for _, c := range strings.Split(capabilities, ",") {
+		for _, s := range hook.ExtraMounts[c] {
+			m, err := parseExtraMount(s)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !seen[m.ContainerPath] {
+				seen[m.ContainerPath] = true
+				mounts = append(mounts, m)
+			}
+		}
+		for _, d := range hook.ExtraDevices[c] {
+			if !path.IsAbs(d) {
+				return nil, nil, fmt.Errorf("invalid device %q: an absolute path is required", d)
+			}
+			if !seen[d] {
+				seen[d] = true
+				devices = append(devices, d)
+			}
+		}
+	}
+	return mounts, devices, nil
+}
+
+// configureCapabilityExtras injects the extra mounts and device nodes of the capabilities of the container.
+func configureCapabilityExtras(hook HookConfig, container containerConfig) {
+	mounts, devices, err := getCapabilityExtras(hook, container.Nvidia.Capabilities)
+	if err != nil {
+		fail(exitCodeBadConfig, err)
+	}
+	for _, m := range mounts {
+		infof("mounting %s on %s", m.HostPath, m.ContainerPath)
+		bindContainerMount(hook.NvidiaContainerCLI, container, m)
+	}
+	for _, d := range devices {
+		infof("injecting device %s", d)
+		injectHostDevice(container, d)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func lockFile(f *os.File) error {
+	return fmt.Errorf("file locking is not supported on %s", runtime.GOOS)
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
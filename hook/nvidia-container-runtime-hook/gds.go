@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+)
+
+const (
+	// Set to "enabled" by the containers using GPUDirect Storage.
+	envNVGDS = "NVIDIA_GDS"
+
+	nvidiaFSDevices = "/dev/nvidia-fs*"
+)
+
+var (
+	defaultGDSLibraries = []string{
+		"/usr/local/cuda/lib64/libcufile*.so*",
+		"/usr/lib*/libcufile*.so*", "/usr/lib*/*/libcufile*.so*",
+	}
+	// cufile.json is read from /etc unless CUFILE_ENV_PATH_JSON says otherwise.
+	defaultGDSFiles = []string{"/etc/cufile.json"}
+)
+
+// configureGDS injects the nvidia-fs devices, cufile.json and libcufile in the containers enabling NVIDIA_GDS.
+func configureGDS(hook HookConfig, container containerConfig) {
+	if container.Env[envNVGDS] != envEnabled {
+		return
+	}
+	if !hook.GDS {
+		warnf("%s is enabled but GPUDirect Storage is disabled by the gds option, ignoring it", envNVGDS)
+		return
+	}
+
+	devices, err := filepath.Glob(nvidiaFSDevices)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if len(devices) == 0 {
+		log.Panicf("%s is enabled but there is no %s device, is nvidia-fs loaded?", envNVGDS, nvidiaFSDevices)
+	}
+	for _, d := range devices {
+		infof("injecting GDS device %s", d)
+		injectHostDevice(container, d)
+	}
+	mountLibraries(hook.NvidiaContainerCLI, container, "/", hook.GDSLibraries)
+	mountHostFiles(hook.NvidiaContainerCLI, container, hook.GDSFiles)
+}
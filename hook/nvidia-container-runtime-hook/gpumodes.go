@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The modes requested by a container: the annotations, set by the scheduler, have precedence over the environment.
+const (
+	computeModeAnnotation     = "nvidia.com/compute-mode"
+	persistenceModeAnnotation = "nvidia.com/persistence-mode"
+	envNVComputeMode          = "NVIDIA_COMPUTE_MODE"
+	envNVPersistenceMode      = "NVIDIA_PERSISTENCE_MODE"
+
+	// The limits are set by the operators of the nodes only, from the allowed ranges.
+	powerLimitAnnotation = "com.nvidia.power-limit"
+	gpuClocksAnnotation  = "com.nvidia.gpu-clocks"
+
+	defaultGPUModesState = "/run/nvidia-container-runtime/gpu-modes.json"
+)
+
+// Compute modes of nvidia-smi -c, and persistence modes of nvidia-smi -pm.
+var (
+	computeModes     = []string{"DEFAULT", "EXCLUSIVE_PROCESS", "PROHIBITED"}
+	persistenceModes = []string{"ENABLED", "DISABLED"}
+)
+
+// parsePowerLimit parses a power limit in W, e.g. 250W.
+func parsePowerLimit(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "W"))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid power limit %s, expected e.g. 250W", s)
+	}
+	return n, nil
+}
+
+// parseGPUClocks parses the locked GPU clocks in MHz, a clock or a min,max range e.g. 1200,1400MHz, and returns
+// them in the format of nvidia-smi -lgc.
+func parseGPUClocks(s string) (string, []int, error) {
+	var clocks []int
+	for _, c := range strings.Split(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "MHZ"), ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(c))
+		if err != nil || n <= 0 {
+			return "", nil, fmt.Errorf("invalid GPU clocks %s, expected e.g. 1200,1400MHz", s)
+		}
+		clocks = append(clocks, n)
+	}
+	if len(clocks) == 1 {
+		clocks = append(clocks, clocks[0])
+	}
+	if len(clocks) != 2 || clocks[0] > clocks[1] {
+		return "", nil, fmt.Errorf("invalid GPU clocks %s, expected e.g. 1200,1400MHz", s)
+	}
+	return fmt.Sprintf("%d,%d", clocks[0], clocks[1]), clocks, nil
+}
+
+// getRequestedLimits returns the power limit and the GPU clocks requested by the annotations of a container.
+func getRequestedLimits(annotations map[string]string) (int, string, error) {
+	power, clocks := 0, ""
+	var err error
+	if s, ok := annotations[powerLimitAnnotation]; ok {
+		if power, err = parsePowerLimit(s); err != nil {
+			return 0, "", err
+		}
+	}
+	if s, ok := annotations[gpuClocksAnnotation]; ok {
+		if clocks, _, err = parseGPUClocks(s); err != nil {
+			return 0, "", err
+		}
+	}
+	return power, clocks, nil
+}
+
+func inRange(r []int, values ...int) bool {
+	if len(r) != 2 {
+		return false
+	}
+	for _, v := range values {
+		if v < r[0] || v > r[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// getRequestedMode returns the mode requested by the annotation or the environment of a container, in upper case.
+func getRequestedMode(annotations map[string]string, env map[string]string, annotation string, envvar string, modes []string) (string, error) {
+	mode, ok := annotations[annotation]
+	if !ok {
+		mode = env[envvar]
+	}
+	if len(mode) == 0 {
+		return "", nil
+	}
+	mode = strings.ToUpper(mode)
+	for _, m := range modes {
+		if m == mode {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("invalid %s %s, expected one of: %s", envvar, mode, strings.Join(modes, ", "))
+}
+
+// checkGPUModes rejects the modes the node doesn't let the containers set.
+func checkGPUModes(config GPUModesConfig, nvidia *nvidiaConfig) error {
+	if len(nvidia.ComputeMode) > 0 && !isAllowedMode(config.AllowedComputeModes, nvidia.ComputeMode) {
+		return fmt.Errorf("compute mode %s is not allowed", nvidia.ComputeMode)
+	}
+	if len(nvidia.PersistenceMode) > 0 && !config.AllowPersistenceMode {
+		return fmt.Errorf("%s requires allow-persistence-mode", envNVPersistenceMode)
+	}
+	if nvidia.PowerLimit > 0 && !inRange(config.AllowedPowerLimit, nvidia.PowerLimit) {
+		return fmt.Errorf("power limit %dW is out of the allowed range %v", nvidia.PowerLimit, config.AllowedPowerLimit)
+	}
+	if len(nvidia.GPUClocks) > 0 {
+		_, clocks, _ := parseGPUClocks(nvidia.GPUClocks)
+		if !inRange(config.AllowedGPUClocks, clocks...) {
+			return fmt.Errorf("GPU clocks %sMHz are out of the allowed range %v", nvidia.GPUClocks, config.AllowedGPUClocks)
+		}
+	}
+	return nil
+}
+
+func isAllowedMode(allowed []string, mode string) bool {
+	for _, m := range allowed {
+		if strings.EqualFold(m, mode) {
+			return true
+		}
+	}
+	return false
+}
+
+// GPUModeEntry records the modes and limits of a GPU before a container set them, empty if the container didn't
+// change them. The locked clocks are reset.
+type GPUModeEntry struct {
+	Container       string `json:"container"`
+	Pid             int    `json:"pid,omitempty"`
+	UUID            string `json:"uuid"`
+	ComputeMode     string `json:"compute_mode,omitempty"`
+	PersistenceMode string `json:"persistence_mode,omitempty"`
+	PowerLimit      string `json:"power_limit,omitempty"`
+	GPUClocksLocked bool   `json:"gpu_clocks_locked,omitempty"`
+}
+
+func (e GPUModeEntry) changed() bool {
+	return len(e.ComputeMode) > 0 || len(e.PersistenceMode) > 0 || len(e.PowerLimit) > 0 || e.GPUClocksLocked
+}
+
+// gpuModes is the node-local record of the GPUs whose modes are set by containers.
+type gpuModes struct {
+	file    *os.File
+	Entries []GPUModeEntry `json:"entries"`
+}
+
+// openGPUModes opens and locks the state of the GPU modes, it must be closed to release the lock.
+func openGPUModes(path string) (*gpuModes, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	m := &gpuModes{file: f}
+	b, err := ioutil.ReadAll(f)
+	if err == nil && len(b) > 0 {
+		err = json.Unmarshal(b, m)
+	}
+	if err != nil {
+		m.close()
+		return nil, fmt.Errorf("invalid GPU modes state %s: %v", path, err)
+	}
+	return m, nil
+}
+
+func (m *gpuModes) save() error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := m.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = m.file.WriteAt(b, 0)
+	return err
+}
+
+func (m *gpuModes) close() {
+	unlockFile(m.file)
+	m.file.Close()
+}
+
+// release removes the entries of a container and returns them.
+func (m *gpuModes) release(container string) []GPUModeEntry {
+	var released []GPUModeEntry
+	entries := m.Entries[:0]
+	for _, e := range m.Entries {
+		if e.Container == container {
+			released = append(released, e)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	m.Entries = entries
+	return released
+}
+
+// prune removes the entries of the containers whose process is gone, e.g. killed without their poststop hook.
+func (m *gpuModes) prune() []GPUModeEntry {
+	var released []GPUModeEntry
+	entries := m.Entries[:0]
+	for _, e := range m.Entries {
+		if e.Pid > 0 {
+			if _, err := os.Stat(fmt.Sprintf("/proc/%d", e.Pid)); os.IsNotExist(err) {
+				released = append(released, e)
+				continue
+			}
+		}
+		entries = append(entries, e)
+	}
+	m.Entries = entries
+	return released
+}
+
+func setGPUMode(config CLIConfig, uuid string, option string, value ...string) error {
+	smi := lookPath(config, "nvidia-smi")
+	if out, err := exec.Command(smi, append([]string{"-i", uuid, option}, value...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("couldn't set %s %s on GPU %s: %s", option, strings.Join(value, " "), uuid, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// restoreGPUModes sets back the modes a container changed, all of them even if one fails.
+func restoreGPUModes(config CLIConfig, entries []GPUModeEntry) error {
+	var errs []string
+	for _, e := range entries {
+		if len(e.ComputeMode) > 0 {
+			if err := setGPUMode(config, e.UUID, "-c", e.ComputeMode); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if len(e.PersistenceMode) > 0 {
+			if err := setGPUMode(config, e.UUID, "-pm", e.PersistenceMode); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if len(e.PowerLimit) > 0 {
+			if err := setGPUMode(config, e.UUID, "-pl", e.PowerLimit); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if e.GPUClocksLocked {
+			if err := setGPUMode(config, e.UUID, "-rgc"); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if e.changed() {
+			infof("restored the modes of GPU %s", e.UUID)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// setContainerGPUModes sets the modes and limits requested by a container on its GPUs and records the previous ones. A GPU
+// whose modes are already set by another container is rejected, its modes would be restored under the other one.
+func setContainerGPUModes(hook HookConfig, cli CLIConfig, container containerConfig) {
+	nvidia := container.Nvidia
+	info, err := getDriverInfo(cli)
+	if err != nil {
+		fail(exitCodeCLIFailure, err)
+	}
+	uuids := info.RequestedUUIDs(nvidia.Devices)
+	gpus, err := queryGPUs(cli, "uuid", "compute_mode", "persistence_mode", "power.limit")
+	if err != nil {
+		fail(exitCodeCLIFailure, err)
+	}
+	current := make(map[string][]string)
+	for _, g := range gpus {
+		current[g[0]] = []string{strings.ToUpper(g[1]), strings.ToUpper(g[2]), g[3]}
+	}
+
+	m, err := openGPUModes(hook.GPUModes.State)
+	if err != nil {
+		log.Panicln(err)
+	}
+	defer m.close()
+
+	if stale := m.prune(); len(stale) > 0 {
+		if err := restoreGPUModes(cli, stale); err != nil {
+			warnf("couldn't restore the GPU modes of the stopped containers: %v", err)
+		}
+	}
+	m.release(container.ID)
+	for _, uuid := range uuids {
+		if _, ok := current[uuid]; !ok {
+			fail(exitCodeCLIFailure, fmt.Errorf("no modes found for GPU %s", uuid))
+		}
+		for _, e := range m.Entries {
+			if e.UUID == uuid {
+				fail(exitCodePolicy, fmt.Errorf("the modes of GPU %s are set by container %s", uuid, e.Container))
+			}
+		}
+	}
+
+	var entries []GPUModeEntry
+	for _, uuid := range uuids {
+		e := GPUModeEntry{Container: container.ID, Pid: container.Pid, UUID: uuid}
+		modes := current[uuid]
+		if len(nvidia.ComputeMode) > 0 && modes[0] != nvidia.ComputeMode {
+			err = setGPUMode(cli, uuid, "-c", nvidia.ComputeMode)
+			if err == nil {
+				e.ComputeMode = modes[0]
+			}
+		}
+		if err == nil && len(nvidia.PersistenceMode) > 0 && modes[1] != nvidia.PersistenceMode {
+			err = setGPUMode(cli, uuid, "-pm", nvidia.PersistenceMode)
+			if err == nil {
+				e.PersistenceMode = modes[1]
+			}
+		}
+		if err == nil && nvidia.PowerLimit > 0 {
+			err = setGPUMode(cli, uuid, "-pl", strconv.Itoa(nvidia.PowerLimit))
+			if err == nil {
+				e.PowerLimit = modes[2]
+			}
+		}
+		if err == nil && len(nvidia.GPUClocks) > 0 {
+			err = setGPUMode(cli, uuid, "-lgc", nvidia.GPUClocks)
+			e.GPUClocksLocked = err == nil
+		}
+		entries = append(entries, e)
+		if err != nil {
+			restoreGPUModes(cli, entries)
+			fail(exitCodeCLIFailure, err)
+		}
+		infof("GPU %s set to compute mode %s, persistence mode %s", uuid,
+			orDefault(nvidia.ComputeMode, modes[0]), orDefault(nvidia.PersistenceMode, modes[1]))
+		if nvidia.PowerLimit > 0 || len(nvidia.GPUClocks) > 0 {
+			power := modes[2]
+			if nvidia.PowerLimit > 0 {
+				power = strconv.Itoa(nvidia.PowerLimit)
+			}
+			infof("GPU %s limited to %s W, GPU clocks %s MHz", uuid, power, orDefault(nvidia.GPUClocks, "unlocked"))
+		}
+	}
+	m.Entries = append(m.Entries, entries...)
+	if err := m.save(); err != nil {
+		restoreGPUModes(cli, entries)
+		log.Panicln(err)
+	}
+}
+
+func orDefault(value string, def string) string {
+	if len(value) == 0 {
+		return def
+	}
+	return value
+}
+
+// releaseGPUModes restores the modes of the GPUs of a container.
+func releaseGPUModes(hook HookConfig, id string) {
+	if _, err := os.Stat(hook.GPUModes.State); os.IsNotExist(err) {
+		return
+	}
+	m, err := openGPUModes(hook.GPUModes.State)
+	if err != nil {
+		log.Panicln(err)
+	}
+	defer m.close()
+
+	if err := restoreGPUModes(hook.NvidiaContainerCLI, m.release(id)); err != nil {
+		log.Panicln(err)
+	}
+	if err := m.save(); err != nil {
+		log.Panicln(err)
+	}
+}
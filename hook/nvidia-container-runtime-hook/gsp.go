@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The open kernel modules run on the GSP of the GPU, with a firmware of the driver version.
+	firmwareDir = "/lib/firmware/nvidia"
+
+	nvidiaCapsDir = "/dev/nvidia-caps"
+	// Capabilities of creating and destroying MIG instances, only given to the containers with
+	// NVIDIA_MIG_CONFIG_DEVICES, and of monitoring them.
+	migConfigCapPath       = "/proc/driver/nvidia/capabilities/mig/config"
+	migMonitorCapPath      = "/proc/driver/nvidia/capabilities/mig/monitor"
+	defaultMIGConfigMinor  = 1
+	defaultMIGMonitorMinor = 2
+)
+
+// NVRM version: NVIDIA UNIX Open Kernel Module for x86_64  535.104.05  Release Build  (dvs-builder@U16-I3-B03-4-3)
+var driverVersionExp = regexp.MustCompile(`NVRM version:.*\s(\d+\.\d+(?:\.\d+)?)\s`)
+
+// parseProcDriverVersion returns the driver version of /proc/driver/nvidia/version and whether it's the open one.
+func parseProcDriverVersion(content string) (string, bool) {
+	m := driverVersionExp.FindStringSubmatch(content)
+	if m == nil {
+		return "", false
+	}
+	return m[1], strings.Contains(m[0], "Open Kernel Module")
+}
+
+// getOpenKernelModulesVersion returns the driver version when the open kernel modules are used: detected
+// unless the open-kernel-modules option says otherwise.
+func getOpenKernelModulesVersion(config CLIConfig) (string, bool) {
+	if config.OpenKernelModules != nil && !*config.OpenKernelModules {
+		return "", false
+	}
+	b, err := ioutil.ReadFile(procDriverVersionPath)
+	if err != nil {
+		if config.OpenKernelModules != nil {
+			log.Panicln("couldn't read the driver version:", err)
+		}
+		return "", false
+	}
+	version, open := parseProcDriverVersion(string(b))
+	if len(version) == 0 {
+		log.Panicln("couldn't find the driver version in", procDriverVersionPath)
+	}
+	return version, open || config.OpenKernelModules != nil
+}
+
+// getMIGCapMinor returns the minor of the nvidia-caps device of a MIG capability.
+func getMIGCapMinor(path string, defaultMinor uint32) uint32 {
+	f, err := os.Open(path)
+	if err != nil {
+		return defaultMinor
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		p := strings.SplitN(s.Text(), ":", 2)
+		if len(p) == 2 && strings.TrimSpace(p[0]) == "DeviceFileMinor" {
+			if minor, err := strconv.ParseUint(strings.TrimSpace(p[1]), 10, 32); err == nil {
+				return uint32(minor)
+			}
+		}
+	}
+	return defaultMinor
+}
+
+// configureOpenKernelModules exposes the GSP firmware of the driver and the nvidia-caps devices to the container.
+func configureOpenKernelModules(config CLIConfig, container containerConfig) {
+	version, open := getOpenKernelModulesVersion(config)
+	if !open {
+		return
+	}
+	root := "/"
+	if config.Root != nil {
+		root = *config.Root
+	}
+
+	firmware, err := filepath.Glob(filepath.Join(root, firmwareDir, version, "gsp*.bin"))
+	if err != nil {
+		log.Panicln(err)
+	}
+	if len(firmware) == 0 {
+		warnf("no GSP firmware of the driver %s in %s", version, filepath.Join(root, firmwareDir))
+	}
+	for _, f := range firmware {
+		p := filepath.Join(firmwareDir, version, filepath.Base(f))
+		infof("mounting the GSP firmware %s", p)
+		bindContainerMount(config, container, cdiMount{HostPath: f, ContainerPath: p, Options: []string{"ro"}})
+	}
+
+	caps, err := filepath.Glob(filepath.Join(nvidiaCapsDir, "nvidia-cap*"))
+	if err != nil {
+		log.Panicln(err)
+	}
+	migConfig := getMIGCapMinor(migConfigCapPath, defaultMIGConfigMinor)
+	for _, c := range caps {
+		_, minor, err := deviceNumbers(c)
+		if err != nil || minor == migConfig {
+			continue
+		}
+		infof("injecting %s", c)
+		injectHostDevice(container, c)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The hooks of the containers configured by the hook, removed at poststop.
+const configuredMarkersDir = "/run/nvidia-container-runtime/configured"
+
+func configuredMarkerPath(dir string, id string) string {
+	return filepath.Join(dir, id)
+}
+
+// isConfigured tells the hook already configured a container: some orchestrators retry the prestart hooks, running
+// nvidia-container-cli again would mount the driver twice. The marker holds the PID of the container, a new container
+// reusing the ID of one whose poststop didn't run isn't mistaken for it.
+func isConfigured(dir string, container containerConfig) bool {
+	b, err := ioutil.ReadFile(configuredMarkerPath(dir, container.ID))
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	return err == nil && pid == container.Pid
+}
+
+// markConfigured records that the hook configured a container, once every step succeeded.
+func markConfigured(dir string, container containerConfig) {
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(configuredMarkerPath(dir, container.ID), []byte(strconv.Itoa(container.Pid)), 0644)
+	}
+	if err != nil {
+		log.Panicln("couldn't mark the container as configured:", err)
+	}
+}
+
+func clearConfigured(dir string, id string) {
+	if err := os.Remove(configuredMarkerPath(dir, id)); err != nil && !os.IsNotExist(err) {
+		log.Panicln("couldn't remove the configured marker of the container:", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Actions on the unhealthy GPUs requested by a container.
+const (
+	healthActionWarn = "warn"
+	healthActionFail = "fail"
+
+	kmsgPath = "/dev/kmsg"
+)
+
+// Fatal XIDs: double bit ECC error, GPU fallen off the bus, NVLink error, contained and uncontained ECC errors.
+var defaultHealthXIDs = []int{48, 74, 79, 94, 95}
+
+var (
+	// NVRM: Xid (PCI:0000:3b:00): 79, pid=..., GPU has fallen off the bus.
+	xidExp = regexp.MustCompile(`NVRM: Xid \(PCI:([0-9a-fA-F]+:[0-9a-fA-F]+:[0-9a-fA-F]+)\): ([0-9]+),`)
+	// Unable to determine the device handle for GPU0000:3B:00.0: GPU is lost. Reboot the system to recover this GPU
+	gpuLostExp = regexp.MustCompile(`device handle for GPU ?([0-9a-fA-F]+:[0-9a-fA-F]+:[0-9a-fA-F]+\.[0-7]): ([^.\n]*)`)
+)
+
+// readKernelXIDs returns the XIDs of the driver in the kernel log within a window, by PCI bus ID.
+func readKernelXIDs(window time.Duration) (map[string][]int, error) {
+	b, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return nil, err
+	}
+	uptime, err := strconv.ParseFloat(strings.Fields(string(b))[0], 64)
+	if err != nil {
+		return nil, err
+	}
+	since := time.Duration(uptime*float64(time.Second)) - window
+
+	f, err := os.OpenFile(kmsgPath, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	xids := make(map[string][]int)
+	buf := make([]byte, 8192)
+	for {
+		// One record per read: <level>,<sequence>,<microseconds since boot>,<flags>;<message>
+		n, err := f.Read(buf)
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EPIPE {
+			// Records overwritten while reading.
+			continue
+		} else if err != nil {
+			break
+		}
+		record := strings.SplitN(string(buf[:n]), ";", 2)
+		fields := strings.Split(record[0], ",")
+		if len(record) != 2 || len(fields) < 3 {
+			continue
+		}
+		usec, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || time.Duration(usec)*time.Microsecond < since {
+			continue
+		}
+		if m := xidExp.FindStringSubmatch(record[1]); m != nil {
+			xid, _ := strconv.Atoi(m[2])
+			id := normalizePCIBusID(m[1] + ".0")
+			xids[id] = append(xids[id], xid)
+		}
+	}
+	return xids, nil
+}
+
+// getUnhealthyGPUs returns the requested GPUs which are lost, have uncorrectable ECC errors, pages pending
+// retirement or fatal XIDs, with the reason.
+func getUnhealthyGPUs(hook HookConfig, devices string) ([]string, error) {
+	cli := hook.NvidiaContainerCLI
+	var unhealthy []string
+	gpus, err := queryGPUs(cli, "index", "uuid", "pci.bus_id", "ecc.errors.uncorrected.volatile.total", "retired_pages.pending")
+	if err != nil {
+		// nvidia-smi fails altogether on the lost GPUs.
+		lost := gpuLostExp.FindAllStringSubmatch(err.Error(), -1)
+		if lost == nil {
+			return nil, err
+		}
+		info, _ := getDriverInfo(cli)
+		for _, m := range lost {
+			id := "GPU " + m[1]
+			if info != nil {
+				for _, d := range info.Devices {
+					if normalizePCIBusID(d.BusID) == normalizePCIBusID(m[1]) {
+						if !isRequested(devices, d.Index, d.UUID) {
+							id = ""
+						} else {
+							id = d.UUID
+						}
+					}
+				}
+			}
+			if len(id) > 0 {
+				unhealthy = append(unhealthy, fmt.Sprintf("%s (%s)", id, strings.TrimSpace(m[2])))
+			}
+		}
+		return unhealthy, nil
+	}
+
+	var xids map[string][]int
+	if len(hook.Health.XIDs) > 0 {
+		if xids, err = readKernelXIDs(hook.Health.XIDWindow.Duration); err != nil {
+			warnf("couldn't read the XIDs of the kernel log: %v", err)
+		}
+	}
+	for _, g := range gpus {
+		if !isRequested(devices, g[0], g[1]) {
+			continue
+		}
+		var reasons []string
+		if n, err := strconv.Atoi(g[3]); err == nil && n > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d uncorrectable ECC errors", n))
+		}
+		if g[4] == "Yes" {
+			reasons = append(reasons, "retired pages pending, the GPU needs a reset")
+		}
+		for _, xid := range xids[normalizePCIBusID(g[2])] {
+			for _, fatal := range hook.Health.XIDs {
+				if xid == fatal {
+					reasons = append(reasons, fmt.Sprintf("Xid %d", xid))
+				}
+			}
+		}
+		if len(reasons) > 0 {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s (%s)", g[1], strings.Join(reasons, ", ")))
+		}
+	}
+	return unhealthy, nil
+}
+
+// checkGPUHealth refuses, or warns about, the unhealthy GPUs requested by a container.
+func checkGPUHealth(hook HookConfig, devices string) {
+	if hook.Health.Action != healthActionWarn && hook.Health.Action != healthActionFail {
+		fail(exitCodeBadConfig, fmt.Errorf("unknown health.action: %s, expected warn or fail", hook.Health.Action))
+	}
+	unhealthy, err := getUnhealthyGPUs(hook, devices)
+	if err != nil {
+		fail(exitCodeCLIFailure, fmt.Errorf("couldn't check the health of the GPUs: %v", err))
+	}
+	if len(unhealthy) == 0 {
+		return
+	}
+	if hook.Health.Action == healthActionFail {
+		fail(exitCodePolicy, fmt.Errorf("unhealthy GPUs requested: %s", strings.Join(unhealthy, "; ")))
+	}
+	warnf("unhealthy GPUs requested: %s", strings.Join(unhealthy, "; "))
+}
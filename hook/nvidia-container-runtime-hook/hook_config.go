@@ -1,59 +1,103 @@
 package main
 
 import (
-	"log"
-	"os"
+	"time"
 
-	"github.com/BurntSushi/toml"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/configfile"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/hookconfig"
 )
 
 const (
-	configPath = "/etc/nvidia-container-runtime/config.toml"
-)
-
-// CLIConfig: options for nvidia-container-cli.
-type CLIConfig struct {
-	Root        *string  `toml:"root"`
-	Path        *string  `toml:"path"`
-	Environment []string `toml:"environment"`
-	Debug       *string  `toml:"debug"`
-	Ldcache     *string  `toml:"ldcache"`
-	LoadKmods   bool     `toml:"load-kmods"`
-	Ldconfig    *string  `toml:"ldconfig"`
-}
+	envHookConfigPrefix = hookconfig.EnvPrefix
 
-type HookConfig struct {
-	DisableRequire bool    `toml:"disable-require"`
-	SwarmResource  *string `toml:"swarm-resource"`
-
-	// used on docker/kubernetes to make sure only mount GPU when the GPU UUIDs have been specified.
-	MountGPUOnlyByUUID bool `toml:"mount-gpu-only-by-uuid"`
+	stagePrestart        = "prestart"
+	stageCreateRuntime   = "createRuntime"
+	stageCreateContainer = "createContainer"
+)
 
-	NvidiaContainerCLI CLIConfig `toml:"nvidia-container-cli"`
-}
+// The options of the hook are shared with the tooling through the hookconfig package.
+type (
+	duration         = hookconfig.Duration
+	CLIConfig        = hookconfig.CLIConfig
+	HookConfig       = hookconfig.HookConfig
+	DriverCapability = hookconfig.DriverCapability
+	MIGConfig        = hookconfig.MIGConfig
+	PodQuotaConfig   = hookconfig.PodQuotaConfig
+	GPUModesConfig   = hookconfig.GPUModesConfig
+	HealthConfig     = hookconfig.HealthConfig
+	MetricsConfig    = hookconfig.MetricsConfig
+	AuditConfig      = hookconfig.AuditConfig
+	SharedDevice     = hookconfig.SharedDevice
+	DriverRoot       = hookconfig.DriverRoot
+)
 
 func getDefaultHookConfig() (config HookConfig) {
 	return HookConfig{
-		DisableRequire: false,
-		SwarmResource:  nil,
+		DisableRequire:            false,
+		SwarmResource:             nil,
+		Stage:                     stagePrestart,
+		Mode:                      modeLegacy,
+		CDISpecDirs:               defaultCDISpecDirs,
+		CSVDirs:                   defaultCSVDirs,
+		RequestSources:            []string{requestSourceEnv},
+		AcceptEnvvarUnprivileged:  true,
+		DeviceListMountsRoot:      defaultDeviceListMountsRoot,
+		LogLevel:                  "info",
+		LogFormat:                 logFormatText,
+		KernelModules:             defaultKernelModules,
+		MuslLinker:                muslLinkerPathFile,
+		UtilityFiles:              utilityFilesAll,
+		RDMALibraries:             defaultRDMALibraries,
+		RDMAFiles:                 defaultRDMAFiles,
+		GDSLibraries:              defaultGDSLibraries,
+		VGPULibraries:             defaultVGPULibraries,
+		GDSFiles:                  defaultGDSFiles,
+		NVSwitchLibraries:         defaultNVSwitchLibraries,
+		FabricManagerCheck:        true,
+		VideoLibraries:            defaultVideoLibraries(),
+		DefaultDriverCapabilities: defaultCapability,
+		UnsupportedCapabilities:   unsupportedCapabilitiesStrip,
+		SELinuxType:               defaultSELinuxType,
+		Parallelism:               defaultParallelism,
+		CLITimeout:                duration{Duration: defaultCLITimeout},
+		BusyRetryInterval:         duration{Duration: time.Second},
+		MPS:                       configfile.DefaultMPSConfig(),
+		PodQuota:                  PodQuotaConfig{State: defaultPodQuotaState},
+		GPUModes:                  GPUModesConfig{State: defaultGPUModesState},
+		Health:                    HealthConfig{XIDs: defaultHealthXIDs, XIDWindow: duration{Duration: time.Hour}},
+		Metrics:                   MetricsConfig{State: defaultMetricsState},
+		Audit:                     AuditConfig{MaxSize: defaultAuditMaxSize, MaxFiles: defaultAuditMaxFiles},
+		SharingState:              defaultSharingState,
+		Runtime:                   configfile.DefaultRuntimeConfig(),
 		NvidiaContainerCLI: CLIConfig{
-			Root:        nil,
-			Path:        nil,
-			Environment: []string{},
-			Debug:       nil,
-			Ldcache:     nil,
-			LoadKmods:   true,
-			Ldconfig:    nil,
+			Root:            nil,
+			Path:            nil,
+			Environment:     []string{},
+			Debug:           nil,
+			Ldcache:         nil,
+			LoadKmods:       true,
+			Ldconfig:        nil,
+			Retries:         3,
+			RetryBackoff:    duration{Duration: time.Second},
+			TransientErrors: defaultTransientErrors,
 		},
 	}
 }
 
+// unknownOptions of the configuration files, logged once the logger is set up.
+var unknownOptions []string
+
+// autoDriverErr of the auto driver root or ldconfig, logged once the logger is set up.
+var autoDriverErr error
+
+// getHookConfig decodes the configuration file, then its drop-in files on top of the defaults.
 func getHookConfig() (config HookConfig) {
 	config = getDefaultHookConfig()
-	_, err := toml.DecodeFile(configPath, &config)
-	if err != nil && !os.IsNotExist(err) {
-		log.Panicln("couldn't open configuration file:", err)
+	unknown, err := hookconfig.Load(*configflag, &config)
+	if err != nil {
+		fail(exitCodeBadConfig, err)
 	}
-
+	unknownOptions = unknown
+	autoDriverErr = resolveAutoDriver(&config.NvidiaContainerCLI, "/")
 	return config
 }
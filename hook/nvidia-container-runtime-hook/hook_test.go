@@ -1,10 +1,38 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
 	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containerd/nri/pkg/api"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/configfile"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/oci"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/allocator"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/devices"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/nvcontainer"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/policy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 func TestParseCudaVersionValid(t *testing.T) {
@@ -19,8 +47,8 @@ func TestParseCudaVersionValid(t *testing.T) {
 		{"4294967295.4294967295.4294967295", [3]uint32{4294967295, 4294967295, 4294967295}},
 	}
 	for _, c := range tests {
-		vmaj, vmin, vpatch := parseCudaVersion(c.version)
-		if vmaj != c.expected[0] || vmin != c.expected[1] || vpatch != c.expected[2] {
+		vmaj, vmin, vpatch, err := parseCudaVersion(c.version)
+		if err != nil || vmaj != c.expected[0] || vmin != c.expected[1] || vpatch != c.expected[2] {
 			t.Errorf("parseCudaVersion(%s): %d.%d.%d (containerInitInfo: %v)", c.version, vmaj, vmin, vpatch, c.expected)
 		}
 	}
@@ -55,10 +83,9 @@ func TestParseCudaVersionInvalid(t *testing.T) {
 		"-9.-1.-116",
 	}
 	for _, c := range tests {
-		mustPanic(t, func() {
-			t.Logf("parseCudaVersion(%s)", c)
-			parseCudaVersion(c)
-		})
+		if _, _, _, err := parseCudaVersion(c); err == nil {
+			t.Errorf("parseCudaVersion(%s) didn't fail", c)
+		}
 	}
 }
 
@@ -84,6 +111,16 @@ func TestGPUUUIDRegexp(t *testing.T) {
 		"GPU-1ef, ":         false,
 		"GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785":                                          true,
 		"GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785,GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8786": true,
+		"MIG-GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785/1/0":                                  true,
+		"MIG-GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785":                                      false,
+		"MIG-GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785/1":                                    false,
+		"MIG-3b1f2b6c-a8e4-5b3e-9e46-2c2f2b6fda4d":                                          true,
+		"MIG-3b1f2b6c-a8e4-5b3e-9e46-2c2f2b6fda4d,GPU-a3f":                                  true,
+		"MIG-xyz":      false,
+		"0:1":          false,
+		"0000:3b:00.0": true,
+		"00000000:3B:00.0,GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785": true,
+		"3b:00.0": false,
 	}
 
 	for str, expected := range tests {
@@ -409,14 +446,16 @@ func TestSwitchOfMountByUUID(t *testing.T) {
 			}
 		}()
 
-		s := &Spec{
-			Process: &Process{Env: t.Envs},
+		s := &oci.Spec{
+			Process: &oci.Process{Env: t.Envs},
 		}
 
-		env := getEnvMap(s.Process.Env, hook.MountGPUOnlyByUUID)
+		env, err := getEnvMap(s.Process.Env, hook.MountGPUOnlyByUUID)
+		if err != nil {
+			return nil, err
+		}
 		envSwarmGPU = hook.SwarmResource
-		nvidiaConfig = getNvidiaConfig(env, hook.MountGPUOnlyByUUID)
-		return nvidiaConfig, e
+		return getNvidiaConfig(env, hook.MountGPUOnlyByUUID)
 	}
 
 	runTest := func(mountGPUOnlyByUUID bool, c *testCase, cii *containerInitInfo) {
@@ -444,3 +483,3205 @@ func TestSwitchOfMountByUUID(t *testing.T) {
 		runTest(true, c, c.ExpectedForOn)
 	}
 }
+
+func TestGetSwarmDevices(t *testing.T) {
+	resources := "DOCKER_RESOURCE_GPU, DOCKER_RESOURCE_NVIDIA-GPU"
+	envSwarmGPU = &resources
+	defer func() { envSwarmGPU = nil }()
+
+	var tests = []struct {
+		env      map[string]string
+		expected string
+	}{
+		{map[string]string{"DOCKER_RESOURCE_GPU": "GPU-1", envNVGPU: "all"}, "GPU-1"},
+		{map[string]string{"DOCKER_RESOURCE_NVIDIA-GPU": "GPU-2,GPU-3", "DOCKER_RESOURCE_GPU": "GPU-3,GPU-1"}, "GPU-3,GPU-1,GPU-2"},
+		{map[string]string{"DOCKER_RESOURCE_GPU": ""}, ""},
+		{map[string]string{envNVGPU: "0"}, "0"},
+		{map[string]string{"DOCKER_RESOURCE_GPU_10": "GPU-4", "DOCKER_RESOURCE_GPU_2": "GPU-2,GPU-3", "DOCKER_RESOURCE_GPU": "GPU-1"}, "GPU-1,GPU-2,GPU-3,GPU-4"},
+		{map[string]string{"DOCKER_RESOURCE_GPU_1": "GPU-1", "DOCKER_RESOURCE_GPU_X": "GPU-2"}, "GPU-1"},
+	}
+	for _, c := range tests {
+		devices, err := getDevices(c.env, false)
+		if err != nil || devices == nil || *devices != c.expected {
+			t.Errorf("getDevices(%v): expected %q got %v (%v)", c.env, c.expected, devices, err)
+		}
+	}
+}
+
+func TestAllocatedDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allocations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pod := "0b6a3b7a-6a8b-4a4e-9c5e-5f2b1c1d8e3f"
+	ioutil.WriteFile(path.Join(dir, pod+".json"), []byte(`{"containers": {"cuda": ["GPU-1", "GPU-2"]}}`), 0644)
+
+	var tests = []struct {
+		pod         string
+		annotations map[string]string
+		expected    string
+	}{
+		{pod, map[string]string{"io.kubernetes.cri.container-name": "cuda"}, "GPU-1,GPU-2"},
+		{pod, map[string]string{"io.kubernetes.container.name": "sidecar"}, ""},
+		{"8c5f2a1e-0d3b-4b6f-a1e2-3c4d5e6f7a8b", map[string]string{"io.kubernetes.cri.container-name": "cuda"}, ""},
+	}
+	for _, c := range tests {
+		devices, err := getAllocatedDevices(dir, c.pod, c.annotations)
+		if err != nil || devices != c.expected {
+			t.Errorf("expected %q got %q (%v)", c.expected, devices, err)
+		}
+	}
+	if _, err := getAllocatedDevices(dir, pod, nil); err == nil {
+		t.Error("expected an error without the name of the container")
+	}
+}
+
+func TestRawDeviceMounts(t *testing.T) {
+	hook := getDefaultHookConfig()
+	hook.MountGPUOnlyByUUID = true
+	s := &oci.Spec{
+		Process: &oci.Process{},
+		Mounts:  []oci.Mount{{Destination: "/dev/nvidia0", Source: "/dev/nvidia0"}, {Destination: "/data", Source: "/dev/null"}},
+		Linux:   &oci.Linux{Devices: []oci.LinuxDevice{{Path: "/dev/nvidiactl"}, {Path: "/dev/fuse"}}},
+	}
+	err := checkRawDeviceMounts(hook, s)
+	if e, ok := err.(*hookError); !ok || e.code != exitCodePolicy || !strings.Contains(e.Error(), "/dev/nvidia0, /dev/nvidiactl") {
+		t.Fatalf("expected the raw device mounts rejected, got %v", err)
+	}
+	if err := checkRawDeviceMounts(hook, &oci.Spec{Process: &oci.Process{}, Mounts: []oci.Mount{{Destination: "/dev", Source: "/dev/../dev"}}}); err == nil {
+		t.Fatal("expected a mount of /dev rejected")
+	}
+	hook.RawDeviceMounts = rawDeviceMountsAllow
+	if err := checkRawDeviceMounts(hook, s); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hook.RawDeviceMounts, hook.MountGPUOnlyByUUID = "", false
+	if err := checkRawDeviceMounts(hook, s); err != nil {
+		t.Fatalf("unexpected error without mount-gpu-only-by-uuid: %v", err)
+	}
+	hook.RawDeviceMounts = "strip"
+	if err := checkRawDeviceMounts(hook, s); err == nil {
+		t.Fatal("expected an unknown policy rejected")
+	}
+}
+
+func TestCheckMIGManagement(t *testing.T) {
+	hook := getDefaultHookConfig()
+	if err := checkMIGManagement(hook, &nvidiaConfig{Devices: "all"}, false); err != nil {
+		t.Errorf("unexpected error without MIG management: %v", err)
+	}
+	nvidia := &nvidiaConfig{Devices: "all", MIGConfigDevices: "all", MIGMonitorDevices: "0"}
+	if err := checkMIGManagement(hook, nvidia, true); err == nil {
+		t.Errorf("expected an error without allow-mig-management")
+	}
+	hook.AllowMIGManagement = true
+	if err := checkMIGManagement(hook, nvidia, false); err == nil {
+		t.Errorf("expected an error for an unprivileged container")
+	}
+	if err := checkMIGManagement(hook, nvidia, true); err != nil {
+		t.Errorf("unexpected error for a privileged container: %v", err)
+	}
+}
+
+func TestExportDevices(t *testing.T) {
+	info := &driverInfo{Devices: []deviceInfo{{Index: "0", UUID: "GPU-0ef"}, {Index: "1", UUID: "GPU-1ef"}}}
+	for devices, expected := range map[string]string{
+		"1":               "GPU-1ef",
+		"all":             "GPU-0ef,GPU-1ef",
+		"0,MIG-1ef/1/0":   "GPU-0ef,MIG-1ef/1/0",
+		"GPU-1ef,1:0":     "GPU-1ef,1:0",
+		"GPU-0ef,GPU-1ef": "GPU-0ef,GPU-1ef",
+	} {
+		if resolved := info.ResolveIndexes(devices); resolved != expected {
+			t.Errorf("resolveIndexes(%s): expected %s got %s", devices, expected, resolved)
+		}
+	}
+
+	spec := map[string]interface{}{"process": map[string]interface{}{"env": []interface{}{"PATH=/bin", envNVGPU + "=0", envNVGPU + "=1"}}}
+	setSpecEnv(spec, envNVGPU, "GPU-1ef")
+	env := spec["process"].(map[string]interface{})["env"]
+	if !reflect.DeepEqual(env, []interface{}{"PATH=/bin", envNVGPU + "=GPU-1ef"}) {
+		t.Errorf("unexpected environment %v", env)
+	}
+}
+
+func TestPCIBusIDs(t *testing.T) {
+	for _, d := range []string{"0,0000:3b:00.0", "00000000:3B:00.0", "GPU-83d7ced8,0:1"} {
+		if err := validatePCIBusIDs(d); err != nil {
+			t.Errorf("validatePCIBusIDs(%s): %v", d, err)
+		}
+	}
+	for _, d := range []string{"3b:00.0", "0000:3b:00", "0000:3g:00.0", "0000:3b:00.8", "0:1.0"} {
+		if err := validatePCIBusIDs(d); err == nil {
+			t.Errorf("validatePCIBusIDs(%s) didn't fail", d)
+		}
+	}
+	if _, err := getDevices(map[string]string{envNVGPU: "0000:3b:00"}, false); err == nil {
+		t.Errorf("getDevices didn't reject a malformed PCI bus ID")
+	}
+	for id, expected := range map[string]string{"0000:3B:00.0": "00000000:3b:00.0", "00000000:3b:00.0": "00000000:3b:00.0"} {
+		if n := normalizePCIBusID(id); n != expected {
+			t.Errorf("normalizePCIBusID(%s): expected %s got %s", id, expected, n)
+		}
+	}
+}
+
+func TestGetDeviceNodes(t *testing.T) {
+	f, err := ioutil.TempFile("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "Character devices:\n  1 mem\n195 nvidia-frontend\n508 nvidia-uvm\n\nBlock devices:\n  8 sd\n")
+	f.Close()
+
+	majors := getDeviceMajors(f.Name())
+	if majors["nvidia-uvm"] != 508 || majors["nvidia-frontend"] != 195 {
+		t.Fatalf("unexpected majors: %v", majors)
+	}
+	if _, ok := majors["sd"]; ok {
+		t.Fatalf("block device parsed as character device: %v", majors)
+	}
+
+	expected := []deviceNode{
+		{Path: "/dev/nvidiactl", Major: 195, Minor: 255},
+		{Path: "/dev/nvidia-modeset", Major: 195, Minor: 254},
+		{Path: "/dev/nvidia0", Major: 195, Minor: 0},
+		{Path: "/dev/nvidia1", Major: 195, Minor: 1},
+		{Path: "/dev/nvidia-uvm", Major: 508, Minor: 0},
+		{Path: "/dev/nvidia-uvm-tools", Major: 508, Minor: 1},
+	}
+	if nodes := devices.Nodes(majors, []uint32{0, 1}); !reflect.DeepEqual(nodes, expected) {
+		t.Fatalf("expected %v got %v", expected, nodes)
+	}
+	if nodes := devices.Nodes(map[string]uint32{}, []uint32{0}); nodes != nil {
+		t.Fatalf("expected no nodes without the kernel module, got %v", nodes)
+	}
+}
+
+func TestKernelModules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kmods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { sysModulePath = p }(sysModulePath)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	sysModulePath = path.Join(dir, "module")
+	os.MkdirAll(path.Join(sysModulePath, "nvidia_uvm"), 0755)
+	root := path.Join(dir, "root")
+	os.MkdirAll(path.Join(root, "sbin"), 0755)
+	ioutil.WriteFile(path.Join(root, "sbin/modprobe"), []byte("#!/bin/sh\necho \"modprobe: FATAL: Module $1 not found\" >&2\nexit 1\n"), 0755)
+	empty := path.Join(dir, "empty")
+
+	var tests = []struct {
+		modules []string
+		root    string
+		output  string
+		loadErr string
+	}{
+		{[]string{"nvidia-uvm"}, empty, "verify-kmods             OK\n", ""},
+		{[]string{"nvidia_uvm", "nvidia"}, root, "verify-kmods             FAIL: kernel modules not loaded: nvidia\n", "couldn't load kernel module nvidia: exit status 1: modprobe: FATAL: Module nvidia not found"},
+		{[]string{"nvidia_modeset"}, empty, "verify-kmods             FAIL: kernel modules not loaded: nvidia_modeset\n", "couldn't find binary modprobe"},
+	}
+	for _, c := range tests {
+		hook := getDefaultHookConfig()
+		hook.KernelModules = c.modules
+		hook.NvidiaContainerCLI.Root = &c.root
+		if c.root == empty && len(c.loadErr) > 0 {
+			// The lookup falls back to the directories of the node.
+			os.Setenv("PATH", "")
+			os.Setenv("PATH", getPATH(hook.NvidiaContainerCLI))
+			if _, err := exec.LookPath("modprobe"); err == nil {
+				t.Log("skipping the missing modprobe case, the node has one")
+				continue
+			}
+		}
+
+		var out bytes.Buffer
+		if ok := runChecks(&out, hook, checks[:1]); out.String() != c.output || ok != strings.HasSuffix(c.output, "OK\n") {
+			t.Errorf("validate %v: expected %q got %q (%v)", c.modules, c.output, out.String(), ok)
+		}
+		err := runCheck(check{"load-kmods", func(hook HookConfig) error {
+			loadKernelModules(hook)
+			return nil
+		}}, hook)
+		if len(c.loadErr) == 0 && err != nil || len(c.loadErr) > 0 && (err == nil || !strings.Contains(err.Error(), c.loadErr)) {
+			t.Errorf("loadKernelModules(%v): expected %q got %v", c.modules, c.loadErr, err)
+		}
+	}
+}
+
+func TestConfigureDeviceNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := devices.Mknod(path.Join(dir, "probe"), nvidiaMajor, nvidiaModesetMinor); err != nil {
+		t.Skip("can't create device nodes:", err)
+	}
+	defer func(root, cgroup string) { cgroupDevicesRoot, procCgroupPath = root, cgroup }(cgroupDevicesRoot, procCgroupPath)
+	cgroupDevicesRoot, procCgroupPath = path.Join(dir, "devices"), path.Join(dir, "cgroup-%d")
+	cgroup := path.Join(cgroupDevicesRoot, "docker/gpu")
+	os.MkdirAll(cgroup, 0755)
+	ioutil.WriteFile(fmt.Sprintf(procCgroupPath, os.Getpid()), []byte("12:devices:/docker/gpu\n"), 0644)
+	rootfs := path.Join(dir, "rootfs")
+	os.MkdirAll(path.Join(rootfs, "dev"), 0755)
+	container := containerConfig{Pid: os.Getpid(), Rootfs: rootfs}
+
+	inject, remove := true, false
+	configureDeviceNodes(HookConfig{InjectModeset: &inject}, container)
+	node := path.Join(rootfs, "dev/nvidia-modeset")
+	if major, minor, err := deviceNumbers(node); err != nil || major != nvidiaMajor || minor != nvidiaModesetMinor {
+		t.Fatalf("expected %s to be 195:254, got %d:%d (%v)", node, major, minor, err)
+	}
+	if info, err := os.Stat(node); err != nil || info.Mode().Perm() != 0666 {
+		t.Errorf("unexpected mode of %s: %v", node, info.Mode())
+	}
+	if b, _ := ioutil.ReadFile(path.Join(cgroup, "devices.allow")); string(b) != "c 195:254 rw" {
+		t.Errorf("unexpected devices.allow rule %q", b)
+	}
+	if entries, _ := ioutil.ReadDir(path.Join(rootfs, "dev")); len(entries) != 1 {
+		t.Errorf("expected only the modeset node, got %d nodes", len(entries))
+	}
+
+	// The device nodes of nvidia-container-cli are bind mounts, they're unmounted in the container first.
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	root := path.Join(dir, "root")
+	os.MkdirAll(path.Join(root, "usr/bin"), 0755)
+	nsenter := path.Join(root, "usr/bin/nsenter")
+	calls := path.Join(dir, "nsenter.log")
+	ioutil.WriteFile(nsenter, []byte("#!/bin/sh\necho \"$@\" >>'"+calls+"'\n"), 0755)
+	hook := HookConfig{InjectModeset: &remove}
+	hook.NvidiaContainerCLI.Root = &root
+
+	configureDeviceNodes(hook, container)
+	if _, err := os.Lstat(node); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed: %v", node, err)
+	}
+	if b, _ := ioutil.ReadFile(calls); string(b) != fmt.Sprintf("--target %d --mount umount %s/dev/nvidia-modeset\n", os.Getpid(), rootfs) {
+		t.Errorf("unexpected nsenter calls %q", b)
+	}
+	if b, _ := ioutil.ReadFile(path.Join(cgroup, "devices.deny")); string(b) != "c 195:254 rw" {
+		t.Errorf("unexpected devices.deny rule %q", b)
+	}
+
+	// A node the hook created isn't mounted.
+	configureDeviceNodes(HookConfig{InjectModeset: &inject}, container)
+	ioutil.WriteFile(nsenter, []byte("#!/bin/sh\necho \"umount: $5: not mounted.\" >&2\nexit 32\n"), 0755)
+	configureDeviceNodes(hook, container)
+	if _, err := os.Lstat(node); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed: %v", node, err)
+	}
+
+	// A node which couldn't be unmounted is kept.
+	configureDeviceNodes(HookConfig{InjectModeset: &inject}, container)
+	ioutil.WriteFile(nsenter, []byte("#!/bin/sh\necho \"umount: $5: target is busy.\" >&2\nexit 32\n"), 0755)
+	mustPanic(t, func() { configureDeviceNodes(hook, container) })
+	if _, err := os.Lstat(node); err != nil {
+		t.Errorf("expected %s to be kept: %v", node, err)
+	}
+}
+
+func TestResolveContainerPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(root, cgroup string) { cgroupDevicesRoot, procCgroupPath = root, cgroup }(cgroupDevicesRoot, procCgroupPath)
+	cgroupDevicesRoot, procCgroupPath = path.Join(dir, "devices"), path.Join(dir, "cgroup-%d")
+	os.MkdirAll(path.Join(cgroupDevicesRoot, "gpu"), 0755)
+	ioutil.WriteFile(fmt.Sprintf(procCgroupPath, os.Getpid()), []byte("12:devices:/gpu\n"), 0644)
+
+	// The /dev of the image leads to a directory of the host.
+	host := path.Join(dir, "host")
+	os.MkdirAll(host, 0755)
+	ioutil.WriteFile(path.Join(host, "nvidia-modeset"), nil, 0644)
+	rootfs := path.Join(dir, "rootfs")
+	os.MkdirAll(rootfs, 0755)
+	os.Symlink(host, path.Join(rootfs, "dev"))
+	container := containerConfig{Pid: os.Getpid(), Rootfs: rootfs}
+
+	root := path.Join("/proc", fmt.Sprint(os.Getpid()), "root", rootfs)
+	if p := containerPath(container, "/dev"); p != path.Join(root, "dev") {
+		t.Errorf("containerPath: unexpected %s", p)
+	}
+	p, err := resolveContainerPath(container, "/dev/nvidia-modeset")
+	if err != nil || p != path.Join(root, host, "nvidia-modeset") {
+		t.Errorf("resolveContainerPath: unexpected %s (%v)", p, err)
+	}
+	removeContainerDevice(CLIConfig{}, container, deviceNode{Path: "/dev/nvidia-modeset", Major: nvidiaMajor, Minor: nvidiaModesetMinor})
+	if _, err := os.Stat(path.Join(host, "nvidia-modeset")); err != nil {
+		t.Errorf("a file of the host was removed: %v", err)
+	}
+}
+
+func TestRemoveContainerFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rootfs := path.Join(dir, "root fs")
+	os.MkdirAll(path.Join(rootfs, "usr/lib64"), 0755)
+	ioutil.WriteFile(path.Join(rootfs, "usr/lib64/libnvidia-fbc.so.1"), nil, 0644)
+	container := containerConfig{Pid: os.Getpid(), Rootfs: rootfs}
+
+	defer func(p string) { procMountInfoPath = p }(procMountInfoPath)
+	procMountInfoPath = path.Join(dir, "mountinfo-%d")
+	escaped := strings.Replace(rootfs, " ", "\\040", -1)
+	ioutil.WriteFile(fmt.Sprintf(procMountInfoPath, os.Getpid()), []byte(
+		"22 1 8:1 / / rw - ext4 /dev/sda1 rw\n"+
+			"40 22 8:1 /var/lib/rootfs "+escaped+" rw - ext4 /dev/sda1 rw\n"+
+			"41 40 8:1 /usr/lib64/libcuda.so.1 "+escaped+"/usr/lib64/libcuda.so.1 ro - ext4 /dev/sda1 rw\n"+
+			"42 22 0:5 / /dev rw - devtmpfs udev rw\n"), 0644)
+
+	mounts, err := getContainerMountPoints(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mounts, map[string]bool{"/": true, "/usr/lib64/libcuda.so.1": true}) {
+		t.Errorf("getContainerMountPoints: unexpected %v", mounts)
+	}
+
+	// The library of the image isn't a mount point, it is kept.
+	removeContainerFiles(CLIConfig{}, container, []string{"/usr/lib64/libnvidia-fbc.so.1", "/usr/lib64/libnvidia-ifr.so.1"})
+	if _, err := os.Stat(path.Join(rootfs, "usr/lib64/libnvidia-fbc.so.1")); err != nil {
+		t.Errorf("the library of the image was removed: %v", err)
+	}
+}
+
+func TestConfigureMuslLinker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "musl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	host := path.Join(dir, "host")
+	os.MkdirAll(host, 0755)
+	ioutil.WriteFile(path.Join(host, "passwd"), []byte("root:x:0:0\n"), 0644)
+	rootfs := path.Join(dir, "rootfs")
+	os.MkdirAll(path.Join(rootfs, "etc"), 0755)
+	os.MkdirAll(path.Join(rootfs, "usr/lib"), 0755)
+	ioutil.WriteFile(path.Join(rootfs, "usr/lib/libcuda.so.1"), nil, 0644)
+	// The path file of the image leads to a file of the host.
+	os.Symlink(path.Join(host, "passwd"), path.Join(rootfs, "etc/ld-musl-x86_64.path"))
+
+	configureMuslLinker(containerConfig{Pid: os.Getpid(), Rootfs: rootfs}, "x86_64")
+	if b, _ := ioutil.ReadFile(path.Join(host, "passwd")); string(b) != "root:x:0:0\n" {
+		t.Errorf("a file of the host was written: %q", b)
+	}
+	if b, _ := ioutil.ReadFile(path.Join(rootfs, "etc/ld-musl-x86_64.path")); string(b) != "/lib\n/usr/local/lib\n/usr/lib\n" {
+		t.Errorf("unexpected path file %q", b)
+	}
+}
+
+func TestCopyLicenseFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vgpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { gridLicenseDir = d }(gridLicenseDir)
+	gridLicenseDir = path.Join(dir, "guest/etc/nvidia")
+	os.MkdirAll(gridLicenseDir, 0755)
+	ioutil.WriteFile(path.Join(gridLicenseDir, "gridd.conf"), []byte("FeatureType=1\n"), 0644)
+	host := path.Join(dir, "host")
+	os.MkdirAll(host, 0755)
+	ioutil.WriteFile(path.Join(host, "gridd.conf"), []byte("host\n"), 0644)
+	rootfs := path.Join(dir, "rootfs")
+	os.MkdirAll(path.Dir(path.Join(rootfs, gridLicenseDir)), 0755)
+	// The license directory of the image leads to a directory of the host.
+	os.Symlink(host, path.Join(rootfs, gridLicenseDir))
+
+	copyLicenseFiles(containerConfig{Pid: os.Getpid(), Rootfs: rootfs})
+	if b, _ := ioutil.ReadFile(path.Join(host, "gridd.conf")); string(b) != "host\n" {
+		t.Errorf("a file of the host was written: %q", b)
+	}
+	if b, _ := ioutil.ReadFile(path.Join(rootfs, host, "gridd.conf")); string(b) != "FeatureType=1\n" {
+		t.Errorf("unexpected license file %q", b)
+	}
+}
+
+func TestAppendMuslLibraryPath(t *testing.T) {
+	tests := []struct {
+		content  string
+		dirs     []string
+		expected string
+	}{
+		{"", []string{"/usr/lib64"}, "/lib\n/usr/local/lib\n/usr/lib\n/usr/lib64\n"},
+		{"/lib:/usr/lib\n", []string{"/usr/lib64"}, "/lib\n/usr/lib\n/usr/lib64\n"},
+		{"/lib\n/usr/lib64\n", []string{"/usr/lib64", "/usr/lib"}, "/lib\n/usr/lib64\n/usr/lib\n"},
+	}
+	for _, c := range tests {
+		if r := appendMuslLibraryPath(c.content, c.dirs); r != c.expected {
+			t.Errorf("appendMuslLibraryPath(%q, %v): expected %q got %q", c.content, c.dirs, c.expected, r)
+		}
+	}
+}
+
+func TestParseQueryOutput(t *testing.T) {
+	rows, err := devices.ParseQueryOutput("GPU-1ef, VGPU\nGPU-2ef, Pass-Through\n\n", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"GPU-1ef", "VGPU"}, {"GPU-2ef", "Pass-Through"}}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("expected %v got %v", expected, rows)
+	}
+
+	if _, err := devices.ParseQueryOutput("GPU-1ef\n", 2); err == nil {
+		t.Fatal("expected an error for a missing field")
+	}
+}
+
+func TestParseDriverInfo(t *testing.T) {
+	out := "NVRM version,CUDA version\n460.32.03,11.2\n\n" +
+		"Device Index,Device Minor,Model,Brand,GPU UUID,Bus Location,Architecture\n" +
+		"0,0,Tesla T4,Tesla,GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785,00000000:00:1e.0,7.5\n"
+	info, err := devices.ParseDriverInfo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &driverInfo{
+		DriverVersion: "460.32.03",
+		CUDAVersion:   "11.2",
+		Devices: []deviceInfo{
+			{Index: "0", Minor: "0", Model: "Tesla T4", Brand: "Tesla", UUID: "GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785", BusID: "00000000:00:1e.0", Architecture: "7.5"},
+		},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("expected %#v got %#v", expected, info)
+	}
+
+	if _, err := devices.ParseDriverInfo("garbage"); err == nil {
+		t.Fatal("expected an error for invalid output")
+	}
+}
+
+func TestGrantedDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "config.json"), []byte(`{"ociVersion": "1.0.0", "process": {"env": []}, "root": {"path": "rootfs"}}`), 0644)
+	cli := getDefaultHookConfig().NvidiaContainerCLI
+	cli.Retries = 0
+	fake := path.Join(dir, "nvidia-container-cli")
+	ioutil.WriteFile(fake, []byte("#!/bin/sh\n"+
+		"echo 'NVRM version,CUDA version'; echo '460.32.03,11.2'; echo\n"+
+		"echo 'Device Index,Device Minor,Model,Brand,GPU UUID,Bus Location,Architecture'\n"+
+		"echo '0,0,Tesla T4,Tesla,GPU-1ef,00000000:00:1e.0,7.5'\n"+
+		"echo '1,1,Tesla T4,Tesla,GPU-2ef,00000000:00:1f.0,7.5'\n"), 0755)
+	cli.Path = &fake
+
+	container := containerConfig{Bundle: dir, Nvidia: &nvidiaConfig{Devices: "1"}}
+	recordGrantedDevices(cli, container)
+	s, err := oci.LoadSpec(path.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Annotations[grantedDevicesAnnotation] != "GPU-2ef" {
+		t.Fatalf("expected GPU-2ef recorded, got %v", s.Annotations)
+	}
+
+	// The annotations are the user's: a container created with them isn't restored.
+	hook := getDefaultHookConfig()
+	hook.CheckpointRestore = true
+	container.Annotations = map[string]string{restoreAnnotation: "true", grantedDevicesAnnotation: "GPU-1ef"}
+	expectPolicyFailure := func(name string, f func()) {
+		defer func() {
+			if e, ok := recover().(*hookError); !ok || e.code != exitCodePolicy {
+				t.Errorf("%s: expected a policy failure, got %v", name, e)
+			}
+		}()
+		f()
+	}
+	expectPolicyFailure("forged restore", func() { isRestore(hook, container) })
+
+	defer func(restore bool) { *restoreflag = restore }(*restoreflag)
+	*restoreflag = true
+	mustPanic(t, func() { isRestore(getDefaultHookConfig(), container) })
+	if !isRestore(hook, container) {
+		t.Fatal("expected a restore")
+	}
+
+	// The recorded GPUs are checked like a request.
+	tests := []struct {
+		name    string
+		granted string
+		denied  []string
+		held    bool
+	}{
+		{"unrequested", "GPU-1ef", nil, false},
+		{"denied", "GPU-2ef", []string{"GPU-2ef"}, false},
+		{"held", "GPU-2ef", nil, true},
+	}
+	for _, c := range tests {
+		hook := getDefaultHookConfig()
+		hook.DeniedDevices = c.denied
+		if c.held {
+			ledger := path.Join(dir, "ledger.json")
+			if err := holdContainerGPUs(ledger, "other", os.Getpid(), []string{"GPU-2ef"}, "", false, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+			hook.Ledger, hook.ExclusiveGPUs = &ledger, true
+		}
+		container.Annotations = map[string]string{grantedDevicesAnnotation: c.granted}
+		expectPolicyFailure(c.name, func() { restoreContainerDevices(hook, cli, container) })
+	}
+	container.Annotations = map[string]string{grantedDevicesAnnotation: "GPU-2ef,GPU-3ef"}
+	mustPanic(t, func() { restoreContainerDevices(getDefaultHookConfig(), cli, container) })
+}
+
+func TestConfiguredMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configured")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	container := containerConfig{ID: "ctr", Pid: 42}
+	if isConfigured(dir, container) {
+		t.Fatal("expected a new container not configured")
+	}
+	markConfigured(dir, container)
+	if !isConfigured(dir, container) {
+		t.Fatal("expected the container configured")
+	}
+	if isConfigured(dir, containerConfig{ID: "ctr", Pid: 43}) {
+		t.Fatal("expected a new container reusing the ID not configured")
+	}
+	clearConfigured(dir, container.ID)
+	clearConfigured(dir, container.ID)
+	if isConfigured(dir, container) {
+		t.Fatal("expected the marker removed")
+	}
+}
+
+func TestRunPostConfigure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "post-configure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// ok records its stdin and the environment of the container, fail exits 1.
+	ok := path.Join(dir, "ok")
+	ioutil.WriteFile(ok, []byte("#!/bin/sh\ncat > "+dir+"/state.json\n"+
+		"echo \"$NVIDIA_CONTAINER_PID $NVIDIA_CONTAINER_ROOTFS $NVIDIA_VISIBLE_DEVICES $NVIDIA_DRIVER_CAPABILITIES\" >> "+dir+"/env\n"), 0755)
+	fail := path.Join(dir, "fail")
+	ioutil.WriteFile(fail, []byte("#!/bin/sh\nexit 1\n"), 0755)
+
+	container := containerConfig{
+		ID:     "ctr",
+		Pid:    42,
+		Bundle: "/run/bundle",
+		Nvidia: &nvidiaConfig{Devices: "0,1", Capabilities: "compute,utility"},
+	}
+	var tests = []struct {
+		description string
+		executables []string
+		runs        int
+		shouldPanic bool
+	}{
+		{"none", nil, 0, false},
+		{"one", []string{ok}, 1, false},
+		{"in order", []string{ok, ok}, 2, false},
+		{"failure", []string{fail, ok}, 0, true},
+		{"not found", []string{path.Join(dir, "missing")}, 0, true},
+	}
+	for _, tc := range tests {
+		os.Remove(path.Join(dir, "env"))
+		hook := getDefaultHookConfig()
+		hook.PostConfigure = tc.executables
+		if tc.shouldPanic {
+			mustPanic(t, func() { runPostConfigure(hook, container, "/rootfs") })
+		} else {
+			runPostConfigure(hook, container, "/rootfs")
+		}
+
+		b, _ := ioutil.ReadFile(path.Join(dir, "env"))
+		if string(b) != strings.Repeat("42 /rootfs 0,1 compute,utility\n", tc.runs) {
+			t.Errorf("%s: expected %d runs with the container environment, got %q", tc.description, tc.runs, b)
+		}
+	}
+
+	b, err := ioutil.ReadFile(path.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state postConfigureState
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	expected := postConfigureState{ID: "ctr", Pid: 42, Bundle: "/run/bundle", Rootfs: "/rootfs", Nvidia: container.Nvidia}
+	if !reflect.DeepEqual(state, expected) {
+		t.Errorf("expected the state %+v on stdin, got %+v", expected, state)
+	}
+}
+
+func TestOCIHooks(t *testing.T) {
+	defer func(c string) { *configflag = c }(*configflag)
+	*configflag = "/etc/gpu.toml"
+	hook := getDefaultHookConfig()
+	hooks := getOCIHooks(hook, "/usr/bin/nvidia-container-runtime-hook", false)
+	prestart := hooks["oci-nvidia-hook.json"]
+	if !prestart.When.Always || !reflect.DeepEqual(prestart.Stages, []string{"prestart"}) ||
+		!reflect.DeepEqual(prestart.Hook.Args, []string{"/usr/bin/nvidia-container-runtime-hook", "-config", "/etc/gpu.toml", "prestart"}) {
+		t.Fatalf("unexpected prestart hook %+v", prestart)
+	}
+	if poststop := hooks["oci-nvidia-hook-poststop.json"]; poststop.Hook.Args[3] != "poststop" || poststop.Stages[0] != "poststop" {
+		t.Fatalf("unexpected poststop hook %+v", poststop)
+	}
+
+	hook.Stage = stageCreateContainer
+	prestart = getOCIHooks(hook, "/usr/bin/nvidia-container-runtime-hook", true)["oci-nvidia-hook.json"]
+	if prestart.When.Always || prestart.When.Annotations[`^com\.nvidia\.devices$`] != ".+" || prestart.Stages[0] != "createContainer" {
+		t.Fatalf("unexpected createContainer hook %+v", prestart)
+	}
+}
+
+func TestLXCEnv(t *testing.T) {
+	f, err := ioutil.TempFile("", "lxc.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "lxc.uts.name = gpu\nlxc.environment = NVIDIA_VISIBLE_DEVICES=0\nlxc.environment=NVIDIA_DRIVER_CAPABILITIES=compute\n")
+	f.Close()
+
+	env, err := getLXCEnv(f.Name(), []string{"PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{envNVGPU: "1", envNVDriverCapabilities: "compute"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected %v got %v", expected, env)
+	}
+	if _, err := getLXCEnv(f.Name()+".missing", nil); err == nil {
+		t.Fatal("missing LXC configuration read")
+	}
+
+	container := containerConfig{Rootfs: "/var/lib/lxc/gpu/rootfs", Nvidia: &nvidiaConfig{Devices: "1"}}
+	cli := getDefaultHookConfig().NvidiaContainerCLI
+	p := "/usr/bin/nvidia-container-cli"
+	cli.Path = &p
+	args := getCLIArgs(getDefaultHookConfig(), cli, container, "")
+	if strings.Contains(strings.Join(args, " "), "--pid") || args[len(args)-1] != container.Rootfs {
+		t.Fatalf("unexpected arguments %v", args)
+	}
+}
+
+func TestApptainerManifest(t *testing.T) {
+	files := []string{"/dev/nvidiactl", "/dev/nvidia0", "/usr/bin/nvidia-smi", "/lib/missing/libcuda.so.460.32.03", "/run/nvidia-persistenced/socket", ""}
+	m := getApptainerManifest(files, &nvidiaConfig{Devices: "0", Capabilities: "compute,utility"})
+	expected := apptainerManifest{
+		Binds: []apptainerBind{
+			{"/usr/bin/nvidia-smi", "/usr/bin/nvidia-smi"},
+			{"/lib/missing/libcuda.so.460.32.03", "/.singularity.d/libs/libcuda.so.460.32.03"},
+			{"/run/nvidia-persistenced/socket", "/run/nvidia-persistenced/socket"},
+		},
+		Devices: []string{"/dev/nvidiactl", "/dev/nvidia0"},
+		Env:     map[string]string{envNVGPU: "0", envNVDriverCapabilities: "compute,utility"},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Fatalf("expected %+v got %+v", expected, m)
+	}
+}
+
+func TestProbeDriverRoot(t *testing.T) {
+	host, err := ioutil.TempDir("", "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(host)
+	touch := func(p string) {
+		os.MkdirAll(path.Join(host, path.Dir(p)), 0755)
+		ioutil.WriteFile(path.Join(host, p), nil, 0644)
+	}
+
+	if _, err := probeDriverRoot(host); err == nil {
+		t.Errorf("probeDriverRoot: expected an error without driver")
+	}
+	touch("usr/lib/x86_64-linux-gnu/libnvidia-ml.so.460.32.03")
+	if root, err := probeDriverRoot(host); err != nil || root != "/" {
+		t.Errorf("probeDriverRoot: expected / got %q %v", root, err)
+	}
+	// A stale driver container doesn't win over the host one of the kernel module.
+	touch("run/nvidia/driver/usr/lib64/libnvidia-ml.so.535.104.05")
+	touch("proc/driver/nvidia/version")
+	ioutil.WriteFile(path.Join(host, "proc/driver/nvidia/version"), []byte("NVRM version: NVIDIA UNIX x86_64 Kernel Module  460.32.03  Sun Dec 27 19:00:34 UTC 2020\n"), 0644)
+	if root, err := probeDriverRoot(host); err != nil || root != "/" {
+		t.Errorf("probeDriverRoot: expected / got %q %v", root, err)
+	}
+	touch("home/kubernetes/bin/nvidia/lib64/libnvidia-ml.so.460.32.03")
+	if root, err := probeDriverRoot(host); err != nil || root != "/home/kubernetes/bin/nvidia" {
+		t.Errorf("probeDriverRoot: expected /home/kubernetes/bin/nvidia got %q %v", root, err)
+	}
+
+	if _, err := probeLdconfig(host); err == nil {
+		t.Errorf("probeLdconfig: expected an error without ldconfig")
+	}
+	touch("sbin/ldconfig")
+	touch("sbin/ldconfig.real")
+	if ldconfig, err := probeLdconfig(host); err != nil || ldconfig != "@/sbin/ldconfig.real" {
+		t.Errorf("probeLdconfig: expected @/sbin/ldconfig.real got %q %v", ldconfig, err)
+	}
+}
+
+func TestResolveAutoDriver(t *testing.T) {
+	host, err := ioutil.TempDir("", "driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(host)
+	touch := func(p string) {
+		os.MkdirAll(path.Join(host, path.Dir(p)), 0755)
+		ioutil.WriteFile(path.Join(host, p), nil, 0644)
+	}
+	auto := func() CLIConfig {
+		root, ldconfig := autoDriverValue, autoDriverValue
+		return CLIConfig{Root: &root, Ldconfig: &ldconfig}
+	}
+
+	touch("sbin/ldconfig")
+	cli := auto()
+	if err := resolveAutoDriver(&cli, host); err == nil || cli.Root != nil || *cli.Ldconfig != "@/sbin/ldconfig" {
+		t.Errorf("resolveAutoDriver: expected the host without driver, got %v %v", cli.Root, err)
+	}
+	touch("run/nvidia/driver/usr/lib64/libnvidia-ml.so.535.104.05")
+	touch("run/nvidia/driver/sbin/ldconfig.real")
+	cli = auto()
+	if err := resolveAutoDriver(&cli, host); err != nil || cli.Root == nil || *cli.Root != "/run/nvidia/driver" || *cli.Ldconfig != "@/run/nvidia/driver/sbin/ldconfig.real" {
+		t.Errorf("resolveAutoDriver: expected the driver container, got %v %v %v", cli.Root, cli.Ldconfig, err)
+	}
+	// Set values are kept.
+	root, ldconfig := "/opt/nvidia", "@/sbin/ldconfig"
+	cli = CLIConfig{Root: &root, Ldconfig: &ldconfig}
+	if err := resolveAutoDriver(&cli, host); err != nil || *cli.Root != root || *cli.Ldconfig != ldconfig {
+		t.Errorf("resolveAutoDriver: expected %s %s, got %s %s", root, ldconfig, *cli.Root, *cli.Ldconfig)
+	}
+}
+
+func TestLdCache(t *testing.T) {
+	for _, c := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"libc.so.6", "libc.so.6", 0},
+		{"libcuda.so.10", "libcuda.so.9", 1},
+		{"libcuda.so.1", "libcuda.so", 1},
+		{"libnvidia-ml.so.1", "libnvidia-ml.so.1.1", -1},
+		{"libm.so.6", "libc.so.6", 1},
+	} {
+		if r := compareLdCacheNames(c.a, c.b); (r > 0) != (c.expected > 0) || (r < 0) != (c.expected < 0) {
+			t.Errorf("compareLdCacheNames(%s, %s): expected %d got %d", c.a, c.b, c.expected, r)
+		}
+	}
+
+	rootfs, err := ioutil.TempDir("", "rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	os.MkdirAll(path.Join(rootfs, "etc/ld.so.conf.d"), 0755)
+	os.MkdirAll(path.Join(rootfs, "usr/lib/x86_64-linux-gnu"), 0755)
+	ioutil.WriteFile(path.Join(rootfs, "etc/ld.so.conf"), []byte("include /etc/ld.so.conf.d/*.conf\n"), 0644)
+	ioutil.WriteFile(path.Join(rootfs, "etc/ld.so.conf.d/x86_64-linux-gnu.conf"), []byte("# multiarch\n/usr/lib/x86_64-linux-gnu\n"), 0644)
+	os.Symlink("/../../usr/lib", path.Join(rootfs, "lib"))
+	for p, expected := range map[string]string{"/lib/x86_64-linux-gnu": "usr/lib/x86_64-linux-gnu", "/lib/../../../etc": "etc"} {
+		if resolved, err := rootfsPath(rootfs, p); err != nil || resolved != path.Join(rootfs, expected) {
+			t.Errorf("rootfsPath(%s): expected %s got %s %v", p, expected, resolved, err)
+		}
+	}
+	if dirs := getLdDirs(rootfs); !reflect.DeepEqual(dirs, []string{"/usr/lib/x86_64-linux-gnu", "/lib64", "/usr/lib64", "/lib", "/usr/lib"}) {
+		t.Errorf("getLdDirs: unexpected %v", dirs)
+	}
+
+	// Any ELF file of the architecture does, the soname is the file name without DT_SONAME.
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := elf.Open(self); err != nil || ldCacheFlags[f.Machine] == 0 {
+		t.Skip("not an ELF platform of the ld.so cache")
+	}
+	b, _ := ioutil.ReadFile(self)
+	ioutil.WriteFile(path.Join(rootfs, "usr/lib/x86_64-linux-gnu/libtest.so.1"), b, 0644)
+	if err := writeLdCache(rootfs); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := ioutil.ReadFile(path.Join(rootfs, "etc/ld.so.cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(cache, []byte("glibc-ld.so.cache1.1\x01\x00\x00\x00")) || !bytes.HasSuffix(cache, []byte("libtest.so.1\x00/usr/lib/x86_64-linux-gnu/libtest.so.1\x00")) {
+		t.Errorf("writeLdCache: unexpected cache %q", cache)
+	}
+}
+
+func TestCapabilityExtras(t *testing.T) {
+	hook := getDefaultHookConfig()
+	hook.ExtraMounts = map[string][]string{
+		"compute": {"/etc/licensing", "/opt/license:/license:rw"},
+		"utility": {"/etc/licensing:ro"},
+	}
+	hook.ExtraDevices = map[string][]string{"compute": {"/dev/nvidia-license"}}
+	mounts, devices, err := getCapabilityExtras(hook, "utility,compute")
+	expected := []cdiMount{
+		{HostPath: "/etc/licensing", ContainerPath: "/etc/licensing", Options: []string{"ro"}},
+		{HostPath: "/opt/license", ContainerPath: "/license"},
+	}
+	if err != nil || !reflect.DeepEqual(mounts, expected) || !reflect.DeepEqual(devices, []string{"/dev/nvidia-license"}) {
+		t.Errorf("getCapabilityExtras: unexpected %+v %v %v", mounts, devices, err)
+	}
+	if mounts, devices, err := getCapabilityExtras(hook, "graphics"); err != nil || len(mounts) > 0 || len(devices) > 0 {
+		t.Errorf("getCapabilityExtras(graphics): unexpected %+v %v %v", mounts, devices, err)
+	}
+
+	for _, invalid := range []string{"licensing", "/a:/b:/c", "/a:b"} {
+		hook.ExtraMounts = map[string][]string{"compute": {invalid}}
+		if _, _, err := getCapabilityExtras(hook, "compute"); err == nil {
+			t.Errorf("getCapabilityExtras(%s): expected an error", invalid)
+		}
+	}
+	hook.ExtraMounts = map[string][]string{"computee": {"/etc/licensing"}}
+	if _, _, err := getCapabilityExtras(hook, "compute"); err == nil {
+		t.Errorf("getCapabilityExtras: expected an error for an unknown capability")
+	}
+}
+
+func TestGenerateNCCLTopo(t *testing.T) {
+	sysfs, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sysfs)
+	for id, attrs := range map[string]map[string]string{
+		"0000:07:00.0": {"vendor": "0x10de", "class": "0x030200", "numa_node": "1", "local_cpus": "ffff0000", "max_link_speed": "16.0 GT/s PCIe", "max_link_width": "16"},
+		"0000:03:00.0": {"vendor": "0x10de", "class": "0x030200", "numa_node": "0", "local_cpus": "0000ffff"},
+		"0000:00:1f.0": {"vendor": "0x8086", "class": "0x060100"},
+	} {
+		os.MkdirAll(path.Join(sysfs, id), 0755)
+		for name, value := range attrs {
+			ioutil.WriteFile(path.Join(sysfs, id, name), []byte(value+"\n"), 0644)
+		}
+	}
+	b, err := generateNCCLTopo(sysfs)
+	expected := `<system version="1">
+  <cpu numaid="0" affinity="0000ffff">
+    <pci busid="0000:03:00.0" class="0x030200"></pci>
+  </cpu>
+  <cpu numaid="1" affinity="ffff0000">
+    <pci busid="0000:07:00.0" class="0x030200" link_speed="16.0 GT/s PCIe" link_width="16"></pci>
+  </cpu>
+</system>
+`
+	if err != nil || string(b) != expected {
+		t.Errorf("generateNCCLTopo: expected\n%s got\n%s %v", expected, b, err)
+	}
+
+	for devices, expected := range map[string]bool{"all": true, "0,1": true, "GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785": false, "0": false} {
+		if isMultiGPURequest(devices) != expected {
+			t.Errorf("isMultiGPURequest(%s): expected %v", devices, expected)
+		}
+	}
+}
+
+func TestParseFabricStates(t *testing.T) {
+	out := `Attached GPUs                             : 2
+GPU 00000000:07:00.0
+    Product Name                          : NVIDIA H100 80GB HBM3
+    GPU UUID                              : GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785
+    Fabric
+        State                             : Completed
+        Status                            : Success
+    GPU Reset Status
+        Reset Required                    : No
+
+GPU 00000000:0F:00.0
+    Product Name                          : NVIDIA H100 80GB HBM3
+    Fabric
+        State                             : In Progress
+        Status                            : N/A
+`
+	expected := map[string]string{"00000000:07:00.0": "Completed, Success", "00000000:0F:00.0": "In Progress, N/A"}
+	if states := parseFabricStates(out); !reflect.DeepEqual(states, expected) {
+		t.Errorf("expected %v got %v", expected, states)
+	}
+}
+
+func TestDRMNodes(t *testing.T) {
+	sysfs, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sysfs)
+	for _, name := range []string{"card1", "renderD129", "controlD65"} {
+		os.MkdirAll(path.Join(sysfs, "0000:07:00.0/drm", name), 0755)
+	}
+
+	nodes := getDRMNodes(sysfs, "00000000:07:00.0")
+	if !reflect.DeepEqual(nodes, []string{"/dev/dri/card1", "/dev/dri/renderD129"}) {
+		t.Errorf("getDRMNodes: unexpected %v", nodes)
+	}
+	if nodes := getDRMNodes(sysfs, "00000000:0F:00.0"); len(nodes) > 0 {
+		t.Errorf("getDRMNodes: unexpected %v", nodes)
+	}
+	if link := getDRMByPathLink("00000000:07:00.0", "/dev/dri/renderD129"); link != "/dev/dri/by-path/pci-0000:07:00.0-render" {
+		t.Errorf("getDRMByPathLink: unexpected %s", link)
+	}
+	if link := getDRMByPathLink("0000:07:00.0", "/dev/dri/card1"); link != "/dev/dri/by-path/pci-0000:07:00.0-card" {
+		t.Errorf("getDRMByPathLink: unexpected %s", link)
+	}
+}
+
+func TestDisplayMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "display")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(x11, runtime string) { x11SocketDir, userRuntimeDir = x11, runtime }(x11SocketDir, userRuntimeDir)
+	x11SocketDir, userRuntimeDir = path.Join(dir, "x11"), path.Join(dir, "user")
+	uid := uint32(os.Getuid())
+	runtimeDir := path.Join(userRuntimeDir, fmt.Sprint(uid))
+	os.MkdirAll(x11SocketDir, 0755)
+	os.MkdirAll(runtimeDir, 0700)
+	for _, s := range []string{path.Join(x11SocketDir, "X1"), path.Join(runtimeDir, "wayland-0")} {
+		l, err := net.Listen("unix", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+	}
+	xauth := path.Join(runtimeDir, ".mutter-Xwaylandauth.1")
+	ioutil.WriteFile(xauth, nil, 0600)
+	ioutil.WriteFile(path.Join(runtimeDir, "secret"), nil, 0600)
+
+	var tests = []struct {
+		env      map[string]string
+		expected []string
+	}{
+		{map[string]string{"DISPLAY": ":1", "XAUTHORITY": xauth}, []string{path.Join(x11SocketDir, "X1"), xauth}},
+		{map[string]string{"DISPLAY": "unix:1.0", "XAUTHORITY": path.Join(runtimeDir, "secret")}, []string{path.Join(x11SocketDir, "X1")}},
+		{map[string]string{"DISPLAY": "remote:1", "XAUTHORITY": xauth}, nil},
+		{map[string]string{"DISPLAY": ":0"}, nil},
+		{map[string]string{"WAYLAND_DISPLAY": "wayland-0", "XDG_RUNTIME_DIR": runtimeDir}, []string{path.Join(runtimeDir, "wayland-0")}},
+		{map[string]string{"WAYLAND_DISPLAY": "wayland-0"}, []string{path.Join(runtimeDir, "wayland-0")}},
+		{map[string]string{"WAYLAND_DISPLAY": "../../x11/X1", "XDG_RUNTIME_DIR": runtimeDir}, nil},
+		{map[string]string{"WAYLAND_DISPLAY": "secret"}, nil},
+	}
+	for _, c := range tests {
+		var mounts []string
+		for _, m := range getDisplayMounts(c.env, uid) {
+			mounts = append(mounts, m.HostPath)
+		}
+		if !reflect.DeepEqual(mounts, c.expected) {
+			t.Errorf("getDisplayMounts(%v): expected %v got %v", c.env, c.expected, mounts)
+		}
+	}
+	if mounts := getDisplayMounts(map[string]string{"WAYLAND_DISPLAY": "wayland-0"}, uid+1); len(mounts) > 0 {
+		t.Errorf("getDisplayMounts: unexpected %v for another uid", mounts)
+	}
+}
+
+func TestVideoLibraries(t *testing.T) {
+	libraries := defaultVideoLibraries()
+	var tests = []struct {
+		capabilities string
+		expected     []string
+	}{
+		{"compute,video", nil},
+		{"compute,utility", nil},
+		{"video,nvdec", nil},
+		{"nvdec", []string{"libnvidia-encode.so*", "libnvidia-opticalflow.so*"}},
+		{"utility,nvenc", []string{"libnvcuvid.so*", "libvdpau_nvidia.so*"}},
+		{"nvjpeg", []string{"libvdpau_nvidia.so*", "libnvidia-encode.so*", "libnvidia-opticalflow.so*"}},
+		{"nvenc,nvdec", nil},
+	}
+	for _, c := range tests {
+		excluded, err := getExcludedVideoLibraries(libraries, c.capabilities)
+		if err != nil || !reflect.DeepEqual(excluded, c.expected) {
+			t.Errorf("getExcludedVideoLibraries(%s): expected %v got %v, %v", c.capabilities, c.expected, excluded, err)
+		}
+	}
+	if _, err := getExcludedVideoLibraries(map[string][]string{"video": {"libnvcuvid.so*"}}, "nvdec"); err == nil {
+		t.Error("expected an error for the libraries of video")
+	}
+
+	container := containerConfig{Rootfs: "/rootfs", Nvidia: &nvidiaConfig{Capabilities: "nvenc,nvdec,utility"}}
+	cli := getDefaultHookConfig().NvidiaContainerCLI
+	p := "/usr/bin/nvidia-container-cli"
+	cli.Path = &p
+	args := getCLIArgs(getDefaultHookConfig(), cli, container, "")
+	if strings.Count(strings.Join(args, " "), "--video") != 1 {
+		t.Errorf("expected a single --video option, got %v", args)
+	}
+}
+
+func TestRequirePolicy(t *testing.T) {
+	var tests = []struct {
+		policy         string
+		disableRequire bool
+		envDisable     bool
+		expected       string
+	}{
+		{"", false, false, requirePolicyEnforce},
+		{"", false, true, requirePolicyIgnore},
+		{"", true, false, requirePolicyIgnore},
+		{requirePolicyEnforce, false, true, requirePolicyEnforce},
+		{requirePolicyEnforce, true, false, requirePolicyEnforce},
+		{requirePolicyWarn, false, true, requirePolicyWarn},
+		{requirePolicyIgnore, false, false, requirePolicyIgnore},
+	}
+	for _, c := range tests {
+		hook := HookConfig{RequirePolicy: c.policy, DisableRequire: c.disableRequire}
+		if policy := getRequirePolicy(hook, &nvidiaConfig{DisableRequire: c.envDisable}); policy != c.expected {
+			t.Errorf("getRequirePolicy(%q, %v, %v): expected %s got %s", c.policy, c.disableRequire, c.envDisable, c.expected, policy)
+		}
+	}
+
+	cli := getDefaultHookConfig().NvidiaContainerCLI
+	p := "/usr/bin/nvidia-container-cli"
+	cli.Path = &p
+	container := containerConfig{Rootfs: "/rootfs", Nvidia: &nvidiaConfig{Requirements: []string{"cuda>=12.0"}, DisableRequire: true}}
+	for policy, expected := range map[string]bool{requirePolicyEnforce: true, requirePolicyWarn: false, "": false} {
+		hook := getDefaultHookConfig()
+		hook.RequirePolicy = policy
+		args := strings.Join(getCLIArgs(hook, cli, container, ""), " ")
+		if strings.Contains(args, "--require=cuda>=12.0") != expected {
+			t.Errorf("require-policy %q: unexpected arguments %s", policy, args)
+		}
+	}
+}
+
+func TestCheckCompat(t *testing.T) {
+	info := &driverInfo{CUDAVersion: "11.2"}
+	var tests = []struct {
+		env      []string
+		expected []string
+	}{
+		{[]string{"NVIDIA_VISIBLE_DEVICES=all", "NVIDIA_REQUIRE_CUDA=cuda>=11.0"}, nil},
+		{[]string{"NVIDIA_VISIBLE_DEVICES=all", "NVIDIA_REQUIRE_CUDA=cuda>=11.4"}, []string{"cuda>=11.4"}},
+		{[]string{"NVIDIA_VISIBLE_DEVICES=all", "NVIDIA_REQUIRE_CUDA=cuda>=11.4 brand=tesla,cuda>=11.0"}, nil},
+		{[]string{"NVIDIA_VISIBLE_DEVICES=all", "NVIDIA_REQUIRE_CUDA=cuda>=11.4", "NVIDIA_DISABLE_REQUIRE=true"}, nil},
+		{[]string{"CUDA_VERSION=12.0"}, []string{"cuda>=12.0"}},
+		{[]string{}, nil},
+	}
+	for _, c := range tests {
+		if failed, err := checkCompat(c.env, info); err != nil || !reflect.DeepEqual(failed, c.expected) {
+			t.Errorf("checkCompat(%v): expected %v got %v", c.env, c.expected, failed)
+		}
+	}
+}
+
+func TestCheckRequirement(t *testing.T) {
+	info := &driverInfo{DriverVersion: "460.32.03", CUDAVersion: "11.2"}
+	devices := []deviceInfo{
+		{Index: "0", Brand: "Tesla", Architecture: "7.5"},
+		{Index: "1", Brand: "NVIDIA RTX", Architecture: "8.6"},
+	}
+	var tests = []struct {
+		requirement string
+		expected    []string
+		err         bool
+	}{
+		{"cuda>=11.0,driver>=450", nil, false},
+		{"cuda>=12.0", []string{"cuda>=12.0 (the driver supports CUDA 11.2)"}, false},
+		{"driver<460", []string{"driver<460 (the driver is 460.32.03)"}, false},
+		{"arch>=7.5", nil, false},
+		{"arch=ampere", []string{"arch=ampere (GPU 0 is 7.5 turing)"}, false},
+		{"brand=tesla,cuda>=11.0 brand=nvidiartx", []string{"brand=tesla (GPU 1 is a NVIDIA RTX)", "brand=nvidiartx (GPU 0 is a Tesla)"}, false},
+		{"brand>tesla", nil, true},
+		{"cuda>=eleven", nil, true},
+		{"memory>=16", nil, true},
+	}
+	for _, c := range tests {
+		failed, err := checkRequirement(c.requirement, info, devices)
+		if (err != nil) != c.err || !reflect.DeepEqual(failed, c.expected) {
+			t.Errorf("checkRequirement(%s): expected %v got %v (%v)", c.requirement, c.expected, failed, err)
+		}
+	}
+}
+
+func TestNodeRequirements(t *testing.T) {
+	env := map[string]string{envNVRequireECC: "enabled", envNVRequireRowRemapping: "healthy", envNVRequireCUDA: "cuda>=11.0"}
+	if requirements := getRequirements(env); !reflect.DeepEqual(requirements, []string{"cuda>=11.0"}) {
+		t.Fatalf("expected the requirements of the hook kept from nvidia-container-cli, got %v", requirements)
+	}
+	if _, err := validateNodeRequirements(map[string]string{envNVRequireECC: "on"}); err == nil {
+		t.Fatal("expected an invalid ECC requirement")
+	}
+
+	dir, err := ioutil.TempDir("", "require")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.MkdirAll(path.Join(dir, "usr/bin"), 0755)
+	ioutil.WriteFile(path.Join(dir, "usr/bin/nvidia-smi"), []byte("#!/bin/sh\n"+
+		"case \"$1\" in\n"+
+		"--query-gpu=*) echo '0, GPU-1ef, Enabled'; echo '1, GPU-2ef, Disabled'; echo '2, GPU-3ef, [N/A]' ;;\n"+
+		"--query-remapped-rows=*) echo 'GPU-1ef, No, No'; echo 'GPU-2ef, Yes, No' ;;\n"+
+		"esac\n"), 0755)
+	cli := getDefaultHookConfig().NvidiaContainerCLI
+	cli.Root = &dir
+	cli.Retries = 0
+
+	nvidia := &nvidiaConfig{Devices: "0", NodeRequirements: getNodeRequirements(env)}
+	names, _ := validateNodeRequirements(nvidia.NodeRequirements)
+	if unsatisfied, err := unsatisfiedNodeRequirements(cli, nvidia, names); err != nil || len(unsatisfied) > 0 {
+		t.Fatalf("unexpected unsatisfied requirements %v (%v)", unsatisfied, err)
+	}
+	nvidia.Devices = "all"
+	unsatisfied, err := unsatisfiedNodeRequirements(cli, nvidia, names)
+	expected := []string{
+		"NVIDIA_REQUIRE_ECC=enabled (ECC is disabled on GPU 1)",
+		"NVIDIA_REQUIRE_ECC=enabled (ECC is disabled on GPU 2)",
+		"NVIDIA_REQUIRE_ROW_REMAPPING=healthy (GPU GPU-2ef has pending row remappings, it needs a reset)",
+	}
+	if err != nil || !reflect.DeepEqual(unsatisfied, expected) {
+		t.Fatalf("expected %v, got %v (%v)", expected, unsatisfied, err)
+	}
+}
+
+func TestWaitForDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.MkdirAll(path.Join(dir, "usr/bin"), 0755)
+	// GPU 0 runs the processes listed in apps until the released file exists, GPU 1 isn't exclusive.
+	apps := path.Join(dir, "apps")
+	released := path.Join(dir, "released")
+	ioutil.WriteFile(path.Join(dir, "usr/bin/nvidia-smi"), []byte("#!/bin/sh\n"+
+		"case \"$1\" in\n"+
+		"--query-gpu=*) echo '0, GPU-1ef, Exclusive_Process'; echo '1, GPU-2ef, Default' ;;\n"+
+		"--query-compute-apps=*) [ -e "+released+" ] || cat "+apps+"; [ ! -e "+released+".next ] || touch "+released+" ;;\n"+
+		"esac\n"), 0755)
+
+	var tests = []struct {
+		description string
+		apps        string
+		release     bool
+		devices     string
+		timeout     time.Duration
+		code        int
+	}{
+		{"idle", "", false, "0", 0, 0},
+		{"busy on another GPU", "GPU-2ef\n", false, "0", 0, 0},
+		{"busy, timeout", "GPU-1ef\n", false, "0", 0, exitCodePolicy},
+		{"busy, timeout with all", "GPU-1ef\nGPU-2ef\n", false, "all", 50 * time.Millisecond, exitCodePolicy},
+		{"released while waiting", "GPU-1ef\n", true, "GPU-1ef", time.Minute, 0},
+	}
+	for _, tc := range tests {
+		os.Remove(released)
+		os.Remove(released + ".next")
+		ioutil.WriteFile(apps, []byte(tc.apps), 0644)
+		if tc.release {
+			ioutil.WriteFile(released+".next", nil, 0644)
+		}
+		hook := getDefaultHookConfig()
+		hook.NvidiaContainerCLI.Root = &dir
+		hook.NvidiaContainerCLI.Retries = 0
+		hook.BusyTimeout = duration{Duration: tc.timeout}
+		hook.BusyRetryInterval = duration{Duration: 10 * time.Millisecond}
+
+		code := 0
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					e, ok := err.(*hookError)
+					if !ok {
+						t.Fatalf("%s: unexpected panic %v", tc.description, err)
+					}
+					code = e.code
+				}
+			}()
+			waitForDevices(hook, tc.devices)
+		}()
+		if code != tc.code {
+			t.Errorf("%s: expected exit code %d, got %d", tc.description, tc.code, code)
+		}
+	}
+}
+
+func TestPodQuota(t *testing.T) {
+	var tests = []struct {
+		cgroupsPath string
+		expected    string
+	}{
+		{"/kubepods/burstable/pod8dbc5577-d0e2-4706-8787-57d52c03ddf2/0123abcd", "8dbc5577-d0e2-4706-8787-57d52c03ddf2"},
+		{"kubepods-burstable-pod8dbc5577_d0e2_4706_8787_57d52c03ddf2.slice:cri-containerd:0123abcd", "8dbc5577-d0e2-4706-8787-57d52c03ddf2"},
+		{"/kubepods/pod6b1d1f1e0c2a4e8f9d3b7a5c4e2f1a0b/0123abcd", "6b1d1f1e0c2a4e8f9d3b7a5c4e2f1a0b"},
+		{"/docker/0123abcd", ""},
+	}
+	for _, c := range tests {
+		if pod := getPodUID(c.cgroupsPath); pod != c.expected {
+			t.Errorf("getPodUID(%s): expected %q got %q", c.cgroupsPath, c.expected, pod)
+		}
+	}
+
+	p := &podGPUs{Pods: make(map[string]map[string][]string)}
+	if err := p.add("pod", "a", []string{"GPU-1ef"}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.add("pod", "b", []string{"gpu-1ef", "GPU-2ef"}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.add("pod", "c", []string{"GPU-3ef"}, 2); err == nil {
+		t.Error("expected a third GPU in the pod to be rejected")
+	}
+	if err := p.add("other", "d", []string{"GPU-3ef"}, 2); err != nil {
+		t.Error(err)
+	}
+	p.remove("b")
+	p.remove("a")
+	if _, ok := p.Pods["pod"]; ok {
+		t.Errorf("expected the pod to be forgotten with its last container, got %v", p.Pods)
+	}
+}
+
+func TestMPSEnvironment(t *testing.T) {
+	config := configfile.DefaultMPSConfig()
+	config.ActiveThreadPercentage = 50
+	var tests = []struct {
+		annotations map[string]string
+		expected    string
+		err         bool
+	}{
+		{nil, "CUDA_MPS_ACTIVE_THREAD_PERCENTAGE=50", false},
+		{map[string]string{configfile.MPSActiveThreadPercentageAnnotation: "25"}, "CUDA_MPS_ACTIVE_THREAD_PERCENTAGE=25", false},
+		{map[string]string{configfile.MPSActiveThreadPercentageAnnotation: "0"}, "", false},
+		{map[string]string{configfile.MPSActiveThreadPercentageAnnotation: "150"}, "", true},
+		{map[string]string{configfile.MPSActiveThreadPercentageAnnotation: "half"}, "", true},
+	}
+	for _, c := range tests {
+		env, err := config.Environment(c.annotations)
+		if (err != nil) != c.err {
+			t.Errorf("Environment(%v): unexpected error %v", c.annotations, err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+		expected := []string{"CUDA_MPS_PIPE_DIRECTORY=/tmp/nvidia-mps", "CUDA_MPS_LOG_DIRECTORY=/var/log/nvidia-mps"}
+		if len(c.expected) > 0 {
+			expected = append(expected, c.expected)
+		}
+		if !reflect.DeepEqual(env, expected) {
+			t.Errorf("Environment(%v): expected %v got %v", c.annotations, expected, env)
+		}
+	}
+}
+
+func TestExpandSharedDevices(t *testing.T) {
+	shared := []SharedDevice{{Name: "nvidia.com/gpu.shared", GPU: "GPU-1ef", Replicas: 2}}
+	var tests = []struct {
+		devices  string
+		physical string
+		replicas []sharedReplica
+		err      bool
+	}{
+		{"0,1", "0,1", nil, false},
+		{"GPU-2ef::3,0", "GPU-2ef,0", []sharedReplica{{"GPU-2ef::3", "GPU-2ef", 3}}, false},
+		{"0::0,0::1", "0", []sharedReplica{{"0::0", "0", 0}, {"0::1", "0", 1}}, false},
+		{"nvidia.com/gpu.shared", "GPU-1ef", []sharedReplica{{"nvidia.com/gpu.shared", "GPU-1ef", 0}}, false},
+		{"nvidia.com/gpu.shared::2", "", nil, true},
+		{"0::first", "", nil, true},
+	}
+	for _, c := range tests {
+		physical, replicas, err := expandSharedDevices(c.devices, shared)
+		if (err != nil) != c.err || physical != c.physical || !reflect.DeepEqual(replicas, c.replicas) {
+			t.Errorf("expandSharedDevices(%s): expected %s %v got %s %v (%v)", c.devices, c.physical, c.replicas, physical, replicas, err)
+		}
+	}
+}
+
+func TestGetRDMADevices(t *testing.T) {
+	if devices := getRDMADevices(map[string]string{envNVMOFED: "disabled"}); devices != nil {
+		t.Errorf("expected no RDMA device, got %v", devices)
+	}
+	devices := getRDMADevices(map[string]string{envNVGDRCopy: envEnabled})
+	if !reflect.DeepEqual(devices, []string{gdrdrvDevice}) {
+		t.Errorf("expected %s, got %v", gdrdrvDevice, devices)
+	}
+}
+
+func TestSelectIMEXChannels(t *testing.T) {
+	host := []string{"0", "1", "2"}
+	var tests = []struct {
+		request  string
+		allowed  []string
+		expected []string
+		err      bool
+	}{
+		{"", []string{"all"}, nil, false},
+		{"none", nil, nil, false},
+		{"all", []string{"all"}, host, false},
+		{"all", []string{"1"}, []string{"1"}, false},
+		{"0,01", []string{"0", "1"}, []string{"0", "1"}, false},
+		{"2", []string{"0", "1"}, nil, true},
+		{"1", nil, nil, true},
+		{"channel1", []string{"all"}, nil, true},
+	}
+	for _, c := range tests {
+		channels, err := policy.SelectIMEXChannels(c.request, c.allowed, host)
+		if (err != nil) != c.err || !reflect.DeepEqual(channels, c.expected) {
+			t.Errorf("SelectIMEXChannels(%s, %v): expected %v got %v (%v)", c.request, c.allowed, c.expected, channels, err)
+		}
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	csv := `# l4t.csv
+dev, /dev/nvhost-ctrl
+lib, /usr/lib/aarch64-linux-gnu/tegra/libcuda.so.1.1
+
+dir, /usr/lib/aarch64-linux-gnu/tegra
+sym,/usr/lib/aarch64-linux-gnu/libcuda.so
+`
+	var files csvFiles
+	if err := parseCSV(strings.NewReader(csv), &files); err != nil {
+		t.Fatal(err)
+	}
+	expected := csvFiles{
+		Devices:     []string{"/dev/nvhost-ctrl"},
+		Libraries:   []string{"/usr/lib/aarch64-linux-gnu/tegra/libcuda.so.1.1"},
+		Directories: []string{"/usr/lib/aarch64-linux-gnu/tegra"},
+		Symlinks:    []string{"/usr/lib/aarch64-linux-gnu/libcuda.so"},
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %v got %v", expected, files)
+	}
+
+	for _, invalid := range []string{"lib /usr/lib/libcuda.so", "lib,", "file, /etc/hosts"} {
+		if err := parseCSV(strings.NewReader(invalid), &files); err == nil {
+			t.Errorf("parseCSV(%q) didn't fail", invalid)
+		}
+	}
+}
+
+func TestParseProcDriverVersion(t *testing.T) {
+	tests := []struct {
+		content string
+		version string
+		open    bool
+	}{
+		{"NVRM version: NVIDIA UNIX Open Kernel Module for x86_64  535.104.05  Release Build  (dvs-builder@U16-I3-B03-4-3)  Sun Aug 20 21:41:49 UTC 2023\nGCC version:  gcc version 12.2.0\n", "535.104.05", true},
+		{"NVRM version: NVIDIA UNIX x86_64 Kernel Module  460.32.03  Sun Dec 27 19:00:34 UTC 2020\nGCC version:  gcc version 9.3.0\n", "460.32.03", false},
+		{"GCC version:  gcc version 9.3.0\n", "", false},
+	}
+	for _, tc := range tests {
+		version, open := parseProcDriverVersion(tc.content)
+		if version != tc.version || open != tc.open {
+			t.Errorf("parseProcDriverVersion(%q): expected %s %v got %s %v", tc.content, tc.version, tc.open, version, open)
+		}
+	}
+}
+
+func TestMetricsState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state := path.Join(dir, "metrics.json")
+
+	activities := []struct {
+		activity hookActivity
+		code     int
+	}{
+		{hookActivity{stage: "prestart", gpus: []string{"GPU-1", "GPU-2"}, cliDuration: 200 * time.Millisecond}, 0},
+		{hookActivity{stage: "prestart", gpus: []string{"GPU-1"}}, exitCodePolicy},
+		{hookActivity{stage: "prestart", gpus: []string{"GPU-1"}, cliDuration: 3 * time.Second}, 0},
+		{hookActivity{stage: "poststop"}, 0},
+	}
+	for _, a := range activities {
+		m, err := openMetricsState(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.add(a.activity, a.code)
+		if err := m.save(); err != nil {
+			t.Fatal(err)
+		}
+		m.close()
+	}
+
+	m, err := openMetricsState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+	out := string(m.format())
+	for _, expected := range []string{
+		`nvidia_container_runtime_hook_invocations_total{stage="poststop"} 1`,
+		`nvidia_container_runtime_hook_invocations_total{stage="prestart"} 3`,
+		`nvidia_container_runtime_hook_failures_total{reason="policy",stage="prestart"} 1`,
+		`nvidia_container_runtime_hook_gpu_mounts_total{gpu="GPU-1"} 2`,
+		`nvidia_container_runtime_hook_gpu_mounts_total{gpu="GPU-2"} 1`,
+		`nvidia_container_runtime_hook_cli_duration_seconds_bucket{le="0.25"} 1`,
+		`nvidia_container_runtime_hook_cli_duration_seconds_bucket{le="5"} 2`,
+		`nvidia_container_runtime_hook_cli_duration_seconds_bucket{le="+Inf"} 2`,
+		`nvidia_container_runtime_hook_cli_duration_seconds_count 2`,
+	} {
+		if !strings.Contains(out, expected+"\n") {
+			t.Errorf("expected %q in:\n%s", expected, out)
+		}
+	}
+}
+
+func TestWriteAuditEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := AuditConfig{Path: path.Join(dir, "log", "audit.log"), MaxSize: 1, MaxFiles: 2}
+
+	read := func(p string) []auditEntry {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []auditEntry
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			var e auditEntry
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("invalid line %q: %v", line, err)
+			}
+			entries = append(entries, e)
+		}
+		return entries
+	}
+
+	granted := auditEntry{Container: "c1", Devices: "0", UUIDs: []string{"GPU-1"}, Capabilities: "utility", Decision: auditGranted}
+	denied := auditEntry{Container: "c2", Devices: "1", Decision: auditDenied, Reason: "GPU GPU-2 is reserved by c3"}
+	for _, e := range []auditEntry{granted, denied} {
+		if err := writeAuditEntry(config, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries := read(config.Path); !reflect.DeepEqual(entries, []auditEntry{granted, denied}) {
+		t.Errorf("expected %v got %v", []auditEntry{granted, denied}, entries)
+	}
+
+	// Past max-size, the log is rotated and the oldest file dropped.
+	for i := 0; i < 2; i++ {
+		if err := ioutil.WriteFile(config.Path, bytes.Repeat([]byte{'\n'}, 1<<20), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeAuditEntry(config, granted); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries := read(config.Path); !reflect.DeepEqual(entries, []auditEntry{granted}) {
+		t.Errorf("expected %v after rotation got %v", []auditEntry{granted}, entries)
+	}
+	for _, p := range []string{config.Path + ".1", config.Path + ".2"} {
+		if _, err := os.Stat(p); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(config.Path + ".3"); err == nil {
+		t.Errorf("%s.3 exists with max-files 2", config.Path)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var path string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	env := map[string]string{
+		envOTLPEndpoint:    server.URL,
+		envOTELServiceName: "hook",
+		envTraceParent:     "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	startTracing("prestart")
+	startSpan("load spec").end()
+	startSpan("nvidia-container-cli")
+	stopTracing(exitCodeCLIFailure, "nvidia-container-cli failed")
+	if tracer != nil {
+		t.Error("tracing not stopped")
+	}
+
+	if path != "/v1/traces" {
+		t.Errorf("expected the spans on /v1/traces got %q", path)
+	}
+	var export struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []traceSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(body, &export); err != nil {
+		t.Fatal(err)
+	}
+	if len(export.ResourceSpans) != 1 || len(export.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected export %s", body)
+	}
+	if attrs := export.ResourceSpans[0].Resource.Attributes; !reflect.DeepEqual(attrs, []otlpAttribute{{"service.name", otlpValue{"hook"}}}) {
+		t.Errorf("unexpected resource %v", attrs)
+	}
+	spans := export.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans got %d", len(spans))
+	}
+	root := spans[0]
+	if root.Name != "prestart" || root.ParentSpanID != "b7ad6b7169203331" {
+		t.Errorf("unexpected root span %+v", root)
+	}
+	for i, s := range spans {
+		if s.TraceID != "0af7651916cd43dd8448eb211c80319c" {
+			t.Errorf("span %s not in the trace of TRACEPARENT: %s", s.Name, s.TraceID)
+		}
+		if i > 0 && s.ParentSpanID != root.SpanID {
+			t.Errorf("span %s not under the root span", s.Name)
+		}
+	}
+	if spans[1].Status.Code != otlpStatusOK || spans[2].Status != (otlpStatus{otlpStatusError, "nvidia-container-cli failed"}) {
+		t.Errorf("unexpected status %v %v", spans[1].Status, spans[2].Status)
+	}
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	if err := runWithTimeout(exec.Command("true"), time.Second); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := runWithTimeout(exec.Command("false"), time.Second); err == nil {
+		t.Error("expected the exit status of false")
+	}
+
+	// The background sleep keeps the output open, Wait only returns once it is killed too.
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", "sleep 10 & sleep 10")
+	cmd.Stdout = &out
+	start := time.Now()
+	err := runWithTimeout(cmd, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected a timeout got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the children weren't killed, returned after %v", elapsed)
+	}
+}
+
+func TestWithSELinuxType(t *testing.T) {
+	for label, expected := range map[string]string{
+		"system_u:object_r:xserver_misc_device_t:s0\x00":    "system_u:object_r:container_file_t:s0",
+		"system_u:object_r:lib_t:s0:c1,c2":                  "system_u:object_r:container_file_t:s0:c1,c2",
+		"unconfined_u:object_r:container_file_t:s0:c12,c34": "unconfined_u:object_r:container_file_t:s0:c12,c34",
+	} {
+		if relabeled, err := withSELinuxType(label, defaultSELinuxType); err != nil || relabeled != expected {
+			t.Errorf("withSELinuxType(%q): expected %s got %s (%v)", label, expected, relabeled, err)
+		}
+	}
+	if _, err := withSELinuxType("unlabeled", defaultSELinuxType); err == nil {
+		t.Errorf("expected an error for an invalid context")
+	}
+}
+
+func TestSameDevice(t *testing.T) {
+	if _, _, err := deviceNumbers("/dev/null"); err != nil {
+		t.Skip("no device nodes:", err)
+	}
+	if !sameDevice("/dev/null", "/dev/null") {
+		t.Errorf("expected /dev/null to be the same device as itself")
+	}
+	if sameDevice("/dev/null", "/dev/zero") || sameDevice("/dev/null", "/nonexistent") {
+		t.Errorf("expected different devices")
+	}
+}
+
+func TestCheckLdconfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ldconfig := path.Join(dir, "ldconfig")
+	ioutil.WriteFile(ldconfig, []byte("#!/bin/sh\n"), 0644)
+
+	for config, ok := range map[string]bool{
+		"ldconfig":          true,
+		"@" + ldconfig:      false,
+		"@" + dir + "/none": false,
+	} {
+		config := config
+		if err := checkLdconfig(CLIConfig{Ldconfig: &config}); (err == nil) != ok {
+			t.Errorf("checkLdconfig(%s): unexpected result %v", config, err)
+		}
+	}
+	os.Chmod(ldconfig, 0755)
+	config := "@" + ldconfig
+	if err := checkLdconfig(CLIConfig{Ldconfig: &config}); err != nil {
+		t.Errorf("checkLdconfig(%s): %v", config, err)
+	}
+}
+
+func TestGetCLIVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cli := path.Join(dir, "nvidia-container-cli")
+	ioutil.WriteFile(cli, []byte("#!/bin/sh\necho 'cli-version: 1.7.0'\necho 'lib-version: 1.7.0'\n"), 0755)
+
+	version, err := getCLIVersion(CLIConfig{Path: &cli})
+	if err != nil || version != "1.7.0" {
+		t.Fatalf("expected 1.7.0 got %s (%v)", version, err)
+	}
+	if compareVersions(version, cgroupV2MinCLIVersion) >= 0 {
+		t.Errorf("expected %s to predate the cgroup v2 support", version)
+	}
+	if isCgroupV2() && len(getCgroupV2Path(os.Getpid())) == 0 {
+		t.Errorf("no cgroup v2 path for the test process")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	if s := versionString(); !strings.HasPrefix(s, version+" (commit "+gitCommit) || !strings.Contains(s, runtime.Version()) {
+		t.Errorf("unexpected version %s", s)
+	}
+
+	var cliCheck check
+	for _, c := range diagnostics {
+		if c.Name == "nvidia-container-cli" {
+			cliCheck = c
+		}
+	}
+	dir, err := ioutil.TempDir("", "version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cli := path.Join(dir, "nvidia-container-cli")
+
+	var tests = []struct {
+		version   string
+		supported bool
+	}{
+		{"0.9.0", false},
+		{minCLIVersion, true},
+		{"1.9.0", true},
+		{nextCLIVersion, false},
+		{"2.1.0", false},
+	}
+	for _, tc := range tests {
+		ioutil.WriteFile(cli, []byte("#!/bin/sh\necho 'cli-version: "+tc.version+"'\n"), 0755)
+		hook := getDefaultHookConfig()
+		hook.NvidiaContainerCLI.Path = &cli
+		// The cgroup v2 support is checked on its own.
+		hook.NvidiaContainerCLI.NoCgroups = true
+		if err := cliCheck.Run(hook); (err == nil) != tc.supported {
+			t.Errorf("%s: expected supported %v, got %v", tc.version, tc.supported, err)
+		}
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	config := CLIConfig{Retries: 2, RetryBackoff: duration{Duration: time.Millisecond}, TransientErrors: defaultTransientErrors}
+	tests := []struct {
+		outputs  []string
+		attempts int
+		fails    bool
+	}{
+		{[]string{""}, 1, false},
+		{[]string{"nvidia-container-cli: initialization error: nvml error: driver/library version mismatch", ""}, 2, false},
+		{[]string{"Failed to initialize NVML: Unknown Error", "Failed to initialize NVML: Unknown Error", "Failed to initialize NVML: Unknown Error"}, 3, true},
+		{[]string{"nvidia-container-cli: device error: GPU-foo: unknown device"}, 1, true},
+	}
+	for _, tc := range tests {
+		attempts := 0
+		err := withRetries(config, "test", func() (string, error) {
+			out := tc.outputs[attempts]
+			attempts++
+			if attempts < len(tc.outputs) || tc.fails {
+				return out, fmt.Errorf("exit status 1")
+			}
+			return out, nil
+		})
+		if attempts != tc.attempts || (err != nil) != tc.fails {
+			t.Errorf("%v: expected %d attempts and failure %v, got %d attempts and %v", tc.outputs, tc.attempts, tc.fails, attempts, err)
+		}
+	}
+}
+
+func TestWithDiscoveryCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dirs []string) { discoveryCacheDirs = dirs }(discoveryCacheDirs)
+	discoveryCacheDirs = []string{dir}
+
+	config := CLIConfig{DiscoveryCache: path.Join(dir, "cache.json")}
+	queries := 0
+	query := func() []string {
+		var uuids []string
+		err := withDiscoveryCache(config, "test", &uuids, func() error {
+			queries++
+			uuids = []string{fmt.Sprintf("GPU-%d", queries)}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uuids
+	}
+
+	for _, expected := range []string{"GPU-1", "GPU-1"} {
+		if uuids := query(); !reflect.DeepEqual(uuids, []string{expected}) {
+			t.Errorf("expected %s got %v", expected, uuids)
+		}
+	}
+	// A device node created or removed changes the key.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(dir, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if uuids := query(); !reflect.DeepEqual(uuids, []string{"GPU-2"}) {
+		t.Errorf("expected the query to run again, got %v", uuids)
+	}
+	invalidateDiscoveryCache(config)
+	if uuids := query(); !reflect.DeepEqual(uuids, []string{"GPU-3"}) {
+		t.Errorf("expected the query to run again after the invalidation, got %v", uuids)
+	}
+
+	config.Root = &dir
+	if uuids := query(); !reflect.DeepEqual(uuids, []string{"GPU-4"}) {
+		t.Errorf("expected distinct entries per driver root, got %v", uuids)
+	}
+}
+
+func TestParallelDo(t *testing.T) {
+	var mu sync.Mutex
+	running, max := 0, 0
+	done := make([]bool, 20)
+	parallelDo(4, len(done), func(i int) {
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		done[i] = true
+		mu.Unlock()
+	})
+	for i, d := range done {
+		if !d {
+			t.Errorf("call %d didn't run", i)
+		}
+	}
+	if max > 4 {
+		t.Errorf("expected at most 4 concurrent calls got %d", max)
+	}
+
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "call 3 failed") {
+			t.Errorf("expected the panic of the failed call got %v", r)
+		}
+	}()
+	parallelDo(4, 8, func(i int) {
+		if i == 3 {
+			log.Panicln("call 3 failed")
+		}
+	})
+}
+
+func TestGetDriverCapabilities(t *testing.T) {
+	hook := getDefaultHookConfig()
+	hook.DriverCapabilities = []DriverCapability{{Name: "ngx", CLIOption: "--ngx"}, {Name: "video", CLIOption: "--video-codecs"}}
+	hook.DisabledDriverCapabilities = []string{"display"}
+	caps, err := getDriverCapabilities(hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DriverCapability{
+		{Name: "compute", CLIOption: "--compute"},
+		{Name: "compat32", CLIOption: "--compat32"},
+		{Name: "graphics", CLIOption: "--graphics"},
+		{Name: "utility", CLIOption: "--utility"},
+		{Name: "video", CLIOption: "--video-codecs"},
+		{Name: "nvenc", CLIOption: "--video"},
+		{Name: "nvdec", CLIOption: "--video"},
+		{Name: "nvjpeg", CLIOption: "--video"},
+		{Name: "vgpu", CLIOption: ""},
+		{Name: "nvswitch", CLIOption: ""},
+		{Name: "ngx", CLIOption: "--ngx"},
+	}
+	if !reflect.DeepEqual(caps, expected) {
+		t.Errorf("expected %v got %v", expected, caps)
+	}
+
+	defer func() {
+		driverCapabilities, defaultDriverCapabilities = builtinCapabilities, defaultCapability
+	}()
+	setDriverCapabilities(hook)
+	nvidia, err := getNvidiaConfig(map[string]string{envNVGPU: "0", envNVDriverCapabilities: "all"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nvidia.Capabilities != "compute,compat32,graphics,utility,video,ngx" {
+		t.Errorf("unexpected capabilities of all: %s", nvidia.Capabilities)
+	}
+	if opt := capabilityToCLI("ngx"); opt != "--ngx" {
+		t.Errorf("expected --ngx got %s", opt)
+	}
+
+	for _, invalid := range []HookConfig{
+		{DriverCapabilities: []DriverCapability{{Name: "ngx", CLIOption: ""}}, DefaultDriverCapabilities: "utility"},
+		{DriverCapabilities: []DriverCapability{{Name: "all", CLIOption: "--all"}}, DefaultDriverCapabilities: "utility"},
+		{DisabledDriverCapabilities: []string{"utility"}, DefaultDriverCapabilities: "utility"},
+		{DefaultDriverCapabilities: "ngx"},
+		{SupportedDriverCapabilities: []string{"ngx"}, DefaultDriverCapabilities: "utility"},
+		{UnsupportedCapabilities: "ignore", DefaultDriverCapabilities: "utility"},
+	} {
+		if _, err := getDriverCapabilities(invalid); err == nil {
+			t.Errorf("getDriverCapabilities(%+v) didn't fail", invalid)
+		}
+	}
+}
+
+func TestFilterCapabilities(t *testing.T) {
+	supported := []string{"compute", "utility"}
+	tests := []struct {
+		requested string
+		explicit  bool
+		policy    string
+		expected  string
+		fails     bool
+	}{
+		{"compute,graphics", true, unsupportedCapabilitiesStrip, "compute", false},
+		{"compute,graphics", true, unsupportedCapabilitiesFail, "", true},
+		{"compute,compat32,graphics,utility,video,display", false, unsupportedCapabilitiesFail, "compute,utility", false},
+		{"utility", true, unsupportedCapabilitiesFail, "utility", false},
+		{"graphics", true, unsupportedCapabilitiesStrip, "", false},
+	}
+	for _, tc := range tests {
+		caps, err := filterCapabilities(tc.requested, supported, tc.explicit, tc.policy)
+		if tc.fails != (err != nil) {
+			t.Errorf("filterCapabilities(%q, %v): unexpected error %v", tc.requested, tc.policy, err)
+		} else if caps != tc.expected {
+			t.Errorf("filterCapabilities(%q, %v): expected %q got %q", tc.requested, tc.policy, tc.expected, caps)
+		}
+	}
+	if caps, _ := filterCapabilities("compute,graphics", nil, true, unsupportedCapabilitiesFail); caps != "compute,graphics" {
+		t.Errorf("expected all the capabilities to be supported, got %q", caps)
+	}
+}
+
+func TestGetWSLMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wsl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"nv_dispi.inf_amd64_b/libcuda.so.1.1", "nv_dispi.inf_amd64_a/libcuda.so.1.1", "nv_dispi.inf_amd64_a/libcuda_loader.so", "iigd_dch.inf_amd64/libigd.so"} {
+		os.MkdirAll(path.Dir(path.Join(dir, f)), 0755)
+		ioutil.WriteFile(path.Join(dir, f), nil, 0644)
+	}
+
+	mounts := getWSLMounts("/usr/lib/wsl/lib", dir)
+	expected := []string{"/usr/lib/wsl/lib", path.Join(dir, "nv_dispi.inf_amd64_a"), path.Join(dir, "nv_dispi.inf_amd64_b")}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("expected %v got %v", expected, mounts)
+	}
+}
+
+func TestNodeProbeMode(t *testing.T) {
+	var tests = []struct {
+		probe    nodeProbe
+		expected string
+	}{
+		{nodeProbe{}, modeLegacy},
+		{nodeProbe{NVML: true}, modeLegacy},
+		{nodeProbe{NVML: true, CDISpecs: true}, modeCDI},
+		{nodeProbe{Tegra: true}, modeCSV},
+		{nodeProbe{Tegra: true, NVML: true}, modeLegacy},
+		{nodeProbe{WSL: true, CDISpecs: true}, modeWSL},
+	}
+	for _, c := range tests {
+		if mode, _ := c.probe.mode(); mode != c.expected {
+			t.Errorf("%+v: expected %s got %s", c.probe, c.expected, mode)
+		}
+	}
+}
+
+func TestSelectDriverRoot(t *testing.T) {
+	roots := []DriverRoot{
+		{Root: "/opt/legacy", Devices: []string{"GPU-83d7*"}},
+		{Root: "/opt/beta", Devices: []string{"GPU-1ef"}},
+	}
+	info := &driverInfo{Devices: []deviceInfo{
+		{Index: "0", UUID: "GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785"},
+		{Index: "1", UUID: "GPU-2ef"},
+	}}
+	var tests = []struct {
+		devices  string
+		info     *driverInfo
+		expected string
+		err      bool
+	}{
+		{"all", info, "", true},
+		{"0", info, "/opt/legacy", false},
+		{"0:1", info, "/opt/legacy", false},
+		{"1", info, "", false},
+		{"0,1", info, "", true},
+		{"0", nil, "", true},
+		{"3", info, "", true},
+		{"none", nil, "", false},
+		{"GPU-2ef", nil, "", false},
+		{"GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785", nil, "/opt/legacy", false},
+		{"gpu-1ef,GPU-2ef", nil, "", true},
+		{"GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785,GPU-1ef", nil, "", true},
+		{"MIG-GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785/1/0", nil, "/opt/legacy", false},
+	}
+	for _, c := range tests {
+		root, err := selectDriverRoot(roots, c.devices, c.info)
+		if (err != nil) != c.err {
+			t.Errorf("selectDriverRoot(%s): unexpected error %v", c.devices, err)
+			continue
+		}
+		r := ""
+		if root != nil {
+			r = *root
+		}
+		if r != c.expected {
+			t.Errorf("selectDriverRoot(%s): expected %q got %q", c.devices, c.expected, r)
+		}
+	}
+}
+
+func TestResolveDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		response string
+		expected string
+		err      bool
+	}{
+		{`{"devices": ["GPU-1ef", "GPU-2ef"]}`, "GPU-1ef,GPU-2ef", false},
+		{`{"devices": []}`, "none", false},
+		{`{"error": "quota exceeded"}`, "", true},
+		{`garbage`, "", true},
+	}
+	for i, c := range tests {
+		resolver := path.Join(dir, fmt.Sprintf("resolver%d", i))
+		script := fmt.Sprintf("#!/bin/sh\ncat >/dev/null\necho '%s'\n", c.response)
+		if err := ioutil.WriteFile(resolver, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		devices, err := resolveDevices(resolver, resolverRequest{Request: "count:2"}, time.Minute)
+		if (err != nil) != c.err || devices != c.expected {
+			t.Errorf("resolveDevices(%s): expected %q (error: %v) got %q (%v)", c.response, c.expected, c.err, devices, err)
+		}
+	}
+
+	// A hung resolver is killed.
+	resolver := path.Join(dir, "hung")
+	if err := ioutil.WriteFile(resolver, []byte("#!/bin/sh\nsleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := resolveDevices(resolver, resolverRequest{Request: "count:2"}, 200*time.Millisecond); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected the resolver to time out, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("the resolver wasn't killed in time")
+	}
+}
+
+func TestGetMigration(t *testing.T) {
+	getEnvMigration := func(env ...string) *migration {
+		m, err := getEnvMap(env, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migration, err := getMigration(m, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return migration
+	}
+
+	m := getEnvMigration("NVIDIA_VISIBLE_DEVICES=0,1", "NVIDIA_DRIVER_CAPABILITIES=all")
+	if m == nil || !m.unchanged() || !reflect.DeepEqual(m.Devices, []string{"nvidia.com/gpu=0", "nvidia.com/gpu=1"}) {
+		t.Fatalf("unexpected migration %#v", m)
+	}
+
+	m = getEnvMigration("CUDA_VERSION=7.5")
+	if m == nil || m.unchanged() || !reflect.DeepEqual(m.Devices, []string{"nvidia.com/gpu=all"}) {
+		t.Fatalf("unexpected migration %#v", m)
+	}
+
+	if m = getEnvMigration(); m != nil {
+		t.Fatalf("unexpected migration for a CPU container %#v", m)
+	}
+}
+
+func TestTopology(t *testing.T) {
+	out := "\t\x1b[4mGPU0\tGPU1\tGPU2\tGPU3\tNIC0\tCPU Affinity\tNUMA Affinity\x1b[0m\n" +
+		"GPU0\t X \tNV2\tPIX\tSYS\tSYS\t0-11\t0\n" +
+		"GPU1\tNV2\t X \tSYS\tPIX\tSYS\t0-11\t0\n" +
+		"GPU2\tPIX\tSYS\t X \tNV4\tSYS\t12-23\t1\n" +
+		"GPU3\tSYS\tPIX\tNV4\t X \tPIX\t12-23\t1\n" +
+		"NIC0\tSYS\tSYS\tSYS\tPIX\t X\n\n" +
+		"Legend:\n\n  X    = Self\n"
+	topo, err := parseGPUTopology(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topo) != 4 || topo["2"]["3"] != "NV4" || topo["0"]["2"] != "PIX" {
+		t.Fatalf("unexpected topology %v", topo)
+	}
+
+	candidates := []string{"0", "1", "2", "3"}
+	if gpus := pickGPUs(topo, candidates, 2, topologyPolicyNVLink); !reflect.DeepEqual(gpus, []string{"2", "3"}) {
+		t.Errorf("expected the GPUs with the most NVLinks, got %v", gpus)
+	}
+	if gpus := pickGPUs(topo, []string{"0", "1", "3"}, 2, topologyPolicyPCIe); !reflect.DeepEqual(gpus, []string{"0", "1"}) {
+		t.Errorf("expected the NVLink GPUs as the closest, got %v", gpus)
+	}
+	if gpus := pickGPUs(topo, candidates, 4, topologyPolicyNVLink); len(gpus) != 4 {
+		t.Errorf("expected all the GPUs, got %v", gpus)
+	}
+
+	if r, err := parseTopologyRequest("count:4,policy:pcie"); err != nil || r != (topologyRequest{4, topologyPolicyPCIe}) {
+		t.Errorf("unexpected request %v (%v)", r, err)
+	}
+	if r, err := parseTopologyRequest("count:2"); err != nil || r.Policy != topologyPolicyNVLink {
+		t.Errorf("expected the nvlink policy by default, got %v (%v)", r, err)
+	}
+	for _, invalid := range []string{"count:0", "count:two", "policy:nvlink", "count:2,policy:numa", "count:2,0"} {
+		if _, err := parseTopologyRequest(invalid); err == nil {
+			t.Errorf("parseTopologyRequest(%s) didn't fail", invalid)
+		}
+	}
+}
+
+func TestAllocator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ledger := path.Join(dir, "ledger.json")
+	socket := path.Join(dir, "allocator.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newAllocatorServer(ledger)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("unix:"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	a := allocator.NewAllocatorClient(conn)
+	ctx := context.Background()
+
+	reply, err := a.Allocate(ctx, &allocator.AllocateRequest{Owner: "ci-runner", Uuids: []string{"GPU-1ef", "GPU-2ef"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Entries) != 2 || reply.Entries[0].Owner != "ci-runner" || reply.Entries[0].Since.AsTime().IsZero() {
+		t.Fatalf("unexpected entries %v", reply.Entries)
+	}
+	var tests = []struct {
+		description string
+		request     *allocator.AllocateRequest
+		code        codes.Code
+	}{
+		{"held by another owner", &allocator.AllocateRequest{Owner: "batch", Uuids: []string{"GPU-2ef"}}, codes.FailedPrecondition},
+		{"no owner", &allocator.AllocateRequest{Uuids: []string{"GPU-3ef"}}, codes.InvalidArgument},
+		{"no GPU", &allocator.AllocateRequest{Owner: "batch"}, codes.InvalidArgument},
+	}
+	for _, tc := range tests {
+		if _, err := a.Allocate(ctx, tc.request); status.Code(err) != tc.code {
+			t.Errorf("%s: expected %v, got %v", tc.description, tc.code, err)
+		}
+	}
+
+	if err := checkLedger(ledger, []string{"GPU-1ef"}, "", ""); err == nil {
+		t.Fatal("expected an error for a reserved GPU")
+	}
+	if err := checkLedger(ledger, []string{"GPU-1ef", "GPU-3ef"}, "ci-runner", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLedger(ledger, []string{"GPU-1ef"}, "", "ci-runner"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Release(ctx, &allocator.ReleaseRequest{Owner: "ci-runner"}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := a.List(ctx, &allocator.ListRequest{})
+	if err != nil || len(list.Entries) != 0 {
+		t.Fatalf("expected an empty ledger, got %v (%v)", list.GetEntries(), err)
+	}
+}
+
+func TestHoldContainerGPUs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ledger := path.Join(dir, "ledger.json")
+
+	if err := holdContainerGPUs(ledger, "ctr1", os.Getpid(), []string{"GPU-1ef"}, "", false, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := holdContainerGPUs(ledger, "ctr2", os.Getpid(), []string{"GPU-1ef"}, "", true, 0, 0); err == nil {
+		t.Fatal("expected an error for a GPU held exclusively")
+	}
+	if err := holdContainerGPUs(ledger, "ctr2", os.Getpid(), []string{"GPU-2ef"}, "", true, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := holdContainerGPUs(ledger, "ctr3", os.Getpid(), []string{"GPU-2ef"}, "", true, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := holdContainerGPUs(ledger, "ctr4", os.Getpid(), []string{"GPU-2ef"}, "", false, 0, 0); err == nil {
+		t.Fatal("expected an error for an exclusive request of a shared GPU")
+	}
+
+	// The holders whose process is gone are released.
+	releaseContainerGPUs(ledger, "ctr1")
+	if err := holdContainerGPUs(ledger, "ctr5", 1<<30, []string{"GPU-1ef"}, "", false, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := holdContainerGPUs(ledger, "ctr6", os.Getpid(), []string{"GPU-1ef"}, "", false, 0, 0); err != nil {
+		t.Fatalf("the GPU of a stopped container is still held: %v", err)
+	}
+
+	// With a timeout, the request waits for the holder to stop.
+	cmd := exec.Command("sleep", "0.3")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go cmd.Wait()
+	if err := holdContainerGPUs(ledger, "ctr7", cmd.Process.Pid, []string{"GPU-3ef"}, "", false, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := holdContainerGPUs(ledger, "ctr8", os.Getpid(), []string{"GPU-3ef"}, "", false, 100*time.Millisecond, 50*time.Millisecond); err == nil {
+		t.Fatal("expected an error past the timeout")
+	}
+	if err := holdContainerGPUs(ledger, "ctr8", os.Getpid(), []string{"GPU-3ef"}, "", false, 5*time.Second, 50*time.Millisecond); err != nil {
+		t.Fatalf("the request didn't wait for the holder: %v", err)
+	}
+}
+
+func TestGetUnhealthyGPUs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.MkdirAll(path.Join(dir, "usr/bin"), 0755)
+	smi := path.Join(dir, "usr/bin/nvidia-smi")
+
+	hook := getDefaultHookConfig()
+	hook.Health.XIDs = nil
+	hook.NvidiaContainerCLI.Root = &dir
+	hook.NvidiaContainerCLI.Retries = 0
+	cli := path.Join(dir, "nvidia-container-cli")
+	ioutil.WriteFile(cli, []byte("#!/bin/sh\nexit 1\n"), 0755)
+	hook.NvidiaContainerCLI.Path = &cli
+	ioutil.WriteFile(smi, []byte("#!/bin/sh\n"+
+		"echo '0, GPU-1ef, 00000000:3B:00.0, 0, No'\n"+
+		"echo '1, GPU-2ef, 00000000:86:00.0, 2, Yes'\n"+
+		"echo '2, GPU-3ef, 00000000:AF:00.0, [N/A], [N/A]'\n"), 0755)
+	unhealthy, err := getUnhealthyGPUs(hook, "all")
+	if err != nil || !reflect.DeepEqual(unhealthy, []string{"GPU-2ef (2 uncorrectable ECC errors, retired pages pending, the GPU needs a reset)"}) {
+		t.Fatalf("unexpected unhealthy GPUs %v (%v)", unhealthy, err)
+	}
+	if unhealthy, err := getUnhealthyGPUs(hook, "0,2"); err != nil || len(unhealthy) > 0 {
+		t.Fatalf("unexpected unhealthy GPUs %v (%v)", unhealthy, err)
+	}
+
+	ioutil.WriteFile(smi, []byte("#!/bin/sh\n"+
+		"echo 'Unable to determine the device handle for GPU0000:86:00.0: GPU is lost.  Reboot the system to recover this GPU'\n"+
+		"exit 15\n"), 0755)
+	unhealthy, err = getUnhealthyGPUs(hook, "1")
+	if err != nil || len(unhealthy) != 1 || !strings.Contains(unhealthy[0], "GPU is lost") {
+		t.Fatalf("unexpected unhealthy GPUs %v (%v)", unhealthy, err)
+	}
+}
+
+func TestGPUModes(t *testing.T) {
+	annotations := map[string]string{computeModeAnnotation: "exclusive_process"}
+	env := map[string]string{envNVComputeMode: "DEFAULT", envNVPersistenceMode: "enabled"}
+	if mode, err := getRequestedMode(annotations, env, computeModeAnnotation, envNVComputeMode, computeModes); err != nil || mode != "EXCLUSIVE_PROCESS" {
+		t.Fatalf("expected the compute mode of the annotation, got %s (%v)", mode, err)
+	}
+	if mode, err := getRequestedMode(annotations, env, persistenceModeAnnotation, envNVPersistenceMode, persistenceModes); err != nil || mode != "ENABLED" {
+		t.Fatalf("expected the persistence mode of the environment, got %s (%v)", mode, err)
+	}
+	if _, err := getRequestedMode(nil, map[string]string{envNVComputeMode: "shared"}, computeModeAnnotation, envNVComputeMode, computeModes); err == nil {
+		t.Fatal("expected an invalid compute mode")
+	}
+
+	config := GPUModesConfig{AllowedComputeModes: []string{"exclusive_process"}}
+	if err := checkGPUModes(config, &nvidiaConfig{ComputeMode: "EXCLUSIVE_PROCESS"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkGPUModes(config, &nvidiaConfig{ComputeMode: "PROHIBITED"}); err == nil {
+		t.Fatal("expected a compute mode not allowed")
+	}
+	if err := checkGPUModes(config, &nvidiaConfig{PersistenceMode: "ENABLED"}); err == nil {
+		t.Fatal("expected the persistence mode not allowed")
+	}
+
+	power, clocks, err := getRequestedLimits(map[string]string{powerLimitAnnotation: "250W", gpuClocksAnnotation: "1200, 1400MHz"})
+	if err != nil || power != 250 || clocks != "1200,1400" {
+		t.Fatalf("unexpected limits %d %s (%v)", power, clocks, err)
+	}
+	if _, clocks, _ := getRequestedLimits(map[string]string{gpuClocksAnnotation: "1300"}); clocks != "1300,1300" {
+		t.Fatalf("expected the clocks locked at 1300, got %s", clocks)
+	}
+	for _, a := range []map[string]string{{powerLimitAnnotation: "high"}, {gpuClocksAnnotation: "1400,1200"}} {
+		if _, _, err := getRequestedLimits(a); err == nil {
+			t.Fatalf("expected invalid limits %v", a)
+		}
+	}
+	config.AllowedPowerLimit, config.AllowedGPUClocks = []int{100, 300}, []int{210, 1410}
+	if err := checkGPUModes(config, &nvidiaConfig{PowerLimit: 250, GPUClocks: "1200,1400"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkGPUModes(config, &nvidiaConfig{PowerLimit: 350}); err == nil {
+		t.Fatal("expected a power limit out of range")
+	}
+	if err := checkGPUModes(config, &nvidiaConfig{GPUClocks: "1200,1500"}); err == nil {
+		t.Fatal("expected GPU clocks out of range")
+	}
+
+	dir, err := ioutil.TempDir("", "gpu-modes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.MkdirAll(path.Join(dir, "usr/bin"), 0755)
+	calls := path.Join(dir, "calls")
+	ioutil.WriteFile(path.Join(dir, "usr/bin/nvidia-smi"), []byte("#!/bin/sh\necho \"$@\" >> "+calls+"\n"), 0755)
+	cli := getDefaultHookConfig().NvidiaContainerCLI
+	cli.Root = &dir
+
+	entries := []GPUModeEntry{
+		{Container: "c1", UUID: "GPU-1ef", ComputeMode: "DEFAULT"},
+		{Container: "c1", UUID: "GPU-2ef", PersistenceMode: "DISABLED"},
+		{Container: "c1", UUID: "GPU-3ef"},
+		{Container: "c1", UUID: "GPU-4ef", PowerLimit: "300.00", GPUClocksLocked: true},
+	}
+	if err := restoreGPUModes(cli, entries); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(calls)
+	if expected := "-i GPU-1ef -c DEFAULT\n-i GPU-2ef -pm DISABLED\n-i GPU-4ef -pl 300.00\n-i GPU-4ef -rgc\n"; string(b) != expected {
+		t.Fatalf("expected the calls %q, got %q", expected, b)
+	}
+}
+
+func TestVFIOGPUs(t *testing.T) {
+	sysfs, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sysfs)
+	for _, d := range []struct{ id, vendor, class, driver, group string }{
+		{"0000:00:02.0", "0x8086", "0x030000", "i915", "1"},
+		{"0000:3b:00.0", nvidiaPCIVendor, "0x030200", vfioPCIDriver, "12"},
+		{"0000:3b:00.1", nvidiaPCIVendor, "0x040300", vfioPCIDriver, "12"},
+		{"0000:86:00.0", nvidiaPCIVendor, "0x030200", "nvidia", "40"},
+	} {
+		dir := path.Join(sysfs, d.id)
+		os.MkdirAll(dir, 0755)
+		ioutil.WriteFile(path.Join(dir, "vendor"), []byte(d.vendor+"\n"), 0644)
+		ioutil.WriteFile(path.Join(dir, "class"), []byte(d.class+"\n"), 0644)
+		os.Symlink("../../../bus/pci/drivers/"+d.driver, path.Join(dir, "driver"))
+		os.Symlink("../../../kernel/iommu_groups/"+d.group, path.Join(dir, "iommu_group"))
+	}
+
+	gpus, err := getVFIOGPUs(sysfs)
+	expected := []vfioGPU{{"0000:3b:00.0", vfioPCIDriver, "12"}, {"0000:86:00.0", "nvidia", "40"}}
+	if err != nil || !reflect.DeepEqual(gpus, expected) {
+		t.Fatalf("expected %v, got %v (%v)", expected, gpus, err)
+	}
+	for _, devices := range []string{"0", "0000:3B:00.0"} {
+		if selected, err := selectVFIOGPUs(gpus, devices); err != nil || !reflect.DeepEqual(selected, gpus[:1]) {
+			t.Errorf("unexpected GPUs %v selected by %s (%v)", selected, devices, err)
+		}
+	}
+	for _, devices := range []string{"all", "1", "2", "GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785"} {
+		if _, err := selectVFIOGPUs(gpus, devices); err == nil {
+			t.Errorf("expected %s not passed through", devices)
+		}
+	}
+	if !isVMRuntime(map[string]string{"io.katacontainers.config.hypervisor.default_memory": "4096"}) || isVMRuntime(nil) {
+		t.Error("expected the Kata containers only to run in a VM")
+	}
+}
+
+func TestGetExcludedUtilityFiles(t *testing.T) {
+	if files := getExcludedUtilityFiles(utilityFilesAll); files != nil {
+		t.Errorf("expected nothing excluded, got %v", files)
+	}
+	if files := getExcludedUtilityFiles(utilityFilesLibraries); !reflect.DeepEqual(files, utilityBinaries) {
+		t.Errorf("expected all binaries excluded, got %v", files)
+	}
+	expected := []string{"/usr/bin/nvidia-debugdump", "/usr/bin/nvidia-persistenced"}
+	if files := getExcludedUtilityFiles(utilityFilesSMI); !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %v excluded, got %v", expected, files)
+	}
+	mustPanic(t, func() { getExcludedUtilityFiles("foo") })
+}
+
+func TestParseMIGCreateOutput(t *testing.T) {
+	out := "Successfully created GPU instance ID  1 on GPU  0 using profile MIG 3g.20gb (ID  9)\n" +
+		"Successfully created compute instance ID  0 on GPU  0 GPU instance ID  1 using profile MIG 3g.20gb (ID  2)\n"
+	m, err := parseMIGCreateOutput(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.GPUUUID = "GPU-1ef"
+	if m.device() != "MIG-GPU-1ef/1/0" || m.GPU != "0" {
+		t.Fatalf("unexpected MIG instance %#v", m)
+	}
+
+	if _, err := parseMIGCreateOutput("Unable to create a GPU instance on GPU  0 using profile 3g.20gb: Insufficient Resources"); err == nil {
+		t.Fatal("expected an error for a failed creation")
+	}
+}
+
+func TestTeardownMIG(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	defer func(d string) { migStateDir = d }(migStateDir)
+	migStateDir = path.Join(dir, "state")
+	calls := path.Join(dir, "calls")
+	os.MkdirAll(path.Join(dir, "usr/bin"), 0755)
+	ioutil.WriteFile(path.Join(dir, "usr/bin/nvidia-smi"), []byte("#!/bin/sh\n"+
+		"case \"$1\" in\n"+
+		"--query-gpu=*) echo '0, GPU-1ef, Enabled'; echo '1, GPU-2ef, Enabled' ;;\n"+
+		"mig) echo \"$@\" >>"+calls+"\n"+
+		"  [ \"$4\" = -cgi ] && echo \"Successfully created GPU instance ID  1 on GPU  $3 using profile MIG 3g.20gb (ID  9)\" &&\n"+
+		"  echo \"Successfully created compute instance ID  0 on GPU  $3 GPU instance ID  1 using profile MIG 3g.20gb (ID  2)\" ;;\n"+
+		"esac\n"+
+		"exit 0\n"), 0755)
+	hook := getDefaultHookConfig()
+	hook.NvidiaContainerCLI.Root = &dir
+	hook.NvidiaContainerCLI.DiscoveryCache = ""
+	hook.DeniedDevices = []string{"0"}
+	container := containerConfig{ID: "ctr", Nvidia: &nvidiaConfig{}}
+
+	// A step failing after the provisioning destroys the instance, created on the allowed GPU.
+	func() {
+		defer func() { recover() }()
+		if device := provisionMIG(hook, container, "3g.20gb"); device != "MIG-GPU-2ef/1/0" {
+			t.Errorf("unexpected MIG device %s", device)
+		}
+		defer teardownMIG(hook, container.ID)
+		fail(exitCodePolicy, fmt.Errorf("quota exceeded"))
+	}()
+	b, _ := ioutil.ReadFile(calls)
+	expected := "mig -i 1 -cgi 3g.20gb -C\nmig -i 1 -gi 1 -ci 0 -dci\nmig -i 1 -gi 1 -dgi\n"
+	if string(b) != expected {
+		t.Errorf("expected the calls %q, got %q", expected, b)
+	}
+	if _, err := os.Stat(migStatePath(container.ID)); !os.IsNotExist(err) {
+		t.Errorf("the MIG state wasn't removed: %v", err)
+	}
+}
+
+func TestNVContainer(t *testing.T) {
+	var tests = []struct {
+		env      []string
+		opts     nvcontainer.Options
+		expected *nvcontainer.Request
+	}{
+		{[]string{}, nvcontainer.Options{}, nil},
+		{[]string{"NVIDIA_VISIBLE_DEVICES=void"}, nvcontainer.Options{}, nil},
+		{[]string{"NVIDIA_VISIBLE_DEVICES=0,1"}, nvcontainer.Options{}, &nvcontainer.Request{Devices: "0,1", Capabilities: "utility"}},
+		{[]string{"NVIDIA_VISIBLE_DEVICES=none", "NVIDIA_DRIVER_CAPABILITIES=all", "NVIDIA_DISABLE_REQUIRE=1"}, nvcontainer.Options{AllCapabilities: "compute,utility"},
+			&nvcontainer.Request{Capabilities: "compute,utility", DisableRequire: true}},
+		{[]string{"NVIDIA_VISIBLE_DEVICES=all"}, nvcontainer.Options{MountGPUOnlyByUUID: true}, &nvcontainer.Request{Capabilities: "utility"}},
+		{[]string{"NVIDIA_VISIBLE_DEVICES=all", "NVIDIA_VISIBLE_DEVICES=GPU-83d7ced8"}, nvcontainer.Options{MountGPUOnlyByUUID: true},
+			&nvcontainer.Request{Devices: "GPU-83d7ced8", Capabilities: "utility"}},
+		{[]string{"CUDA_VERSION=9.0"}, nvcontainer.Options{}, &nvcontainer.Request{Devices: "all", Capabilities: nvcontainer.AllCapabilities, Requirements: []string{"cuda>=9.0"}}},
+	}
+	for i, c := range tests {
+		req, err := nvcontainer.ResolveDevices(c.env, c.opts)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(req, c.expected) {
+			t.Fatalf("%d: expected %+v got %+v", i, c.expected, req)
+		}
+	}
+	if _, err := nvcontainer.ResolveDevices([]string{"NVIDIA_VISIBLE_DEVICES"}, nvcontainer.Options{}); err == nil {
+		t.Fatal("invalid environment accepted")
+	}
+
+	spec := map[string]interface{}{"process": map[string]interface{}{"env": []interface{}{"A=1"}}, "ociVersion": "1.0.0"}
+	edits := nvcontainer.ContainerEdits{
+		Env:         []string{"B=2"},
+		DeviceNodes: []nvcontainer.DeviceNode{{Path: "/dev/nvidia0", Major: 195}},
+		Mounts:      []nvcontainer.Mount{{HostPath: "/usr/lib/libcuda.so", ContainerPath: "/usr/lib/libcuda.so", Options: []string{"ro"}}},
+		Hooks:       []nvcontainer.Hook{{HookName: "createContainer", Path: "/usr/bin/ldconfig"}},
+	}
+	if err := nvcontainer.ApplyToSpec(spec, edits); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(spec)
+	expected := `{"hooks":{"createContainer":[{"path":"/usr/bin/ldconfig"}]},` +
+		`"linux":{"devices":[{"fileMode":438,"major":195,"minor":0,"path":"/dev/nvidia0","type":"c"}],` +
+		`"resources":{"devices":[{"access":"rwm","allow":true,"major":195,"minor":0,"type":"c"}]}},` +
+		`"mounts":[{"destination":"/usr/lib/libcuda.so","options":["rbind","ro"],"source":"/usr/lib/libcuda.so","type":"bind"}],` +
+		`"ociVersion":"1.0.0","process":{"env":["A=1","B=2"]}}`
+	if string(b) != expected {
+		t.Fatalf("expected %s got %s", expected, b)
+	}
+}
+
+func TestIsGPURequested(t *testing.T) {
+	dir, err := ioutil.TempDir("", "requested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "8dbc5577-d0e2-4706-8787-57d52c03ddf2.json"), []byte(`{"containers": {"cuda": ["GPU-1ef"]}}`), 0644)
+	pod := &oci.Linux{CgroupsPath: "/kubepods/pod8dbc5577-d0e2-4706-8787-57d52c03ddf2/ctr"}
+	mounts := []oci.Mount{{Destination: "/var/run/nvidia-container-devices/GPU-1ef", Source: "/dev/null"}}
+	allocations := nvcontainer.RequestOptions{DevicePluginAllocations: dir, MountGPUOnlyByUUID: true}
+
+	tests := []struct {
+		env         []string
+		annotations map[string]string
+		mounts      []oci.Mount
+		linux       *oci.Linux
+		opts        nvcontainer.RequestOptions
+		expected    bool
+	}{
+		{nil, nil, nil, nil, nvcontainer.RequestOptions{}, false},
+		{[]string{"NVIDIA_VISIBLE_DEVICES=0"}, nil, nil, nil, nvcontainer.RequestOptions{}, true},
+		{[]string{"CUDA_VERSION=8.0.61"}, nil, nil, nil, nvcontainer.RequestOptions{}, true},
+		// The annotations and the volume mounts only with their request sources.
+		{nil, map[string]string{"com.nvidia.devices": "0"}, nil, nil, nvcontainer.RequestOptions{}, false},
+		{nil, map[string]string{"com.nvidia.devices": "0"}, nil, nil, nvcontainer.RequestOptions{Sources: []string{"annotations"}}, true},
+		{nil, nil, mounts, nil, nvcontainer.RequestOptions{}, false},
+		{nil, nil, mounts, nil, nvcontainer.RequestOptions{Sources: []string{"volume-mounts", "env"}}, true},
+		{[]string{"NVIDIA_VISIBLE_DEVICES=0"}, nil, nil, nil, nvcontainer.RequestOptions{Sources: []string{"volume-mounts"}}, false},
+		// The Swarm resources, numbered or not.
+		{[]string{"DOCKER_RESOURCE_GPU_1=GPU-1ef"}, nil, nil, nil, nvcontainer.RequestOptions{SwarmResource: "DOCKER_RESOURCE_GPU"}, true},
+		{[]string{"DOCKER_RESOURCE_GPU=GPU-1ef"}, nil, nil, nil, nvcontainer.RequestOptions{}, false},
+		// The allocations of the device plugin replace the other requests of the pods.
+		{nil, map[string]string{"io.kubernetes.cri.container-name": "cuda"}, nil, pod, allocations, true},
+		{[]string{"NVIDIA_VISIBLE_DEVICES=GPU-1ef"}, map[string]string{"io.kubernetes.cri.container-name": "sidecar"}, nil, pod, allocations, false},
+		{[]string{"NVIDIA_VISIBLE_DEVICES=GPU-1ef"}, map[string]string{"io.kubernetes.cri.container-name": "sidecar"}, nil, nil, allocations, true},
+	}
+	for i, c := range tests {
+		spec := &oci.Spec{Process: &oci.Process{Env: c.env}, Annotations: c.annotations, Mounts: c.mounts, Linux: c.linux}
+		if requested, err := nvcontainer.IsGPURequested(spec, c.opts); err != nil || requested != c.expected {
+			t.Errorf("%d: expected %v got %v (%v)", i, c.expected, requested, err)
+		}
+	}
+	if _, err := nvcontainer.IsGPURequested(&oci.Spec{}, nvcontainer.RequestOptions{Sources: []string{"labels"}}); err == nil {
+		t.Error("expected an error for an unknown request source")
+	}
+}
+
+func TestResolveCDIDevices(t *testing.T) {
+	specs := []cdiSpec{{
+		Kind:           "nvidia.com/gpu",
+		ContainerEdits: cdiContainerEdits{DeviceNodes: []cdiDeviceNode{{Path: "/dev/nvidiactl"}}},
+		Devices: []cdiDevice{
+			{Name: "0", ContainerEdits: cdiContainerEdits{DeviceNodes: []cdiDeviceNode{{Path: "/dev/nvidia0"}}}},
+			{Name: "1", ContainerEdits: cdiContainerEdits{DeviceNodes: []cdiDeviceNode{{Path: "/dev/nvidia1"}}}},
+		},
+	}}
+
+	edits, err := resolveCDIDevices(specs, "0,nvidia.com/gpu=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, e := range edits {
+		for _, d := range e.DeviceNodes {
+			paths = append(paths, d.Path)
+		}
+	}
+	if !reflect.DeepEqual(paths, []string{"/dev/nvidiactl", "/dev/nvidia0", "/dev/nvidia1"}) {
+		t.Fatalf("unexpected device nodes %v", paths)
+	}
+
+	if _, err := resolveCDIDevices(specs, "vendor.com/fpga=0"); err == nil {
+		t.Fatal("unknown device kind resolved")
+	}
+}
+
+func TestLoadCDISpecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cdi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	etc, run := path.Join(dir, "etc"), path.Join(dir, "run")
+	os.MkdirAll(etc, 0755)
+	os.MkdirAll(run, 0755)
+	ioutil.WriteFile(path.Join(etc, "nvidia.json"), []byte(`{"cdiVersion": "0.5.0", "kind": "nvidia.com/gpu", "devices": [{"name": "0"}]}`), 0644)
+	ioutil.WriteFile(path.Join(run, "nvidia.yaml"), []byte("cdiVersion: 0.5.0\n"+
+		"kind: nvidia.com/gpu\n"+
+		"devices:\n"+
+		"- name: \"0\"\n"+
+		"  containerEdits:\n"+
+		"    deviceNodes:\n"+
+		"    - path: /dev/nvidia0\n"+
+		"      major: 195\n"+
+		"    mounts:\n"+
+		"    - hostPath: /usr/bin/nvidia-smi\n"+
+		"      containerPath: /usr/bin/nvidia-smi\n"+
+		"      options: [ro, nosuid]\n"), 0644)
+
+	specs := loadCDISpecs([]string{etc, run})
+	if len(specs) != 2 || len(specs[0].Devices) != 1 {
+		t.Fatalf("unexpected specs %+v", specs)
+	}
+	edits := specs[0].Devices[0].ContainerEdits
+	expected := cdiContainerEdits{
+		DeviceNodes: []cdiDeviceNode{{Path: "/dev/nvidia0", Major: 195}},
+		Mounts:      []cdiMount{{HostPath: "/usr/bin/nvidia-smi", ContainerPath: "/usr/bin/nvidia-smi", Options: []string{"ro", "nosuid"}}},
+	}
+	if !reflect.DeepEqual(edits, expected) {
+		t.Errorf("the YAML spec doesn't have the precedence: %+v", edits)
+	}
+
+	ioutil.WriteFile(path.Join(run, "broken.yml"), []byte("kind: [nvidia.com/gpu\n"), 0644)
+	if _, err := nvcontainer.LoadCDISpecs([]string{run}); err == nil || !strings.Contains(err.Error(), "broken.yml") {
+		t.Errorf("expected a decoding error of broken.yml, got %v", err)
+	}
+}
+
+func TestGetMIGParent(t *testing.T) {
+	tests := map[string]string{
+		"MIG-GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785/1/0": "GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785",
+		"0:1": "0",
+		"MIG-3b1f2b6c-a8e4-5b3e-9e46-2c2f2b6fda4d": "",
+		"GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785": "",
+	}
+	for d, expected := range tests {
+		if parent, _ := getMIGParent(d); parent != expected {
+			t.Fatalf("getMIGParent(%s): expected %q got %q", d, expected, parent)
+		}
+	}
+
+	if !isRequested("MIG-GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785/1/0", "0", "GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785") {
+		t.Fatal("the parent GPU of a MIG device isn't requested")
+	}
+	if err := devices.ValidateMIGDevices("0,MIG-GPU-83d7ced8/1"); err == nil {
+		t.Fatal("invalid MIG device accepted")
+	}
+}
+
+func TestGetHookConfigDropIn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hook-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := path.Join(dir, "config.toml")
+	files := map[string]string{
+		"config.toml":             "disable-require = true\nmount-gpu-only-by-uuid = true\n[nvidia-container-cli]\nload-kmods = false\n",
+		"config.toml.d/10-a.toml": "mount-gpu-only-by-uuid = false\n[nvidia-container-cli]\nroot = \"/a\"\n",
+		"config.toml.d/20-b.toml": "[nvidia-container-cli]\nroot = \"/b\"\n",
+		"config.toml.d/README":    "ignored",
+	}
+	for name, content := range files {
+		os.MkdirAll(path.Dir(path.Join(dir, name)), 0755)
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(p string) { *configflag = p }(*configflag)
+	*configflag = config
+	hook := getHookConfig()
+	if !hook.DisableRequire || hook.MountGPUOnlyByUUID || hook.NvidiaContainerCLI.LoadKmods {
+		t.Fatalf("unexpected configuration %+v", hook)
+	}
+	if hook.NvidiaContainerCLI.Root == nil || *hook.NvidiaContainerCLI.Root != "/b" {
+		t.Fatalf("unexpected root %v", hook.NvidiaContainerCLI.Root)
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	env := map[string]string{
+		"NVIDIA_CONTAINER_RUNTIME_HOOK_MOUNT_GPU_ONLY_BY_UUID":    "true",
+		"NVIDIA_CONTAINER_RUNTIME_HOOK_KERNEL_MODULES":            "nvidia,nvidia_uvm",
+		"NVIDIA_CONTAINER_RUNTIME_HOOK_BUSY_TIMEOUT":              "30s",
+		"NVIDIA_CONTAINER_RUNTIME_HOOK_INJECT_MODESET":            "false",
+		"NVIDIA_CONTAINER_RUNTIME_HOOK_NVIDIA_CONTAINER_CLI_ROOT": "/run/nvidia/driver",
+		"NVIDIA_CONTAINER_RUNTIME_HOOK_MIG_PROVISIONING":          "1",
+		"NVIDIA_CONTAINER_RUNTIME_HOOK_PARALLELISM":               "4",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	config := getDefaultHookConfig()
+	if err := configfile.ApplyEnvOverrides(&config, envHookConfigPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if !config.MountGPUOnlyByUUID || !config.MIG.Provisioning || config.BusyTimeout.Seconds() != 30 || config.Parallelism != 4 {
+		t.Fatalf("unexpected configuration %+v", config)
+	}
+	if !reflect.DeepEqual(config.KernelModules, []string{"nvidia", "nvidia_uvm"}) {
+		t.Fatalf("unexpected kernel modules %v", config.KernelModules)
+	}
+	if config.InjectModeset == nil || *config.InjectModeset || *config.NvidiaContainerCLI.Root != "/run/nvidia/driver" {
+		t.Fatalf("unexpected configuration %+v", config)
+	}
+
+	os.Setenv("NVIDIA_CONTAINER_RUNTIME_HOOK_DISABLE_REQUIRE", "maybe")
+	defer os.Unsetenv("NVIDIA_CONTAINER_RUNTIME_HOOK_DISABLE_REQUIRE")
+	if err := configfile.ApplyEnvOverrides(&config, envHookConfigPrefix); err == nil {
+		t.Fatal("invalid boolean accepted")
+	}
+	os.Unsetenv("NVIDIA_CONTAINER_RUNTIME_HOOK_DISABLE_REQUIRE")
+	os.Setenv("NVIDIA_CONTAINER_RUNTIME_HOOK_PARALLELISM", "four")
+	if err := configfile.ApplyEnvOverrides(&config, envHookConfigPrefix); err == nil {
+		t.Fatal("invalid integer accepted")
+	}
+}
+
+func TestCheckContainerEnv(t *testing.T) {
+	if err := configfile.CheckContainerEnv([]string{"NCCL_SOCKET_IFNAME=eth1", "NCCL_DEBUG="}); err != nil {
+		t.Errorf("CheckContainerEnv: unexpected error %v", err)
+	}
+	for _, e := range []string{"NCCL_DEBUG", "=INFO"} {
+		if err := configfile.CheckContainerEnv([]string{e}); err == nil {
+			t.Errorf("CheckContainerEnv(%s): expected an error", e)
+		}
+	}
+}
+
+func TestConfigSearchPaths(t *testing.T) {
+	for _, p := range []string{configfile.DefaultPath, configfile.VendorPath} {
+		if _, err := os.Stat(p); err == nil {
+			t.Skip("configuration file found in", p)
+		}
+	}
+	dir, err := ioutil.TempDir("", "xdg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_CONFIG_HOME", os.Getenv("XDG_CONFIG_HOME"))
+	os.Setenv("XDG_CONFIG_HOME", dir)
+
+	user := path.Join(dir, "nvidia-container-runtime", "config.toml")
+	if paths := configfile.SearchPaths(); paths[len(paths)-1] != user {
+		t.Fatalf("unexpected search paths %v", paths)
+	}
+	if p := configfile.Find(); p != configfile.DefaultPath {
+		t.Errorf("expected the default path without configuration, got %s", p)
+	}
+	os.MkdirAll(path.Join(dir, "nvidia-container-runtime", "config.toml.d"), 0755)
+	ioutil.WriteFile(path.Join(dir, "nvidia-container-runtime", "config.toml.d", "10-user.toml"), []byte("debug = true\n"), 0644)
+	if p := configfile.Find(); p != user {
+		t.Errorf("expected %s, got %s", user, p)
+	}
+}
+
+func TestWriteConfigAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := path.Join(dir, "config.toml")
+	ioutil.WriteFile(config, []byte("policy-version = \"1\"\n"), 0644)
+
+	if err := configfile.WriteAtomic(config, []byte("policy-version = \"2\"\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	hook := getDefaultHookConfig()
+	if _, err := configfile.Load(config, &hook); err != nil || hook.PolicyVersion != "2" {
+		t.Fatalf("unexpected policy version %s (%v)", hook.PolicyVersion, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 || files[0].Mode().Perm() != 0640 {
+		t.Errorf("unexpected files %v", files)
+	}
+}
+
+func TestHookLogger(t *testing.T) {
+	var out bytes.Buffer
+	l := &hookLogger{out: &out, level: levelInfo, format: logFormatJSON, id: "ctr", bundle: "/b"}
+	l.output(levelDebug, "hidden")
+	l.output(levelWarning, "shown")
+
+	var e logEntry
+	if err := json.Unmarshal([]byte(out.String()), &e); err != nil {
+		t.Fatalf("invalid JSON line %q: %v", out.String(), err)
+	}
+	if e.Level != "warning" || e.Message != "shown" || e.ID != "ctr" || e.Bundle != "/b" {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	out.Reset()
+	l.format = logFormatText
+	l.pod = getPodMetadata(map[string]string{"io.kubernetes.cri.sandbox-namespace": "ml", "io.kubernetes.cri.sandbox-name": "train-0",
+		"io.kubernetes.cri.container-name": "cuda"}, "/kubepods/besteffort/pod0b6a3b7a-6a8b-4a4e-9c5e-5f2b1c1d8e3f/ctr")
+	l.output(levelError, "failed")
+	expected := `pod_namespace="ml" pod_name="train-0" pod_uid="0b6a3b7a-6a8b-4a4e-9c5e-5f2b1c1d8e3f" container_name="cuda"`
+	if !strings.Contains(out.String(), expected) {
+		t.Fatalf("expected %s in %q", expected, out.String())
+	}
+	if s := l.pod.String(); s != "pod ml/train-0 (0b6a3b7a-6a8b-4a4e-9c5e-5f2b1c1d8e3f) container cuda" {
+		t.Fatalf("unexpected pod %s", s)
+	}
+	if getPodMetadata(map[string]string{"io.kubernetes.pod.uid": "u"}, "").UID != "u" || getPodMetadata(nil, "/docker/ctr").isSet() {
+		t.Fatal("unexpected pod metadata")
+	}
+}
+
+func TestLoadSpec(t *testing.T) {
+	f, err := ioutil.TempFile("", "config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `{"process": {"env": ["CUDA_VERSION=foo"]}, "root": {"path": "rootfs"}}`)
+	f.Close()
+
+	s, err := oci.LoadSpec(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := s.Getenv("CUDA_VERSION"); !ok || v != "foo" {
+		t.Fatalf("unexpected CUDA_VERSION %q", v)
+	}
+	if _, ok := s.Getenv("CUDA"); ok {
+		t.Fatal("CUDA found in the environment")
+	}
+	env, err := getEnvMap(s.Process.Env, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getNvidiaConfig(env, false); err == nil {
+		t.Fatal("invalid CUDA_VERSION accepted")
+	}
+
+	if _, err := getEnvMap([]string{"NVIDIA_VISIBLE_DEVICES"}, false); err == nil {
+		t.Fatal("invalid environment accepted")
+	}
+	if _, err := oci.LoadSpec(f.Name() + ".missing"); err == nil {
+		t.Fatal("missing OCI spec loaded")
+	}
+
+	ioutil.WriteFile(f.Name(), []byte(`{"ociVersion": "1.0.0", "process": {"args": ["sh"], "env": ["A=1"], "cwd": "/"},
+		"root": {"path": "rootfs"}, "mounts": [{"destination": "/a", "source": "/b", "options": ["ro", {"x": [1]}]}, {"destination": "/c"}],
+		"linux": {"seccomp": {"syscalls": [{"names": ["read"]}]}, "cgroupsPath": "/pod"}, "hooks": {"prestart": []}, "annotations": {"k": "v"}}`), 0644)
+	s, err = oci.LoadSpec(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &oci.Spec{Process: &oci.Process{Env: []string{"A=1"}}, Root: &oci.Root{Path: "rootfs"},
+		Mounts: []oci.Mount{{Destination: "/a", Source: "/b"}, {Destination: "/c"}}, Annotations: map[string]string{"k": "v"}, Linux: &oci.Linux{CgroupsPath: "/pod"}}
+	if !reflect.DeepEqual(s, expected) {
+		t.Fatalf("expected %+v got %+v", expected, s)
+	}
+	if err := os.Truncate(f.Name(), oci.MaxSpecSize+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := oci.LoadSpec(f.Name()); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("expected the OCI spec too large, got %v", err)
+	}
+}
+
+func TestGetHookState(t *testing.T) {
+	f, err := ioutil.TempFile("", "state.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `{"id": "ctr", "pid": 42, "bundlePath": "/bundle"}`)
+	f.Close()
+
+	defer func() { *stateflag, *bundleflag = "", "" }()
+	*stateflag = f.Name()
+	h, err := getHookState()
+	if err != nil || h.ID != "ctr" || h.Pid != 42 || h.Bundle != "/bundle" {
+		t.Fatalf("unexpected state %+v (%v)", h, err)
+	}
+	*bundleflag = "/other"
+	if h, err = getHookState(); err != nil || h.ID != "ctr" || h.Bundle != "/other" {
+		t.Fatalf("unexpected state %+v (%v)", h, err)
+	}
+	*stateflag = ""
+	if h, err = getHookState(); err != nil || h.ID != "" || h.Bundle != "/other" {
+		t.Fatalf("unexpected state %+v (%v)", h, err)
+	}
+	*stateflag = f.Name() + ".missing"
+	if _, err := getHookState(); err == nil {
+		t.Fatal("missing state read")
+	}
+}
+
+func TestApplyRequestSources(t *testing.T) {
+	annotations := map[string]string{"com.nvidia.devices": "GPU-a3f", "com.nvidia.capabilities": "compute"}
+	tests := []struct {
+		sources  []string
+		expected map[string]string
+	}{
+		{[]string{"env"}, map[string]string{envNVGPU: "all", "PATH": "/bin"}},
+		{[]string{"annotations"}, map[string]string{envNVGPU: "GPU-a3f", envNVDriverCapabilities: "compute", "PATH": "/bin"}},
+		{[]string{"env", "annotations"}, map[string]string{envNVGPU: "all", envNVDriverCapabilities: "compute", "PATH": "/bin"}},
+		{[]string{"annotations", "env"}, map[string]string{envNVGPU: "GPU-a3f", envNVDriverCapabilities: "compute", "PATH": "/bin"}},
+	}
+	for _, c := range tests {
+		env := map[string]string{envNVGPU: "all", "PATH": "/bin"}
+		if _, err := applyRequestSources(env, &oci.Spec{Annotations: annotations}, c.sources, defaultDeviceListMountsRoot); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(env, c.expected) {
+			t.Errorf("applyRequestSources(%v): expected %v got %v", c.sources, c.expected, env)
+		}
+	}
+
+	if _, err := applyRequestSources(map[string]string{}, &oci.Spec{}, []string{"labels"}, defaultDeviceListMountsRoot); err == nil {
+		t.Fatal("unknown request source accepted")
+	}
+
+	mounts := []oci.Mount{
+		{Destination: "/var/run/nvidia-container-devices/GPU-a3f", Source: "/dev/null"},
+		{Destination: "/var/run/nvidia-container-devices/GPU-b4e", Source: "/dev/null"},
+		{Destination: "/var/run/nvidia-container-devices/GPU-c5d", Source: "/tmp/file"},
+		{Destination: "/var/run/other/GPU-d6c", Source: "/dev/null"},
+	}
+	env := map[string]string{envNVGPU: "all"}
+	source, err := applyRequestSources(env, &oci.Spec{Mounts: mounts}, []string{"volume-mounts"}, defaultDeviceListMountsRoot)
+	if err != nil || source != requestSourceVolumeMounts || env[envNVGPU] != "GPU-a3f,GPU-b4e" {
+		t.Fatalf("unexpected volume-mounts request %v from %s: %v", env, source, err)
+	}
+
+	// The source of the devices is the one which set them, whatever the sources without devices before it.
+	sourceTests := []struct {
+		env      map[string]string
+		mounts   []oci.Mount
+		expected string
+	}{
+		{map[string]string{envNVGPU: "0"}, nil, requestSourceEnv},
+		{map[string]string{envNVGPU: "0"}, mounts, requestSourceVolumeMounts},
+		{map[string]string{envNVDriverCapabilities: "all"}, mounts, requestSourceVolumeMounts},
+		{map[string]string{envNVDriverCapabilities: "all"}, nil, ""},
+	}
+	for _, c := range sourceTests {
+		source, err := applyRequestSources(c.env, &oci.Spec{Mounts: c.mounts}, []string{"volume-mounts", "env"}, defaultDeviceListMountsRoot)
+		if err != nil || source != c.expected {
+			t.Errorf("applyRequestSources(%v, %v): expected the source %q got %q (%v)", c.env, c.mounts, c.expected, source, err)
+		}
+	}
+}
+
+func TestCheckDevicePolicy(t *testing.T) {
+	info := &driverInfo{Devices: []deviceInfo{
+		{Index: "0", UUID: "GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785"},
+		{Index: "1", UUID: "GPU-5e2c1a77-3821-a34c-ce5d-e9264cfa8786"},
+	}}
+	tests := []struct {
+		allowed []string
+		denied  []string
+		devices string
+		ok      bool
+	}{
+		{nil, nil, "all", true},
+		{[]string{"GPU-83d7ced8-*"}, nil, "0", true},
+		{[]string{"GPU-83d7ced8-*"}, nil, "all", false},
+		{[]string{"GPU-83d7ced8-*"}, nil, "GPU-5e2c1a77-3821-a34c-ce5d-e9264cfa8786", false},
+		{nil, []string{"1"}, "0", true},
+		{nil, []string{"1"}, "GPU-5e2c1a77-3821-a34c-ce5d-e9264cfa8786", false},
+	}
+	for _, c := range tests {
+		hook := HookConfig{AllowedDevices: c.allowed, DeniedDevices: c.denied}
+		if err := policy.CheckDevices(hook, info, c.devices); (err == nil) != c.ok {
+			t.Errorf("CheckDevices(%v, %v, %s): %v", c.allowed, c.denied, c.devices, err)
+		}
+	}
+}
+
+func TestGPUList(t *testing.T) {
+	info := &driverInfo{DriverVersion: "535.104.05", CUDAVersion: "12.2", Devices: []deviceInfo{
+		{Index: "0", UUID: "GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785", BusID: "0000:3B:00.0"},
+		{Index: "1", UUID: "GPU-5e2c1a77-3821-a34c-ce5d-e9264cfa8786", BusID: "0000:86:00.0"},
+	}}
+	tree := parseMIGTree("GPU 0: A100-SXM4-40GB (UUID: GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785)\n" +
+		"  MIG 3g.20gb     Device  0: (UUID: MIG-3b1f2b6c-a8e4-5b3e-9e46-2c2f2b6fda4d)\n" +
+		"GPU 1: A100-SXM4-40GB (UUID: GPU-5e2c1a77-3821-a34c-ce5d-e9264cfa8786)\n")
+	if len(tree["0"]) != 1 || tree["0"][0].Index != "0:0" || tree["0"][0].Profile != "3g.20gb" || len(tree["1"]) != 0 {
+		t.Fatalf("unexpected MIG devices %v", tree)
+	}
+
+	list := getGPUList(HookConfig{DeniedDevices: []string{"1"}}, info, tree)
+	if !reflect.DeepEqual(list.GPUs[0].Request, []string{"0", "GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785", "00000000:3b:00.0", "all"}) ||
+		!list.GPUs[0].Allowed || list.GPUs[1].Allowed {
+		t.Errorf("unexpected GPUs %+v", list.GPUs)
+	}
+	list = getGPUList(HookConfig{MountGPUOnlyByUUID: true}, info, tree)
+	if !reflect.DeepEqual(list.GPUs[0].MIGDevices[0].Request, []string{"MIG-3b1f2b6c-a8e4-5b3e-9e46-2c2f2b6fda4d"}) {
+		t.Errorf("unexpected MIG devices %+v", list.GPUs[0].MIGDevices)
+	}
+}
+
+func TestUnknownDevices(t *testing.T) {
+	info := &driverInfo{Devices: []deviceInfo{{Index: "0", UUID: "GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785"}}}
+	migs := parseMIGList("GPU 0: A100-SXM4-40GB (UUID: GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785)\n" +
+		"  MIG 1g.5gb Device 0: (UUID: MIG-3b1f2b6c-a8e4-5b3e-9e46-2c2f2b6fda4d)\n")
+	if !reflect.DeepEqual(migs, []string{"MIG-3b1f2b6c-a8e4-5b3e-9e46-2c2f2b6fda4d"}) {
+		t.Fatalf("unexpected MIG devices %v", migs)
+	}
+
+	devices := "0,all,GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785,MIG-3b1f2b6c-a8e4-5b3e-9e46-2c2f2b6fda4d,MIG-GPU-83d7ced8-3821-a34c-ce5d-e9264cfa8785/1/0"
+	if unknown := info.UnknownDevices(devices, migs); len(unknown) > 0 {
+		t.Fatalf("unexpected unknown devices %v", unknown)
+	}
+	unknown := info.UnknownDevices("1,GPU-5e2c1a77,MIG-5e2c1a77,0:0", migs)
+	if !reflect.DeepEqual(unknown, []string{"1", "GPU-5e2c1a77", "MIG-5e2c1a77"}) {
+		t.Fatalf("unexpected unknown devices %v", unknown)
+	}
+}
+
+func TestRunCleanupStep(t *testing.T) {
+	if err := runCleanupStep(func() {}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err := runCleanupStep(func() { log.Panicln("couldn't read the container state:", "EIO") })
+	if err == nil || err.Error() != "couldn't read the container state: EIO" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = runCleanupStep(func() { fail(exitCodeCLIFailure, fmt.Errorf("nvidia-smi failed")) })
+	if err == nil || err.Error() != "nvidia-smi failed" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	var hook HookConfig
+	config := `
+default-driver-capabilities = "utility"
+allowed-devices = ["0"]
+
+[profiles.training]
+default-driver-capabilities = "compute,utility"
+allowed-devices = []
+cli-timeout = "5m"
+
+[profiles.training.nvidia-container-cli]
+no-cgroups = true
+
+[profiles.typo]
+allowed-device = ["1"]
+`
+	hook = getDefaultHookConfig()
+	if _, err := toml.Decode(config, &hook); err != nil {
+		t.Fatal(err)
+	}
+	training := hook
+	if unknown, err := applyProfile(&training, "training"); err != nil || len(unknown) > 0 {
+		t.Fatalf("unexpected error %v, unknown options %v", err, unknown)
+	}
+	if training.DefaultDriverCapabilities != "compute,utility" || len(training.AllowedDevices) != 0 ||
+		training.CLITimeout.Minutes() != 5 || !training.NvidiaContainerCLI.NoCgroups || training.LogLevel != "info" {
+		t.Errorf("unexpected configuration %+v", training)
+	}
+	if hook.DefaultDriverCapabilities != "utility" || len(hook.AllowedDevices) != 1 {
+		t.Errorf("the configuration changed: %+v", hook)
+	}
+
+	typo := hook
+	if unknown, _ := applyProfile(&typo, "typo"); !reflect.DeepEqual(unknown, []string{"profiles.typo.allowed-device"}) {
+		t.Errorf("unexpected unknown options %v", unknown)
+	}
+	if _, err := applyProfile(&typo, "inference"); err == nil {
+		t.Errorf("unknown profile applied")
+	}
+
+	s := &oci.Spec{Process: &oci.Process{Env: []string{envNVProfile + "=training"}}, Annotations: map[string]string{}}
+	hook.AcceptEnvvarUnprivileged = false
+	if name := getProfileName(hook, s); name != "" {
+		t.Errorf("profile %s of an unprivileged container", name)
+	}
+	hook.AcceptEnvvarUnprivileged = true
+	s.Annotations[profileAnnotation] = "inference"
+	if name := getProfileName(hook, s); name != "inference" {
+		t.Errorf("expected the profile of the annotation, got %s", name)
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	var keys func(typ reflect.Type, prefix string)
+	keys = func(typ reflect.Type, prefix string) {
+		for i := 0; i < typ.NumField(); i++ {
+			key := prefix + typ.Field(i).Tag.Get("toml")
+			if _, ok := configDocs[key]; !ok {
+				t.Errorf("option %s is not documented", key)
+			}
+			if ft := typ.Field(i).Type; isTable(ft) && ft.Kind() != reflect.Map {
+				if ft.Kind() == reflect.Slice {
+					ft = ft.Elem()
+				}
+				keys(ft, key+".")
+			}
+		}
+	}
+	keys(reflect.TypeOf(HookConfig{}), "")
+
+	config := getDefaultHookConfig()
+	if err := configfile.Set(&config, "nvidia-container-cli.root", "/run/nvidia/driver"); err != nil {
+		t.Fatal(err)
+	}
+	if err := configfile.Set(&config, "busy-timeout", "30s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := configfile.Set(&config, "parallelism", "4"); err != nil || config.Parallelism != 4 {
+		t.Fatalf("parallelism not set: %v", err)
+	}
+	if err := configfile.Set(&config, "nvidia-container-cli.roots", "/run/nvidia/driver"); err == nil {
+		t.Fatal("unknown option set")
+	}
+	if err := configfile.Set(&config, "mounts", "/etc/nvidia"); err == nil || !strings.Contains(err.Error(), "unsupported option type") {
+		t.Fatalf("expected an unsupported option type, got %v", err)
+	}
+	config.DriverRoots = []DriverRoot{{Root: "/opt/legacy", Devices: []string{"GPU-83d7*"}}}
+	config.Profiles = map[string]map[string]interface{}{"training": {"default-driver-capabilities": "compute,utility"}}
+
+	var b bytes.Buffer
+	writeConfig(&b, config)
+	decoded := getDefaultHookConfig()
+	md, err := toml.Decode(b.String(), &decoded)
+	if err != nil {
+		t.Fatalf("invalid configuration %v:\n%s", err, b.String())
+	}
+	if len(md.Undecoded()) > 0 {
+		t.Fatalf("unknown options %v", md.Undecoded())
+	}
+	// Unset lists are decoded as empty ones, compare the written configurations.
+	var b2 bytes.Buffer
+	writeConfig(&b2, decoded)
+	if b2.String() != b.String() || *decoded.NvidiaContainerCLI.Root != "/run/nvidia/driver" || decoded.BusyTimeout.Seconds() != 30 {
+		t.Fatalf("configuration changed:\n%s", b2.String())
+	}
+}
+
+func TestNRIPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "nvidia.json"), []byte(`{"cdiVersion": "0.5.0", "kind": "nvidia.com/gpu", "devices": [{"name": "0",
+		"containerEdits": {"env": ["FOO=bar"], "deviceNodes": [{"path": "/dev/nvidia0", "major": 195}],
+		"mounts": [{"hostPath": "/usr/bin/nvidia-smi", "containerPath": "/usr/bin/nvidia-smi", "options": ["ro"]}]}}]}`), 0644)
+	fake := path.Join(dir, "nvidia-container-cli")
+	ioutil.WriteFile(fake, []byte("#!/bin/sh\n"+
+		"echo 'NVRM version,CUDA version'; echo '460.32.03,11.2'; echo\n"+
+		"echo 'Device Index,Device Minor,Model,Brand,GPU UUID,Bus Location,Architecture'\n"+
+		"echo '0,0,Tesla T4,Tesla,GPU-1ef,00000000:00:1e.0,7.5'\n"+
+		"echo '1,1,Tesla T4,Tesla,GPU-2ef,00000000:00:1f.0,7.5'\n"), 0755)
+	hook := getDefaultHookConfig()
+	hook.Mode = modeCDI
+	hook.CDISpecDirs = []string{dir}
+	hook.NvidiaContainerCLI.Path = &fake
+	hook.NvidiaContainerCLI.Retries = 0
+	hook.DeniedDevices = []string{"1"}
+	self := "/usr/bin/nvidia-container-runtime-hook"
+
+	// The container gets the edits of the CDI spec of its device.
+	adjust, err := getNRIAdjustment(hook, self, &api.Container{Id: "ctr", Env: []string{"NVIDIA_VISIBLE_DEVICES=0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := []*api.LinuxDevice{{Path: "/dev/nvidia0", Type: "c", Major: 195, FileMode: api.FileMode(os.FileMode(0666))}}
+	mounts := []*api.Mount{{Destination: "/usr/bin/nvidia-smi", Type: "bind", Source: "/usr/bin/nvidia-smi", Options: []string{"rbind", "ro"}}}
+	env := []*api.KeyValue{{Key: "NVIDIA_VISIBLE_DEVICES", Value: "0"}, {Key: "FOO", Value: "bar"}}
+	if !reflect.DeepEqual(adjust.Linux.Devices, devices) || !reflect.DeepEqual(adjust.Mounts, mounts) || !reflect.DeepEqual(adjust.Env, env) {
+		t.Errorf("unexpected adjustment %v", adjust)
+	}
+	if adjust, err := getNRIAdjustment(hook, self, &api.Container{Id: "ctr", Env: []string{"PATH=/bin"}}); adjust != nil || err != nil {
+		t.Errorf("adjusted a container without GPUs: %v (%v)", adjust, err)
+	}
+
+	// The policies of the hook apply: the denied devices, and the requests of the unprivileged containers.
+	plugin := &nriPlugin{hook: hook, self: self}
+	pod := &api.PodSandbox{Name: "pod", Namespace: "default"}
+	if _, _, err := plugin.CreateContainer(context.Background(), pod, &api.Container{Id: "ctr", Env: []string{"NVIDIA_VISIBLE_DEVICES=1"}}); err == nil {
+		t.Error("expected the denied device to be rejected")
+	}
+	hook.AcceptEnvvarUnprivileged = false
+	if _, err := getNRIAdjustment(hook, self, &api.Container{Id: "ctr", Env: []string{"NVIDIA_VISIBLE_DEVICES=0"}}); err == nil {
+		t.Error("expected the request of the environment to be rejected")
+	}
+	hook.RequestSources = []string{requestSourceVolumeMounts, requestSourceEnv}
+	mount := &api.Mount{Destination: path.Join(defaultDeviceListMountsRoot, "0"), Source: "/dev/null"}
+	if adjust, err := getNRIAdjustment(hook, self, &api.Container{Id: "ctr", Mounts: []*api.Mount{mount}}); err != nil || len(adjust.Linux.Devices) != 1 {
+		t.Errorf("expected the request of the volume mounts to be adjusted: %v (%v)", adjust, err)
+	}
+
+	// Outside of CDI mode the container gets the hook.
+	hook.Mode = modeLegacy
+	adjust, err = getNRIAdjustment(hook, self, &api.Container{Id: "ctr", Mounts: []*api.Mount{mount}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks := &api.Hooks{
+		Prestart: []*api.Hook{{Path: self, Args: []string{"nvidia-container-runtime-hook", "prestart"}}},
+		Poststop: []*api.Hook{{Path: self, Args: []string{"nvidia-container-runtime-hook", "poststop"}}},
+	}
+	if !reflect.DeepEqual(adjust.Hooks, hooks) || len(adjust.Mounts) > 0 {
+		t.Errorf("unexpected adjustment %v", adjust)
+	}
+}
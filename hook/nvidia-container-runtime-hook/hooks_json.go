@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/configfile"
+)
+
+const defaultHooksDir = "/usr/share/containers/oci/hooks.d"
+
+// ociHook is a hook definition of the hooks.d directories of Podman and CRI-O:
+// github.com/containers/common/blob/main/pkg/hooks/docs/oci-hooks.5.md
+type ociHook struct {
+	Version string         `json:"version"`
+	Hook    ociHookCommand `json:"hook"`
+	When    ociHookWhen    `json:"when"`
+	Stages  []string       `json:"stages"`
+}
+
+type ociHookCommand struct {
+	Path string   `json:"path"`
+	Args []string `json:"args,omitempty"`
+}
+
+type ociHookWhen struct {
+	Always bool `json:"always,omitempty"`
+	// regular expressions of the annotation keys and values, any match is enough.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// getOCIHooks returns the hook definitions of the prestart stage of the configuration and of poststop, by file name.
+// The matchers of hooks.d can't test the environment of the containers: the hook always runs unless annotationsOnly,
+// and does nothing for the containers without NVIDIA_VISIBLE_DEVICES.
+func getOCIHooks(hook HookConfig, path string, annotationsOnly bool) map[string]ociHook {
+	args := []string{path}
+	if *configflag != configfile.DefaultPath {
+		args = append(args, "-config", *configflag)
+	}
+	when := ociHookWhen{Always: true}
+	if annotationsOnly {
+		annotations := []string{migProfileAnnotation}
+		for a := range requestAnnotations {
+			annotations = append(annotations, a)
+		}
+		sort.Strings(annotations)
+		when = ociHookWhen{Annotations: make(map[string]string)}
+		for _, a := range annotations {
+			when.Annotations["^"+regexp.QuoteMeta(a)+"$"] = ".+"
+		}
+	}
+
+	hooks := make(map[string]ociHook)
+	for name, stage := range map[string]string{"oci-nvidia-hook.json": hook.Stage, "oci-nvidia-hook-poststop.json": "poststop"} {
+		hooks[name] = ociHook{
+			Version: "1.0.0",
+			Hook:    ociHookCommand{Path: path, Args: append(append([]string{}, args...), stage)},
+			When:    when,
+			Stages:  []string{stage},
+		}
+	}
+	return hooks
+}
+
+func doGenerateHooksJSON(args []string) {
+	flags := flag.NewFlagSet("generate-hooks-json", flag.ExitOnError)
+	dir := flags.String("dir", defaultHooksDir, "hooks.d directory the definitions are written to, stdout if -")
+	annotationsOnly := flags.Bool("annotations-only", false, "run the hook only for the containers requesting GPUs with annotations")
+	flags.Parse(args)
+
+	defer exit()
+
+	hook := getHookConfig()
+	self, err := os.Executable()
+	if err != nil {
+		log.Panicln("could not find the hook executable:", err)
+	}
+	hooks := getOCIHooks(hook, self, *annotationsOnly)
+	var names []string
+	for name := range hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b, err := json.MarshalIndent(hooks[name], "", "  ")
+		if err != nil {
+			log.Panicln(err)
+		}
+		b = append(b, '\n')
+		if *dir == "-" {
+			fmt.Print(string(b))
+			continue
+		}
+		if err := os.MkdirAll(*dir, 0755); err != nil {
+			log.Panicln(err)
+		}
+		// Replaced atomically, Podman may read the directory meanwhile.
+		if err := writeTextfile(filepath.Join(*dir, name), b); err != nil {
+			log.Panicln("could not write the hook definition:", err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// IMEX channels of multi-node NVLink requested by the container: "all" or a list of channel numbers.
+	envNVIMEXChannels = "NVIDIA_IMEX_CHANNELS"
+
+	imexChannelsDir        = "/dev/nvidia-caps-imex-channels"
+	imexChannelsDeviceName = "nvidia-caps-imex-channels"
+)
+
+// getHostIMEXChannels returns the numbers of the channel device nodes of the host.
+func getHostIMEXChannels(dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "channel*"))
+	if err != nil {
+		log.Panicln(err)
+	}
+	var channels []string
+	for _, m := range matches {
+		n := strings.TrimPrefix(filepath.Base(m), "channel")
+		if _, err := strconv.ParseUint(n, 10, 32); err == nil {
+			channels = append(channels, n)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// injectIMEXChannels creates the channel device nodes missing on the host and injects them in the container.
+func injectIMEXChannels(container containerConfig, channels []string) {
+	major, ok := getDeviceMajors(procDevicesPath)[imexChannelsDeviceName]
+	if !ok {
+		log.Panicf("%s is not in %s, does the driver support IMEX?", imexChannelsDeviceName, procDevicesPath)
+	}
+	for _, dir := range []string{imexChannelsDir, containerPath(container, imexChannelsDir)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Panicln("could not create", dir, ":", err)
+		}
+	}
+	for _, c := range channels {
+		minor, _ := strconv.ParseUint(c, 10, 32)
+		node := deviceNode{Path: filepath.Join(imexChannelsDir, "channel"+c), Major: major, Minor: uint32(minor)}
+		createDeviceNode(node)
+		infof("injecting IMEX channel %s", node.Path)
+		injectContainerDevice(container, node)
+	}
+}
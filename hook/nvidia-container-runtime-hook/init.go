@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/configfile"
+)
+
+// The driver installations init looks for: the driver containers of the GPU operator, the driver installer of GKE,
+// then the host. The first one matching the loaded kernel module wins.
+var driverRootCandidates = []string{"/run/nvidia/driver", "/home/kubernetes/bin/nvidia", "/"}
+
+// The library directories of the distributions and of GKE, relative to a driver root.
+var driverLibDirs = []string{"usr/lib64", "usr/lib/x86_64-linux-gnu", "usr/lib/aarch64-linux-gnu", "usr/lib", "lib64", "lib"}
+
+// The ldconfig of the host, Ubuntu's /sbin/ldconfig is a wrapper script of ldconfig.real.
+var ldconfigCandidates = []string{"/sbin/ldconfig.real", "/sbin/ldconfig", "/usr/sbin/ldconfig"}
+
+// getDriverLibVersion returns the version of the libnvidia-ml.so of a driver root, empty if there is none.
+func getDriverLibVersion(root string) string {
+	for _, dir := range driverLibDirs {
+		libs, _ := filepath.Glob(filepath.Join(root, dir, "libnvidia-ml.so.*.*"))
+		for _, lib := range libs {
+			if v := strings.TrimPrefix(filepath.Base(lib), "libnvidia-ml.so."); len(v) > 0 {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// probeDriverRoot returns the driver root of the node seen from host, "/" for the host itself: the candidate whose
+// libraries are the version of the kernel module, or the first one with libraries if the module isn't loaded.
+func probeDriverRoot(host string) (string, error) {
+	var kernel string
+	if b, err := ioutil.ReadFile(filepath.Join(host, procDriverVersionPath)); err == nil {
+		kernel, _ = parseProcDriverVersion(string(b))
+	}
+	var found []string
+	for _, root := range driverRootCandidates {
+		v := getDriverLibVersion(filepath.Join(host, root))
+		if len(v) == 0 {
+			continue
+		}
+		if len(kernel) == 0 || v == kernel {
+			return root, nil
+		}
+		found = append(found, fmt.Sprintf("%s (%s)", root, v))
+	}
+	if len(found) > 0 {
+		return "", fmt.Errorf("no driver libraries of the kernel module %s, found: %s", kernel, strings.Join(found, ", "))
+	}
+	return "", fmt.Errorf("no driver libraries in %s", strings.Join(driverRootCandidates, ", "))
+}
+
+// probeLdconfig returns the ldconfig option of the host seen from host.
+func probeLdconfig(host string) (string, error) {
+	for _, ldconfig := range ldconfigCandidates {
+		if info, err := os.Stat(filepath.Join(host, ldconfig)); err == nil && info.Mode().IsRegular() {
+			return "@" + ldconfig, nil
+		}
+	}
+	return "", fmt.Errorf("no ldconfig in %s", strings.Join(ldconfigCandidates, ", "))
+}
+
+// doInit writes the configuration of a new node: the options of the existing configuration file, if any, with the
+// root and ldconfig of nvidia-container-cli probed from the node.
+func doInit(args []string) {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	out := flags.String("o", "", "file the configuration is written to, the -config file if unset, stdout if -")
+	host := flags.String("host", "/", "root of the node, e.g. where it is mounted in a container")
+	flags.Parse(args)
+
+	defer exit()
+	log.SetFlags(0)
+
+	root, err := probeDriverRoot(*host)
+	if err != nil {
+		fail(exitCodeError, err)
+	}
+	ldconfig, err := probeLdconfig(*host)
+	if err != nil {
+		fail(exitCodeError, err)
+	}
+	log.Printf("driver root: %s, ldconfig: %s", root, ldconfig)
+
+	config := getDefaultHookConfig()
+	if b, err := ioutil.ReadFile(*configflag); err == nil {
+		if _, err := toml.Decode(string(b), &config); err != nil {
+			fail(exitCodeBadConfig, fmt.Errorf("%s: %v", *configflag, err))
+		}
+	} else if !os.IsNotExist(err) {
+		fail(exitCodeBadConfig, err)
+	}
+	config.NvidiaContainerCLI.Root = nil
+	if root != "/" {
+		config.NvidiaContainerCLI.Root = &root
+	}
+	config.NvidiaContainerCLI.Ldconfig = &ldconfig
+
+	var b bytes.Buffer
+	writeConfig(&b, config)
+	switch *out {
+	case "-":
+		os.Stdout.Write(b.Bytes())
+	case "":
+		*out = *configflag
+		fallthrough
+	default:
+		if err := os.MkdirAll(filepath.Dir(*out), 0755); err != nil {
+			fail(exitCodeError, err)
+		}
+		if err := configfile.WriteAtomic(*out, b.Bytes(), 0644); err != nil {
+			fail(exitCodeError, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var sysModulePath = "/sys/module"
+
+var defaultKernelModules = []string{"nvidia", "nvidia_uvm", "nvidia_modeset"}
+
+// isModuleLoaded checks sysfs, module names use underscores there even if modprobe accepts dashes.
+func isModuleLoaded(name string) bool {
+	_, err := os.Stat(filepath.Join(sysModulePath, strings.Replace(name, "-", "_", -1)))
+	return err == nil
+}
+
+// loadKernelModules loads the modules which aren't loaded yet with modprobe from kmod,
+// it replaces the --load-kmods option of nvidia-container-cli.
+func loadKernelModules(hook HookConfig) {
+	var modprobe string
+	for _, name := range hook.KernelModules {
+		if isModuleLoaded(name) {
+			continue
+		}
+		if len(modprobe) == 0 {
+			modprobe = lookPath(hook.NvidiaContainerCLI, "modprobe")
+		}
+
+		infof("loading kernel module %s", name)
+		out, err := exec.Command(modprobe, name).CombinedOutput()
+		if err != nil {
+			log.Panicf("couldn't load kernel module %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+		}
+	}
+}
+
+// verifyKernelModules returns an error listing the modules which aren't loaded.
+func verifyKernelModules(modules []string) error {
+	var missing []string
+	for _, name := range modules {
+		if !isModuleLoaded(name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("kernel modules not loaded: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
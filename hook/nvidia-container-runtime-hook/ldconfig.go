@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The ldconfig of nvidia-container-cli when unset, the host one.
+const defaultLdconfig = "@/sbin/ldconfig"
+
+// The directories the dynamic linker always searches, after the ones of ld.so.conf.
+var ldTrustedDirs = []string{"/lib64", "/usr/lib64", "/lib", "/usr/lib"}
+
+// The flags of the entries of ld.so.cache read by the dynamic linker of each architecture: FLAG_ELF_LIBC6 and the
+// 64-bit library flag of the architecture.
+var ldCacheFlags = map[elf.Machine]int32{
+	elf.EM_386:     0x0003,
+	elf.EM_X86_64:  0x0303,
+	elf.EM_PPC64:   0x0503,
+	elf.EM_AARCH64: 0x0a03,
+}
+
+// getLdconfig returns the path of the ldconfig of the configuration and whether it's a host path ('@' prefix) or
+// one of the container.
+func getLdconfig(cli CLIConfig) (string, bool) {
+	ldconfig := defaultLdconfig
+	if cli.Ldconfig != nil {
+		ldconfig = *cli.Ldconfig
+	}
+	if strings.HasPrefix(ldconfig, "@") {
+		return strings.TrimPrefix(ldconfig, "@"), true
+	}
+	return ldconfig, false
+}
+
+// checkLdconfig checks the ldconfig of the host, the ones in the containers are up to the images.
+func checkLdconfig(cli CLIConfig) error {
+	ldconfig, host := getLdconfig(cli)
+	if !host {
+		return nil
+	}
+	info, err := os.Stat(ldconfig)
+	if err != nil {
+		return fmt.Errorf("%v, set nvidia-container-cli.ldconfig to the ldconfig of the host", err)
+	}
+	if info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", ldconfig)
+	}
+	return nil
+}
+
+// updateLdCache updates the ld.so cache of the container after libraries were injected: in the hook with
+// builtin-ldconfig, else with the host ldconfig on the rootfs or the one of the container chrooted in it.
+func updateLdCache(config CLIConfig, container containerConfig) {
+	root := containerPath(container, "/")
+	if config.BuiltinLdconfig {
+		if err := writeLdCache(root); err != nil {
+			warnf("couldn't update the ld.so cache of the container: %v", err)
+		}
+		return
+	}
+	ldconfig, host := getLdconfig(config)
+	var cmd *exec.Cmd
+	if host {
+		if err := checkLdconfig(config); err != nil {
+			warnf("couldn't update the ld.so cache of the container: %v", err)
+			return
+		}
+		cmd = exec.Command(ldconfig, "-r", root)
+	} else {
+		cmd = exec.Command(ldconfig)
+		if err := setChroot(cmd, root); err != nil {
+			warnf("couldn't update the ld.so cache of the container: %v", err)
+			return
+		}
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		warnf("couldn't update the ld.so cache of the container: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+}
+
+// rootfsPath returns the path of p in rootfs, its symlinks resolved in rootfs: an image can't lead the hook out of it.
+func rootfsPath(rootfs, p string) (string, error) {
+	resolved := "/"
+	pending := strings.Split(p, "/")
+	for links := 0; len(pending) > 0; {
+		c := pending[0]
+		pending = pending[1:]
+		if len(c) == 0 || c == "." {
+			continue
+		}
+		if c == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, c)
+		info, err := os.Lstat(filepath.Join(rootfs, next))
+		if os.IsNotExist(err) {
+			resolved = path.Join(append([]string{next}, pending...)...)
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links: %s", p)
+		}
+		target, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(rootfs, resolved), nil
+}
+
+// getLdDirs returns the library directories of the ld.so.conf of rootfs, its includes expanded, then the trusted ones.
+func getLdDirs(rootfs string) []string {
+	var dirs []string
+	seen := make(map[string]bool)
+	var parse func(conf string, depth int)
+	parse = func(conf string, depth int) {
+		p, err := rootfsPath(rootfs, conf)
+		if err != nil || depth > 8 {
+			return
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return
+		}
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			line := s.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			f := strings.Fields(line)
+			switch {
+			case len(f) == 0:
+			case f[0] == "include":
+				for _, pattern := range f[1:] {
+					if !path.IsAbs(pattern) {
+						pattern = path.Join(path.Dir(conf), pattern)
+					}
+					dir, err := rootfsPath(rootfs, path.Dir(pattern))
+					if err != nil {
+						continue
+					}
+					matches, _ := filepath.Glob(filepath.Join(dir, path.Base(pattern)))
+					sort.Strings(matches)
+					for _, m := range matches {
+						parse(path.Join(path.Dir(pattern), filepath.Base(m)), depth+1)
+					}
+				}
+			case f[0] == "hwcap":
+			default:
+				for _, dir := range f {
+					// The old lib=type syntax of the directories.
+					dir = path.Clean(strings.SplitN(dir, "=", 2)[0])
+					if path.IsAbs(dir) && !seen[dir] {
+						seen[dir] = true
+						dirs = append(dirs, dir)
+					}
+				}
+			}
+		}
+	}
+	parse("/etc/ld.so.conf", 0)
+	for _, dir := range ldTrustedDirs {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+type ldCacheEntry struct {
+	flags  int32
+	soname string
+	path   string
+}
+
+// compareLdCacheNames is _dl_cache_libcmp of glibc: the numbers of the names are compared by value.
+func compareLdCacheNames(a, b string) int {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	i, j := 0, 0
+	for i < len(a) {
+		switch {
+		case isDigit(a[i]) && j < len(b) && isDigit(b[j]):
+			var x, y int
+			for ; i < len(a) && isDigit(a[i]); i++ {
+				x = x*10 + int(a[i]-'0')
+			}
+			for ; j < len(b) && isDigit(b[j]); j++ {
+				y = y*10 + int(b[j]-'0')
+			}
+			if x != y {
+				return x - y
+			}
+		case isDigit(a[i]):
+			return 1
+		case j < len(b) && isDigit(b[j]):
+			return -1
+		case j >= len(b):
+			return 1
+		case a[i] != b[j]:
+			return int(a[i]) - int(b[j])
+		default:
+			i++
+			j++
+		}
+	}
+	if j < len(b) {
+		return -1
+	}
+	return 0
+}
+
+// getLdCacheEntries returns the libraries of the library directories of rootfs by soname, the first directory
+// providing a soname wins. The soname links missing are created like ldconfig does.
+func getLdCacheEntries(rootfs string) []ldCacheEntry {
+	var entries []ldCacheEntry
+	seen := make(map[string]bool)
+	for _, dir := range getLdDirs(rootfs) {
+		d, err := rootfsPath(rootfs, dir)
+		if err != nil {
+			continue
+		}
+		files, err := ioutil.ReadDir(d)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			name := f.Name()
+			if !strings.HasPrefix(name, "lib") && !strings.HasPrefix(name, "ld-") || !strings.Contains(name, ".so") {
+				continue
+			}
+			p, err := rootfsPath(rootfs, path.Join(dir, name))
+			if err != nil {
+				continue
+			}
+			lib, err := elf.Open(p)
+			if err != nil {
+				continue
+			}
+			flags, ok := ldCacheFlags[lib.Machine]
+			// The cache is little endian, and x32 libraries have flags of their own.
+			ok = ok && lib.ByteOrder == binary.LittleEndian && (lib.Class == elf.ELFCLASS32) == (lib.Machine == elf.EM_386)
+			soname := name
+			if names, err := lib.DynString(elf.DT_SONAME); err == nil && len(names) > 0 {
+				soname = names[0]
+			}
+			lib.Close()
+			key := fmt.Sprintf("%s:%d", soname, flags)
+			if !ok || seen[key] || strings.Contains(soname, "/") {
+				continue
+			}
+			seen[key] = true
+			link := filepath.Join(d, soname)
+			if _, err := os.Lstat(link); os.IsNotExist(err) {
+				if err := os.Symlink(name, link); err != nil {
+					continue
+				}
+			}
+			entries = append(entries, ldCacheEntry{flags, soname, path.Join(dir, soname)})
+		}
+	}
+	// The dynamic linker searches the cache by dichotomy, in descending order.
+	sort.SliceStable(entries, func(i, j int) bool {
+		if c := compareLdCacheNames(entries[i].soname, entries[j].soname); c != 0 {
+			return c > 0
+		}
+		return entries[i].flags > entries[j].flags
+	})
+	return entries
+}
+
+// encodeLdCache returns the ld.so.cache of the entries in the format of glibc 2.32 and later, read by the dynamic
+// linkers of the older ones too: a header, the entries then their strings, at offsets from the start of the file.
+func encodeLdCache(entries []ldCacheEntry) []byte {
+	const headerSize, entrySize = 48, 24
+	var strs bytes.Buffer
+	offset := uint32(headerSize + entrySize*len(entries))
+	var b bytes.Buffer
+	b.WriteString("glibc-ld.so.cache1.1")
+	binary.Write(&b, binary.LittleEndian, uint32(len(entries)))
+	var table bytes.Buffer
+	for _, e := range entries {
+		key := offset + uint32(strs.Len())
+		strs.WriteString(e.soname + "\x00")
+		value := offset + uint32(strs.Len())
+		strs.WriteString(e.path + "\x00")
+		// flags, key, value, osversion, hwcap
+		binary.Write(&table, binary.LittleEndian, e.flags)
+		binary.Write(&table, binary.LittleEndian, [3]uint32{key, value, 0})
+		binary.Write(&table, binary.LittleEndian, uint64(0))
+	}
+	binary.Write(&b, binary.LittleEndian, uint32(strs.Len()))
+	// flags: little endian, then the padding, the offset of the extensions and the unused words.
+	b.Write([]byte{2, 0, 0, 0})
+	b.Write(make([]byte, 16))
+	b.Write(table.Bytes())
+	b.Write(strs.Bytes())
+	return b.Bytes()
+}
+
+// writeLdCache writes the ld.so.cache of rootfs from its libraries without running a binary of the image.
+func writeLdCache(rootfs string) error {
+	cache, err := rootfsPath(rootfs, "/etc/ld.so.cache")
+	if err != nil {
+		return err
+	}
+	return writeTextfile(cache, encodeLdCache(getLdCacheEntries(rootfs)))
+}
@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setChroot runs the command chrooted in root.
+func setChroot(cmd *exec.Cmd, root string) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: root}
+	return nil
+}
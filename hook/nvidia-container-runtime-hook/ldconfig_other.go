@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// setChroot is a stub, so that the code shared with tooling builds on every OS.
+func setChroot(cmd *exec.Cmd, root string) error {
+	return fmt.Errorf("chroot is not supported on %s", runtime.GOOS)
+}
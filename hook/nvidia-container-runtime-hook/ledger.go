@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	envNVReservation = "NVIDIA_GPU_RESERVATION"
+	// NVIDIA_GPU_SHARED=true lets a container share its GPUs with the other sharing containers, with exclusive-gpus.
+	envNVGPUShared = "NVIDIA_GPU_SHARED"
+)
+
+// LedgerEntry records a GPU held by an owner: a reservation of an external agent or a container.
+// A GPU may have several shared holders.
+type LedgerEntry struct {
+	UUID   string    `json:"uuid"`
+	Owner  string    `json:"owner"`
+	Since  time.Time `json:"since"`
+	Shared bool      `json:"shared,omitempty"`
+	// process of the container holding the GPU, its entries are dropped once it's gone.
+	Pid int `json:"pid,omitempty"`
+}
+
+// ledger is the node-local record of GPU ownership, shared by the hook and the allocation service.
+type ledger struct {
+	file    *os.File
+	Entries []LedgerEntry `json:"entries"`
+}
+
+// openLedger opens and locks the ledger, it must be closed to release the lock.
+func openLedger(path string) (*ledger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	l := &ledger{file: f}
+	b, err := ioutil.ReadAll(f)
+	if err == nil && len(b) > 0 {
+		err = json.Unmarshal(b, l)
+	}
+	if err != nil {
+		l.close()
+		return nil, fmt.Errorf("invalid ledger %s: %v", path, err)
+	}
+	return l, nil
+}
+
+func (l *ledger) save() error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = l.file.WriteAt(b, 0)
+	return err
+}
+
+func (l *ledger) close() {
+	unlockFile(l.file)
+	l.file.Close()
+}
+
+// owner returns the owner of a GPU, empty if it's free.
+func (l *ledger) owner(uuid string) string {
+	for _, e := range l.Entries {
+		if strings.EqualFold(e.UUID, uuid) {
+			return e.Owner
+		}
+	}
+	return ""
+}
+
+func (l *ledger) allocate(owner string, uuids []string) error {
+	for _, uuid := range uuids {
+		if o := l.owner(uuid); len(o) > 0 && o != owner {
+			return fmt.Errorf("GPU %s is held by %s", uuid, o)
+		}
+	}
+	for _, uuid := range uuids {
+		if len(l.owner(uuid)) == 0 {
+			l.Entries = append(l.Entries, LedgerEntry{UUID: uuid, Owner: owner, Since: time.Now()})
+		}
+	}
+	return nil
+}
+
+func (l *ledger) release(owner string) {
+	entries := l.Entries[:0]
+	for _, e := range l.Entries {
+		if e.Owner != owner {
+			entries = append(entries, e)
+		}
+	}
+	l.Entries = entries
+}
+
+// prune drops the entries of the containers whose process is gone, e.g. killed without their poststop hook.
+func (l *ledger) prune() {
+	entries := l.Entries[:0]
+	for _, e := range l.Entries {
+		if e.Pid > 0 {
+			if _, err := os.Stat(fmt.Sprintf("/proc/%d", e.Pid)); os.IsNotExist(err) {
+				infof("releasing %s of %s, its process %d is gone", e.UUID, e.Owner, e.Pid)
+				continue
+			}
+		}
+		entries = append(entries, e)
+	}
+	l.Entries = entries
+}
+
+// hold records GPUs held by a container, exclusively unless shared: a GPU held by another owner is rejected,
+// but for the reservation the container claims and the other shared holders of a shared GPU.
+func (l *ledger) hold(container string, pid int, uuids []string, reservation string, shared bool) error {
+	for _, uuid := range uuids {
+		for _, e := range l.Entries {
+			if !strings.EqualFold(e.UUID, uuid) || e.Owner == container || (len(reservation) > 0 && e.Owner == reservation) {
+				continue
+			}
+			if !shared || !e.Shared {
+				return fmt.Errorf("GPU %s is held by %s", uuid, e.Owner)
+			}
+		}
+	}
+	for _, uuid := range uuids {
+		held := false
+		for _, e := range l.Entries {
+			held = held || (strings.EqualFold(e.UUID, uuid) && e.Owner == container)
+		}
+		if !held {
+			l.Entries = append(l.Entries, LedgerEntry{UUID: uuid, Owner: container, Since: time.Now(), Shared: shared, Pid: pid})
+		}
+	}
+	return nil
+}
+
+// holdContainerGPUs records the GPUs of a container in the ledger until its poststop hook, see hold. The GPUs held
+// by others are waited for until the timeout, the ledger is unlocked between the retries.
+func holdContainerGPUs(path string, container string, pid int, uuids []string, reservation string, shared bool, timeout time.Duration, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		l, err := openLedger(path)
+		if err != nil {
+			return err
+		}
+		l.prune()
+		held := l.hold(container, pid, uuids, reservation, shared)
+		if held == nil {
+			err = l.save()
+		}
+		l.close()
+		if held == nil {
+			return err
+		}
+		if timeout <= 0 {
+			return held
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v after %v", held, timeout)
+		}
+		infof("%v, retrying in %v", held, interval)
+		time.Sleep(interval)
+	}
+}
+
+// claimLedgerGPUs holds the GPUs of a container in the ledger with exclusive-gpus, otherwise checks that they
+// aren't held by another owner.
+func claimLedgerGPUs(hook HookConfig, container containerConfig, uuids []string) {
+	var err error
+	if hook.ExclusiveGPUs {
+		shared := container.Env[envNVGPUShared] == "true"
+		err = holdContainerGPUs(*hook.Ledger, container.ID, container.Pid, uuids, container.Env[envNVReservation], shared,
+			hook.BusyTimeout.Duration, hook.BusyRetryInterval.Duration)
+	} else {
+		err = checkLedger(*hook.Ledger, uuids, container.Env[envNVReservation], container.ID)
+	}
+	if err != nil {
+		fail(exitCodePolicy, err)
+	}
+}
+
+// checkLedger rejects GPUs held by another owner than the reservation claimed by the container,
+// or the container itself for the GPUs it was given by topology.
+func checkLedger(path string, uuids []string, reservation string, container string) error {
+	l, err := openLedger(path)
+	if err != nil {
+		return err
+	}
+	defer l.close()
+
+	for _, uuid := range uuids {
+		if o := l.owner(uuid); len(o) > 0 && o != reservation && o != container {
+			return fmt.Errorf("GPU %s is reserved by %s", uuid, o)
+		}
+	}
+	return nil
+}
+
+// releaseContainerGPUs releases the GPUs held by a container in the ledger.
+func releaseContainerGPUs(path string, container string) {
+	l, err := openLedger(path)
+	if err != nil {
+		log.Panicln(err)
+	}
+	defer l.close()
+
+	l.release(container)
+	if err := l.save(); err != nil {
+		log.Panicln(err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+)
+
+// matchesAny matches the base name of a library against glob patterns like "libnvidia-fbc*".
+func matchesAny(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, err := filepath.Match(p, name); err != nil {
+			log.Panicln("invalid library pattern:", p)
+		} else if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getContainerLibraryDir returns the directory where nvidia-container-cli injected the driver libraries.
+func getContainerLibraryDir(container containerConfig) string {
+	for _, dir := range driverLibraryDirs {
+		if hasDriverLibraries(containerPath(container, dir)) {
+			return dir
+		}
+	}
+	return driverLibraryDirs[0]
+}
+
+// excludeLibraries removes the injected libraries matching the patterns, the libraries of the image are kept.
+func excludeLibraries(config CLIConfig, container containerConfig, patterns []string) {
+	var matches []string
+	for _, dir := range driverLibraryDirs {
+		files, err := ioutil.ReadDir(containerPath(container, dir))
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if matchesAny(f.Name(), patterns) {
+				matches = append(matches, path.Join(dir, f.Name()))
+			}
+		}
+	}
+	removeContainerFiles(config, container, matches)
+}
+
+// includeLibraries mounts extra host libraries (globs relative to the driver root) next to the injected ones.
+func includeLibraries(config CLIConfig, container containerConfig, patterns []string) {
+	root := "/"
+	if config.Root != nil {
+		root = *config.Root
+	}
+	mountLibraries(config, container, root, patterns)
+}
+
+// mountLibraries mounts the host libraries matching the patterns under root read-only in the library directory of
+// the container, like nvidia-container-cli does for the driver libraries.
+func mountLibraries(config CLIConfig, container containerConfig, root string, patterns []string) {
+	dir := getContainerLibraryDir(container)
+	for _, p := range patterns {
+		matches, err := filepath.Glob(filepath.Join(root, p))
+		if err != nil {
+			log.Panicln("invalid library pattern:", p)
+		}
+		for _, src := range matches {
+			// Resolve the versioned file behind the library symlinks.
+			real, err := filepath.EvalSymlinks(src)
+			if err != nil {
+				log.Panicln("couldn't resolve", src, ":", err)
+			}
+			dst := path.Join(dir, filepath.Base(src))
+			infof("mounting %s at %s in the container", real, dst)
+			bindContainerMount(config, container, cdiMount{HostPath: real, ContainerPath: dst, Options: []string{"ro"}})
+		}
+	}
+}
+
+// filterLibraries applies the library filters of the configuration to the files injected by nvidia-container-cli.
+func filterLibraries(hook HookConfig, container containerConfig) {
+	if len(hook.ExcludeLibraries) > 0 {
+		excludeLibraries(hook.NvidiaContainerCLI, container, hook.ExcludeLibraries)
+	}
+	if len(hook.IncludeLibraries) > 0 {
+		includeLibraries(hook.NvidiaContainerCLI, container, hook.IncludeLibraries)
+	}
+}
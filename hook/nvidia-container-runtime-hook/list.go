@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/policy"
+)
+
+var (
+	smiGPUExp = regexp.MustCompile(`^GPU ([0-9]+): .*\(UUID: (GPU-[^)]+)\)`)
+	smiMIGExp = regexp.MustCompile(`^\s+MIG (\S+)\s+Device\s+([0-9]+): \(UUID: (MIG-[^)]+)\)`)
+)
+
+type listedMIGDevice struct {
+	Index   string   `json:"index"`
+	Profile string   `json:"profile"`
+	UUID    string   `json:"uuid"`
+	Request []string `json:"requestedBy"`
+}
+
+type listedGPU struct {
+	Index        string            `json:"index"`
+	UUID         string            `json:"uuid"`
+	BusID        string            `json:"busId"`
+	Model        string            `json:"model"`
+	Architecture string            `json:"architecture"`
+	Allowed      bool              `json:"allowed"`
+	Request      []string          `json:"requestedBy"`
+	MIGDevices   []listedMIGDevice `json:"migDevices,omitempty"`
+}
+
+// gpuList is the output of the list command: the GPUs and MIG devices, with the values of NVIDIA_VISIBLE_DEVICES
+// selecting them under the configuration of the hook.
+type gpuList struct {
+	DriverVersion      string      `json:"driverVersion"`
+	CUDAVersion        string      `json:"cudaVersion"`
+	MountGPUOnlyByUUID bool        `json:"mountGPUOnlyByUUID"`
+	GPUs               []listedGPU `json:"gpus"`
+}
+
+// parseMIGTree parses nvidia-smi -L, the MIG devices by index of their GPU:
+//
+//	GPU 0: NVIDIA A100-SXM4-40GB (UUID: GPU-<uuid>)
+//	  MIG 1g.5gb      Device  0: (UUID: MIG-<uuid>)
+func parseMIGTree(out string) map[string][]listedMIGDevice {
+	tree := make(map[string][]listedMIGDevice)
+	gpu := ""
+	for _, line := range strings.Split(out, "\n") {
+		if m := smiGPUExp.FindStringSubmatch(line); m != nil {
+			gpu = m[1]
+		} else if m := smiMIGExp.FindStringSubmatch(line); m != nil && len(gpu) > 0 {
+			tree[gpu] = append(tree[gpu], listedMIGDevice{Index: gpu + ":" + m[2], Profile: m[1], UUID: m[3]})
+		}
+	}
+	return tree
+}
+
+// getGPUList lists the GPUs of the driver, with the values of NVIDIA_VISIBLE_DEVICES selecting them: the indexes
+// and "all" are ignored with mount-gpu-only-by-uuid.
+func getGPUList(hook HookConfig, info *driverInfo, migTree map[string][]listedMIGDevice) gpuList {
+	list := gpuList{
+		DriverVersion:      info.DriverVersion,
+		CUDAVersion:        info.CUDAVersion,
+		MountGPUOnlyByUUID: hook.MountGPUOnlyByUUID,
+	}
+	for _, d := range info.Devices {
+		gpu := listedGPU{
+			Index:        d.Index,
+			UUID:         d.UUID,
+			BusID:        d.BusID,
+			Model:        d.Model,
+			Architecture: d.Architecture,
+			Allowed:      policy.DeviceAllowed(hook, d),
+		}
+		if !hook.MountGPUOnlyByUUID {
+			gpu.Request = append(gpu.Request, d.Index)
+		}
+		gpu.Request = append(gpu.Request, d.UUID, normalizePCIBusID(d.BusID))
+		if !hook.MountGPUOnlyByUUID {
+			gpu.Request = append(gpu.Request, "all")
+		}
+		for _, m := range migTree[d.Index] {
+			if !hook.MountGPUOnlyByUUID {
+				m.Request = append(m.Request, m.Index)
+			}
+			m.Request = append(m.Request, m.UUID)
+			gpu.MIGDevices = append(gpu.MIGDevices, m)
+		}
+		list.GPUs = append(list.GPUs, gpu)
+	}
+	return list
+}
+
+func printGPUList(list gpuList) {
+	fmt.Printf("Driver %s, CUDA %s\n\n", list.DriverVersion, list.CUDAVersion)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tUUID\tBUS ID\tMODEL\tALLOWED\tREQUESTED BY")
+	for _, g := range list.GPUs {
+		allowed := "yes"
+		if !g.Allowed {
+			allowed = "no"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", g.Index, g.UUID, g.BusID, g.Model, allowed, strings.Join(g.Request, ", "))
+		for _, m := range g.MIGDevices {
+			fmt.Fprintf(w, "  %s\t%s\t\tMIG %s\t%s\t%s\n", m.Index, m.UUID, m.Profile, allowed, strings.Join(m.Request, ", "))
+		}
+	}
+	w.Flush()
+	if list.MountGPUOnlyByUUID {
+		fmt.Println("\nmount-gpu-only-by-uuid is set: the indexes and all select no GPU")
+	}
+}
+
+// doList prints the GPUs and MIG devices as the hook sees them, in a table or as JSON.
+func doList(args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	format := flags.String("format", "table", "output format: table or json")
+	flags.Parse(args)
+
+	defer exit()
+	log.SetFlags(0)
+
+	if *format != "table" && *format != "json" {
+		fail(exitCodeUsage, fmt.Errorf("unknown format %s, expected table or json", *format))
+	}
+	hook := getHookConfig()
+	info, err := getDriverInfo(hook.NvidiaContainerCLI)
+	if err != nil {
+		fail(exitCodeCLIFailure, err)
+	}
+	smi := lookPath(hook.NvidiaContainerCLI, "nvidia-smi")
+	out, err := queryDriver(hook.NvidiaContainerCLI, smi, "-L")
+	if err != nil {
+		fail(exitCodeCLIFailure, fmt.Errorf("nvidia-smi failed: %v", err))
+	}
+
+	list := getGPUList(hook, info, parseMIGTree(string(out)))
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(list); err != nil {
+			log.Panicln(err)
+		}
+		return
+	}
+	printGPUList(list)
+}
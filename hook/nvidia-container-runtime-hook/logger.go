@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarning
+	levelError
+)
+
+var logLevels = map[string]logLevel{
+	"debug":   levelDebug,
+	"info":    levelInfo,
+	"warning": levelWarning,
+	"error":   levelError,
+}
+
+func (l logLevel) String() string {
+	for name, level := range logLevels {
+		if level == l {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// hookLogger writes leveled messages with the container they relate to, as text or JSON lines.
+// It is the output of the log package too: log.Panic* messages are the errors failing the hook.
+type hookLogger struct {
+	sync.Mutex
+	out    io.Writer
+	level  logLevel
+	format string
+	id     string
+	bundle string
+	pod    podMetadata
+}
+
+// logger is only set up for the hook stages, the other commands print their messages as they are.
+var logger *hookLogger
+
+type logEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"msg"`
+	ID      string `json:"id,omitempty"`
+	Bundle  string `json:"bundle,omitempty"`
+	podMetadata
+}
+
+func (l *hookLogger) output(level logLevel, msg string) {
+	if level < l.level {
+		return
+	}
+	e := logEntry{time.Now().UTC().Format(time.RFC3339Nano), level.String(), msg, l.id, l.bundle, l.pod}
+
+	var line string
+	if l.format == logFormatJSON {
+		b, _ := json.Marshal(e)
+		line = string(b)
+	} else {
+		line = fmt.Sprintf("time=%q level=%s msg=%q", e.Time, e.Level, e.Message)
+		if len(e.ID) > 0 {
+			line += fmt.Sprintf(" id=%q bundle=%q", e.ID, e.Bundle)
+		}
+		if l.pod.isSet() {
+			line += fmt.Sprintf(" pod_namespace=%q pod_name=%q pod_uid=%q container_name=%q", l.pod.Namespace, l.pod.Name, l.pod.UID, l.pod.Container)
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	fmt.Fprintln(l.out, line)
+}
+
+func (l *hookLogger) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	l.output(levelError, msg)
+	if l.out != os.Stderr {
+		// The runtime reports the stderr of failed hooks, and kubelet the events of the pod.
+		if l.pod.isSet() {
+			msg = fmt.Sprintf("%s: %s", l.pod, msg)
+		}
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	return len(p), nil
+}
+
+// setupLogger configures the logger of a hook stage from the configuration.
+func setupLogger(hook HookConfig) {
+	level, ok := logLevels[hook.LogLevel]
+	if !ok {
+		fail(exitCodeBadConfig, fmt.Errorf("unknown log-level: %s", hook.LogLevel))
+	}
+	if *debugflag {
+		level = levelDebug
+	}
+	if hook.LogFormat != logFormatText && hook.LogFormat != logFormatJSON {
+		fail(exitCodeBadConfig, fmt.Errorf("unknown log-format: %s", hook.LogFormat))
+	}
+
+	l := &hookLogger{out: os.Stderr, level: level, format: hook.LogFormat}
+	if hook.LogFile != nil {
+		f, err := os.OpenFile(*hook.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fail(exitCodeBadConfig, fmt.Errorf("couldn't open log file: %v", err))
+		}
+		l.out = f
+	}
+	logger = l
+	log.SetFlags(0)
+	log.SetOutput(logger)
+
+	debugf("nvidia-container-runtime-hook %s", versionString())
+	if len(hook.PolicyVersion) > 0 {
+		infof("policy version %s", hook.PolicyVersion)
+	}
+	for _, key := range unknownOptions {
+		warnf("ignoring unknown option %s", key)
+	}
+	if autoDriverErr != nil {
+		warnf("could not probe the driver: %v", autoDriverErr)
+	}
+}
+
+// setLogContext adds the container to the messages logged from now on.
+func setLogContext(id string, bundle string) {
+	if logger != nil {
+		logger.id = id
+		logger.bundle = bundle
+	}
+}
+
+// setLogPod adds the Kubernetes pod of the container to the messages logged from now on.
+func setLogPod(pod podMetadata) {
+	if logger != nil {
+		logger.pod = pod
+	}
+}
+
+func logf(level logLevel, format string, v ...interface{}) {
+	if logger == nil {
+		if level >= levelInfo {
+			log.Printf(format, v...)
+		}
+		return
+	}
+	logger.output(level, fmt.Sprintf(format, v...))
+}
+
+func debugf(format string, v ...interface{}) {
+	logf(levelDebug, format, v...)
+}
+
+func infof(format string, v ...interface{}) {
+	logf(levelInfo, format, v...)
+}
+
+func warnf(format string, v ...interface{}) {
+	logf(levelWarning, format, v...)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// The environment of the LXC hooks: lxc.hook.mount runs in the mount namespace of the container, its rootfs is
+// mounted on LXC_ROOTFS_MOUNT.
+const (
+	envLXCName        = "LXC_NAME"
+	envLXCHookType    = "LXC_HOOK_TYPE"
+	envLXCRootfsMount = "LXC_ROOTFS_MOUNT"
+	envLXCRootfsPath  = "LXC_ROOTFS_PATH"
+	envLXCConfigFile  = "LXC_CONFIG_FILE"
+)
+
+// getLXCEnv returns the environment of an LXC container: the lxc.environment entries of its configuration, e.g. set
+// by LXD, then the NVIDIA variables of the environment of the hook.
+func getLXCEnv(config string, environ []string) (map[string]string, error) {
+	var env []string
+	if len(config) > 0 {
+		f, err := os.Open(config)
+		if err != nil {
+			return nil, fmt.Errorf("could not open the LXC configuration: %v", err)
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			p := strings.SplitN(s.Text(), "=", 2)
+			if len(p) == 2 && strings.TrimSpace(p[0]) == "lxc.environment" {
+				env = append(env, strings.TrimSpace(p[1]))
+			}
+		}
+		if err := s.Err(); err != nil {
+			return nil, fmt.Errorf("could not read the LXC configuration: %v", err)
+		}
+	}
+	for _, e := range environ {
+		if strings.HasPrefix(e, "NVIDIA_") {
+			env = append(env, e)
+		}
+	}
+	return getEnvMap(env, false)
+}
+
+// inUserNamespace tells the hook runs in a user namespace, the one of an unprivileged container.
+func inUserNamespace() bool {
+	b, err := ioutil.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	f := strings.Fields(string(b))
+	return len(f) != 3 || f[0] != "0" || f[1] != "0" || f[2] != "4294967295"
+}
+
+// doLXC configures an LXC container from its mount hook, with the protocol of the LXC hooks instead of the OCI state:
+// lxc.hook.mount = /usr/bin/nvidia-container-runtime-hook lxc, the arguments LXC adds are ignored. The device cgroup
+// of the container is the one of the hook, LXD allows the devices itself with no-cgroups.
+func doLXC() {
+	defer exit()
+	log.SetFlags(0)
+
+	hook := getHookConfig()
+	setupLogger(hook)
+	cli := hook.NvidiaContainerCLI
+	setLogContext(os.Getenv(envLXCName), "")
+	if t := os.Getenv(envLXCHookType); len(t) > 0 && t != "mount" {
+		fail(exitCodeUsage, fmt.Errorf("the hook must be an lxc.hook.mount hook, not %s", t))
+	}
+	rootfs := os.Getenv(envLXCRootfsMount)
+	if len(rootfs) == 0 {
+		rootfs = os.Getenv(envLXCRootfsPath)
+	}
+	if len(rootfs) == 0 {
+		fail(exitCodeUsage, fmt.Errorf("%s is unset, is the hook run by LXC?", envLXCRootfsMount))
+	}
+
+	env, err := getLXCEnv(os.Getenv(envLXCConfigFile), os.Environ())
+	if err != nil {
+		fail(exitCodeBadSpec, err)
+	}
+	nvidia, err := getNvidiaConfig(env, hook.MountGPUOnlyByUUID)
+	if err != nil {
+		fail(exitCodeBadSpec, err)
+	}
+	if nvidia == nil {
+		// Not a GPU container, nothing to do.
+		return
+	}
+	container := containerConfig{ID: os.Getenv(envLXCName), Rootfs: rootfs, Env: env, Nvidia: nvidia}
+
+	muslArch := getMuslArch(rootfs)
+	cliArgs := getCLIArgs(hook, cli, container, muslArch)
+	if inUserNamespace() {
+		// The driver files are owned by the unmapped root of the host.
+		cliArgs = append([]string{cliArgs[0], "--user"}, cliArgs[1:]...)
+	}
+	if hook.DryRun || *dryrunflag {
+		infof("dry run: %v", cliArgs)
+		return
+	}
+	infof("exec command: %v", cliArgs)
+	if err := runCLI(hook, cli, cliArgs); err != nil {
+		fail(exitCodeCLIFailure, fmt.Errorf("nvidia-container-cli failed: %v", err))
+	}
+	if len(muslArch) == 0 && cli.BuiltinLdconfig {
+		if err := writeLdCache(rootfs); err != nil {
+			warnf("couldn't update the ld.so cache of the container: %v", err)
+		}
+	}
+}
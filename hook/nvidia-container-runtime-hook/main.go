@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -12,25 +14,78 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
-	"syscall"
+	"time"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/configfile"
 )
 
 var (
-	debugflag = flag.Bool("debug", false, "enable debug output")
+	debugflag   = flag.Bool("debug", false, "enable debug output")
+	configflag  = flag.String("config", "", "path of the configuration file, the first one found in "+strings.Join(configfile.SearchPaths(), ", ")+" if unset")
+	dryrunflag  = flag.Bool("dry-run", false, "print how the container would be configured without changing it")
+	versionflag = flag.Bool("version", false, "print the version and build information")
+	stateflag   = flag.String("state", "", "path of the state of the container, read from stdin if unset")
+	bundleflag  = flag.String("bundle", "", "path of the bundle of the container, instead of the one of its state")
+	restoreflag = flag.Bool("restore", false, "the container is restored from a checkpoint, set by nvidia-container-runtime")
 
 	defaultPATH = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
 )
 
+// Exit codes of the hook, so that orchestrators can tell misconfiguration apart from driver failures.
+const (
+	exitCodeError      = 1 // unclassified failure
+	exitCodeUsage      = 2
+	exitCodeBadSpec    = 3 // invalid container state or OCI spec
+	exitCodeBadConfig  = 4 // invalid hook configuration
+	exitCodeCLIFailure = 5 // nvidia-container-cli or the driver failed
+	exitCodePolicy     = 6 // the request is denied, e.g. GPUs reserved by others
+)
+
+// hookError is an error with the exit code of the hook.
+type hookError struct {
+	code int
+	err  error
+}
+
+func (e *hookError) Error() string {
+	return e.err.Error()
+}
+
+func (e *hookError) Unwrap() error {
+	return e.err
+}
+
+// fail aborts the hook like log.Panic, exit() recovers the error and exits with its code.
+// Errors which already have a code keep it.
+func fail(code int, err error) {
+	if _, ok := err.(*hookError); !ok {
+		err = &hookError{code, err}
+	}
+	panic(err)
+}
+
 func exit() {
 	if err := recover(); err != nil {
-		if _, ok := err.(runtime.Error); ok {
+		code := exitCodeError
+		switch e := err.(type) {
+		case *hookError:
+			log.Println(e)
+			code = e.code
+		case runtime.Error:
 			log.Println(err)
 		}
 		if *debugflag {
 			log.Printf("%s", debug.Stack())
 		}
-		os.Exit(1)
+		reason := strings.TrimSpace(fmt.Sprint(err))
+		recordAudit(code, reason)
+		recordMetrics(code)
+		stopTracing(code, reason)
+		os.Exit(code)
 	}
+	recordAudit(0, "")
+	recordMetrics(0)
+	stopTracing(0, "")
 	os.Exit(0)
 }
 
@@ -40,34 +95,86 @@ func getPATH(config CLIConfig) string {
 	dirs = append(dirs, defaultPATH...)
 
 	if config.Root != nil {
+		root := path.Clean(*config.Root)
 		rootDirs := []string{}
 		for _, dir := range dirs {
-			rootDirs = append(rootDirs, path.Join(*config.Root, dir))
+			// PATH is set by lookPath, it may already have the directories of the root.
+			if !strings.HasPrefix(dir, root+"/") {
+				rootDirs = append(rootDirs, path.Join(root, dir))
+			}
 		}
 		// directories with the root prefix have higher precedence
 		dirs = append(rootDirs, dirs...)
 	}
-	return strings.Join(dirs, ":")
-}
 
-func getCLIPath(config CLIConfig) string {
-	if config.Path != nil {
-		return *config.Path
+	// PATH mustn't grow with the lookups, e.g. when polling the GPUs.
+	var unique []string
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		if !seen[dir] {
+			seen[dir] = true
+			unique = append(unique, dir)
+		}
 	}
+	return strings.Join(unique, ":")
+}
 
+// lookPath finds a driver or system binary, preferring the driver root.
+func lookPath(config CLIConfig, name string) string {
 	if err := os.Setenv("PATH", getPATH(config)); err != nil {
 		log.Panicln("couldn't set PATH variable:", err)
 	}
 
-	path, err := exec.LookPath("nvidia-container-cli")
+	path, err := exec.LookPath(name)
 	if err != nil {
-		log.Panicln("couldn't find binary nvidia-container-cli in", os.Getenv("PATH"), ":", err)
+		log.Panicf("couldn't find binary %s in %s: %v", name, os.Getenv("PATH"), err)
 	}
 	return path
 }
 
+const defaultCLITimeout = 30 * time.Second
+
+// runWithTimeout runs a command, killing it and its children past the timeout if not 0:
+// a wedged driver mustn't hang the creation of the container.
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) error {
+	if timeout <= 0 {
+		return cmd.Run()
+	}
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		if err := killProcessGroup(cmd); err != nil {
+			warnf("couldn't kill %s: %v", cmd.Path, err)
+		}
+		<-done
+		return fmt.Errorf("timed out after %v, killed", timeout)
+	}
+}
+
+func getCLIPath(config CLIConfig) string {
+	if config.Path != nil {
+		return *config.Path
+	}
+	return lookPath(config, "nvidia-container-cli")
+}
+
 // getRootfsPath returns an absolute path. We don't need to resolve symlinks for now.
+// A relative root path is relative to the bundle, the working directory of the hook
+// is only guaranteed to be the bundle for the prestart and createRuntime stages.
 func getRootfsPath(config containerConfig) string {
+	if !filepath.IsAbs(config.Rootfs) && len(config.Bundle) > 0 {
+		return filepath.Join(config.Bundle, config.Rootfs)
+	}
 	rootfs, err := filepath.Abs(config.Rootfs)
 	if err != nil {
 		log.Panicln(err)
@@ -75,29 +182,13 @@ func getRootfsPath(config containerConfig) string {
 	return rootfs
 }
 
-func doPrestart() {
-	var err error
-
-	defer exit()
-	log.SetFlags(0)
-
-	hook := getHookConfig()
-	cli := hook.NvidiaContainerCLI
-
-	container := getContainerConfig(hook)
-	nvidia := container.Nvidia
-	if nvidia == nil {
-		// Not a GPU container, nothing to do.
-		return
-	}
-
-	rootfs := getRootfsPath(container)
-
+// getCLIArgs returns the nvidia-container-cli command configuring the container.
+func getCLIArgs(hook HookConfig, cli CLIConfig, container containerConfig, muslArch string) []string {
 	args := []string{getCLIPath(cli)}
 	if cli.Root != nil {
 		args = append(args, fmt.Sprintf("--root=%s", *cli.Root))
 	}
-	if cli.LoadKmods {
+	if cli.LoadKmods && !hook.LoadKernelModules {
 		args = append(args, "--load-kmods")
 	}
 	if *debugflag {
@@ -109,35 +200,380 @@ func doPrestart() {
 		args = append(args, fmt.Sprintf("--ldcache=%s", *cli.Ldcache))
 	}
 	args = append(args, "configure")
+	if cli.NoCgroups {
+		args = append(args, "--no-cgroups")
+	}
 
-	if cli.Ldconfig != nil {
+	if len(muslArch) > 0 {
+		// ldconfig would generate a cache the musl dynamic linker never reads.
+		infof("musl rootfs detected (%s), skipping ldconfig", muslArch)
+	} else if cli.BuiltinLdconfig {
+		// The cache is written once the libraries are mounted.
+	} else if cli.Ldconfig != nil {
 		args = append(args, fmt.Sprintf("--ldconfig=%s", *cli.Ldconfig))
 	}
 
-	if len(nvidia.Devices) > 0 {
-		args = append(args, fmt.Sprintf("--device=%s", nvidia.Devices))
+	if len(container.Nvidia.Devices) > 0 {
+		args = append(args, fmt.Sprintf("--device=%s", container.Nvidia.Devices))
+	}
+	if len(container.Nvidia.MIGConfigDevices) > 0 {
+		args = append(args, fmt.Sprintf("--mig-config=%s", container.Nvidia.MIGConfigDevices))
+	}
+	if len(container.Nvidia.MIGMonitorDevices) > 0 {
+		args = append(args, fmt.Sprintf("--mig-monitor=%s", container.Nvidia.MIGMonitorDevices))
 	}
 
-	for _, cap := range strings.Split(nvidia.Capabilities, ",") {
+	options := make(map[string]bool)
+	for _, cap := range strings.Split(container.Nvidia.Capabilities, ",") {
 		if len(cap) == 0 {
 			break
 		}
-		args = append(args, capabilityToCLI(cap))
+		// The parts of video share its option.
+		if option := capabilityToCLI(cap); len(option) > 0 && !options[option] {
+			options[option] = true
+			args = append(args, option)
+		}
 	}
 
-	if !hook.DisableRequire && !nvidia.DisableRequire {
-		for _, req := range nvidia.Requirements {
+	// With the warn policy, the hook checks the requirements itself.
+	if getRequirePolicy(hook, container.Nvidia) == requirePolicyEnforce {
+		for _, req := range container.Nvidia.Requirements {
 			args = append(args, fmt.Sprintf("--require=%s", req))
 		}
 	}
 
-	args = append(args, fmt.Sprintf("--pid=%s", strconv.FormatUint(uint64(container.Pid), 10)))
-	args = append(args, rootfs)
+	if container.Pid > 0 {
+		// Without it, the rootfs is configured from the namespaces of the hook, e.g. the LXC mount hooks.
+		args = append(args, fmt.Sprintf("--pid=%s", strconv.FormatUint(uint64(container.Pid), 10)))
+	}
+	args = append(args, container.Rootfs)
+	return args
+}
 
-	log.Printf("exec command: %v", args)
+// runCLI runs nvidia-container-cli as a child instead of exec'ing it, the container still needs to be adjusted
+// afterwards, and retries it on the transient errors of the driver.
+func runCLI(hook HookConfig, cli CLIConfig, args []string) error {
 	env := append(os.Environ(), cli.Environment...)
-	err = syscall.Exec(args[0], args, env)
-	log.Panicln("exec failed:", err)
+	return withRetries(cli, "nvidia-container-cli", func() (string, error) {
+		var stderr bytes.Buffer
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Env = env
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+		err := runWithTimeout(cmd, hook.CLITimeout.Duration)
+		return stderr.String(), err
+	})
+}
+
+// doPrestart configures the container, it runs at the stage selected in the configuration:
+// prestart, or createRuntime/createContainer for runtimes following the OCI runtime spec v1.1.
+func doPrestart(stage string) {
+	var err error
+
+	defer exit()
+	log.SetFlags(0)
+
+	hook := getHookConfig()
+	setupLogger(hook)
+	cli := hook.NvidiaContainerCLI
+	if hook.Stage != stage {
+		infof("configured for the %s stage, nothing to do at %s", hook.Stage, stage)
+		return
+	}
+	startActivity(hook.Metrics, stage)
+	startTracing(stage)
+
+	container, err := getContainerConfig(&hook)
+	if err != nil {
+		fail(exitCodeBadSpec, err)
+	}
+	setTraceAttribute("container.id", container.ID)
+	dryRun := hook.DryRun || *dryrunflag
+	guarded := len(container.ID) > 0 && !dryRun
+	if guarded && isConfigured(configuredMarkersDir, container) {
+		infof("the container is already configured, nothing to do")
+		return
+	}
+	migProfile := getMIGProfile(hook, &container)
+	nvidia := container.Nvidia
+	if nvidia == nil {
+		// Not a GPU container, nothing to do.
+		if dryRun {
+			printDryRun(hook, cli, container)
+		}
+		return
+	}
+
+	if !dryRun {
+		startAudit(hook, container)
+	}
+	resolveMode(&hook)
+	rootfs := getRootfsPath(container)
+	container.Rootfs = rootfs
+
+	restore := isRestore(hook, container)
+	imexChannels := evaluatePolicy(&hook, container)
+	cli = hook.NvidiaContainerCLI
+	if restore && !dryRun {
+		restoreContainerDevices(hook, cli, container)
+		return
+	}
+
+	if dryRun {
+		if len(migProfile) > 0 {
+			infof("dry run: a MIG instance of profile %s would be provisioned", migProfile)
+		}
+		printDryRun(hook, cli, container)
+		return
+	}
+
+	// The instance is created once the policy allows the container, and destroyed if a later step fails.
+	if len(migProfile) > 0 {
+		nvidia.Devices = provisionMIG(hook, container, migProfile)
+		defer teardownMIG(hook, container.ID)
+	}
+
+	if hook.LoadKernelModules {
+		loadKernelModules(hook)
+	}
+	if hook.CreateDeviceNodes {
+		createDeviceNodes()
+	}
+
+	if hook.Ledger != nil && len(nvidia.Devices) > 0 {
+		info, err := getDriverInfo(cli)
+		if err != nil {
+			fail(exitCodeCLIFailure, err)
+		}
+		claimLedgerGPUs(hook, container, info.RequestedUUIDs(nvidia.Devices))
+	}
+
+	if len(hook.Health.Action) > 0 && len(nvidia.Devices) > 0 {
+		checkGPUHealth(hook, nvidia.Devices)
+	}
+
+	if (len(nvidia.ComputeMode) > 0 || len(nvidia.PersistenceMode) > 0 || nvidia.PowerLimit > 0 || len(nvidia.GPUClocks) > 0) &&
+		len(nvidia.Devices) > 0 {
+		setContainerGPUModes(hook, cli, container)
+	}
+
+	if hook.PodQuota.MaxGPUs > 0 && len(container.Pod) > 0 && len(nvidia.Devices) > 0 {
+		info, err := getDriverInfo(cli)
+		if err != nil {
+			fail(exitCodeCLIFailure, err)
+		}
+		if err := checkPodQuota(hook.PodQuota, container.Pod, container.ID, info.RequestedUUIDs(nvidia.Devices)); err != nil {
+			fail(exitCodePolicy, err)
+		}
+	}
+
+	if hook.BusyTimeout.Duration > 0 && len(nvidia.Devices) > 0 {
+		waitForDevices(hook, nvidia.Devices)
+	}
+
+	if hook.FabricManagerCheck && len(nvidia.Devices) > 0 && hasNVSwitches() {
+		checkFabricManager(cli)
+	}
+
+	if len(container.Replicas) > 0 {
+		recordSharedGPUs(hook, cli, container)
+	}
+
+	if hook.MPS.Enabled {
+		mountMPSDirectories(hook, container)
+	}
+
+	if activity != nil && len(nvidia.Devices) > 0 {
+		activity.gpus = getMountedGPUs(cli, nvidia.Devices)
+	}
+
+	switch hook.Mode {
+	case modeLegacy:
+	case modeCDI, modeCSV, modeWSL:
+		switch hook.Mode {
+		case modeCDI:
+			configureCDI(hook, container)
+		case modeCSV:
+			configureCSV(hook, container)
+		case modeWSL:
+			configureWSL(hook, container)
+		}
+		configureRDMA(hook, container)
+		configureGDS(hook, container)
+		configureNVSwitch(hook, container)
+		configureCapabilityExtras(hook, container)
+		configureDisplay(hook, container)
+		configureNCCLTopo(hook, container)
+		if len(imexChannels) > 0 {
+			injectIMEXChannels(container, imexChannels)
+		}
+		injectMIGManagementCaps(container)
+		relabelContainerFiles(hook, container)
+		if hook.VerifyDeviceAccess {
+			verifyDeviceAccess(container)
+		}
+		if hook.AppArmorCheck {
+			checkAppArmorProfile(container)
+		}
+		if hook.CheckpointRestore && len(nvidia.Devices) > 0 {
+			recordGrantedDevices(cli, container)
+		}
+		runPostConfigure(hook, container, rootfs)
+		if len(hook.PostStop) > 0 {
+			recordContainerState(container, rootfs)
+		}
+		if guarded {
+			markConfigured(configuredMarkersDir, container)
+		}
+		return
+	default:
+		fail(exitCodeBadConfig, fmt.Errorf("unknown mode: %s", hook.Mode))
+	}
+
+	vgpu := hook.DetectVGPU && isVGPUGuest(cli)
+	if vgpu {
+		infof("vGPU guest detected")
+		checkVGPUDevices(cli, nvidia.Devices)
+	} else if hasCapability(nvidia.Capabilities, vgpuCapability) {
+		warnf("the %s driver capability is only provided to the vGPU guests found with detect-vgpu", vgpuCapability)
+	}
+
+	muslArch := getMuslArch(rootfs)
+	if len(muslArch) == 0 && !cli.BuiltinLdconfig && cli.Ldconfig != nil {
+		if err := checkLdconfig(cli); err != nil {
+			fail(exitCodeBadConfig, err)
+		}
+	}
+	args := getCLIArgs(hook, cli, container, muslArch)
+
+	infof("exec command: %v", args)
+	cliSpan := startSpan("nvidia-container-cli")
+	cliSpan.setAttribute("devices", nvidia.Devices)
+	cliSpan.setAttribute("capabilities", nvidia.Capabilities)
+	start := time.Now()
+	err = runCLI(hook, cli, args)
+	if activity != nil {
+		activity.cliDuration = time.Since(start)
+	}
+	if err != nil {
+		cliSpan.setAttribute("error", err.Error())
+		if vgpu {
+			fail(exitCodeCLIFailure, fmt.Errorf("nvidia-container-cli failed on a vGPU guest, check the license status with nvidia-smi -q: %v", err))
+		}
+		if e := checkCgroupV2Support(cli); e != nil {
+			fail(exitCodeCLIFailure, e)
+		}
+		fail(exitCodeCLIFailure, fmt.Errorf("nvidia-container-cli failed: %v", err))
+	}
+	cliSpan.end()
+	if len(muslArch) == 0 && cli.BuiltinLdconfig {
+		updateLdCache(cli, container)
+	}
+
+	configureDeviceNodes(hook, container)
+	configureDRM(hook, container)
+	configureDisplay(hook, container)
+	filterUtilityFiles(hook, container)
+	filterLibraries(hook, container)
+	filterVideoLibraries(hook, container)
+	configureOpenKernelModules(cli, container)
+	configureRDMA(hook, container)
+	configureGDS(hook, container)
+	configureNVSwitch(hook, container)
+	configureCapabilityExtras(hook, container)
+	configureNCCLTopo(hook, container)
+	if len(imexChannels) > 0 {
+		injectIMEXChannels(container, imexChannels)
+	}
+
+	if vgpu {
+		configureVGPU(hook, container)
+	}
+
+	if hook.RecordVersions {
+		recordVersions(hook, container)
+	}
+
+	if len(muslArch) > 0 {
+		switch hook.MuslLinker {
+		case muslLinkerPathFile:
+			configureMuslLinker(container, muslArch)
+		case muslLinkerNone:
+		default:
+			fail(exitCodeBadConfig, fmt.Errorf("unknown musl-linker strategy: %s", hook.MuslLinker))
+		}
+	}
+
+	relabelContainerFiles(hook, container)
+	if hook.VerifyDeviceAccess {
+		verifyDeviceAccess(container)
+	}
+	if hook.AppArmorCheck {
+		checkAppArmorProfile(container)
+	}
+	if hook.CheckpointRestore && len(nvidia.Devices) > 0 {
+		recordGrantedDevices(cli, container)
+	}
+	runPostConfigure(hook, container, rootfs)
+	if len(hook.PostStop) > 0 {
+		recordContainerState(container, rootfs)
+	}
+	if guarded {
+		markConfigured(configuredMarkersDir, container)
+	}
+}
+
+func doPoststop() {
+	defer exit()
+	log.SetFlags(0)
+
+	hook := getHookConfig()
+	setupLogger(hook)
+	startActivity(hook.Metrics, "poststop")
+	state, err := getHookState()
+	if err != nil {
+		fail(exitCodeBadSpec, err)
+	}
+	setLogContext(state.ID, state.Bundle)
+
+	// Undo in the reverse order of prestart, a failed step doesn't keep the others from running.
+	steps := []func(){func() { runPostStop(hook, state.ID) }, func() { releaseSharedGPUs(hook, state.ID) }}
+	if len(state.ID) > 0 {
+		steps = append(steps, func() { clearConfigured(configuredMarkersDir, state.ID) })
+	}
+	if hook.MIG.Provisioning {
+		steps = append(steps, func() { releaseMIG(hook, state.ID) })
+	}
+	if hook.GPUModes.Enabled() {
+		steps = append(steps, func() { releaseGPUModes(hook, state.ID) })
+	}
+	if hook.PodQuota.MaxGPUs > 0 {
+		steps = append(steps, func() { releasePodQuota(hook.PodQuota, state.ID) })
+	}
+	if (hook.TopologySelection || hook.ExclusiveGPUs) && hook.Ledger != nil {
+		steps = append(steps, func() { releaseContainerGPUs(*hook.Ledger, state.ID) })
+	}
+	failed := 0
+	for _, step := range steps {
+		if err := runCleanupStep(step); err != nil {
+			warnf("cleanup failed: %v", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Panicf("%d of %d cleanup steps failed", failed, len(steps))
+	}
+}
+
+// runCleanupStep returns the error a step panicked with.
+func runCleanupStep(step func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s", strings.TrimSpace(fmt.Sprint(r)))
+		}
+	}()
+	step()
+	return nil
 }
 
 func usage() {
@@ -145,30 +581,87 @@ func usage() {
 	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, "\nCommands:\n")
 	fmt.Fprintf(os.Stderr, "  prestart\n        run the prestart hook\n")
+	fmt.Fprintf(os.Stderr, "  createRuntime\n        run the createRuntime hook (OCI runtime spec v1.1)\n")
+	fmt.Fprintf(os.Stderr, "  createContainer\n        run the createContainer hook (OCI runtime spec v1.1)\n")
+	fmt.Fprintf(os.Stderr, "  validate\n        check the node configuration\n")
+	fmt.Fprintf(os.Stderr, "  diagnose\n        check the node and its driver, with a report of the usual misconfigurations\n")
+	fmt.Fprintf(os.Stderr, "  list\n        list the GPUs and MIG devices, and the requests selecting them under the configuration\n")
+	fmt.Fprintf(os.Stderr, "  config\n        print, edit or check the configuration file\n")
+	fmt.Fprintf(os.Stderr, "  check-compat\n        check whether images can run with the driver of this node\n")
+	fmt.Fprintf(os.Stderr, "  migrate-report\n        report how the running containers would work with CDI\n")
+	fmt.Fprintf(os.Stderr, "  serve\n        run the GPU allocation service\n")
+	fmt.Fprintf(os.Stderr, "  check-device-access\n        open device nodes, run in the cgroup of a container by verify-device-access\n")
+	fmt.Fprintf(os.Stderr, "  apparmor-rules\n        print the AppArmor rules letting the containers use the driver\n")
+	fmt.Fprintf(os.Stderr, "  resolve-devices\n        resolve the devices of a container and write them into its spec, before it's created\n")
+	fmt.Fprintf(os.Stderr, "  nri\n        run as an NRI plugin of containerd or CRI-O, adjusting the GPU containers before they're created\n")
+	fmt.Fprintf(os.Stderr, "  assign-vfio\n        pass the GPUs of a container of a VM-based runtime through with VFIO, before it's created\n")
+	fmt.Fprintf(os.Stderr, "  generate-hooks-json\n        write the hooks.d definitions of the hook for Podman and CRI-O\n")
+	fmt.Fprintf(os.Stderr, "  lxc\n        configure an LXC container, run as its lxc.hook.mount hook\n")
+	fmt.Fprintf(os.Stderr, "  apptainer\n        print the binds, devices and environment of the GPUs requested by the environment, for Apptainer\n")
+	fmt.Fprintf(os.Stderr, "  init\n        write the configuration of a new node, with the driver root and ldconfig probed from it\n")
 	fmt.Fprintf(os.Stderr, "  poststart\n        no-op\n")
-	fmt.Fprintf(os.Stderr, "  poststop\n        no-op\n")
+	fmt.Fprintf(os.Stderr, "  poststop\n        run the poststop hook\n")
 }
 
 func main() {
 	flag.Usage = usage
 	flag.Parse()
 
+	if *versionflag {
+		printVersion()
+		os.Exit(0)
+	}
+	if len(*configflag) == 0 {
+		*configflag = configfile.Find()
+	}
 	args := flag.Args()
 	if len(args) == 0 {
 		flag.Usage()
-		os.Exit(2)
+		os.Exit(exitCodeUsage)
 	}
 
 	switch args[0] {
-	case "prestart":
-		doPrestart()
+	case stagePrestart, stageCreateRuntime, stageCreateContainer:
+		doPrestart(args[0])
 		os.Exit(0)
+	case "validate":
+		doValidate(args[1:])
+	case "diagnose":
+		doDiagnose()
+	case "list":
+		doList(args[1:])
+	case "config":
+		doConfig(args[1:])
+	case "check-compat":
+		doCheckCompat(args[1:])
+	case "migrate-report":
+		doMigrateReport(args[1:])
+	case "serve":
+		doServe(args[1:])
+	case "check-device-access":
+		doCheckDeviceAccess(args[1:])
+	case "apparmor-rules":
+		doAppArmorRules()
+	case "resolve-devices":
+		doResolveDevices(args[1:])
+	case "nri":
+		doNRI(args[1:])
+	case "assign-vfio":
+		doAssignVFIO(args[1:])
+	case "generate-hooks-json":
+		doGenerateHooksJSON(args[1:])
+	case "lxc":
+		doLXC()
+	case "apptainer":
+		doApptainer(args[1:])
+	case "init":
+		doInit(args[1:])
 	case "poststart":
-		fallthrough
-	case "poststop":
 		os.Exit(0)
+	case "poststop":
+		doPoststop()
 	default:
 		flag.Usage()
-		os.Exit(2)
+		os.Exit(exitCodeUsage)
 	}
 }
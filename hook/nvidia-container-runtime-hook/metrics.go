@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMetricsState = "/run/nvidia-container-runtime/metrics.json"
+
+	metricsPrefix = "nvidia_container_runtime_hook_"
+	metricsJob    = "nvidia-container-runtime-hook"
+)
+
+// Upper bounds in seconds of the buckets of the nvidia-container-cli latency.
+var cliDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Reasons of the failed invocations, by exit code.
+var failureReasons = map[int]string{
+	exitCodeError:      "error",
+	exitCodeUsage:      "usage",
+	exitCodeBadSpec:    "bad_spec",
+	exitCodeBadConfig:  "bad_config",
+	exitCodeCLIFailure: "cli_failure",
+	exitCodePolicy:     "policy",
+}
+
+// hookActivity is what an invocation of the hook did, added to the metrics when it exits.
+type hookActivity struct {
+	config      MetricsConfig
+	stage       string
+	gpus        []string
+	cliDuration time.Duration
+}
+
+// activity of the current invocation, nil when the metrics are disabled.
+var activity *hookActivity
+
+func startActivity(config MetricsConfig, stage string) {
+	if config.Enabled() {
+		activity = &hookActivity{config: config, stage: stage}
+	}
+}
+
+// getMountedGPUs returns the UUIDs of the requested GPUs, the requested devices if the driver can't tell.
+func getMountedGPUs(cli CLIConfig, devices string) []string {
+	if info, err := getDriverInfo(cli); err == nil {
+		if uuids := info.RequestedUUIDs(devices); len(uuids) > 0 {
+			return uuids
+		}
+	}
+	return strings.Split(devices, ",")
+}
+
+// metricsState holds the counters of all the invocations of the hook.
+type metricsState struct {
+	file        *os.File
+	Invocations map[string]uint64            `json:"invocations"`
+	Failures    map[string]map[string]uint64 `json:"failures"`
+	GPUMounts   map[string]uint64            `json:"gpu_mounts"`
+	// cumulative counts of the buckets of cliDurationBuckets.
+	CLIBuckets []uint64 `json:"cli_buckets"`
+	CLISum     float64  `json:"cli_sum"`
+	CLICount   uint64   `json:"cli_count"`
+}
+
+// openMetricsState opens and locks the counters, it must be closed to release the lock.
+func openMetricsState(path string) (*metricsState, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	m := &metricsState{file: f}
+	b, err := ioutil.ReadAll(f)
+	if err == nil && len(b) > 0 {
+		err = json.Unmarshal(b, m)
+	}
+	if err != nil {
+		m.close()
+		return nil, fmt.Errorf("invalid metrics state %s: %v", path, err)
+	}
+	if m.Invocations == nil {
+		m.Invocations = make(map[string]uint64)
+	}
+	if m.Failures == nil {
+		m.Failures = make(map[string]map[string]uint64)
+	}
+	if m.GPUMounts == nil {
+		m.GPUMounts = make(map[string]uint64)
+	}
+	if len(m.CLIBuckets) != len(cliDurationBuckets) {
+		m.CLIBuckets = make([]uint64, len(cliDurationBuckets))
+	}
+	return m, nil
+}
+
+func (m *metricsState) save() error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := m.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = m.file.WriteAt(b, 0)
+	return err
+}
+
+func (m *metricsState) close() {
+	unlockFile(m.file)
+	m.file.Close()
+}
+
+// add counts an invocation exiting with code, its GPUs are only counted as mounted on success.
+func (m *metricsState) add(a hookActivity, code int) {
+	m.Invocations[a.stage]++
+	if code != 0 {
+		reason, ok := failureReasons[code]
+		if !ok {
+			reason = failureReasons[exitCodeError]
+		}
+		if m.Failures[a.stage] == nil {
+			m.Failures[a.stage] = make(map[string]uint64)
+		}
+		m.Failures[a.stage][reason]++
+	} else {
+		for _, gpu := range a.gpus {
+			m.GPUMounts[gpu]++
+		}
+	}
+	if a.cliDuration > 0 {
+		s := a.cliDuration.Seconds()
+		for i, le := range cliDurationBuckets {
+			if s <= le {
+				m.CLIBuckets[i]++
+			}
+		}
+		m.CLISum += s
+		m.CLICount++
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys(m map[string]uint64) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// format renders the counters in the Prometheus text exposition format.
+func (m *metricsState) format() []byte {
+	var b bytes.Buffer
+	header := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, kind)
+	}
+
+	header("invocations_total", "counter", "Invocations of the hook by stage.")
+	for _, stage := range sortedKeys(m.Invocations) {
+		fmt.Fprintf(&b, "%sinvocations_total{stage=\"%s\"} %d\n", metricsPrefix, labelEscaper.Replace(stage), m.Invocations[stage])
+	}
+
+	header("failures_total", "counter", "Failed invocations of the hook by stage and reason, policy for the rejected requests.")
+	var stages []string
+	for stage := range m.Failures {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		for _, reason := range sortedKeys(m.Failures[stage]) {
+			fmt.Fprintf(&b, "%sfailures_total{reason=\"%s\",stage=\"%s\"} %d\n", metricsPrefix, reason, labelEscaper.Replace(stage), m.Failures[stage][reason])
+		}
+	}
+
+	header("gpu_mounts_total", "counter", "GPUs mounted in the containers.")
+	for _, gpu := range sortedKeys(m.GPUMounts) {
+		fmt.Fprintf(&b, "%sgpu_mounts_total{gpu=\"%s\"} %d\n", metricsPrefix, labelEscaper.Replace(gpu), m.GPUMounts[gpu])
+	}
+
+	header("cli_duration_seconds", "histogram", "Latency of nvidia-container-cli configure.")
+	for i, le := range cliDurationBuckets {
+		fmt.Fprintf(&b, "%scli_duration_seconds_bucket{le=\"%g\"} %d\n", metricsPrefix, le, m.CLIBuckets[i])
+	}
+	fmt.Fprintf(&b, "%scli_duration_seconds_bucket{le=\"+Inf\"} %d\n", metricsPrefix, m.CLICount)
+	fmt.Fprintf(&b, "%scli_duration_seconds_sum %g\n", metricsPrefix, m.CLISum)
+	fmt.Fprintf(&b, "%scli_duration_seconds_count %d\n", metricsPrefix, m.CLICount)
+	return b.Bytes()
+}
+
+// writeTextfile replaces the file atomically, node_exporter must never read a partial file.
+func writeTextfile(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// pushMetrics replaces the metrics of the node in the Pushgateway.
+func pushMetrics(url string, b []byte) error {
+	instance, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	url = fmt.Sprintf("%s/metrics/job/%s/instance/%s", strings.TrimSuffix(url, "/"), metricsJob, instance)
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// recordMetrics adds the activity of the invocation to the metrics. The metrics are best effort,
+// a failure is logged and doesn't change the exit code of the hook.
+func recordMetrics(code int) {
+	if activity == nil {
+		return
+	}
+	a := *activity
+	activity = nil
+
+	m, err := openMetricsState(a.config.State)
+	if err != nil {
+		warnf("couldn't record the metrics: %v", err)
+		return
+	}
+	defer m.close()
+
+	m.add(a, code)
+	if err := m.save(); err != nil {
+		warnf("couldn't record the metrics: %v", err)
+		return
+	}
+	b := m.format()
+	if len(a.config.Textfile) > 0 {
+		if err := writeTextfile(a.config.Textfile, b); err != nil {
+			warnf("couldn't write the metrics: %v", err)
+		}
+	}
+	if len(a.config.Pushgateway) > 0 {
+		if err := pushMetrics(a.config.Pushgateway, b); err != nil {
+			warnf("couldn't push the metrics: %v", err)
+		}
+	}
+}
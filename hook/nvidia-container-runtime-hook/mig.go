@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/devices"
+)
+
+// getMIGParent returns the GPU a MIG device belongs to, as a UUID or an index.
+func getMIGParent(d string) (string, bool) {
+	return devices.MIGParent(d)
+}
+
+// checkMIGManagement only lets the privileged containers manage or monitor MIG instances, when the node allows it.
+func checkMIGManagement(hook HookConfig, nvidia *nvidiaConfig, privileged bool) error {
+	for _, e := range []struct{ name, devices string }{
+		{envNVMIGConfigDevices, nvidia.MIGConfigDevices},
+		{envNVMIGMonitorDevices, nvidia.MIGMonitorDevices},
+	} {
+		switch {
+		case len(e.devices) == 0:
+		case !hook.AllowMIGManagement:
+			return fmt.Errorf("%s requires allow-mig-management", e.name)
+		case !privileged:
+			return fmt.Errorf("%s requires a privileged container", e.name)
+		}
+	}
+	return nil
+}
+
+// injectMIGManagementCaps injects the nvidia-caps devices of the MIG capabilities, nvidia-container-cli
+// does it with --mig-config and --mig-monitor.
+func injectMIGManagementCaps(container containerConfig) {
+	if len(container.Nvidia.MIGConfigDevices) > 0 {
+		injectMIGCap(container, getMIGCapMinor(migConfigCapPath, defaultMIGConfigMinor))
+	}
+	if len(container.Nvidia.MIGMonitorDevices) > 0 {
+		injectMIGCap(container, getMIGCapMinor(migMonitorCapPath, defaultMIGMonitorMinor))
+	}
+}
+
+func injectMIGCap(container containerConfig, minor uint32) {
+	path := filepath.Join(nvidiaCapsDir, fmt.Sprintf("nvidia-cap%d", minor))
+	infof("injecting %s", path)
+	injectHostDevice(container, path)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/policy"
+)
+
+const (
+	migProfileAnnotation = "nvidia.com/mig-profile"
+	migModeEnabled       = "Enabled"
+)
+
+var (
+	migStateDir = "/run/nvidia-container-runtime/mig"
+
+	// Output of nvidia-smi mig -cgi <profile> -C:
+	// Successfully created GPU instance ID  1 on GPU  0 using profile MIG 3g.20gb (ID  9)
+	// Successfully created compute instance ID  0 on GPU  0 GPU instance ID  1 using profile MIG 3g.20gb (ID  2)
+	migGIExp = regexp.MustCompile(`created GPU instance ID\s+(\d+) on GPU\s+(\d+)`)
+	migCIExp = regexp.MustCompile(`created compute instance ID\s+(\d+) on GPU\s+(\d+) GPU instance ID\s+(\d+)`)
+)
+
+// migInstance is a MIG device created for a container, recorded to destroy it at poststop.
+type migInstance struct {
+	GPU     string `json:"gpu"`
+	GPUUUID string `json:"gpu_uuid"`
+	GI      string `json:"gi"`
+	CI      string `json:"ci"`
+}
+
+// device returns the MIG device in the format understood by nvidia-container-cli.
+func (m migInstance) device() string {
+	return fmt.Sprintf("MIG-%s/%s/%s", m.GPUUUID, m.GI, m.CI)
+}
+
+func parseMIGCreateOutput(out string) (*migInstance, error) {
+	gi := migGIExp.FindStringSubmatch(out)
+	ci := migCIExp.FindStringSubmatch(out)
+	if gi == nil || ci == nil || ci[3] != gi[1] {
+		return nil, fmt.Errorf("unexpected nvidia-smi output: %s", strings.TrimSpace(out))
+	}
+	return &migInstance{GPU: gi[2], GI: gi[1], CI: ci[1]}, nil
+}
+
+func isAllowedProfile(config MIGConfig, profile string) bool {
+	for _, p := range config.AllowedProfiles {
+		if p == profile {
+			return true
+		}
+	}
+	return false
+}
+
+func migStatePath(id string) string {
+	return filepath.Join(migStateDir, id+".json")
+}
+
+// createMIGInstance creates a GPU and compute instance of the profile on the first requested and allowed
+// MIG-enabled GPU with enough capacity.
+func createMIGInstance(hook HookConfig, devices string, profile string) (*migInstance, error) {
+	config := hook.NvidiaContainerCLI
+	gpus, err := queryGPUs(config, "index", "uuid", "mig.mode.current")
+	if err != nil {
+		return nil, err
+	}
+
+	smi := lookPath(config, "nvidia-smi")
+	var errs []string
+	for _, gpu := range gpus {
+		if gpu[2] != migModeEnabled || (len(devices) > 0 && !isRequested(devices, gpu[0], gpu[1])) ||
+			!policy.DeviceAllowed(hook, deviceInfo{Index: gpu[0], UUID: gpu[1]}) {
+			continue
+		}
+		out, err := exec.Command(smi, "mig", "-i", gpu[0], "-cgi", profile, "-C").CombinedOutput()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("GPU %s: %s", gpu[0], strings.TrimSpace(string(out))))
+			continue
+		}
+		m, err := parseMIGCreateOutput(string(out))
+		if err != nil {
+			return nil, err
+		}
+		m.GPUUUID = gpu[1]
+		invalidateDiscoveryCache(config)
+		return m, nil
+	}
+	return nil, fmt.Errorf("couldn't create a MIG instance of profile %s: %s", profile, strings.Join(errs, "; "))
+}
+
+func destroyMIGInstance(config CLIConfig, m migInstance) error {
+	smi := lookPath(config, "nvidia-smi")
+	if out, err := exec.Command(smi, "mig", "-i", m.GPU, "-gi", m.GI, "-ci", m.CI, "-dci").CombinedOutput(); err != nil {
+		return fmt.Errorf("couldn't destroy compute instance %s: %s", m.device(), strings.TrimSpace(string(out)))
+	}
+	if out, err := exec.Command(smi, "mig", "-i", m.GPU, "-gi", m.GI, "-dgi").CombinedOutput(); err != nil {
+		return fmt.Errorf("couldn't destroy GPU instance %s: %s", m.device(), strings.TrimSpace(string(out)))
+	}
+	invalidateDiscoveryCache(config)
+	return nil
+}
+
+// getMIGProfile returns the MIG profile requested by the annotation of the container, empty if none, making it a
+// GPU container.
+func getMIGProfile(hook HookConfig, container *containerConfig) string {
+	profile, ok := container.Annotations[migProfileAnnotation]
+	if !hook.MIG.Provisioning || !ok {
+		return ""
+	}
+	if !isAllowedProfile(hook.MIG, profile) {
+		fail(exitCodePolicy, fmt.Errorf("MIG profile %s is not allowed", profile))
+	}
+	if container.Nvidia == nil {
+		// The annotation is enough to make it a GPU container.
+		container.Env[envNVGPU] = noneGPU
+		nvidia, err := getNvidiaConfig(container.Env, hook.MountGPUOnlyByUUID)
+		if err != nil {
+			fail(exitCodeBadSpec, err)
+		}
+		container.Nvidia = nvidia
+	}
+	return profile
+}
+
+// provisionMIG creates the MIG instance requested by the annotation of the container and returns its device.
+func provisionMIG(hook HookConfig, container containerConfig, profile string) string {
+	m, err := createMIGInstance(hook, container.Nvidia.Devices, profile)
+	if err != nil {
+		fail(exitCodeCLIFailure, err)
+	}
+	infof("created MIG instance %s", m.device())
+
+	b, err := json.Marshal(m)
+	if err == nil {
+		if err = os.MkdirAll(migStateDir, 0755); err == nil {
+			err = ioutil.WriteFile(migStatePath(container.ID), b, 0644)
+		}
+	}
+	if err == nil && hook.Ledger != nil {
+		var l *ledger
+		if l, err = openLedger(*hook.Ledger); err == nil {
+			if err = l.allocate(container.ID, []string{m.device()}); err == nil {
+				err = l.save()
+			}
+			l.close()
+		}
+	}
+	if err != nil {
+		destroyMIGInstance(hook.NvidiaContainerCLI, *m)
+		log.Panicln("couldn't record the MIG instance:", err)
+	}
+	return m.device()
+}
+
+// teardownMIG destroys the MIG instance of a container whose prestart failed, deferred after provisionMIG: the
+// runtime doesn't run the poststop hooks of the containers it failed to create.
+func teardownMIG(hook HookConfig, id string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	func() {
+		defer func() {
+			if err := recover(); err != nil {
+				warnf("couldn't destroy the MIG instance of the failed container: %v", err)
+			}
+		}()
+		releaseMIG(hook, id)
+	}()
+	panic(r)
+}
+
+// releaseMIG destroys the MIG instance created for a container, if any.
+func releaseMIG(hook HookConfig, id string) {
+	b, err := ioutil.ReadFile(migStatePath(id))
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Panicln("couldn't read the MIG state:", err)
+	}
+
+	var m migInstance
+	if err := json.Unmarshal(b, &m); err != nil {
+		log.Panicln("invalid MIG state:", err)
+	}
+	if err := destroyMIGInstance(hook.NvidiaContainerCLI, m); err != nil {
+		log.Panicln(err)
+	}
+	infof("destroyed MIG instance %s", m.device())
+
+	if hook.Ledger != nil {
+		l, err := openLedger(*hook.Ledger)
+		if err != nil {
+			log.Panicln(err)
+		}
+		defer l.close()
+		l.release(id)
+		if err := l.save(); err != nil {
+			log.Panicln(err)
+		}
+	}
+	os.Remove(migStatePath(id))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/oci"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/nvcontainer"
+)
+
+const cdiGPUKind = nvcontainer.GPUKind
+
+// Bundles of the running containers for docker, containerd and CRI-O.
+var defaultBundleGlobs = []string{
+	"/run/containerd/io.containerd.runtime.v1.linux/*/*/config.json",
+	"/run/containerd/io.containerd.runtime.v2.task/*/*/config.json",
+	"/run/docker/containerd/daemon/io.containerd.runtime.v1.linux/*/*/config.json",
+	"/var/run/containers/storage/overlay-containers/*/userdata/config.json",
+}
+
+type migration struct {
+	// CDI device names equivalent to the environment of the container.
+	Devices []string
+	// Behaviors which would change under CDI.
+	Notes []string
+}
+
+func (m migration) unchanged() bool {
+	return len(m.Notes) == 0
+}
+
+// getMigration describes how a container environment translates to CDI devices.
+func getMigration(env map[string]string, mountGPUOnlyByUUID bool) (*migration, error) {
+	nvidia, err := getNvidiaConfig(env, mountGPUOnlyByUUID)
+	if err != nil || nvidia == nil {
+		return nil, err
+	}
+
+	m := &migration{}
+	if _, ok := env[envNVGPU]; !ok {
+		m.Notes = append(m.Notes, "GPUs are implied by "+envLegacyCUDAVersion+", request them explicitly")
+	}
+	if len(nvidia.Devices) == 0 {
+		m.Notes = append(m.Notes, "no GPU requested, only the driver capabilities are used")
+	}
+	for _, d := range strings.Split(nvidia.Devices, ",") {
+		if len(d) > 0 {
+			m.Devices = append(m.Devices, fmt.Sprintf("%s=%s", cdiGPUKind, d))
+		}
+	}
+	if nvidia.Capabilities != getAllCapabilities() {
+		m.Notes = append(m.Notes, "CDI injects every driver capability instead of "+nvidia.Capabilities)
+	}
+	if len(nvidia.Requirements) > 0 && !nvidia.DisableRequire {
+		m.Notes = append(m.Notes, "requirements are not checked under CDI: "+strings.Join(nvidia.Requirements, "; "))
+	}
+	return m, nil
+}
+
+func doMigrateReport(args []string) {
+	flags := flag.NewFlagSet("migrate-report", flag.ExitOnError)
+	bundles := flags.String("bundles", strings.Join(defaultBundleGlobs, ","), "comma-separated globs of the config.json of the containers to inspect")
+	flags.Parse(args)
+
+	defer exit()
+	log.SetFlags(0)
+
+	hook := getHookConfig()
+	setDriverCapabilities(hook)
+	envSwarmGPU = hook.SwarmResource
+
+	for _, pattern := range strings.Split(*bundles, ",") {
+		specs, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Panicln("invalid bundle glob:", err)
+		}
+		for _, spec := range specs {
+			id := filepath.Base(filepath.Dir(spec))
+			s, err := oci.LoadSpec(spec)
+			if err != nil {
+				fmt.Printf("%s: skipped: %v\n", id, err)
+				continue
+			}
+			env, err := getEnvMap(s.Process.Env, hook.MountGPUOnlyByUUID)
+			if err != nil {
+				fmt.Printf("%s: skipped: %v\n", id, err)
+				continue
+			}
+			m, err := getMigration(env, hook.MountGPUOnlyByUUID)
+			if err != nil {
+				fmt.Printf("%s: skipped: %v\n", id, err)
+				continue
+			}
+			if m == nil {
+				continue
+			}
+
+			status := "needs changes"
+			if m.unchanged() {
+				status = "unchanged"
+			}
+			fmt.Printf("%s: %s\n", id, status)
+			if len(m.Devices) > 0 {
+				fmt.Printf("  devices: --device %s (annotation cdi.k8s.io/nvidia: %s)\n", strings.Join(m.Devices, " --device "), strings.Join(m.Devices, ","))
+			}
+			for _, n := range m.Notes {
+				fmt.Printf("  - %s\n", n)
+			}
+		}
+	}
+}
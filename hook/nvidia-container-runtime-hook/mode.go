@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// modeAuto picks the mode from the node, for fleets mixing discrete GPUs, Jetson and WSL2 systems.
+const modeAuto = "auto"
+
+const (
+	// Exposed by the kernel driver of the discrete GPUs, the driver of NVML.
+	procDriverVersionPath = "/proc/driver/nvidia/version"
+
+	tegraFamilyPath      = "/sys/devices/soc0/family"
+	deviceTreeCompatible = "/proc/device-tree/compatible"
+)
+
+// nodeProbe is what the node offers to configure the containers.
+type nodeProbe struct {
+	WSL      bool
+	Tegra    bool
+	NVML     bool
+	CDISpecs bool
+}
+
+func isTegra() bool {
+	if b, err := ioutil.ReadFile(tegraFamilyPath); err == nil && strings.EqualFold(strings.TrimSpace(string(b)), "tegra") {
+		return true
+	}
+	b, err := ioutil.ReadFile(deviceTreeCompatible)
+	return err == nil && strings.Contains(string(b), "nvidia,tegra")
+}
+
+func hasCDIGPUSpecs(dirs []string) bool {
+	for _, spec := range loadCDISpecs(dirs) {
+		if spec.Kind == cdiGPUKind {
+			return true
+		}
+	}
+	return false
+}
+
+func probeNode(hook HookConfig) nodeProbe {
+	_, err := os.Stat(procDriverVersionPath)
+	return nodeProbe{
+		WSL:      isWSL(),
+		Tegra:    isTegra(),
+		NVML:     err == nil,
+		CDISpecs: hasCDIGPUSpecs(hook.CDISpecDirs),
+	}
+}
+
+// mode returns the mode of the node and why: WSL2, then the iGPU of Jetson systems, then the CDI specs
+// generated for the GPUs, nvidia-container-cli otherwise.
+func (p nodeProbe) mode() (string, string) {
+	switch {
+	case p.WSL:
+		return modeWSL, dxgDevice + " exists"
+	case p.Tegra && !p.NVML:
+		return modeCSV, "Tegra system without a discrete GPU driver"
+	case p.CDISpecs:
+		return modeCDI, "CDI specs of " + cdiGPUKind + " exist"
+	case p.NVML:
+		return modeLegacy, "the NVIDIA driver is loaded"
+	}
+	return modeLegacy, "nothing detected, defaulting to nvidia-container-cli"
+}
+
+// resolveMode replaces the auto mode by the mode of the node.
+func resolveMode(hook *HookConfig) {
+	if hook.Mode != modeAuto {
+		return
+	}
+	mode, reason := probeNode(*hook).mode()
+	infof("using the %s mode: %s", mode, reason)
+	hook.Mode = mode
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/configfile"
+)
+
+// mountMPSDirectories makes the MPS control daemon of the node reachable from the container. The directories
+// are mounted where the environment of the container expects them, set by nvidia-container-runtime.
+func mountMPSDirectories(hook HookConfig, container containerConfig) {
+	env, err := hook.MPS.Environment(container.Annotations)
+	if err != nil {
+		log.Panicln(err)
+	}
+	for _, e := range env {
+		if _, ok := container.Env[e[:strings.Index(e, "=")]]; !ok {
+			// The directories still work at the default locations of CUDA, the percentage doesn't.
+			warnf("%s isn't set in the container, the environment of the process can't be changed from a hook", e)
+		}
+	}
+
+	for _, d := range []struct {
+		host string
+		env  string
+	}{
+		{hook.MPS.PipeDirectory, configfile.EnvMPSPipeDirectory},
+		{hook.MPS.LogDirectory, configfile.EnvMPSLogDirectory},
+	} {
+		if _, err := os.Stat(d.host); err != nil {
+			log.Panicf("couldn't find the MPS directory %s, is nvidia-cuda-mps-control running? %v", d.host, err)
+		}
+		target := d.host
+		if p := container.Env[d.env]; len(p) > 0 {
+			target = p
+		}
+		infof("mounting the MPS directory %s at %s", d.host, target)
+		bindContainerMount(hook.NvidiaContainerCLI, container, cdiMount{HostPath: d.host, ContainerPath: target})
+	}
+}
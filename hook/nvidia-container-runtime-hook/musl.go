@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	muslLinkerPathFile = "path-file"
+	muslLinkerNone     = "none"
+)
+
+var (
+	// The musl dynamic linker ignores ld.so.cache, it searches these directories unless a path file exists.
+	muslDefaultLibraryPath = []string{"/lib", "/usr/local/lib", "/usr/lib"}
+
+	// Directories where nvidia-container-cli mounts the driver libraries.
+	driverLibraryDirs = []string{"/usr/lib64", "/usr/lib/x86_64-linux-gnu", "/usr/lib/aarch64-linux-gnu", "/usr/lib/powerpc64le-linux-gnu", "/usr/lib"}
+)
+
+// getMuslArch returns the architecture of the musl dynamic linker in the rootfs, empty for other libcs.
+func getMuslArch(rootfs string) string {
+	matches, err := filepath.Glob(filepath.Join(rootfs, "lib", "ld-musl-*.so.1"))
+	if err != nil || len(matches) == 0 {
+		return ""
+	}
+	name := filepath.Base(matches[0])
+	return strings.TrimSuffix(strings.TrimPrefix(name, "ld-musl-"), ".so.1")
+}
+
+func hasDriverLibraries(dir string) bool {
+	for _, pattern := range []string{"libcuda.so*", "libnvidia-*.so*"} {
+		if matches, _ := filepath.Glob(filepath.Join(dir, pattern)); len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// appendMuslLibraryPath adds dirs to the musl path file content, keeping the existing entries first.
+func appendMuslLibraryPath(content string, dirs []string) string {
+	var entries []string
+	if len(strings.TrimSpace(content)) == 0 {
+		entries = append(entries, muslDefaultLibraryPath...)
+	} else {
+		// Entries are separated by colons or newlines.
+		entries = strings.FieldsFunc(content, func(r rune) bool { return r == ':' || r == '\n' })
+	}
+
+	for _, dir := range dirs {
+		found := false
+		for _, e := range entries {
+			if strings.TrimSpace(e) == dir {
+				found = true
+				break
+			}
+		}
+		if !found {
+			entries = append(entries, dir)
+		}
+	}
+	return strings.Join(entries, "\n") + "\n"
+}
+
+// configureMuslLinker makes the injected libraries visible to the musl dynamic linker
+// by adding their directories to /etc/ld-musl-<arch>.path in the container.
+func configureMuslLinker(container containerConfig, arch string) {
+	var dirs []string
+	for _, dir := range driverLibraryDirs {
+		if hasDriverLibraries(containerPath(container, dir)) {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return
+	}
+
+	// The path file of the image may be a symlink, it's read and replaced in the rootfs only.
+	name := filepath.Join("/etc", "ld-musl-"+arch+".path")
+	pathFile, err := resolveContainerPath(container, name)
+	if err != nil {
+		log.Panicln("could not resolve musl path file:", err)
+	}
+	var content []byte
+	if target, err := rootfsPath(containerPath(container, "/"), name); err == nil {
+		content, err = ioutil.ReadFile(target)
+		if err != nil && !os.IsNotExist(err) {
+			log.Panicln("could not read musl path file:", err)
+		}
+	}
+	infof("adding %v to the musl library path", dirs)
+	if err := writeTextfile(pathFile, []byte(appendMuslLibraryPath(string(content), dirs))); err != nil {
+		log.Panicln("could not write musl path file:", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	ncclTopoFileAuto = "auto"
+	// NCCL reads the topology file there unless NCCL_TOPO_FILE is set, the hook runs once the environment of the
+	// container is set.
+	ncclTopoContainerPath = "/var/run/nvidia-topologyd/virtualTopology.xml"
+	// The topology generated from sysfs when the node has no file.
+	ncclTopoGeneratedPath = "/run/nvidia-container-runtime/nccl-topo.xml"
+)
+
+// The topology files of the nodes shipping one, e.g. the Azure ND images.
+var ncclTopoFileCandidates = []string{"/etc/nccl/topo.xml", "/opt/microsoft/ndv5-topo.xml", "/opt/microsoft/ndv4-topo.xml"}
+
+// ncclTopoSystem is the topology file of NCCL, the attributes missing are detected by NCCL.
+type ncclTopoSystem struct {
+	XMLName xml.Name      `xml:"system"`
+	Version string        `xml:"version,attr"`
+	CPUs    []ncclTopoCPU `xml:"cpu"`
+}
+
+type ncclTopoCPU struct {
+	NUMAID   string        `xml:"numaid,attr"`
+	Affinity string        `xml:"affinity,attr,omitempty"`
+	PCI      []ncclTopoPCI `xml:"pci"`
+}
+
+type ncclTopoPCI struct {
+	BusID     string `xml:"busid,attr"`
+	Class     string `xml:"class,attr,omitempty"`
+	LinkSpeed string `xml:"link_speed,attr,omitempty"`
+	LinkWidth string `xml:"link_width,attr,omitempty"`
+}
+
+func readSysfsAttr(dir string, name string) string {
+	b, _ := ioutil.ReadFile(filepath.Join(dir, name))
+	return strings.TrimSpace(string(b))
+}
+
+// generateNCCLTopo returns the topology of the NVIDIA GPUs of sysfs: their PCI links under the CPUs of their
+// NUMA node.
+func generateNCCLTopo(sysfs string) ([]byte, error) {
+	gpus, err := getVFIOGPUs(sysfs)
+	if err != nil {
+		return nil, err
+	}
+	if len(gpus) == 0 {
+		return nil, fmt.Errorf("no NVIDIA GPU in %s", sysfs)
+	}
+	cpus := make(map[string]*ncclTopoCPU)
+	var nodes []string
+	for _, g := range gpus {
+		dir := filepath.Join(sysfs, g.BusID)
+		node := readSysfsAttr(dir, "numa_node")
+		if len(node) == 0 || node == "-1" {
+			node = "0"
+		}
+		if cpus[node] == nil {
+			cpus[node] = &ncclTopoCPU{NUMAID: node, Affinity: readSysfsAttr(dir, "local_cpus")}
+			nodes = append(nodes, node)
+		}
+		cpus[node].PCI = append(cpus[node].PCI, ncclTopoPCI{
+			BusID:     g.BusID,
+			Class:     readSysfsAttr(dir, "class"),
+			LinkSpeed: readSysfsAttr(dir, "max_link_speed"),
+			LinkWidth: readSysfsAttr(dir, "max_link_width"),
+		})
+	}
+	sort.Strings(nodes)
+	system := ncclTopoSystem{Version: "1"}
+	for _, node := range nodes {
+		system.CPUs = append(system.CPUs, *cpus[node])
+	}
+	b, err := xml.MarshalIndent(system, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// getNCCLTopoFile returns the topology file of the node: the configured one, or with "auto" the file shipped with
+// the node, else the one generated from sysfs on first use.
+func getNCCLTopoFile(hook HookConfig) (string, error) {
+	if hook.NCCLTopoFile != ncclTopoFileAuto {
+		if _, err := os.Stat(hook.NCCLTopoFile); err != nil {
+			return "", err
+		}
+		return hook.NCCLTopoFile, nil
+	}
+	for _, f := range append(ncclTopoFileCandidates, ncclTopoGeneratedPath) {
+		if _, err := os.Stat(f); err == nil {
+			return f, nil
+		}
+	}
+	b, err := generateNCCLTopo(pciDevicesDir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(ncclTopoGeneratedPath), 0755); err != nil {
+		return "", err
+	}
+	if err := writeTextfile(ncclTopoGeneratedPath, b); err != nil {
+		return "", err
+	}
+	return ncclTopoGeneratedPath, nil
+}
+
+// isMultiGPURequest tells the device requests of more than one GPU, the ones of the NCCL users.
+func isMultiGPURequest(devices string) bool {
+	return devices == "all" || strings.Contains(devices, ",")
+}
+
+// configureNCCLTopo mounts the topology file of the node in the multi-GPU containers, a missing topology only
+// costs NCCL the detection.
+func configureNCCLTopo(hook HookConfig, container containerConfig) {
+	if len(hook.NCCLTopoFile) == 0 || !isMultiGPURequest(container.Nvidia.Devices) {
+		return
+	}
+	f, err := getNCCLTopoFile(hook)
+	if err != nil {
+		warnf("no NCCL topology file: %v", err)
+		return
+	}
+	infof("mounting the NCCL topology %s", f)
+	bindContainerMount(hook.NvidiaContainerCLI, container, cdiMount{HostPath: f, ContainerPath: ncclTopoContainerPath, Options: []string{"ro"}})
+}
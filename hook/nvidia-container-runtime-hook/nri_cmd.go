@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/oci"
+)
+
+const (
+	defaultNRIPluginName  = "nvidia-container-runtime-hook"
+	defaultNRIPluginIndex = "10"
+)
+
+// nriPlugin adjusts the GPU containers of containerd or CRI-O before they're created.
+type nriPlugin struct {
+	hook HookConfig
+	self string
+	// The profiles and the capabilities of the requests are applied to globals, one request at a time.
+	sync.Mutex
+}
+
+func (p *nriPlugin) Configure(ctx context.Context, config, runtime, version string) (stub.EventMask, error) {
+	infof("registered as an NRI plugin of %s %s", runtime, version)
+	return 0, nil
+}
+
+func (p *nriPlugin) CreateContainer(ctx context.Context, pod *api.PodSandbox, c *api.Container) (*api.ContainerAdjustment, []*api.ContainerUpdate, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	adjust, err := getNRIAdjustment(p.hook, p.self, c)
+	if err != nil {
+		warnf("rejected the container %s of the pod %s/%s: %v", c.Name, pod.Namespace, pod.Name, err)
+	} else if adjust != nil {
+		infof("adjusted the container %s of the pod %s/%s", c.Name, pod.Namespace, pod.Name)
+	}
+	return adjust, nil, err
+}
+
+// getNRISpec returns the parts of the OCI spec of a container the runtime passes to the NRI plugins. The capabilities
+// of the process aren't among them: the container is taken as unprivileged.
+func getNRISpec(c *api.Container) *oci.Spec {
+	s := &oci.Spec{
+		Process:     &oci.Process{Env: c.Env},
+		Root:        &oci.Root{},
+		Annotations: c.Annotations,
+		Linux:       &oci.Linux{},
+	}
+	for _, m := range c.Mounts {
+		s.Mounts = append(s.Mounts, oci.Mount{Destination: m.Destination, Source: m.Source})
+	}
+	if c.Linux != nil {
+		s.Linux.CgroupsPath = c.Linux.CgroupsPath
+	}
+	return s
+}
+
+// addNRIHook adds a hook to the stage of the OCI runtime spec it runs at.
+func addNRIHook(hooks *api.Hooks, stage string, h *api.Hook) error {
+	switch stage {
+	case "prestart":
+		hooks.Prestart = append(hooks.Prestart, h)
+	case "createRuntime":
+		hooks.CreateRuntime = append(hooks.CreateRuntime, h)
+	case "createContainer":
+		hooks.CreateContainer = append(hooks.CreateContainer, h)
+	case "startContainer":
+		hooks.StartContainer = append(hooks.StartContainer, h)
+	case "poststart":
+		hooks.Poststart = append(hooks.Poststart, h)
+	case "poststop":
+		hooks.Poststop = append(hooks.Poststop, h)
+	default:
+		return fmt.Errorf("unknown hook stage %q", stage)
+	}
+	return nil
+}
+
+// getNRIAdjustment returns the adjustment of a container created by containerd or CRI-O, nil if it doesn't request
+// GPUs. The request is resolved and checked like the hook does, a rejected container fails before its creation.
+// In CDI mode the container gets the edits of the CDI specs of its devices, otherwise, or to hold its GPUs in the
+// ledger, the hook at its stage and at poststop: nvidia-container-cli needs the process of the container.
+func getNRIAdjustment(hook HookConfig, self string, c *api.Container) (adjust *api.ContainerAdjustment, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s", strings.TrimSpace(fmt.Sprint(r)))
+		}
+	}()
+
+	resolveMode(&hook)
+	withHook := hook.Mode != modeCDI || (hook.Ledger != nil && hook.ExclusiveGPUs)
+	if withHook {
+		// The hook resolves the request again, the devices it selects are only recorded then.
+		hook.DryRun = true
+	}
+	container, err := getSpecConfig(&hook, HookState{ID: c.Id}, getNRISpec(c))
+	if err != nil {
+		return nil, err
+	}
+	nvidia := container.Nvidia
+	if nvidia == nil {
+		return nil, nil
+	}
+	evaluatePolicy(&hook, container)
+	if hook.Ledger != nil && len(nvidia.Devices) > 0 {
+		info, err := getDriverInfo(hook.NvidiaContainerCLI)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLedger(*hook.Ledger, info.RequestedUUIDs(nvidia.Devices), container.Env[envNVReservation], container.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	adjust = &api.ContainerAdjustment{}
+	if withHook {
+		args := []string{filepath.Base(self)}
+		if len(*configflag) > 0 {
+			args = append(args, "-config", *configflag)
+		}
+		hooks := &api.Hooks{}
+		for _, stage := range []string{hook.Stage, "poststop"} {
+			if err := addNRIHook(hooks, stage, &api.Hook{Path: self, Args: append(append([]string{}, args...), stage)}); err != nil {
+				return nil, err
+			}
+		}
+		adjust.AddHooks(hooks)
+		return adjust, nil
+	}
+
+	edits, err := resolveCDIDevices(loadCDISpecs(hook.CDISpecDirs), nvidia.Devices)
+	if err != nil {
+		return nil, err
+	}
+	// The devices selected for the container, e.g. by topology, are the ones it sees.
+	adjust.AddEnv(envNVGPU, container.Env[envNVGPU])
+	hooks := &api.Hooks{}
+	for _, e := range edits {
+		for _, v := range e.Env {
+			p := strings.SplitN(v, "=", 2)
+			if len(p) != 2 {
+				return nil, fmt.Errorf("invalid environment variable of a CDI spec: %q", v)
+			}
+			adjust.AddEnv(p[0], p[1])
+		}
+		for _, d := range e.DeviceNodes {
+			major, minor := d.Major, d.Minor
+			if major == 0 {
+				host := d.HostPath
+				if len(host) == 0 {
+					host = d.Path
+				}
+				if major, minor, err = deviceNumbers(host); err != nil {
+					return nil, fmt.Errorf("could not get the device numbers of %s: %v", host, err)
+				}
+			}
+			adjust.AddDevice(&api.LinuxDevice{Path: d.Path, Type: "c", Major: int64(major), Minor: int64(minor), FileMode: api.FileMode(os.FileMode(0666))})
+		}
+		for _, m := range e.Mounts {
+			adjust.AddMount(&api.Mount{Destination: m.ContainerPath, Type: "bind", Source: m.HostPath, Options: append([]string{"rbind"}, m.Options...)})
+		}
+		for _, h := range e.Hooks {
+			if err := addNRIHook(hooks, h.HookName, &api.Hook{Path: h.Path, Args: h.Args, Env: h.Env}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	adjust.AddHooks(hooks)
+	return adjust, nil
+}
+
+// doNRI runs the hook as a long-running NRI plugin of containerd or CRI-O, which adjusts the GPU containers before
+// they're created instead of the runtime running the hook in each of them.
+func doNRI(args []string) {
+	flags := flag.NewFlagSet("nri", flag.ExitOnError)
+	socket := flags.String("socket", api.DefaultSocketPath, "NRI socket of the runtime")
+	name := flags.String("name", defaultNRIPluginName, "name of the plugin, unless started by the runtime")
+	index := flags.String("index", defaultNRIPluginIndex, "index of the plugin, the runtime calls the plugins in their index order")
+	flags.Parse(args)
+
+	defer exit()
+	log.SetFlags(0)
+
+	hook := getHookConfig()
+	setupLogger(hook)
+	self, err := os.Executable()
+	if err != nil {
+		log.Panicln("couldn't find the hook executable:", err)
+	}
+
+	opts := []stub.Option{stub.WithSocketPath(*socket)}
+	// The runtime names the plugins it starts from its plugin directory.
+	if len(os.Getenv(api.PluginNameEnvVar)) == 0 {
+		opts = append(opts, stub.WithPluginName(*name), stub.WithPluginIdx(*index))
+	}
+	s, err := stub.New(&nriPlugin{hook: hook, self: self}, opts...)
+	if err != nil {
+		log.Panicln("couldn't create the NRI plugin:", err)
+	}
+	if err := s.Run(context.Background()); err != nil {
+		log.Panicln(err)
+	}
+}
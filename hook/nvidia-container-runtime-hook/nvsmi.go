@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/devices"
+)
+
+var migListExp = regexp.MustCompile(`(?m)^\s*MIG .*\(UUID: (MIG-[^)]+)\)`)
+
+// queryGPUs runs nvidia-smi --query-gpu and returns one row of values per GPU.
+// The hook doesn't link against NVML, nvidia-smi exposes the same fields.
+func queryGPUs(config CLIConfig, fields ...string) ([][]string, error) {
+	smi := lookPath(config, "nvidia-smi")
+	out, err := queryDriver(config, smi, "--query-gpu="+strings.Join(fields, ","), "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-smi failed: %v", err)
+	}
+	return devices.ParseQueryOutput(string(out), len(fields))
+}
+
+// queryComputeApps returns the processes running on the GPUs, e.g. gpu_uuid,pid.
+func queryComputeApps(config CLIConfig, fields ...string) ([][]string, error) {
+	smi := lookPath(config, "nvidia-smi")
+	out, err := queryDriver(config, smi, "--query-compute-apps="+strings.Join(fields, ","), "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-smi failed: %v", err)
+	}
+	return devices.ParseQueryOutput(string(out), len(fields))
+}
+
+// queryRemappedRows returns the row remapping state of the GPUs supporting it, Ampere and later.
+func queryRemappedRows(config CLIConfig, fields ...string) ([][]string, error) {
+	smi := lookPath(config, "nvidia-smi")
+	out, err := queryDriver(config, smi, "--query-remapped-rows="+strings.Join(fields, ","), "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-smi failed: %v", err)
+	}
+	return devices.ParseQueryOutput(string(out), len(fields))
+}
+
+// listMIGDevices returns the UUIDs of the MIG devices, nvidia-smi -L lists them under their GPU.
+func listMIGDevices(config CLIConfig) ([]string, error) {
+	var uuids []string
+	err := withDiscoveryCache(config, "mig-devices", &uuids, func() error {
+		smi := lookPath(config, "nvidia-smi")
+		out, err := queryDriver(config, smi, "-L")
+		if err != nil {
+			return fmt.Errorf("nvidia-smi failed: %v", err)
+		}
+		uuids = parseMIGList(string(out))
+		return nil
+	})
+	return uuids, err
+}
+
+// parseMIGList parses the lines like "  MIG 1g.5gb Device 0: (UUID: MIG-<uuid>)".
+func parseMIGList(out string) []string {
+	var uuids []string
+	for _, m := range migListExp.FindAllStringSubmatch(out, -1) {
+		uuids = append(uuids, m[1])
+	}
+	return uuids
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Set to "enabled" by the containers managing the NVSwitches, like the nvswitch driver capability.
+	envNVNVSwitch = "NVIDIA_NVSWITCH"
+
+	// Driver capability of the NVSwitch devices and of the NSCQ library querying them.
+	nvswitchCapability = "nvswitch"
+
+	// The control device and the NVSwitches of the HGX and DGX systems.
+	nvswitchDevices = "/dev/nvidia-nvswitch*"
+)
+
+var defaultNVSwitchLibraries = []string{"/usr/lib*/libnvidia-nscq*.so*", "/usr/lib*/*/libnvidia-nscq*.so*"}
+
+// hasNVSwitches tells the nodes whose GPUs are connected by NVSwitches, their fabric is set up by the fabric manager.
+func hasNVSwitches() bool {
+	devices, _ := filepath.Glob(nvswitchDevices)
+	return len(devices) > 0
+}
+
+// parseFabricStates returns the fabric state of the GPUs of nvidia-smi -q by bus ID, e.g. "Completed, Success".
+// The GPUs before Hopper report N/A, their fabric isn't reported by the driver.
+//
+//	GPU 00000000:07:00.0
+//	    Fabric
+//	        State                             : Completed
+//	        Status                            : Success
+func parseFabricStates(out string) map[string]string {
+	states := make(map[string]string)
+	var gpu string
+	fabric := false
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if id := strings.TrimPrefix(line, "GPU "); id != line && pciBusIDExp.MatchString(id) {
+			gpu, fabric = id, false
+			continue
+		}
+		p := strings.SplitN(line, ":", 2)
+		key := strings.TrimSpace(p[0])
+		if len(p) == 1 {
+			fabric = key == "Fabric"
+			continue
+		}
+		if !fabric || len(gpu) == 0 {
+			continue
+		}
+		value := strings.TrimSpace(p[1])
+		switch key {
+		case "State":
+			states[gpu] = value
+		case "Status":
+			states[gpu] += ", " + value
+		}
+	}
+	return states
+}
+
+// checkFabricManager fails while the fabric of a GPU isn't set up: the CUDA applications of the containers would
+// fail to initialize until the fabric manager completes.
+func checkFabricManager(config CLIConfig) {
+	smi := lookPath(config, "nvidia-smi")
+	out, err := queryDriver(config, smi, "-q")
+	if err != nil {
+		fail(exitCodeCLIFailure, fmt.Errorf("nvidia-smi failed: %v", err))
+	}
+	for gpu, state := range parseFabricStates(string(out)) {
+		if state != "Completed, Success" && !strings.HasPrefix(state, "N/A") {
+			fail(exitCodeCLIFailure, fmt.Errorf("the NVSwitch fabric of GPU %s isn't ready (%s), is nvidia-fabricmanager running?", gpu, state))
+		}
+	}
+}
+
+// configureNVSwitch injects the NVSwitch devices and the NSCQ library in the containers requesting the nvswitch
+// capability or enabling NVIDIA_NVSWITCH, unless the capability is disabled.
+func configureNVSwitch(hook HookConfig, container containerConfig) {
+	requested := hasCapability(container.Nvidia.Capabilities, nvswitchCapability)
+	if !requested && container.Env[envNVNVSwitch] == envEnabled {
+		if _, ok := findCapability(driverCapabilities, nvswitchCapability); !ok {
+			warnf("%s is enabled but the %s driver capability is disabled, ignoring it", envNVNVSwitch, nvswitchCapability)
+			return
+		}
+		requested = true
+	}
+	if !requested {
+		return
+	}
+
+	devices, err := filepath.Glob(nvswitchDevices)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if len(devices) == 0 {
+		log.Panicf("the %s capability is requested but there is no %s device, is this an NVSwitch system?", nvswitchCapability, nvswitchDevices)
+	}
+	for _, d := range devices {
+		infof("injecting NVSwitch device %s", d)
+		injectHostDevice(container, d)
+	}
+	includeLibraries(hook.NvidiaContainerCLI, container, hook.NVSwitchLibraries)
+}
@@ -0,0 +1,268 @@
+// Package oci holds the subset of the OCI runtime specification used by the hook and the runtime.
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L94-L100
+type Root struct {
+	Path string `json:"path"`
+}
+
+// github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L102-L112
+type Mount struct {
+	Destination string `json:"destination"`
+	Source      string `json:"source,omitempty"`
+}
+
+// github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L30-L57
+type Process struct {
+	Env             []string         `json:"env,omitempty"`
+	Capabilities    *json.RawMessage `json:"capabilities,omitempty"`
+	ApparmorProfile string           `json:"apparmorProfile,omitempty"`
+	User            User             `json:"user"`
+}
+
+// github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L85-L92
+type User struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+// github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L61-L72
+type LinuxCapabilities struct {
+	Bounding []string `json:"bounding,omitempty"`
+}
+
+// github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L140-L172
+type Linux struct {
+	Devices     []LinuxDevice `json:"devices,omitempty"`
+	CgroupsPath string        `json:"cgroupsPath,omitempty"`
+}
+
+// github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L392-L410
+type LinuxDevice struct {
+	Path string `json:"path"`
+}
+
+// We use pointers to structs, similarly to the latest version of runtime-spec:
+// https://github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L5-L28
+type Spec struct {
+	Process     *Process          `json:"process,omitempty"`
+	Root        *Root             `json:"root,omitempty"`
+	Mounts      []Mount           `json:"mounts,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Linux       *Linux            `json:"linux,omitempty"`
+}
+
+// Getenv returns the value of a variable of the process environment, the last definition wins:
+// docker appends the variables of the container after those of the image.
+func (s *Spec) Getenv(name string) (string, bool) {
+	value, found := "", false
+	for _, e := range s.Process.Env {
+		if strings.HasPrefix(e, name+"=") {
+			value, found = strings.TrimPrefix(e, name+"="), true
+		}
+	}
+	return value, found
+}
+
+// MaxSpecSize bounds the OCI specs read by the hook and the runtime, CSI drivers can add thousands of mounts.
+const MaxSpecSize = 64 << 20
+
+// limitedReader fails instead of truncating a spec larger than the limit, a streamed spec has no size to check.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		if n, _ := l.r.Read(make([]byte, 1)); n == 0 {
+			return 0, io.EOF
+		}
+		return 0, fmt.Errorf("OCI spec exceeds %d bytes", int64(MaxSpecSize))
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func openSpec(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() && fi.Size() > MaxSpecSize {
+		f.Close()
+		return nil, fmt.Errorf("OCI spec of %d bytes exceeds %d bytes", fi.Size(), int64(MaxSpecSize))
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&limitedReader{f, MaxSpecSize}, f}, nil
+}
+
+func LoadSpec(path string) (spec *Spec, err error) {
+	f, err := openSpec(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open OCI spec: %v", err)
+	}
+	defer f.Close()
+
+	if spec, err = decodeSpec(json.NewDecoder(f)); err != nil {
+		return nil, fmt.Errorf("could not decode OCI spec: %v", err)
+	}
+	if spec.Process == nil {
+		return nil, fmt.Errorf("Process is empty in OCI spec")
+	}
+	if spec.Root == nil {
+		return nil, fmt.Errorf("Root is empty in OCI spec")
+	}
+	return
+}
+
+// decodeSpec streams the spec, only the fields of Spec are decoded: the others, e.g. the seccomp profile or the
+// options of the mounts, are skipped without being kept in memory.
+func decodeSpec(d *json.Decoder) (*Spec, error) {
+	spec := &Spec{}
+	_, err := decodeObject(d, map[string]interface{}{
+		"process": func(d *json.Decoder) error {
+			p := &Process{}
+			ok, err := decodeObject(d, map[string]interface{}{"env": &p.Env, "capabilities": &p.Capabilities, "apparmorProfile": &p.ApparmorProfile, "user": &p.User})
+			if ok {
+				spec.Process = p
+			}
+			return err
+		},
+		"root": &spec.Root,
+		"mounts": func(d *json.Decoder) error {
+			return decodeArray(d, func(d *json.Decoder) error {
+				var m Mount
+				err := d.Decode(&m)
+				spec.Mounts = append(spec.Mounts, m)
+				return err
+			})
+		},
+		"annotations": &spec.Annotations,
+		"linux": func(d *json.Decoder) error {
+			l := &Linux{}
+			ok, err := decodeObject(d, map[string]interface{}{"devices": &l.Devices, "cgroupsPath": &l.CgroupsPath})
+			if ok {
+				spec.Linux = l
+			}
+			return err
+		},
+	})
+	return spec, err
+}
+
+// decodeObject decodes the given fields of the next JSON object, either with a decoding function or into a pointer,
+// and skips the others. It returns false for null.
+func decodeObject(d *json.Decoder, fields map[string]interface{}) (bool, error) {
+	t, err := d.Token()
+	if err != nil || t == nil {
+		return false, err
+	}
+	if t != json.Delim('{') {
+		return false, fmt.Errorf("expected an object, got %v", t)
+	}
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return false, err
+		}
+		key, _ := t.(string)
+		switch field := fields[key].(type) {
+		case func(*json.Decoder) error:
+			err = field(d)
+		case nil:
+			err = skipValue(d)
+		default:
+			err = d.Decode(field)
+		}
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	_, err = d.Token()
+	return true, err
+}
+
+// decodeArray calls decode for every element of the next JSON array, if not null.
+func decodeArray(d *json.Decoder, decode func(*json.Decoder) error) error {
+	t, err := d.Token()
+	if err != nil || t == nil {
+		return err
+	}
+	if t != json.Delim('[') {
+		return fmt.Errorf("expected an array, got %v", t)
+	}
+	for d.More() {
+		if err := decode(d); err != nil {
+			return err
+		}
+	}
+	_, err = d.Token()
+	return err
+}
+
+func skipValue(d *json.Decoder) error {
+	depth := 0
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// UpdateSpec edits the OCI spec in place, fields unknown to the hook are preserved.
+func UpdateSpec(path string, update func(spec map[string]interface{})) error {
+	f, err := openSpec(path)
+	if err != nil {
+		return fmt.Errorf("could not open OCI spec: %v", err)
+	}
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("could not read OCI spec: %v", err)
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return fmt.Errorf("could not decode OCI spec: %v", err)
+	}
+
+	update(spec)
+
+	if b, err = json.Marshal(spec); err != nil {
+		return fmt.Errorf("could not encode OCI spec: %v", err)
+	}
+	// Replace the file atomically, the runtime or other hooks might read it concurrently.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("could not write OCI spec: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("could not write OCI spec: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultParallelism = 4
+
+// parallelDo runs fn(0) ... fn(count-1) with at most n calls at once, sequentially if n <= 1.
+// The hook fails by panicking: the first panic of the calls is raised again in the caller once they are all done.
+func parallelDo(n int, count int, fn func(i int)) {
+	if n <= 1 || count <= 1 {
+		for i := 0; i < count; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var failure interface{}
+	slots := make(chan struct{}, n)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer func() {
+				if r := recover(); r != nil {
+					once.Do(func() { failure = r })
+				}
+				<-slots
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+	if failure != nil {
+		panic(failure)
+	}
+}
+
+// injectContainerDevices injects the device nodes in parallel, once each.
+func injectContainerDevices(container containerConfig, nodes []deviceNode, parallelism int) {
+	var unique []deviceNode
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		if !seen[n.Path] {
+			seen[n.Path] = true
+			unique = append(unique, n)
+		}
+	}
+	parallelDo(parallelism, len(unique), func(i int) {
+		infof("injecting device node %s", unique[i].Path)
+		injectContainerDevice(container, unique[i])
+	})
+}
+
+// bindContainerMounts runs the mounts in parallel, keeping their order where it matters: the mounts of a
+// path are done before the mounts nested in it, the mounts of the same path in their order.
+func bindContainerMounts(config CLIConfig, container containerConfig, mounts []cdiMount, parallelism int) {
+	depth := func(m cdiMount) int {
+		return strings.Count(strings.Trim(m.ContainerPath, "/"), "/")
+	}
+	waves := make(map[int][][]cdiMount)
+	var depths []int
+	for _, m := range mounts {
+		d := depth(m)
+		if _, ok := waves[d]; !ok {
+			depths = append(depths, d)
+		}
+		grouped := false
+		for i, g := range waves[d] {
+			if g[0].ContainerPath == m.ContainerPath {
+				waves[d][i] = append(g, m)
+				grouped = true
+				break
+			}
+		}
+		if !grouped {
+			waves[d] = append(waves[d], []cdiMount{m})
+		}
+	}
+	sort.Ints(depths)
+
+	for _, d := range depths {
+		groups := waves[d]
+		parallelDo(parallelism, len(groups), func(i int) {
+			for _, m := range groups[i] {
+				infof("mounting %s at %s", m.HostPath, m.ContainerPath)
+				bindContainerMount(config, container, m)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// <domain>:<bus>:<device>.<function>, e.g. 0000:3b:00.0, the domain may have 4 or 8 digits as printed by
+// lspci and nvidia-smi.
+var pciBusIDExp = regexp.MustCompile(`^` + nvidiaPCIBusIDFmt + `$`)
+
+// Alphanumerics with colons and dots, the CDI device names have a vendor and a class.
+var pciBusIDLikeExp = regexp.MustCompile(`^[0-9a-zA-Z]*:[0-9a-zA-Z:.]*$`)
+
+// isPCIBusID tells the devices meant as PCI bus IDs, <GPU index>:<MIG index> have no dot nor two colons.
+func isPCIBusID(d string) bool {
+	return pciBusIDLikeExp.MatchString(d) && (strings.Contains(d, ".") || strings.Count(d, ":") > 1)
+}
+
+// validatePCIBusIDs rejects malformed PCI bus IDs early, nvidia-container-cli would only report an unknown device.
+func validatePCIBusIDs(devices string) error {
+	for _, d := range strings.Split(devices, ",") {
+		if isPCIBusID(d) && !pciBusIDExp.MatchString(d) {
+			return fmt.Errorf("invalid PCI bus ID %s, expected <domain>:<bus>:<device>.<function>, e.g. 0000:3b:00.0", d)
+		}
+	}
+	return nil
+}
+
+// normalizePCIBusID formats a bus ID like nvidia-container-cli: 8 digits domain, lower case.
+func normalizePCIBusID(id string) string {
+	m := pciBusIDExp.FindStringSubmatch(id)
+	if m == nil {
+		return strings.ToLower(id)
+	}
+	domain, _ := strconv.ParseUint(m[1], 16, 32)
+	return strings.ToLower(fmt.Sprintf("%08x:%s:%s.%s", domain, m[2], m[3], m[4]))
+}
+
+// resolvePCIBusIDs replaces the PCI bus IDs of a device request by the UUIDs of their GPUs.
+func resolvePCIBusIDs(cli CLIConfig, devices string) (string, error) {
+	found := false
+	for _, d := range strings.Split(devices, ",") {
+		found = found || isPCIBusID(d)
+	}
+	if !found {
+		return devices, nil
+	}
+
+	resolved, unknown, err := lookupPCIBusIDs(cli, devices)
+	if len(unknown) > 0 && len(cli.DiscoveryCache) > 0 {
+		// The cache may predate the GPUs, e.g. hot-plugged ones.
+		invalidateDiscoveryCache(cli)
+		resolved, unknown, err = lookupPCIBusIDs(cli, devices)
+	}
+	if err != nil {
+		return "", &hookError{exitCodeCLIFailure, err}
+	}
+	if len(unknown) > 0 {
+		return "", &hookError{exitCodeBadSpec, fmt.Errorf("unknown PCI bus IDs requested: %s", strings.Join(unknown, ", "))}
+	}
+	return resolved, nil
+}
+
+func lookupPCIBusIDs(cli CLIConfig, devices string) (string, []string, error) {
+	info, err := getDriverInfo(cli)
+	if err != nil {
+		return "", nil, err
+	}
+	var resolved, unknown []string
+	for _, d := range strings.Split(devices, ",") {
+		if !isPCIBusID(d) {
+			resolved = append(resolved, d)
+			continue
+		}
+		uuid := ""
+		for _, dev := range info.Devices {
+			if normalizePCIBusID(dev.BusID) == normalizePCIBusID(d) {
+				uuid = dev.UUID
+			}
+		}
+		if len(uuid) == 0 {
+			unknown = append(unknown, d)
+			continue
+		}
+		debugf("resolved the PCI bus ID %s to %s", d, uuid)
+		resolved = append(resolved, uuid)
+	}
+	return strings.Join(resolved, ","), unknown, nil
+}
@@ -0,0 +1,189 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v3.21.12
+// source: allocator.proto
+
+package allocator
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Allocator_Allocate_FullMethodName = "/nvidia.container.allocator.v1.Allocator/Allocate"
+	Allocator_Release_FullMethodName  = "/nvidia.container.allocator.v1.Allocator/Release"
+	Allocator_List_FullMethodName     = "/nvidia.container.allocator.v1.Allocator/List"
+)
+
+// AllocatorClient is the client API for Allocator service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AllocatorClient interface {
+	// Allocate reserves GPUs for an owner, it fails if one of them is held by another owner.
+	Allocate(ctx context.Context, in *AllocateRequest, opts ...grpc.CallOption) (*AllocateResponse, error)
+	// Release releases all the GPUs of an owner.
+	Release(ctx context.Context, in *ReleaseRequest, opts ...grpc.CallOption) (*ReleaseResponse, error)
+	// List returns the GPUs held on the node.
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+}
+
+type allocatorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAllocatorClient(cc grpc.ClientConnInterface) AllocatorClient {
+	return &allocatorClient{cc}
+}
+
+func (c *allocatorClient) Allocate(ctx context.Context, in *AllocateRequest, opts ...grpc.CallOption) (*AllocateResponse, error) {
+	out := new(AllocateResponse)
+	err := c.cc.Invoke(ctx, Allocator_Allocate_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *allocatorClient) Release(ctx context.Context, in *ReleaseRequest, opts ...grpc.CallOption) (*ReleaseResponse, error) {
+	out := new(ReleaseResponse)
+	err := c.cc.Invoke(ctx, Allocator_Release_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *allocatorClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, Allocator_List_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AllocatorServer is the server API for Allocator service.
+// All implementations must embed UnimplementedAllocatorServer
+// for forward compatibility
+type AllocatorServer interface {
+	// Allocate reserves GPUs for an owner, it fails if one of them is held by another owner.
+	Allocate(context.Context, *AllocateRequest) (*AllocateResponse, error)
+	// Release releases all the GPUs of an owner.
+	Release(context.Context, *ReleaseRequest) (*ReleaseResponse, error)
+	// List returns the GPUs held on the node.
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	mustEmbedUnimplementedAllocatorServer()
+}
+
+// UnimplementedAllocatorServer must be embedded to have forward compatible implementations.
+type UnimplementedAllocatorServer struct {
+}
+
+func (UnimplementedAllocatorServer) Allocate(context.Context, *AllocateRequest) (*AllocateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Allocate not implemented")
+}
+func (UnimplementedAllocatorServer) Release(context.Context, *ReleaseRequest) (*ReleaseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Release not implemented")
+}
+func (UnimplementedAllocatorServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedAllocatorServer) mustEmbedUnimplementedAllocatorServer() {}
+
+// UnsafeAllocatorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AllocatorServer will
+// result in compilation errors.
+type UnsafeAllocatorServer interface {
+	mustEmbedUnimplementedAllocatorServer()
+}
+
+func RegisterAllocatorServer(s grpc.ServiceRegistrar, srv AllocatorServer) {
+	s.RegisterService(&Allocator_ServiceDesc, srv)
+}
+
+func _Allocator_Allocate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AllocateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AllocatorServer).Allocate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Allocator_Allocate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AllocatorServer).Allocate(ctx, req.(*AllocateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Allocator_Release_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReleaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AllocatorServer).Release(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Allocator_Release_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AllocatorServer).Release(ctx, req.(*ReleaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Allocator_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AllocatorServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Allocator_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AllocatorServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Allocator_ServiceDesc is the grpc.ServiceDesc for Allocator service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Allocator_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "nvidia.container.allocator.v1.Allocator",
+	HandlerType: (*AllocatorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Allocate",
+			Handler:    _Allocator_Allocate_Handler,
+		},
+		{
+			MethodName: "Release",
+			Handler:    _Allocator_Release_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _Allocator_List_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "allocator.proto",
+}
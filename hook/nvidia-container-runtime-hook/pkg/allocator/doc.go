@@ -0,0 +1,4 @@
+// Package allocator is the gRPC API of the node-local GPU allocation service of the hook.
+package allocator
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative allocator.proto
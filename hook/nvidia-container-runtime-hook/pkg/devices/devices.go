@@ -0,0 +1,130 @@
+// Package devices discovers the NVIDIA devices of a node: the device nodes of the kernel driver, the GPUs and the
+// MIG devices known to the driver, and the devices matched by the requests. The device nodes themselves are only
+// supported on Linux, the rest builds everywhere for the tooling sharing it with the hook.
+package devices
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	ProcDevicesPath = "/proc/devices"
+	ProcGPUsPath    = "/proc/driver/nvidia/gpus"
+
+	// github.com/NVIDIA/nvidia-modprobe/blob/master/modprobe-utils/nvidia-modprobe-utils.h
+	NvidiaMajor         = 195
+	NvidiaCtlMinor      = 255
+	NvidiaModesetMinor  = 254
+	NvidiaUVMMinor      = 0
+	NvidiaUVMToolsMinor = 1
+
+	NvidiaDeviceName    = "nvidia-frontend"
+	NvidiaLegacyName    = "nvidia"
+	NvidiaUVMDeviceName = "nvidia-uvm"
+)
+
+// Node is a character device node.
+type Node struct {
+	Path  string
+	Major uint32
+	Minor uint32
+}
+
+// Mkdev mirrors the makedev() macro of glibc, the syscall package doesn't provide it.
+func Mkdev(major, minor uint32) uint64 {
+	dev := (uint64(major) & 0x00000fff) << 8
+	dev |= (uint64(major) & 0xfffff000) << 32
+	dev |= (uint64(minor) & 0x000000ff) << 0
+	dev |= (uint64(minor) & 0xffffff00) << 12
+	return dev
+}
+
+// Majors parses the "Character devices" section of /proc/devices.
+func Majors(path string) (map[string]uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	majors := make(map[string]uint32)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "Block devices:" {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		major, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		majors[fields[1]] = uint32(major)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", path, err)
+	}
+	return majors, nil
+}
+
+// GPUMinors returns the device minors of the GPUs known to the kernel driver.
+// NVML is not available to the hook, the driver exposes the same information under procfs.
+func GPUMinors(path string) ([]uint32, error) {
+	infos, err := filepath.Glob(filepath.Join(path, "*", "information"))
+	if err != nil {
+		return nil, err
+	}
+
+	var minors []uint32
+	for _, info := range infos {
+		b, err := ioutil.ReadFile(info)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", info, err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			p := strings.SplitN(line, ":", 2)
+			if len(p) != 2 || strings.TrimSpace(p[0]) != "Device Minor" {
+				continue
+			}
+			minor, err := strconv.ParseUint(strings.TrimSpace(p[1]), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid device minor in %s: %s", info, p[1])
+			}
+			minors = append(minors, uint32(minor))
+		}
+	}
+	return minors, nil
+}
+
+// Nodes returns the device nodes of the kernel driver and of its GPUs, none if the driver isn't loaded.
+func Nodes(majors map[string]uint32, gpus []uint32) []Node {
+	_, frontend := majors[NvidiaDeviceName]
+	_, legacy := majors[NvidiaLegacyName]
+	if !frontend && !legacy {
+		// The kernel module isn't loaded, nothing we can create.
+		return nil
+	}
+
+	nodes := []Node{
+		{"/dev/nvidiactl", NvidiaMajor, NvidiaCtlMinor},
+		{"/dev/nvidia-modeset", NvidiaMajor, NvidiaModesetMinor},
+	}
+	for _, minor := range gpus {
+		nodes = append(nodes, Node{fmt.Sprintf("/dev/nvidia%d", minor), NvidiaMajor, minor})
+	}
+	if uvm, ok := majors[NvidiaUVMDeviceName]; ok {
+		nodes = append(nodes,
+			Node{"/dev/nvidia-uvm", uvm, NvidiaUVMMinor},
+			Node{"/dev/nvidia-uvm-tools", uvm, NvidiaUVMToolsMinor})
+	}
+	return nodes
+}
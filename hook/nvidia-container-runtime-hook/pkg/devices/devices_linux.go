@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package devices
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Mknod creates a character device node.
+func Mknod(path string, major, minor uint32) error {
+	return syscall.Mknod(path, syscall.S_IFCHR|0666, int(Mkdev(major, minor)))
+}
+
+// Numbers returns the major and minor numbers of a character device node, inverting Mkdev.
+func Numbers(path string) (major, minor uint32, err error) {
+	var st syscall.Stat_t
+	if err = syscall.Stat(path, &st); err != nil {
+		return 0, 0, err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+		return 0, 0, fmt.Errorf("%s is not a character device", path)
+	}
+	dev := uint64(st.Rdev)
+	major = uint32((dev>>8)&0x00000fff) | uint32((dev>>32)&0xfffff000)
+	minor = uint32(dev&0x000000ff) | uint32((dev>>12)&0xffffff00)
+	return major, minor, nil
+}
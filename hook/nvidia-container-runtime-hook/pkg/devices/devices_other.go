@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package devices
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Mknod is a stub, the device nodes are only supported on Linux.
+func Mknod(path string, major, minor uint32) error {
+	return fmt.Errorf("creating device nodes is not supported on %s", runtime.GOOS)
+}
+
+// Numbers is a stub, the device nodes are only supported on Linux.
+func Numbers(path string) (major, minor uint32, err error) {
+	return 0, 0, fmt.Errorf("device nodes are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,170 @@
+package devices
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DeviceInfo is a GPU known to the driver.
+type DeviceInfo struct {
+	Index        string
+	Minor        string
+	Model        string
+	Brand        string
+	UUID         string
+	BusID        string
+	Architecture string
+}
+
+// DriverInfo is the driver of the node and its GPUs, as reported by nvidia-container-cli info.
+type DriverInfo struct {
+	DriverVersion string
+	CUDAVersion   string
+	Devices       []DeviceInfo
+}
+
+// ParseDriverInfo parses the output of nvidia-container-cli info --csv:
+//
+//	NVRM version,CUDA version
+//	<driver>,<cuda>
+//
+//	Device Index,Device Minor,Model,Brand,GPU UUID,Bus Location,Architecture
+//	<one line per device>
+func ParseDriverInfo(out string) (*DriverInfo, error) {
+	sections := strings.Split(strings.TrimSpace(out), "\n\n")
+	driver, err := ParseQueryOutput(strings.Join(dropHeader(strings.Split(sections[0], "\n")), "\n"), 2)
+	if err != nil || len(driver) != 1 {
+		return nil, fmt.Errorf("unexpected driver information: %q", sections[0])
+	}
+
+	info := &DriverInfo{
+		DriverVersion: driver[0][0],
+		CUDAVersion:   driver[0][1],
+	}
+	if len(sections) < 2 {
+		return info, nil
+	}
+
+	devices, err := ParseQueryOutput(strings.Join(dropHeader(strings.Split(sections[1], "\n")), "\n"), 7)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected device information: %v", err)
+	}
+	for _, d := range devices {
+		info.Devices = append(info.Devices, DeviceInfo{d[0], d[1], d[2], d[3], d[4], d[5], d[6]})
+	}
+	return info, nil
+}
+
+// ParseQueryOutput parses the CSV output of the queries of nvidia-smi, without header, into rows of nfields values.
+func ParseQueryOutput(out string, nfields int) ([][]string, error) {
+	var rows [][]string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		values := strings.Split(line, ",")
+		if len(values) != nfields {
+			return nil, fmt.Errorf("unexpected nvidia-smi output: %s", line)
+		}
+		for i := range values {
+			values[i] = strings.TrimSpace(values[i])
+		}
+		rows = append(rows, values)
+	}
+	return rows, nil
+}
+
+// dropHeader drops the CSV header.
+func dropHeader(lines []string) []string {
+	if len(lines) == 0 {
+		return lines
+	}
+	return lines[1:]
+}
+
+// IsRequested tells whether a GPU is requested by a device request, directly or through one of its MIG devices.
+func IsRequested(devices string, index string, uuid string) bool {
+	for _, d := range strings.Split(devices, ",") {
+		if parent, ok := MIGParent(d); ok {
+			d = parent
+		}
+		if d == "all" || d == index || strings.EqualFold(d, uuid) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches matches a GPU UUID or index against patterns, a trailing '*' matches a prefix.
+func Matches(patterns []string, id string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(strings.ToLower(id), strings.ToLower(strings.TrimSuffix(p, "*"))) {
+				return true
+			}
+		} else if strings.EqualFold(id, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestedUUIDs returns the UUIDs of the GPUs matching a device request.
+func (info *DriverInfo) RequestedUUIDs(devices string) []string {
+	var uuids []string
+	for _, d := range info.Devices {
+		if IsRequested(devices, d.Index, d.UUID) {
+			uuids = append(uuids, d.UUID)
+		}
+	}
+	return uuids
+}
+
+// ResolveIndexes replaces "all" and the GPU indexes of a device request by the UUIDs of the GPUs,
+// the MIG devices are kept as requested.
+func (info *DriverInfo) ResolveIndexes(devices string) string {
+	var resolved []string
+	for _, d := range strings.Split(devices, ",") {
+		found := false
+		for _, dev := range info.Devices {
+			if d == "all" || d == dev.Index {
+				resolved = append(resolved, dev.UUID)
+				found = true
+			}
+		}
+		if !found {
+			resolved = append(resolved, d)
+		}
+	}
+	return strings.Join(resolved, ",")
+}
+
+// UnknownDevices returns the requested indexes and UUIDs matching no GPU, nor MIG device, of the node.
+// The MIG devices are only needed for MIG-<UUID> requests.
+func (info *DriverInfo) UnknownDevices(devices string, migDevices []string) []string {
+	var unknown []string
+	for _, d := range strings.Split(devices, ",") {
+		id := d
+		if parent, ok := MIGParent(d); ok {
+			id = parent
+		}
+		if len(id) == 0 || id == "all" {
+			continue
+		}
+
+		found := false
+		if strings.HasPrefix(strings.ToUpper(id), "MIG-") {
+			for _, m := range migDevices {
+				found = found || strings.EqualFold(m, id)
+			}
+		} else {
+			for _, dev := range info.Devices {
+				found = found || id == dev.Index || strings.EqualFold(id, dev.UUID)
+			}
+		}
+		if !found {
+			unknown = append(unknown, d)
+		}
+	}
+	return unknown
+}
@@ -0,0 +1,52 @@
+package devices
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The formats of the GPU UUIDs and of the MIG devices: MIG-GPU-<GPU UUID>/<GI>/<CI> or MIG-<UUID>.
+const (
+	GPUUUIDFmt   = `[gG][pP][uU]-([0-9a-fA-F-]){1,75}`
+	MIGDeviceFmt = `[mM][iI][gG]-(` + GPUUUIDFmt + `/[0-9]+/[0-9]+|([0-9a-fA-F-]){1,75})`
+)
+
+// <GPU index>:<MIG index>, as accepted by nvidia-container-cli.
+var migIndexExp = regexp.MustCompile(`^([0-9]+):[0-9]+$`)
+
+var migDeviceExp = regexp.MustCompile(`^` + MIGDeviceFmt + `$`)
+
+// IsMIGDevice tells the MIG devices of the requests, well-formed or not.
+func IsMIGDevice(d string) bool {
+	return strings.HasPrefix(strings.ToUpper(d), "MIG-") || migIndexExp.MatchString(d)
+}
+
+// MIGParent returns the GPU a MIG device belongs to, as a UUID or an index.
+// MIG-<UUID> devices don't name their GPU, only the driver can map them.
+func MIGParent(d string) (string, bool) {
+	if m := migIndexExp.FindStringSubmatch(d); m != nil {
+		return m[1], true
+	}
+	if !migDeviceExp.MatchString(d) {
+		return "", false
+	}
+	p := strings.SplitN(d[len("MIG-"):], "/", 2)
+	if len(p) != 2 {
+		return "", false
+	}
+	return p[0], true
+}
+
+// ValidateMIGDevices rejects malformed MIG devices early, nvidia-container-cli would only report an unknown device.
+func ValidateMIGDevices(devices string) error {
+	for _, d := range strings.Split(devices, ",") {
+		if !IsMIGDevice(d) {
+			continue
+		}
+		if !migIndexExp.MatchString(d) && !migDeviceExp.MatchString(d) {
+			return fmt.Errorf("invalid MIG device %s, expected MIG-GPU-<GPU UUID>/<GI>/<CI>, MIG-<UUID> or <GPU index>:<MIG index>", d)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+// Package hookconfig is the configuration of the hook, shared with the tooling checking or generating it, e.g. the
+// policy checkers of a CI. It only decodes the options, the hook gives them their defaults and applies them.
+package hookconfig
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/configfile"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/devices"
+)
+
+// EnvPrefix prefixes the environment variables overriding the options, e.g. NVIDIA_CONTAINER_RUNTIME_HOOK_LOG_LEVEL.
+const EnvPrefix = "NVIDIA_CONTAINER_RUNTIME_HOOK_"
+
+// Duration is a time.Duration decoded from a string like "30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// CLIConfig: options for nvidia-container-cli.
+type CLIConfig struct {
+	Root        *string  `toml:"root"`
+	Path        *string  `toml:"path"`
+	Environment []string `toml:"environment"`
+	Debug       *string  `toml:"debug"`
+	Ldcache     *string  `toml:"ldcache"`
+	LoadKmods   bool     `toml:"load-kmods"`
+	Ldconfig    *string  `toml:"ldconfig"`
+	// the ld.so cache of the containers is written by the hook instead of running an ldconfig.
+	BuiltinLdconfig bool `toml:"builtin-ldconfig"`
+	// the GSP firmware and the nvidia-caps devices of the open kernel modules are injected, detected if unset.
+	OpenKernelModules *bool `toml:"open-kernel-modules"`
+	// retries of nvidia-container-cli and nvidia-smi failing with one of the transient errors, after a backoff doubled each time.
+	Retries         int      `toml:"retries"`
+	RetryBackoff    Duration `toml:"retry-backoff"`
+	TransientErrors []string `toml:"transient-errors"`
+	// node-local cache of the GPUs and MIG devices found by the driver queries, disabled if empty.
+	DiscoveryCache string `toml:"discovery-cache"`
+	// leave the devices cgroup alone, the runtime allows the devices, e.g. with the rules of the OCI spec on cgroup v2.
+	NoCgroups bool `toml:"no-cgroups"`
+}
+
+// HookConfig: options of the hook, the configuration file and its drop-in files.
+type HookConfig struct {
+	DisableRequire bool `toml:"disable-require"`
+	// environment variables of the GPUs allocated by Docker Swarm, comma-separated, their devices and those of their
+	// numbered variables are merged.
+	SwarmResource *string `toml:"swarm-resource"`
+
+	// OCI hook stage configuring the container: prestart, createRuntime or createContainer.
+	Stage string `toml:"stage"`
+
+	// how the container is configured: "legacy" runs nvidia-container-cli, "cdi" applies the CDI specs of the devices,
+	// "csv" injects the driver files of Jetson systems listed by the CSV files, "wsl" the driver of the WSL2 host,
+	// "auto" picks one of them from the node.
+	Mode        string   `toml:"mode"`
+	CDISpecDirs []string `toml:"cdi-spec-dirs"`
+	CSVDirs     []string `toml:"csv-dirs"`
+
+	// fail on unknown options of the configuration files instead of ignoring them with a warning.
+	StrictConfig bool `toml:"strict-config"`
+	// named profiles of options, [profiles.<name>] tables, set over the configuration for the containers requesting them
+	// with the com.nvidia.profile annotation or NVIDIA_PROFILE, and the profile of the other containers.
+	Profiles       map[string]map[string]interface{} `toml:"profiles"`
+	DefaultProfile string                            `toml:"default-profile"`
+	// host paths, host[:container][:ro|rw], and device nodes injected in the containers requesting a driver capability,
+	// by capability.
+	ExtraMounts  map[string][]string `toml:"mounts"`
+	ExtraDevices map[string][]string `toml:"devices"`
+	// version of the policy set by the administrator, logged by each invocation and in the audit log.
+	PolicyVersion string `toml:"policy-version"`
+
+	// print how the containers would be configured instead of configuring them, like the -dry-run flag.
+	DryRun bool `toml:"dry-run"`
+
+	// messages of the hook stages: minimum level (debug, info, warning, error), file (stderr if unset), format (text or json).
+	LogLevel  string  `toml:"log-level"`
+	LogFile   *string `toml:"log-file"`
+	LogFormat string  `toml:"log-format"`
+
+	// where the devices and capabilities are requested, by precedence: "env" (NVIDIA_VISIBLE_DEVICES
+	// and NVIDIA_DRIVER_CAPABILITIES), "annotations" (com.nvidia.devices and com.nvidia.capabilities)
+	// and "volume-mounts" (devices only).
+	RequestSources []string `toml:"request-sources"`
+	// "volume-mounts" requests: mounts of /dev/null on <device-list-volume-mounts-root>/<device>.
+	DeviceListMountsRoot string `toml:"device-list-volume-mounts-root"`
+	// directory of the allocation files of the Kubernetes device plugin, <pod UID>.json. With mount-gpu-only-by-uuid,
+	// they're the only device requests of the containers of the pods.
+	DevicePluginAllocations *string `toml:"device-plugin-allocations"`
+
+	// allow unprivileged containers to request devices with NVIDIA_VISIBLE_DEVICES, rather than annotations only.
+	AcceptEnvvarUnprivileged bool `toml:"accept-nvidia-visible-devices-envvar-when-unprivileged"`
+
+	// GPUs (UUIDs or indexes, a trailing '*' matches a prefix) the containers may, or may not, use.
+	AllowedDevices []string `toml:"allowed-devices"`
+	DeniedDevices  []string `toml:"denied-devices"`
+
+	// check that the requested GPUs and MIG devices exist before running nvidia-container-cli.
+	ValidateDevices bool `toml:"validate-devices"`
+
+	// evaluate the NVIDIA_REQUIRE_* constraints before running nvidia-container-cli, reporting all the failed ones.
+	ValidateRequirements bool `toml:"validate-requirements"`
+	// enforce, warn about or ignore the requirements of all the containers, regardless of NVIDIA_DISABLE_REQUIRE.
+	RequirePolicy string `toml:"require-policy"`
+
+	// used on docker/kubernetes to make sure only mount GPU when the GPU UUIDs have been specified.
+	MountGPUOnlyByUUID bool `toml:"mount-gpu-only-by-uuid"`
+	// "reject" the unprivileged containers mounting NVIDIA device nodes or /dev themselves, bypassing the requests,
+	// or "allow" them. Rejected by default with mount-gpu-only-by-uuid.
+	RawDeviceMounts string `toml:"raw-device-mounts"`
+
+	// create the missing /dev/nvidia* device nodes on the host before running nvidia-container-cli.
+	CreateDeviceNodes bool `toml:"create-device-nodes"`
+
+	// load the kernel modules from the hook instead of relying on the load-kmods option of nvidia-container-cli.
+	LoadKernelModules bool     `toml:"load-kernel-modules"`
+	KernelModules     []string `toml:"kernel-modules"`
+
+	// include or exclude these device nodes regardless of the capabilities, unset follows the capabilities.
+	InjectUVMTools *bool `toml:"inject-uvm-tools"`
+	InjectModeset  *bool `toml:"inject-modeset"`
+	// the DRM nodes of the GPUs, unset injects them in the containers requesting graphics or display.
+	InjectDRM *bool `toml:"inject-drm"`
+	// mount the X11 and Wayland sockets named by the environment of the containers requesting display.
+	DisplayForwarding bool `toml:"display-forwarding"`
+
+	// how to expose the driver libraries to musl based images (e.g. Alpine): "path-file" or "none".
+	MuslLinker string `toml:"musl-linker"`
+
+	// query nvidia-smi to detect vGPU guests and provide the license client configuration to the container.
+	DetectVGPU bool `toml:"detect-vgpu"`
+	// libraries of the guest driver mounted in the containers requesting the vgpu capability on vGPU guests.
+	VGPULibraries []string `toml:"vgpu-libraries"`
+
+	// record the GPUs of the containers in their spec, their restore from a checkpoint gets the same GPUs.
+	CheckpointRestore bool `toml:"checkpoint-restore"`
+
+	// write the injected driver versions in the bundle, and optionally as an annotation of config.json.
+	RecordVersions           bool `toml:"record-versions"`
+	RecordVersionsAnnotation bool `toml:"record-versions-annotation"`
+
+	// executables run after the GPUs are configured, they receive the container state as JSON on stdin.
+	PostConfigure []string `toml:"post-configure"`
+	// executables run by the poststop hook to undo what post-configure set up on the node, they receive the same state.
+	PostStop []string `toml:"post-stop"`
+
+	// executable or unix socket (unix:///path) resolving the requested devices to a list of GPU UUIDs.
+	DeviceResolver *string `toml:"device-resolver"`
+	// pick the GPUs of the count:<n>[,policy:nvlink|pcie] requests by topology, before the device resolver.
+	TopologySelection bool `toml:"topology-selection"`
+	// give the SELinux type to the NVIDIA device nodes of the containers ("devices"), and to the bind mounts of the hook ("all").
+	SELinuxRelabel string `toml:"selinux-relabel"`
+	SELinuxType    string `toml:"selinux-type"`
+	// check that the processes of the containers can open their NVIDIA devices once they're injected.
+	VerifyDeviceAccess bool `toml:"verify-device-access"`
+	// warn when the AppArmor profile of the containers keeps them from opening their NVIDIA devices.
+	AppArmorCheck bool `toml:"apparmor-check"`
+	// let the privileged containers manage or monitor the MIG instances with NVIDIA_MIG_CONFIG_DEVICES and NVIDIA_MIG_MONITOR_DEVICES.
+	AllowMIGManagement bool `toml:"allow-mig-management"`
+	// write the resolved devices and capabilities of the containers into their environment, through the wrapper.
+	ExportDevices bool `toml:"export-devices"`
+	// variables, NAME=value, set in the environment of the GPU containers not setting them, through the wrapper.
+	ContainerEnv []string `toml:"container-env"`
+	// NCCL topology file mounted in the multi-GPU containers, "auto" the one of the node or one generated from sysfs.
+	NCCLTopoFile string `toml:"nccl-topo-file"`
+
+	// driver capabilities added to the built-in ones or changing their nvidia-container-cli option,
+	// the ones removed from the node, and the capabilities of the containers not setting NVIDIA_DRIVER_CAPABILITIES.
+	DriverCapabilities         []DriverCapability `toml:"driver-capabilities"`
+	DisabledDriverCapabilities []string           `toml:"disabled-driver-capabilities"`
+	DefaultDriverCapabilities  string             `toml:"default-driver-capabilities"`
+
+	// capabilities the containers may use, all if empty, and what to do with the others requested by name: strip or fail.
+	SupportedDriverCapabilities []string `toml:"supported-driver-capabilities"`
+	UnsupportedCapabilities     string   `toml:"unsupported-capabilities"`
+
+	// concurrent driver queries, device nodes and mounts, for the containers of many GPUs or MIG devices.
+	Parallelism int `toml:"parallelism"`
+
+	// nvidia-container-cli configure is killed past this timeout, 0s waits forever.
+	CLITimeout Duration `toml:"cli-timeout"`
+
+	// wait for GPUs held by another container in exclusive mode instead of failing right away.
+	BusyTimeout       Duration `toml:"busy-timeout"`
+	BusyRetryInterval Duration `toml:"busy-retry-interval"`
+
+	// ledger of the GPUs reserved through the allocation service, the hook rejects GPUs reserved by others.
+	Ledger *string `toml:"ledger"`
+	// record the GPUs of the containers in the ledger until their poststop hook, rejecting the requests of GPUs
+	// already held unless all the holders set NVIDIA_GPU_SHARED=true.
+	ExclusiveGPUs bool `toml:"exclusive-gpus"`
+
+	// files of the utility capability: "all", "libraries" (no binaries) or "nvidia-smi".
+	UtilityFiles string `toml:"utility-files"`
+
+	// glob patterns of libraries removed from the injected files, and of extra host libraries to inject.
+	ExcludeLibraries []string `toml:"exclude-libraries"`
+	IncludeLibraries []string `toml:"include-libraries"`
+
+	// host libraries and files of the containers enabling NVIDIA_MOFED or NVIDIA_GDRCOPY, the files keep their path.
+	RDMALibraries []string `toml:"rdma-libraries"`
+	RDMAFiles     []string `toml:"rdma-files"`
+
+	// IMEX channels the containers may request with NVIDIA_IMEX_CHANNELS, numbers or "all"; none if empty.
+	AllowedIMEXChannels []string `toml:"allowed-imex-channels"`
+
+	// allow the containers to enable GPUDirect Storage with NVIDIA_GDS, and the host files it takes.
+	GDS          bool     `toml:"gds"`
+	GDSLibraries []string `toml:"gds-libraries"`
+	GDSFiles     []string `toml:"gds-files"`
+
+	// host libraries, relative to the driver root, mounted in the containers requesting the nvswitch capability.
+	NVSwitchLibraries []string `toml:"nvswitch-libraries"`
+	// check that the fabric manager set up the fabric of the GPUs of the NVSwitch systems before granting them.
+	FabricManagerCheck bool `toml:"fabric-manager-check"`
+	// libraries of --video kept by the nvenc, nvdec and nvjpeg capabilities, by capability.
+	VideoLibraries map[string][]string `toml:"video-libraries"`
+
+	MIG MIGConfig `toml:"mig"`
+
+	// sharing of the GPUs through the MPS control daemon of the node.
+	MPS configfile.MPSConfig `toml:"mps"`
+
+	// maximum of distinct GPUs mounted in the containers of a Kubernetes pod, 0 for no limit.
+	PodQuota PodQuotaConfig `toml:"pod-quota"`
+
+	// compute and persistence modes the containers may set on their GPUs with annotations or the environment,
+	// and power limit and clocks with annotations.
+	GPUModes GPUModesConfig `toml:"gpu-modes"`
+
+	// refuse ("fail") or warn about ("warn") the requested GPUs which are lost, have uncorrectable ECC errors
+	// or fatal XIDs in the kernel log, unchecked if unset.
+	Health HealthConfig `toml:"health"`
+
+	// Prometheus metrics of the hook activity, disabled without a textfile nor a pushgateway.
+	Metrics MetricsConfig `toml:"metrics"`
+
+	// log of the GPU requests and of the decisions, disabled without a path.
+	Audit AuditConfig `toml:"audit"`
+
+	// options of the nvidia-container-runtime wrapper, unused by the hook.
+	Runtime configfile.RuntimeConfig `toml:"nvidia-container-runtime"`
+
+	NvidiaContainerCLI CLIConfig `toml:"nvidia-container-cli"`
+
+	// virtual device names of shared GPUs, and the record of the containers sharing them.
+	SharedDevices []SharedDevice `toml:"shared-devices"`
+	SharingState  string         `toml:"sharing-state"`
+
+	// per-GPU driver roots, overriding the root of nvidia-container-cli for these devices.
+	DriverRoots []DriverRoot `toml:"driver-roots"`
+}
+
+// DriverCapability maps a value of NVIDIA_DRIVER_CAPABILITIES to the option of nvidia-container-cli
+// injecting its device nodes and libraries.
+type DriverCapability struct {
+	Name      string `toml:"name" json:"name"`
+	CLIOption string `toml:"cli-option" json:"cli_option"`
+}
+
+// MIGConfig: on-demand provisioning of MIG instances requested with an annotation.
+type MIGConfig struct {
+	Provisioning    bool     `toml:"provisioning"`
+	AllowedProfiles []string `toml:"allowed-profiles"`
+}
+
+// PodQuotaConfig: limit of the distinct GPUs mounted in the containers of a Kubernetes pod.
+type PodQuotaConfig struct {
+	MaxGPUs int    `toml:"max-gpus"`
+	State   string `toml:"state"`
+}
+
+// GPUModesConfig: the modes and limits the containers may set on their GPUs, restored at poststop.
+type GPUModesConfig struct {
+	AllowedComputeModes  []string `toml:"allowed-compute-modes"`
+	AllowPersistenceMode bool     `toml:"allow-persistence-mode"`
+	// [min, max] of the power limits in W and of the locked GPU clocks in MHz, none allowed if empty.
+	AllowedPowerLimit []int  `toml:"allowed-power-limit"`
+	AllowedGPUClocks  []int  `toml:"allowed-gpu-clocks"`
+	State             string `toml:"state"`
+}
+
+// Enabled tells if the containers may set anything, their settings are then restored at poststop.
+func (c GPUModesConfig) Enabled() bool {
+	return len(c.AllowedComputeModes) > 0 || c.AllowPersistenceMode || len(c.AllowedPowerLimit) > 0 || len(c.AllowedGPUClocks) > 0
+}
+
+// HealthConfig: checks of the requested GPUs before they're injected.
+type HealthConfig struct {
+	Action    string   `toml:"action"`
+	XIDs      []int    `toml:"xids"`
+	XIDWindow Duration `toml:"xid-window"`
+}
+
+// MetricsConfig: Prometheus metrics of the hook activity, written for the textfile collector of node_exporter
+// and/or pushed to a Pushgateway. The hook doesn't live long enough to be scraped, the counters are kept in State.
+type MetricsConfig struct {
+	Textfile    string `toml:"textfile"`
+	Pushgateway string `toml:"pushgateway"`
+	State       string `toml:"state"`
+}
+
+func (c MetricsConfig) Enabled() bool {
+	return len(c.Textfile) > 0 || len(c.Pushgateway) > 0
+}
+
+// AuditConfig: append-only log of the GPU requests of the containers and of the decisions, as JSON lines.
+// The log is rotated to <path>.1 ... <path>.<max-files> once it reaches max-size MiB.
+type AuditConfig struct {
+	Path     string `toml:"path"`
+	MaxSize  int    `toml:"max-size"`
+	MaxFiles int    `toml:"max-files"`
+}
+
+// SharedDevice: a virtual device name of a GPU shared by several containers, e.g. nvidia.com/gpu.shared.
+type SharedDevice struct {
+	Name string `toml:"name"`
+	// UUID or index of the physical GPU.
+	GPU string `toml:"gpu"`
+	// replicas of <name>::<replica> requests, any replica if 0.
+	Replicas int `toml:"replicas"`
+}
+
+// DriverRoot: driver installation used for a set of GPUs, on hosts running several driver branches.
+type DriverRoot struct {
+	Root string `toml:"root"`
+	// GPU UUIDs, a trailing '*' matches a range of UUIDs sharing the same prefix.
+	Devices []string `toml:"devices"`
+}
+
+func (r DriverRoot) Matches(uuid string) bool {
+	return devices.Matches(r.Devices, uuid)
+}
+
+// Load decodes the configuration file, then its drop-in files on top of config, usually the defaults of the hook:
+// the options set by a drop-in file override the previous ones, the others are kept. The environment overrides
+// them all. It returns the unknown options, an error with strict-config.
+func Load(path string, config *HookConfig) ([]string, error) {
+	unknown, err := configfile.Load(path, config)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open configuration file: %v", err)
+	}
+	if err := configfile.ApplyEnvOverrides(config, EnvPrefix); err != nil {
+		return nil, err
+	}
+
+	// A misspelled option silently keeps its default value.
+	if len(unknown) > 0 && config.StrictConfig {
+		return nil, fmt.Errorf("unknown options in the configuration: %s", strings.Join(unknown, ", "))
+	}
+	return unknown, nil
+}
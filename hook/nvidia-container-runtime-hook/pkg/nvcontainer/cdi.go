@@ -0,0 +1,157 @@
+package nvcontainer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// GPUKind is the CDI kind of the NVIDIA GPUs, the default of the unqualified device names.
+const GPUKind = "nvidia.com/gpu"
+
+// Subset of the CDI specification:
+// github.com/container-orchestrated-devices/container-device-interface/blob/v0.5.0/specs-go/config.go
+type CDISpec struct {
+	Version        string         `json:"cdiVersion" yaml:"cdiVersion"`
+	Kind           string         `json:"kind" yaml:"kind"`
+	Devices        []CDIDevice    `json:"devices" yaml:"devices"`
+	ContainerEdits ContainerEdits `json:"containerEdits,omitempty" yaml:"containerEdits,omitempty"`
+}
+
+type CDIDevice struct {
+	Name           string         `json:"name" yaml:"name"`
+	ContainerEdits ContainerEdits `json:"containerEdits" yaml:"containerEdits"`
+}
+
+type ContainerEdits struct {
+	Env         []string     `json:"env,omitempty" yaml:"env,omitempty"`
+	DeviceNodes []DeviceNode `json:"deviceNodes,omitempty" yaml:"deviceNodes,omitempty"`
+	Mounts      []Mount      `json:"mounts,omitempty" yaml:"mounts,omitempty"`
+	Hooks       []Hook       `json:"hooks,omitempty" yaml:"hooks,omitempty"`
+}
+
+type DeviceNode struct {
+	Path     string `json:"path" yaml:"path"`
+	HostPath string `json:"hostPath,omitempty" yaml:"hostPath,omitempty"`
+	Major    uint32 `json:"major,omitempty" yaml:"major,omitempty"`
+	Minor    uint32 `json:"minor,omitempty" yaml:"minor,omitempty"`
+}
+
+type Mount struct {
+	HostPath      string   `json:"hostPath" yaml:"hostPath"`
+	ContainerPath string   `json:"containerPath" yaml:"containerPath"`
+	Options       []string `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+type Hook struct {
+	HookName string   `json:"hookName" yaml:"hookName"`
+	Path     string   `json:"path" yaml:"path"`
+	Args     []string `json:"args,omitempty" yaml:"args,omitempty"`
+	Env      []string `json:"env,omitempty" yaml:"env,omitempty"`
+}
+
+// LoadCDISpecs reads the JSON and YAML spec files of the directories, later directories have higher precedence.
+func LoadCDISpecs(dirs []string) (specs []CDISpec, err error) {
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read CDI spec directory: %v", err)
+		}
+		for _, f := range files {
+			p := filepath.Join(dir, f.Name())
+			unmarshal := json.Unmarshal
+			switch filepath.Ext(p) {
+			case ".json":
+			case ".yaml", ".yml":
+				unmarshal = yaml.Unmarshal
+			default:
+				continue
+			}
+
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				return nil, fmt.Errorf("could not read CDI spec: %v", err)
+			}
+			var spec CDISpec
+			if err := unmarshal(b, &spec); err != nil {
+				return nil, fmt.Errorf("could not decode CDI spec %s: %v", p, err)
+			}
+			specs = append([]CDISpec{spec}, specs...)
+		}
+	}
+	return specs, nil
+}
+
+// ResolveCDIDevices returns the edits of the devices, a list of fully-qualified CDI names (nvidia.com/gpu=0) or of
+// names of the nvidia.com/gpu kind (0, GPU-<uuid>, all).
+func ResolveCDIDevices(specs []CDISpec, devices string) ([]ContainerEdits, error) {
+	var edits []ContainerEdits
+	used := make(map[int]bool)
+	for _, d := range strings.Split(devices, ",") {
+		if len(d) == 0 {
+			continue
+		}
+		kind, name := GPUKind, d
+		if p := strings.SplitN(d, "=", 2); len(p) == 2 {
+			kind, name = p[0], p[1]
+		}
+
+		found := false
+		for i, spec := range specs {
+			if spec.Kind != kind {
+				continue
+			}
+			for _, dev := range spec.Devices {
+				if dev.Name != name {
+					continue
+				}
+				if !used[i] {
+					// The spec wide edits apply once, whatever the number of devices.
+					used[i] = true
+					edits = append(edits, spec.ContainerEdits)
+				}
+				edits = append(edits, dev.ContainerEdits)
+				found = true
+				break
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unresolvable CDI device %s=%s", kind, name)
+		}
+	}
+	return edits, nil
+}
+
+// BuildMounts returns the merged edits of the devices of a request from the CDI specs of the directories: the device
+// nodes, mounts, environment and hooks to add to the spec of the container.
+func BuildMounts(req *Request, specDirs []string) (ContainerEdits, error) {
+	var merged ContainerEdits
+	if req == nil {
+		return merged, nil
+	}
+	specs, err := LoadCDISpecs(specDirs)
+	if err != nil {
+		return merged, err
+	}
+	edits, err := ResolveCDIDevices(specs, req.Devices)
+	if err != nil {
+		return merged, err
+	}
+	for _, e := range edits {
+		merged.Env = append(merged.Env, e.Env...)
+		merged.DeviceNodes = append(merged.DeviceNodes, e.DeviceNodes...)
+		merged.Mounts = append(merged.Mounts, e.Mounts...)
+		merged.Hooks = append(merged.Hooks, e.Hooks...)
+	}
+	return merged, nil
+}
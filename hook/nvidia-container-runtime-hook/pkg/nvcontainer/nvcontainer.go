@@ -0,0 +1,122 @@
+// Package nvcontainer resolves the GPU requests of the containers and applies them to their OCI specs, for the
+// containerd and CRI-O plugins or the Kubernetes device plugin which can't exec the hook before the containers exist.
+package nvcontainer
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	EnvVisibleDevices     = "NVIDIA_VISIBLE_DEVICES"
+	EnvDriverCapabilities = "NVIDIA_DRIVER_CAPABILITIES"
+	EnvDisableRequire     = "NVIDIA_DISABLE_REQUIRE"
+	EnvRequirePrefix      = "NVIDIA_REQUIRE_"
+	EnvRequireCUDA        = EnvRequirePrefix + "CUDA"
+	EnvLegacyCUDAVersion  = "CUDA_VERSION"
+
+	DefaultCapabilities = "utility"
+	AllCapabilities     = "compute,compat32,graphics,utility,video,display"
+)
+
+// The formats of the devices accepted by mount-gpu-only-by-uuid: GPU UUIDs, MIG devices and PCI bus IDs.
+const (
+	gpuUUIDFmt   = `[gG][pP][uU]-([0-9a-fA-F-]){1,75}`
+	migDeviceFmt = `[mM][iI][gG]-(` + gpuUUIDFmt + `/[0-9]+/[0-9]+|([0-9a-fA-F-]){1,75})`
+	pciBusIDFmt  = `([0-9a-fA-F]{4}|[0-9a-fA-F]{8}):([0-9a-fA-F]{2}):([0-9a-fA-F]{2})\.([0-7])`
+	deviceFmt    = `(` + gpuUUIDFmt + `|` + migDeviceFmt + `|` + pciBusIDFmt + `)`
+)
+
+var gpuUUIDListExp = regexp.MustCompile(`^` + deviceFmt + `(,|,` + deviceFmt + `)*$`)
+
+// Options are the options of the hook configuration the resolution depends on.
+type Options struct {
+	// Only the requests of GPU UUIDs or PCI bus IDs are honored, see mount-gpu-only-by-uuid.
+	MountGPUOnlyByUUID bool
+	// Capabilities of the requests without any, DefaultCapabilities if empty.
+	DefaultCapabilities string
+	// Capabilities "all" stands for, AllCapabilities if empty.
+	AllCapabilities string
+}
+
+// Request is the GPU request of a container.
+type Request struct {
+	// Devices is the comma-separated list of the devices, empty for none.
+	Devices        string
+	Capabilities   string
+	Requirements   []string
+	DisableRequire bool
+}
+
+// ResolveDevices returns the GPU request of the environment of a container, with the semantics of the hook for the
+// new and legacy CUDA images. It returns nil for the containers without GPUs.
+func ResolveDevices(env []string, opts Options) (*Request, error) {
+	m := make(map[string]string)
+	for _, e := range env {
+		p := strings.SplitN(e, "=", 2)
+		if len(p) != 2 {
+			return nil, fmt.Errorf("environment error: %q is not a NAME=value pair", e)
+		}
+		if _, ok := m[p[0]]; ok && p[0] == EnvVisibleDevices && opts.MountGPUOnlyByUUID && !gpuUUIDListExp.MatchString(p[1]) {
+			// The first value wins, unless a later one is a list of UUIDs.
+			continue
+		}
+		m[p[0]] = p[1]
+	}
+
+	legacy := len(m[EnvLegacyCUDAVersion]) > 0 && len(m[EnvRequireCUDA]) == 0
+	devices, ok := m[EnvVisibleDevices]
+	switch {
+	case !ok && legacy:
+		// Legacy CUDA images use all the GPUs when the variable is unset.
+		devices = "all"
+	case !ok || len(devices) == 0 || devices == "void":
+		return nil, nil
+	}
+	if opts.MountGPUOnlyByUUID && devices != "none" && !gpuUUIDListExp.MatchString(devices) {
+		devices = "none"
+	}
+	if devices == "none" {
+		devices = ""
+	}
+
+	all := orDefault(opts.AllCapabilities, AllCapabilities)
+	capabilities, ok := m[EnvDriverCapabilities]
+	switch {
+	case !ok && legacy:
+		capabilities = all
+	case len(capabilities) == 0:
+		capabilities = orDefault(opts.DefaultCapabilities, DefaultCapabilities)
+	case capabilities == "all":
+		capabilities = all
+	}
+
+	var requirements []string
+	for name, value := range m {
+		if strings.HasPrefix(name, EnvRequirePrefix) {
+			requirements = append(requirements, value)
+		}
+	}
+	if legacy {
+		var major, minor int
+		if _, err := fmt.Sscanf(m[EnvLegacyCUDAVersion], "%d.%d", &major, &minor); err != nil {
+			if _, err := fmt.Sscanf(m[EnvLegacyCUDAVersion], "%d", &major); err != nil {
+				return nil, fmt.Errorf("invalid CUDA version: %s", m[EnvLegacyCUDAVersion])
+			}
+		}
+		requirements = append(requirements, fmt.Sprintf("cuda>=%d.%d", major, minor))
+	}
+	// Don't fail on invalid values.
+	disableRequire, _ := strconv.ParseBool(m[EnvDisableRequire])
+
+	return &Request{devices, capabilities, requirements, disableRequire}, nil
+}
+
+func orDefault(value, def string) string {
+	if len(value) == 0 {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,264 @@
+package nvcontainer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/oci"
+)
+
+// The sources of the device and capability requests of the containers, see request-sources.
+const (
+	RequestSourceEnv          = "env"
+	RequestSourceAnnotations  = "annotations"
+	RequestSourceVolumeMounts = "volume-mounts"
+
+	DefaultDeviceListMountsRoot = "/var/run/nvidia-container-devices"
+)
+
+// RequestAnnotations are the annotations requesting devices and capabilities, and the environment variables they
+// stand for.
+var RequestAnnotations = map[string]string{
+	"com.nvidia.devices":      EnvVisibleDevices,
+	"com.nvidia.capabilities": EnvDriverCapabilities,
+}
+
+// ContainerNameAnnotations are the annotations of the name of a container in its pod, set by containerd and CRI-O.
+var ContainerNameAnnotations = []string{"io.kubernetes.cri.container-name", "io.kubernetes.container.name"}
+
+// The pod UID in the cgroup path of a Kubernetes container, with the cgroupfs driver:
+//
+//	/kubepods/burstable/pod8dbc5577-d0e2-4706-8787-57d52c03ddf2/<container>
+//
+// with the systemd driver:
+//
+//	kubepods-burstable-pod8dbc5577_d0e2_4706_8787_57d52c03ddf2.slice:cri-containerd:<container>
+//
+// Static pods have a hash instead of a UUID.
+var podUIDExp = regexp.MustCompile(`pod([0-9a-fA-F]{8}[-_]?[0-9a-fA-F]{4}[-_]?[0-9a-fA-F]{4}[-_]?[0-9a-fA-F]{4}[-_]?[0-9a-fA-F]{12})`)
+
+// RequestOptions are the options of the hook configuration selecting where the containers request GPUs.
+type RequestOptions struct {
+	// Sources in precedence order, see request-sources. The environment only if empty.
+	Sources []string
+	// Directory of the volume-mount requests, DefaultDeviceListMountsRoot if empty.
+	DeviceListMountsRoot string
+	// Comma-separated Swarm generic resource variables, see swarm-resource. None if empty.
+	SwarmResource string
+	// Directory of the allocation files of the device plugin, the only requests of the pods with
+	// MountGPUOnlyByUUID. Disabled if empty.
+	DevicePluginAllocations string
+	MountGPUOnlyByUUID      bool
+}
+
+// DevicesFromMounts returns the devices requested as mounts of /dev/null on <root>/<device>,
+// unlike the environment they can't be set by the image or the user of a kubernetes pod.
+func DevicesFromMounts(mounts []oci.Mount, root string) *string {
+	root = filepath.Clean(root)
+	var devices []string
+	for _, m := range mounts {
+		if filepath.Clean(m.Source) != "/dev/null" {
+			continue
+		}
+		dst := filepath.Clean(m.Destination)
+		if filepath.Dir(dst) != root {
+			continue
+		}
+		devices = append(devices, filepath.Base(dst))
+	}
+	if len(devices) == 0 {
+		return nil
+	}
+	ret := strings.Join(devices, ",")
+	return &ret
+}
+
+// ApplyRequestSources sets the device and capability requests from the sources, the first source
+// setting a request has precedence. The environment of the image is ignored if it isn't a source.
+// It returns the source of the device request, empty if no source requests devices.
+func ApplyRequestSources(env map[string]string, s *oci.Spec, sources []string, mountsRoot string) (string, error) {
+	requests := make(map[string]string)
+	devicesSource := ""
+	for i := len(sources) - 1; i >= 0; i-- {
+		// The devices are attributed to the source which set them, not to the sources without devices above it.
+		set := func(name, value string) {
+			requests[name] = value
+			if name == EnvVisibleDevices {
+				devicesSource = sources[i]
+			}
+		}
+		switch sources[i] {
+		case RequestSourceEnv:
+			for _, name := range RequestAnnotations {
+				if value, ok := env[name]; ok {
+					set(name, value)
+				}
+			}
+		case RequestSourceAnnotations:
+			for annotation, name := range RequestAnnotations {
+				if value, ok := s.Annotations[annotation]; ok {
+					set(name, value)
+				}
+			}
+		case RequestSourceVolumeMounts:
+			if devices := DevicesFromMounts(s.Mounts, mountsRoot); devices != nil {
+				set(EnvVisibleDevices, *devices)
+			}
+		default:
+			return "", fmt.Errorf("unknown request source: %s", sources[i])
+		}
+	}
+
+	for _, name := range RequestAnnotations {
+		if value, ok := requests[name]; ok {
+			env[name] = value
+		} else {
+			delete(env, name)
+		}
+	}
+	return devicesSource, nil
+}
+
+// swarmResourceValues returns the values of a Swarm resource variable, then of its numbered variables in order:
+// DOCKER_RESOURCE_GPU, DOCKER_RESOURCE_GPU_1, DOCKER_RESOURCE_GPU_2...
+func swarmResourceValues(env map[string]string, name string) ([]string, bool) {
+	var values []string
+	value, found := env[name]
+	if found {
+		values = append(values, value)
+	}
+	var numbers []int
+	for k := range env {
+		if !strings.HasPrefix(k, name+"_") {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(k, name+"_")); err == nil && n >= 0 {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	for _, n := range numbers {
+		values, found = append(values, env[fmt.Sprintf("%s_%d", name, n)]), true
+	}
+	return values, found
+}
+
+// SwarmDevices merges the devices of the Swarm resources set, in the order of the comma-separated resources:
+// generic resources may be advertised under several names, e.g. DOCKER_RESOURCE_GPU and DOCKER_RESOURCE_NVIDIA-GPU,
+// and a service reserving several of them gets numbered variables. It returns nil if none is set.
+func SwarmDevices(env map[string]string, resources string) *string {
+	var devices []string
+	found := false
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(resources, ",") {
+		values, ok := swarmResourceValues(env, strings.TrimSpace(name))
+		if !ok {
+			continue
+		}
+		found = true
+		for _, d := range strings.Split(strings.Join(values, ","), ",") {
+			if len(d) > 0 && !seen[d] {
+				seen[d] = true
+				devices = append(devices, d)
+			}
+		}
+	}
+	if !found {
+		return nil
+	}
+	ret := strings.Join(devices, ",")
+	return &ret
+}
+
+// PodUID returns the UID of the pod of a container from its cgroup path, empty outside of Kubernetes.
+func PodUID(cgroupsPath string) string {
+	m := podUIDExp.FindAllStringSubmatch(cgroupsPath, -1)
+	if m == nil {
+		return ""
+	}
+	return strings.ToLower(strings.Replace(m[len(m)-1][1], "_", "-", -1))
+}
+
+// ContainerName returns the name of a container in its pod from its annotations, empty if not annotated.
+func ContainerName(annotations map[string]string) string {
+	for _, a := range ContainerNameAnnotations {
+		if n, ok := annotations[a]; ok {
+			return n
+		}
+	}
+	return ""
+}
+
+// podAllocations is the allocation file the device plugin writes for each pod, <pod UID>.json:
+//
+//	{"containers": {"<container name>": ["GPU-<uuid>", ...]}}
+type podAllocations struct {
+	Containers map[string][]string `json:"containers"`
+}
+
+// AllocatedDevices returns the devices the device plugin allocated to a container of a pod, empty if none.
+func AllocatedDevices(dir string, pod string, name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, pod+".json"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("could not read the allocations of pod %s: %v", pod, err)
+	}
+	var allocations podAllocations
+	if err := json.Unmarshal(b, &allocations); err != nil {
+		return "", fmt.Errorf("invalid allocations of pod %s: %v", pod, err)
+	}
+	return strings.Join(allocations.Containers[name], ","), nil
+}
+
+// IsGPURequested tells if a container requests GPUs from any of the sources of the hook: the request sources, the
+// legacy CUDA images, the Swarm resources and the allocation files of the device plugin. The request itself is
+// resolved and checked by the hook, this only tells the containers it must run in.
+func IsGPURequested(spec *oci.Spec, opts RequestOptions) (bool, error) {
+	env := make(map[string]string)
+	if spec.Process != nil {
+		for _, e := range spec.Process.Env {
+			if p := strings.SplitN(e, "=", 2); len(p) == 2 {
+				env[p[0]] = p[1]
+			}
+		}
+	}
+	sources := opts.Sources
+	if len(sources) == 0 {
+		sources = []string{RequestSourceEnv}
+	}
+	root := opts.DeviceListMountsRoot
+	if len(root) == 0 {
+		root = DefaultDeviceListMountsRoot
+	}
+	if _, err := ApplyRequestSources(env, spec, sources, root); err != nil {
+		return false, err
+	}
+	if len(opts.DevicePluginAllocations) > 0 && opts.MountGPUOnlyByUUID && spec.Linux != nil {
+		if pod := PodUID(spec.Linux.CgroupsPath); len(pod) > 0 {
+			name := ContainerName(spec.Annotations)
+			if len(name) == 0 {
+				// The hook rejects it.
+				return true, nil
+			}
+			// The allocations replace the other requests of the pods.
+			devices, err := AllocatedDevices(opts.DevicePluginAllocations, pod, name)
+			return len(devices) > 0, err
+		}
+	}
+	if len(opts.SwarmResource) > 0 && SwarmDevices(env, opts.SwarmResource) != nil {
+		return true, nil
+	}
+	if _, ok := env[EnvVisibleDevices]; ok {
+		return true, nil
+	}
+	_, ok := env[EnvLegacyCUDAVersion]
+	return ok, nil
+}
@@ -0,0 +1,82 @@
+package nvcontainer
+
+import (
+	"fmt"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/devices"
+)
+
+// ApplyToSpec applies edits to an OCI spec before the container is created, fields unknown to the package are
+// preserved: the environment of the process, the device nodes with their device cgroup rules, bind mounts and hooks.
+// The device numbers of the nodes without any are read from their host path.
+func ApplyToSpec(spec map[string]interface{}, edits ContainerEdits) error {
+	if len(edits.Env) > 0 {
+		process := object(spec, "process")
+		env, _ := process["env"].([]interface{})
+		for _, e := range edits.Env {
+			env = append(env, e)
+		}
+		process["env"] = env
+	}
+
+	if len(edits.DeviceNodes) > 0 {
+		linux := object(spec, "linux")
+		resources := object(linux, "resources")
+		nodes, _ := linux["devices"].([]interface{})
+		rules, _ := resources["devices"].([]interface{})
+		for _, d := range edits.DeviceNodes {
+			major, minor := d.Major, d.Minor
+			if major == 0 {
+				host := d.HostPath
+				if len(host) == 0 {
+					host = d.Path
+				}
+				var err error
+				if major, minor, err = devices.Numbers(host); err != nil {
+					return fmt.Errorf("could not get the device numbers of %s: %v", host, err)
+				}
+			}
+			nodes = append(nodes, map[string]interface{}{"path": d.Path, "type": "c", "major": major, "minor": minor, "fileMode": 0666})
+			rules = append(rules, map[string]interface{}{"allow": true, "type": "c", "major": major, "minor": minor, "access": "rwm"})
+		}
+		linux["devices"], resources["devices"] = nodes, rules
+	}
+
+	if len(edits.Mounts) > 0 {
+		mounts, _ := spec["mounts"].([]interface{})
+		for _, m := range edits.Mounts {
+			options := []interface{}{"rbind"}
+			for _, o := range m.Options {
+				options = append(options, o)
+			}
+			mounts = append(mounts, map[string]interface{}{"destination": m.ContainerPath, "source": m.HostPath, "type": "bind", "options": options})
+		}
+		spec["mounts"] = mounts
+	}
+
+	if len(edits.Hooks) > 0 {
+		hooks := object(spec, "hooks")
+		for _, h := range edits.Hooks {
+			stage, _ := hooks[h.HookName].([]interface{})
+			hook := map[string]interface{}{"path": h.Path}
+			if len(h.Args) > 0 {
+				hook["args"] = h.Args
+			}
+			if len(h.Env) > 0 {
+				hook["env"] = h.Env
+			}
+			hooks[h.HookName] = append(stage, hook)
+		}
+	}
+	return nil
+}
+
+// object returns the object of a key of a JSON object, created if missing.
+func object(parent map[string]interface{}, key string) map[string]interface{} {
+	o, _ := parent[key].(map[string]interface{})
+	if o == nil {
+		o = make(map[string]interface{})
+		parent[key] = o
+	}
+	return o
+}
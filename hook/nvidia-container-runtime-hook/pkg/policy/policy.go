@@ -0,0 +1,68 @@
+// Package policy enforces the device policies of the hook configuration on the GPU requests of the containers, for
+// the hook and for the tooling checking requests against a configuration, e.g. the policy checkers of a CI.
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/devices"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/hookconfig"
+)
+
+// DeviceAllowed tells whether a GPU is among the allowed devices and not among the denied ones.
+func DeviceAllowed(config hookconfig.HookConfig, d devices.DeviceInfo) bool {
+	allowed := len(config.AllowedDevices) == 0 || devices.Matches(config.AllowedDevices, d.UUID) || devices.Matches(config.AllowedDevices, d.Index)
+	return allowed && !devices.Matches(config.DeniedDevices, d.UUID) && !devices.Matches(config.DeniedDevices, d.Index)
+}
+
+// CheckDevices rejects the requests of GPUs outside of the allowed devices or among the denied ones.
+func CheckDevices(config hookconfig.HookConfig, info *devices.DriverInfo, request string) error {
+	var denied []string
+	for _, d := range info.Devices {
+		if !devices.IsRequested(request, d.Index, d.UUID) {
+			continue
+		}
+		if !DeviceAllowed(config, d) {
+			denied = append(denied, fmt.Sprintf("%s (%s)", d.Index, d.UUID))
+		}
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("GPUs not allowed on this node: %s", strings.Join(denied, ", "))
+	}
+	return nil
+}
+
+// SelectIMEXChannels returns the channels of a request, which must all be allowed. "all" requests
+// the allowed channels, or the channels of the host when all are allowed.
+func SelectIMEXChannels(request string, allowed []string, host []string) ([]string, error) {
+	if len(request) == 0 || request == "none" || request == "void" {
+		return nil, nil
+	}
+	isAllowed := make(map[string]bool)
+	for _, a := range allowed {
+		isAllowed[a] = true
+	}
+	allowAll := isAllowed["all"]
+	if request == "all" {
+		if allowAll {
+			return host, nil
+		}
+		return allowed, nil
+	}
+
+	var channels []string
+	for _, c := range strings.Split(request, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(c), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IMEX channel %q", c)
+		}
+		channel := strconv.FormatUint(n, 10)
+		if !allowAll && !isAllowed[channel] {
+			return nil, fmt.Errorf("IMEX channel %s is not allowed", channel)
+		}
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Annotations of the Kubernetes pod of a container, set by containerd and CRI-O.
+var (
+	podNamespaceAnnotations = []string{"io.kubernetes.cri.sandbox-namespace", "io.kubernetes.pod.namespace"}
+	podNameAnnotations      = []string{"io.kubernetes.cri.sandbox-name", "io.kubernetes.pod.name"}
+	podUIDAnnotations       = []string{"io.kubernetes.cri.sandbox-uid", "io.kubernetes.pod.uid"}
+)
+
+// podMetadata identifies the Kubernetes pod and container of a container, in the logs, audit log and errors.
+type podMetadata struct {
+	Namespace string `json:"podNamespace,omitempty"`
+	Name      string `json:"podName,omitempty"`
+	UID       string `json:"podUID,omitempty"`
+	Container string `json:"containerName,omitempty"`
+}
+
+func getAnnotation(annotations map[string]string, keys []string) string {
+	for _, k := range keys {
+		if v, ok := annotations[k]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// getPodMetadata reads the metadata of the pod from the annotations, the UID from the cgroup path if not annotated.
+func getPodMetadata(annotations map[string]string, cgroupsPath string) podMetadata {
+	p := podMetadata{
+		Namespace: getAnnotation(annotations, podNamespaceAnnotations),
+		Name:      getAnnotation(annotations, podNameAnnotations),
+		UID:       getAnnotation(annotations, podUIDAnnotations),
+		Container: getAnnotation(annotations, containerNameAnnotations),
+	}
+	if len(p.UID) == 0 {
+		p.UID = getPodUID(cgroupsPath)
+	}
+	return p
+}
+
+func (p podMetadata) isSet() bool {
+	return p != podMetadata{}
+}
+
+func (p podMetadata) String() string {
+	s := fmt.Sprintf("pod %s/%s", p.Namespace, p.Name)
+	if len(p.UID) > 0 {
+		s += fmt.Sprintf(" (%s)", p.UID)
+	}
+	if len(p.Container) > 0 {
+		s += " container " + p.Container
+	}
+	return s
+}
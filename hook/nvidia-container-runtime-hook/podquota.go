@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/nvcontainer"
+)
+
+const defaultPodQuotaState = "/run/nvidia-container-runtime/pod-gpus.json"
+
+// getPodUID returns the UID of the pod of a container from its cgroup path, empty outside of Kubernetes.
+func getPodUID(cgroupsPath string) string {
+	return nvcontainer.PodUID(cgroupsPath)
+}
+
+// podGPUs records the GPUs of the containers of each pod: pod UID -> container ID -> GPU UUIDs.
+type podGPUs struct {
+	file *os.File
+	Pods map[string]map[string][]string `json:"pods"`
+}
+
+// openPodGPUs opens and locks the state of the pod quota, it must be closed to release the lock.
+func openPodGPUs(path string) (*podGPUs, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	p := &podGPUs{file: f}
+	b, err := ioutil.ReadAll(f)
+	if err == nil && len(b) > 0 {
+		err = json.Unmarshal(b, p)
+	}
+	if err != nil {
+		p.close()
+		return nil, fmt.Errorf("invalid pod quota state %s: %v", path, err)
+	}
+	if p.Pods == nil {
+		p.Pods = make(map[string]map[string][]string)
+	}
+	return p, nil
+}
+
+func (p *podGPUs) save() error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := p.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = p.file.WriteAt(b, 0)
+	return err
+}
+
+func (p *podGPUs) close() {
+	unlockFile(p.file)
+	p.file.Close()
+}
+
+// add records the GPUs of a container, unless the pod would then use more than max distinct GPUs.
+func (p *podGPUs) add(pod string, container string, uuids []string, max int) error {
+	distinct := make(map[string]bool)
+	for id, gpus := range p.Pods[pod] {
+		if id == container {
+			continue
+		}
+		for _, uuid := range gpus {
+			distinct[strings.ToLower(uuid)] = true
+		}
+	}
+	for _, uuid := range uuids {
+		distinct[strings.ToLower(uuid)] = true
+	}
+	if len(distinct) > max {
+		var all []string
+		for uuid := range distinct {
+			all = append(all, uuid)
+		}
+		sort.Strings(all)
+		return fmt.Errorf("pod %s would use %d GPUs, more than the maximum of %d: %s", pod, len(distinct), max, strings.Join(all, ","))
+	}
+
+	if p.Pods[pod] == nil {
+		p.Pods[pod] = make(map[string][]string)
+	}
+	p.Pods[pod][container] = uuids
+	return nil
+}
+
+// remove forgets the GPUs of a container, and its pod with the last of them.
+func (p *podGPUs) remove(container string) {
+	for pod, containers := range p.Pods {
+		delete(containers, container)
+		if len(containers) == 0 {
+			delete(p.Pods, pod)
+		}
+	}
+}
+
+// checkPodQuota records the GPUs of a container in its pod, rejecting them beyond the quota.
+func checkPodQuota(config PodQuotaConfig, pod string, container string, uuids []string) error {
+	p, err := openPodGPUs(config.State)
+	if err != nil {
+		return err
+	}
+	defer p.close()
+
+	if err := p.add(pod, container, uuids, config.MaxGPUs); err != nil {
+		return err
+	}
+	return p.save()
+}
+
+func releasePodQuota(config PodQuotaConfig, container string) {
+	p, err := openPodGPUs(config.State)
+	if err != nil {
+		log.Panicln(err)
+	}
+	defer p.close()
+
+	p.remove(container)
+	if err := p.save(); err != nil {
+		log.Panicln(err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/policy"
+)
+
+// evaluatePolicy selects the driver root of the devices of a container and enforces the device, IMEX channel and
+// requirement policies, for the hook and the NRI plugin alike. It returns the IMEX channels of the container.
+func evaluatePolicy(hook *HookConfig, container containerConfig) []string {
+	nvidia := container.Nvidia
+	cli := hook.NvidiaContainerCLI
+	policySpan := startSpan("evaluate policy")
+	if root := getDriverRoot(*hook, nvidia.Devices); root != nil {
+		infof("using driver root %s", *root)
+		hook.NvidiaContainerCLI.Root = root
+		cli = hook.NvidiaContainerCLI
+	}
+
+	if hook.ValidateDevices && len(nvidia.Devices) > 0 {
+		validateDevices(cli, nvidia.Devices, hook.Parallelism)
+	}
+
+	if len(nvidia.Devices) > 0 && (len(hook.AllowedDevices) > 0 || len(hook.DeniedDevices) > 0) {
+		info, err := getDriverInfo(cli)
+		if err != nil {
+			fail(exitCodeCLIFailure, err)
+		}
+		if err := policy.CheckDevices(*hook, info, nvidia.Devices); err != nil {
+			fail(exitCodePolicy, err)
+		}
+	}
+
+	imexChannels, err := policy.SelectIMEXChannels(container.Env[envNVIMEXChannels], hook.AllowedIMEXChannels, getHostIMEXChannels(imexChannelsDir))
+	if err != nil {
+		fail(exitCodePolicy, err)
+	}
+
+	requirePolicy := getRequirePolicy(*hook, nvidia)
+	if (hook.ValidateRequirements || requirePolicy == requirePolicyWarn) && requirePolicy != requirePolicyIgnore && len(nvidia.Requirements) > 0 {
+		checkRequirements(cli, nvidia, requirePolicy)
+	}
+	if requirePolicy != requirePolicyIgnore && len(nvidia.NodeRequirements) > 0 {
+		checkNodeRequirements(cli, nvidia, requirePolicy)
+	}
+	policySpan.end()
+	return imexChannels
+}
+
+// validateDevices fails with the list of the requested devices unknown to the driver,
+// nvidia-container-cli would only report the first one at mount time.
+func validateDevices(cli CLIConfig, devices string, parallelism int) {
+	unknown := getUnknownDevices(cli, devices, parallelism)
+	if len(unknown) > 0 && len(cli.DiscoveryCache) > 0 {
+		// The cache may predate the devices, e.g. MIG devices created by an administrator.
+		invalidateDiscoveryCache(cli)
+		unknown = getUnknownDevices(cli, devices, parallelism)
+	}
+	if len(unknown) > 0 {
+		fail(exitCodeBadSpec, fmt.Errorf("unknown devices requested: %s", strings.Join(unknown, ", ")))
+	}
+}
+
+// getUnknownDevices queries the GPUs and the MIG devices at once.
+func getUnknownDevices(cli CLIConfig, devices string, parallelism int) []string {
+	var info *driverInfo
+	var migDevices []string
+	queries := []func() error{func() (err error) {
+		info, err = getDriverInfo(cli)
+		return err
+	}}
+	if strings.Contains(strings.ToUpper(devices), "MIG-") {
+		queries = append(queries, func() (err error) {
+			migDevices, err = listMIGDevices(cli)
+			return err
+		})
+	}
+	parallelDo(parallelism, len(queries), func(i int) {
+		if err := queries[i](); err != nil {
+			fail(exitCodeCLIFailure, err)
+		}
+	})
+	return info.UnknownDevices(devices, migDevices)
+}
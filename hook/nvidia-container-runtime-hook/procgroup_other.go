@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup is a no-op, process groups are only used on Linux.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills the process of the command.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
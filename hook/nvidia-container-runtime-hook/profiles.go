@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/oci"
+)
+
+// The profile of a container: the annotation, set by the orchestrator e.g. from the runtime class, has precedence
+// over the environment.
+const (
+	profileAnnotation = "com.nvidia.profile"
+	envNVProfile      = "NVIDIA_PROFILE"
+)
+
+// applyProfile sets the options of a named profile, a [profiles.<name>] table of any options of the hook,
+// over the configuration. The keys unknown to the hook are returned.
+func applyProfile(hook *HookConfig, name string) ([]string, error) {
+	profile, ok := hook.Profiles[name]
+	if !ok {
+		var names []string
+		for n := range hook.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown profile %s, expected one of: %s", name, strings.Join(names, ", "))
+	}
+
+	// The profile is decoded like a configuration file, e.g. for the durations and the tables.
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(profile); err != nil {
+		return nil, fmt.Errorf("invalid profile %s: %v", name, err)
+	}
+	md, err := toml.Decode(b.String(), hook)
+	if err != nil {
+		return nil, fmt.Errorf("invalid profile %s: %v", name, err)
+	}
+	var unknown []string
+	for _, key := range md.Undecoded() {
+		unknown = append(unknown, fmt.Sprintf("profiles.%s.%s", name, key))
+	}
+	return unknown, nil
+}
+
+// getProfileName returns the profile requested by a container, the default one if none. The environment is only
+// read when the container could request devices from it, a profile may allow more than the default.
+func getProfileName(hook HookConfig, s *oci.Spec) string {
+	if name, ok := s.Annotations[profileAnnotation]; ok {
+		return name
+	}
+	if hook.AcceptEnvvarUnprivileged || isPrivileged(s) {
+		if name, ok := s.Getenv(envNVProfile); ok {
+			return name
+		}
+	}
+	return hook.DefaultProfile
+}
+
+// setContainerProfile applies the profile of a container to the configuration of the hook.
+func setContainerProfile(hook *HookConfig, s *oci.Spec) error {
+	name := getProfileName(*hook, s)
+	if len(name) == 0 {
+		return nil
+	}
+	code := exitCodeBadConfig
+	if name != hook.DefaultProfile {
+		// Requested by the container.
+		code = exitCodeBadSpec
+	}
+	unknown, err := applyProfile(hook, name)
+	if err != nil {
+		return &hookError{code, err}
+	}
+	if len(unknown) > 0 {
+		if hook.StrictConfig {
+			return &hookError{exitCodeBadConfig, fmt.Errorf("unknown options in the configuration: %s", strings.Join(unknown, ", "))}
+		}
+		for _, key := range unknown {
+			warnf("ignoring unknown option %s", key)
+		}
+	}
+	debugf("applied the profile %s", name)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/oci"
+)
+
+const (
+	rawDeviceMountsAllow  = "allow"
+	rawDeviceMountsReject = "reject"
+)
+
+// isNvidiaDevicePath matches the NVIDIA device nodes, their directories, and /dev which holds them all.
+func isNvidiaDevicePath(p string) bool {
+	p = filepath.Clean(p)
+	return p == "/dev" || strings.HasPrefix(p, "/dev/nvidia")
+}
+
+// getRawDeviceMounts returns the NVIDIA device nodes a spec mounts or creates from the host by itself: a device
+// plugin or a user with hostPath volumes would get GPUs the hook never granted.
+func getRawDeviceMounts(s *oci.Spec) []string {
+	var raw []string
+	for _, m := range s.Mounts {
+		if filepath.IsAbs(m.Source) && isNvidiaDevicePath(m.Source) {
+			raw = append(raw, m.Source)
+		}
+	}
+	if s.Linux != nil {
+		for _, d := range s.Linux.Devices {
+			if isNvidiaDevicePath(d.Path) {
+				raw = append(raw, d.Path)
+			}
+		}
+	}
+	return raw
+}
+
+// checkRawDeviceMounts rejects the unprivileged containers mounting the NVIDIA device nodes themselves, the
+// privileged ones get all the devices anyway. The hook runs after the runtime set up the mounts, it can't strip them.
+func checkRawDeviceMounts(hook HookConfig, s *oci.Spec) error {
+	policy := hook.RawDeviceMounts
+	if len(policy) == 0 {
+		policy = rawDeviceMountsAllow
+		if hook.MountGPUOnlyByUUID {
+			policy = rawDeviceMountsReject
+		}
+	}
+	switch policy {
+	case rawDeviceMountsAllow:
+		return nil
+	case rawDeviceMountsReject:
+	default:
+		return &hookError{exitCodeBadConfig, fmt.Errorf("unknown raw-device-mounts policy: %s", policy)}
+	}
+	if isPrivileged(s) {
+		return nil
+	}
+	if raw := getRawDeviceMounts(s); len(raw) > 0 {
+		return &hookError{exitCodePolicy, fmt.Errorf("the GPUs must be requested, not mounted from the host: %s", strings.Join(raw, ", "))}
+	}
+	return nil
+}
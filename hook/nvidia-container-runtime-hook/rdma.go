@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Set to "enabled" by the containers using the InfiniBand devices of MOFED, or GDRCopy.
+	envNVMOFED   = "NVIDIA_MOFED"
+	envNVGDRCopy = "NVIDIA_GDRCOPY"
+	// Value of the variables enabling a feature.
+	envEnabled = "enabled"
+
+	infinibandDevices = "/dev/infiniband/*"
+	gdrdrvDevice      = "/dev/gdrdrv"
+)
+
+var (
+	// Kernel modules of GPUDirect RDMA: nvidia_peermem of the driver, nv_peer_mem of Mellanox before it.
+	peerMemModules = []string{"nvidia_peermem", "nv_peer_mem"}
+
+	defaultRDMALibraries = []string{
+		"/usr/lib*/libibverbs.so*", "/usr/lib*/*/libibverbs.so*",
+		"/usr/lib*/librdmacm.so*", "/usr/lib*/*/librdmacm.so*",
+		"/usr/lib*/libgdrapi.so*", "/usr/lib*/*/libgdrapi.so*",
+	}
+	// The verbs providers are looked up at the paths libibverbs was built with.
+	defaultRDMAFiles = []string{
+		"/etc/libibverbs.d/*",
+		"/usr/lib*/libibverbs/*", "/usr/lib*/*/libibverbs/*",
+	}
+)
+
+func isPeerMemLoaded() bool {
+	for _, m := range peerMemModules {
+		if _, err := os.Stat(filepath.Join("/sys/module", m)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// getRDMADevices returns the device nodes requested by the NVIDIA_MOFED and NVIDIA_GDRCOPY variables.
+func getRDMADevices(env map[string]string) []string {
+	var devices []string
+	if env[envNVMOFED] == envEnabled {
+		matches, err := filepath.Glob(infinibandDevices)
+		if err != nil {
+			log.Panicln(err)
+		}
+		if len(matches) == 0 {
+			log.Panicf("%s is enabled but there is no device in %s, is MOFED loaded?", envNVMOFED, filepath.Dir(infinibandDevices))
+		}
+		devices = append(devices, matches...)
+	}
+	if env[envNVGDRCopy] == envEnabled {
+		devices = append(devices, gdrdrvDevice)
+	}
+	return devices
+}
+
+// mountHostFiles mounts the host files matching the patterns read-only at the same paths in the container.
+func mountHostFiles(config CLIConfig, container containerConfig, patterns []string) {
+	for _, p := range patterns {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			log.Panicln("invalid file pattern:", p)
+		}
+		for _, src := range matches {
+			if info, err := os.Stat(src); err != nil || info.IsDir() {
+				continue
+			}
+			infof("mounting %s in the container", src)
+			bindContainerMount(config, container, cdiMount{HostPath: src, ContainerPath: src, Options: []string{"ro"}})
+		}
+	}
+}
+
+// configureRDMA injects the InfiniBand and GDRCopy devices requested by the container, with their user-space libraries.
+func configureRDMA(hook HookConfig, container containerConfig) {
+	devices := getRDMADevices(container.Env)
+	if len(devices) == 0 {
+		return
+	}
+	if container.Env[envNVMOFED] == envEnabled && !isPeerMemLoaded() {
+		warnf("neither of %v is loaded, GPUDirect RDMA is unavailable", peerMemModules)
+	}
+
+	for _, d := range devices {
+		infof("injecting RDMA device %s", d)
+		injectHostDevice(container, d)
+	}
+	mountLibraries(hook.NvidiaContainerCLI, container, "/", hook.RDMALibraries)
+	mountHostFiles(hook.NvidiaContainerCLI, container, hook.RDMAFiles)
+}
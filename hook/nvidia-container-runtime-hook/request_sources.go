@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/oci"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/nvcontainer"
+)
+
+// The request sources are shared with nvidia-container-runtime through nvcontainer, it injects the hook in the
+// containers requesting GPUs.
+const (
+	requestSourceEnv          = nvcontainer.RequestSourceEnv
+	requestSourceAnnotations  = nvcontainer.RequestSourceAnnotations
+	requestSourceVolumeMounts = nvcontainer.RequestSourceVolumeMounts
+
+	defaultDeviceListMountsRoot = nvcontainer.DefaultDeviceListMountsRoot
+)
+
+// Annotations requesting devices and capabilities, and the environment variables they stand for.
+var requestAnnotations = nvcontainer.RequestAnnotations
+
+// applyRequestSources sets the device and capability requests from the sources, the first source
+// setting a request has precedence. The environment of the image is ignored if it isn't a source.
+// It returns the source of the device request, empty if no source requests devices.
+func applyRequestSources(env map[string]string, s *oci.Spec, sources []string, mountsRoot string) (string, error) {
+	return nvcontainer.ApplyRequestSources(env, s, sources, mountsRoot)
+}
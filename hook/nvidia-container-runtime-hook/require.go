@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Constraints of the NVIDIA_REQUIRE_* variables, as understood by nvidia-container-cli --require.
+const (
+	constraintCUDA   = "cuda"
+	constraintDriver = "driver"
+	constraintArch   = "arch"
+	constraintBrand  = "brand"
+)
+
+var constraintOps = []string{">=", "<=", "=", ">", "<"}
+
+// Requirements of the memory integrity of the requested GPUs, checked by the hook only: nvidia-container-cli
+// doesn't know them.
+const (
+	envNVRequireECC          = "NVIDIA_REQUIRE_ECC"
+	envNVRequireRowRemapping = "NVIDIA_REQUIRE_ROW_REMAPPING"
+)
+
+// Policies of the requirements of the containers, require-policy overrides NVIDIA_DISABLE_REQUIRE.
+const (
+	requirePolicyEnforce = "enforce"
+	requirePolicyWarn    = "warn"
+	requirePolicyIgnore  = "ignore"
+)
+
+// nodeRequirements are the values of the requirements of the hook.
+var nodeRequirements = map[string][]string{
+	envNVRequireECC: {"enabled", "disabled"},
+	// no pending row remapping nor remapping failure, the GPUs predating row remapping have none.
+	envNVRequireRowRemapping: {"healthy"},
+}
+
+// Architecture names of the compute capabilities, arch=ampere is accepted as well as arch>=8.0.
+var archNames = map[string]string{
+	"3": "kepler", "5": "maxwell", "6": "pascal",
+	"7.0": "volta", "7.2": "volta", "7.5": "turing",
+	"8.0": "ampere", "8.6": "ampere", "8.7": "ampere", "8.9": "ada",
+	"9": "hopper",
+}
+
+type constraint struct {
+	Name  string
+	Op    string
+	Value string
+}
+
+func (c constraint) String() string {
+	return c.Name + c.Op + c.Value
+}
+
+func parseConstraint(s string) (*constraint, error) {
+	for _, name := range []string{constraintCUDA, constraintDriver, constraintArch, constraintBrand} {
+		if !strings.HasPrefix(s, name) {
+			continue
+		}
+		for _, op := range constraintOps {
+			if !strings.HasPrefix(s[len(name):], op) {
+				continue
+			}
+			c := &constraint{name, op, s[len(name)+len(op):]}
+			if len(c.Value) == 0 {
+				break
+			}
+			if (name == constraintBrand || (name == constraintArch && !isVersion(c.Value))) && op != "=" {
+				return nil, fmt.Errorf("invalid constraint %s: only = applies to names", s)
+			}
+			if (name == constraintCUDA || name == constraintDriver) && !isVersion(c.Value) {
+				return nil, fmt.Errorf("invalid constraint %s: not a version", s)
+			}
+			return c, nil
+		}
+		break
+	}
+	return nil, fmt.Errorf("invalid constraint %s", s)
+}
+
+func isVersion(s string) bool {
+	_, _, _, err := parseCudaVersion(s)
+	return err == nil
+}
+
+func compareWith(op string, r int) bool {
+	switch op {
+	case ">=":
+		return r >= 0
+	case "<=":
+		return r <= 0
+	case "=":
+		return r == 0
+	case ">":
+		return r > 0
+	case "<":
+		return r < 0
+	}
+	return false
+}
+
+// getArchName returns the name of a compute capability, e.g. ampere for 8.6.
+func getArchName(arch string) string {
+	if name, ok := archNames[arch]; ok {
+		return name
+	}
+	return archNames[strings.SplitN(arch, ".", 2)[0]]
+}
+
+// unsatisfiedBy returns why the node or one of the GPUs doesn't satisfy the constraint, empty if it does.
+// The driver constraint holds when the driver version is unknown, the GPU constraints when there are no GPUs.
+func (c constraint) unsatisfiedBy(info *driverInfo, devices []deviceInfo) string {
+	switch c.Name {
+	case constraintCUDA:
+		if !compareWith(c.Op, compareVersions(info.CUDAVersion, c.Value)) {
+			return fmt.Sprintf("%s (the driver supports CUDA %s)", c, info.CUDAVersion)
+		}
+	case constraintDriver:
+		if len(info.DriverVersion) > 0 && !compareWith(c.Op, compareVersions(info.DriverVersion, c.Value)) {
+			return fmt.Sprintf("%s (the driver is %s)", c, info.DriverVersion)
+		}
+	case constraintArch:
+		for _, d := range devices {
+			ok := false
+			if isVersion(c.Value) {
+				ok = isVersion(d.Architecture) && compareWith(c.Op, compareVersions(d.Architecture, c.Value))
+			} else {
+				ok = strings.EqualFold(getArchName(d.Architecture), c.Value)
+			}
+			if !ok {
+				return fmt.Sprintf("%s (GPU %s is %s %s)", c, d.Index, d.Architecture, getArchName(d.Architecture))
+			}
+		}
+	case constraintBrand:
+		for _, d := range devices {
+			if !strings.EqualFold(strings.Replace(d.Brand, " ", "", -1), c.Value) {
+				return fmt.Sprintf("%s (GPU %s is a %s)", c, d.Index, d.Brand)
+			}
+		}
+	}
+	return ""
+}
+
+// checkRequirement evaluates a requirement: space-separated alternatives are ORed, comma-separated
+// constraints are ANDed. It returns the unsatisfied constraints of every alternative, nil if one holds.
+func checkRequirement(requirement string, info *driverInfo, devices []deviceInfo) ([]string, error) {
+	var failed []string
+	for _, alternative := range strings.Fields(requirement) {
+		var unsatisfied []string
+		for _, s := range strings.Split(alternative, ",") {
+			c, err := parseConstraint(s)
+			if err != nil {
+				return nil, err
+			}
+			if reason := c.unsatisfiedBy(info, devices); len(reason) > 0 {
+				unsatisfied = append(unsatisfied, reason)
+			}
+		}
+		if len(unsatisfied) == 0 {
+			return nil, nil
+		}
+		failed = append(failed, strings.Join(unsatisfied, ", "))
+	}
+	return failed, nil
+}
+
+// getRequirePolicy returns how the requirements of a container are handled: per require-policy if set, else ignored
+// with disable-require or NVIDIA_DISABLE_REQUIRE, and enforced otherwise.
+func getRequirePolicy(hook HookConfig, nvidia *nvidiaConfig) string {
+	switch hook.RequirePolicy {
+	case requirePolicyEnforce, requirePolicyWarn, requirePolicyIgnore:
+		return hook.RequirePolicy
+	case "":
+	default:
+		fail(exitCodeBadConfig, fmt.Errorf("unknown require-policy %q: enforce, warn or ignore", hook.RequirePolicy))
+	}
+	if hook.DisableRequire || nvidia.DisableRequire {
+		return requirePolicyIgnore
+	}
+	return requirePolicyEnforce
+}
+
+// failRequirements fails with the unsatisfied requirements, or only logs them with the warn policy.
+func failRequirements(policy string, err error) {
+	if policy == requirePolicyWarn {
+		warnf("%v, starting the container anyway (require-policy = %q)", err, policy)
+		return
+	}
+	fail(exitCodeCLIFailure, err)
+}
+
+// checkRequirements fails with the constraints of the container the node doesn't satisfy, before
+// nvidia-container-cli reports the first of them with less details.
+func checkRequirements(cli CLIConfig, nvidia *nvidiaConfig, policy string) {
+	info, err := getDriverInfo(cli)
+	if err != nil {
+		failRequirements(policy, err)
+		return
+	}
+	var devices []deviceInfo
+	for _, d := range info.Devices {
+		if isRequested(nvidia.Devices, d.Index, d.UUID) {
+			devices = append(devices, d)
+		}
+	}
+
+	var errs []string
+	for _, req := range nvidia.Requirements {
+		failed, err := checkRequirement(req, info, devices)
+		if err != nil {
+			fail(exitCodeBadSpec, err)
+		}
+		if len(failed) > 0 {
+			errs = append(errs, fmt.Sprintf("%q: %s", req, strings.Join(failed, " or ")))
+		}
+	}
+	if len(errs) > 0 {
+		failRequirements(policy, fmt.Errorf("unsatisfied requirements: %s", strings.Join(errs, "; ")))
+	}
+}
+
+func getNodeRequirements(env map[string]string) map[string]string {
+	var requirements map[string]string
+	for name := range nodeRequirements {
+		if value, ok := env[name]; ok {
+			if requirements == nil {
+				requirements = make(map[string]string)
+			}
+			requirements[name] = value
+		}
+	}
+	return requirements
+}
+
+// validateNodeRequirements returns the requirements of the hook in a stable order.
+func validateNodeRequirements(requirements map[string]string) ([]string, error) {
+	var names []string
+	for name, value := range requirements {
+		if !isAllowedMode(nodeRequirements[name], value) {
+			return nil, fmt.Errorf("invalid %s %s, expected one of: %s", name, value, strings.Join(nodeRequirements[name], ", "))
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// unsatisfiedNodeRequirements returns why the requested GPUs don't satisfy the requirements of the hook.
+func unsatisfiedNodeRequirements(cli CLIConfig, nvidia *nvidiaConfig, names []string) ([]string, error) {
+	var unsatisfied []string
+	for _, name := range names {
+		value := strings.ToLower(nvidia.NodeRequirements[name])
+		switch name {
+		case envNVRequireECC:
+			gpus, err := queryGPUs(cli, "index", "uuid", "ecc.mode.current")
+			if err != nil {
+				return nil, err
+			}
+			for _, g := range gpus {
+				mode := strings.ToLower(g[2])
+				if mode != "enabled" {
+					mode = "disabled"
+				}
+				if isRequested(nvidia.Devices, g[0], g[1]) && mode != value {
+					unsatisfied = append(unsatisfied, fmt.Sprintf("%s=%s (ECC is %s on GPU %s)", name, value, mode, g[0]))
+				}
+			}
+		case envNVRequireRowRemapping:
+			rows, err := queryRemappedRows(cli, "gpu_uuid", "remapped_rows.pending", "remapped_rows.failure")
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range rows {
+				if !isRequested(nvidia.Devices, "", r[0]) {
+					continue
+				}
+				if r[1] == "Yes" {
+					unsatisfied = append(unsatisfied, fmt.Sprintf("%s=%s (GPU %s has pending row remappings, it needs a reset)", name, value, r[0]))
+				} else if r[2] == "Yes" {
+					unsatisfied = append(unsatisfied, fmt.Sprintf("%s=%s (GPU %s failed to remap rows)", name, value, r[0]))
+				}
+			}
+		}
+	}
+	return unsatisfied, nil
+}
+
+// checkNodeRequirements fails with the requirements of the hook the requested GPUs don't satisfy.
+func checkNodeRequirements(cli CLIConfig, nvidia *nvidiaConfig, policy string) {
+	names, err := validateNodeRequirements(nvidia.NodeRequirements)
+	if err != nil {
+		fail(exitCodeBadSpec, err)
+	}
+	unsatisfied, err := unsatisfiedNodeRequirements(cli, nvidia, names)
+	if err != nil {
+		failRequirements(policy, err)
+		return
+	}
+	if len(unsatisfied) > 0 {
+		failRequirements(policy, fmt.Errorf("unsatisfied requirements: %s", strings.Join(unsatisfied, "; ")))
+	}
+}
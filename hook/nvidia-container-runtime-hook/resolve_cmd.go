@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/oci"
+)
+
+// doResolveDevices resolves the device request of a container before it's created, and writes the devices
+// back into its environment: the hooks run once the container process has its environment.
+// The nvidia-container-runtime wrapper runs it for the topology requests, and for all the GPU containers
+// with export-devices: the indexes are resolved to UUIDs, which CUDA_VISIBLE_DEVICES gets too unless set,
+// and the capabilities are the ones left by supported-driver-capabilities.
+func doResolveDevices(args []string) {
+	flags := flag.NewFlagSet("resolve-devices", flag.ExitOnError)
+	bundle := flags.String("bundle", ".", "bundle of the container")
+	id := flags.String("id", "", "ID of the container")
+	flags.Parse(args)
+
+	defer exit()
+	log.SetFlags(0)
+
+	hook := getHookConfig()
+	setupLogger(hook)
+	container, err := loadContainerConfig(&hook, HookState{ID: *id, Bundle: *bundle}, nil)
+	if err != nil {
+		fail(exitCodeBadSpec, err)
+	}
+	if container.Nvidia == nil || len(container.Nvidia.Devices) == 0 {
+		return
+	}
+
+	env := [][2]string{{envNVGPU, container.Nvidia.Devices}}
+	if hook.ExportDevices {
+		cli := hook.NvidiaContainerCLI
+		if root := getDriverRoot(hook, container.Nvidia.Devices); root != nil {
+			cli.Root = root
+		}
+		info, err := getDriverInfo(cli)
+		if err != nil {
+			fail(exitCodeCLIFailure, err)
+		}
+		devices := info.ResolveIndexes(container.Nvidia.Devices)
+		env = [][2]string{{envNVGPU, devices}}
+		if _, ok := container.Env[envCUDAVisibleDevices]; !ok {
+			env = append(env, [2]string{envCUDAVisibleDevices, devices})
+		}
+		// An empty variable would get the default capabilities.
+		if len(container.Nvidia.Capabilities) > 0 {
+			env = append(env, [2]string{envNVDriverCapabilities, container.Nvidia.Capabilities})
+		}
+	}
+
+	if hook.DryRun || *dryrunflag {
+		for _, e := range env {
+			infof("dry run: %s=%s would be written", e[0], e[1])
+		}
+		return
+	}
+	err = oci.UpdateSpec(path.Join(*bundle, "config.json"), func(spec map[string]interface{}) {
+		for _, e := range env {
+			setSpecEnv(spec, e[0], e[1])
+		}
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+	for _, e := range env {
+		infof("wrote %s=%s", e[0], e[1])
+	}
+}
+
+// setSpecEnv replaces the definitions of a variable of the process environment.
+func setSpecEnv(spec map[string]interface{}, name string, value string) {
+	process, _ := spec["process"].(map[string]interface{})
+	if process == nil {
+		return
+	}
+	list, _ := process["env"].([]interface{})
+	env := []interface{}{}
+	for _, v := range list {
+		if v, ok := v.(string); ok && strings.HasPrefix(v, name+"=") {
+			continue
+		}
+		env = append(env, v)
+	}
+	process["env"] = append(env, name+"="+value)
+}
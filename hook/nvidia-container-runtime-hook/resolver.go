@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	resolverSocketPrefix = "unix://"
+	// The timeout of the resolvers when cli-timeout is disabled, a resolver mustn't hang the creation of the container.
+	resolverTimeout = 10 * time.Second
+)
+
+type resolverRequest struct {
+	Request string `json:"request"`
+	Bundle  string `json:"bundle"`
+	Pid     int    `json:"pid"`
+}
+
+type resolverResponse struct {
+	Devices []string `json:"devices"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// needsResolution excludes the values which don't request any device.
+func needsResolution(devices string) bool {
+	return len(devices) > 0 && devices != "void" && devices != "none"
+}
+
+// resolveDevices asks an external allocator for the concrete devices of a request, e.g. "count:2".
+// The resolver is either an executable reading the request on stdin, or a unix socket "unix:///path". It's killed,
+// or its connection closed, past the timeout.
+func resolveDevices(resolver string, req resolverRequest, timeout time.Duration) (string, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	if timeout <= 0 {
+		timeout = resolverTimeout
+	}
+
+	var out []byte
+	if strings.HasPrefix(resolver, resolverSocketPrefix) {
+		out, err = resolveWithSocket(strings.TrimPrefix(resolver, resolverSocketPrefix), b, timeout)
+	} else {
+		var stdout bytes.Buffer
+		cmd := exec.Command(resolver)
+		cmd.Stdin = bytes.NewReader(b)
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		err = runWithTimeout(cmd, timeout)
+		out = stdout.Bytes()
+	}
+	if err != nil {
+		return "", fmt.Errorf("device resolver %s failed: %v", resolver, err)
+	}
+
+	var resp resolverResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return "", fmt.Errorf("invalid response from device resolver %s: %v", resolver, err)
+	}
+	if len(resp.Error) > 0 {
+		return "", fmt.Errorf("device resolver %s rejected %q: %s", resolver, req.Request, resp.Error)
+	}
+	if len(resp.Devices) == 0 {
+		return "none", nil
+	}
+	return strings.Join(resp.Devices, ","), nil
+}
+
+// resolveWithSocket sends the request as a single JSON line and reads a single JSON line back.
+func resolveWithSocket(path string, req []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write(append(req, '\n')); err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(conn).ReadBytes('\n')
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Errors of the driver which go away by themselves, e.g. right after a driver upgrade until the new
+// kernel modules are loaded, or during the reset of a GPU.
+var defaultTransientErrors = []string{
+	"Driver/library version mismatch",
+	"Unknown Error",
+	"NVML_ERROR_UNKNOWN",
+	"driver not loaded",
+}
+
+// isTransientError tells whether the output of a failed command matches one of the transient errors.
+func isTransientError(config CLIConfig, output string) bool {
+	for _, e := range config.TransientErrors {
+		if len(e) > 0 && strings.Contains(strings.ToLower(output), strings.ToLower(e)) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetries runs attempt until it succeeds, fails with an error which isn't transient, or the retries
+// are exhausted. attempt returns the output of the command classifying its failure. The backoff doubles
+// after each attempt.
+func withRetries(config CLIConfig, what string, attempt func() (string, error)) error {
+	backoff := config.RetryBackoff.Duration
+	for i := 0; ; i++ {
+		out, err := attempt()
+		if err == nil || i >= config.Retries || !isTransientError(config, out+err.Error()) {
+			return err
+		}
+		warnf("%s failed with a transient error, retrying in %v (%d/%d): %s", what, backoff, i+1, config.Retries, strings.TrimSpace(out))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// queryDriver runs a command querying the driver, retrying on the transient errors, and returns its output.
+func queryDriver(config CLIConfig, path string, args ...string) ([]byte, error) {
+	var out []byte
+	err := withRetries(config, path, func() (string, error) {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(path, args...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		out = stdout.Bytes()
+		// nvidia-smi reports the NVML errors on stdout.
+		return stdout.String() + stderr.String(), err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
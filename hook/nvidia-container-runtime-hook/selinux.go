@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// What selinux-relabel relabels: the NVIDIA device nodes of the containers, or the bind mounts of the hook too.
+const (
+	selinuxRelabelDevices = "devices"
+	selinuxRelabelAll     = "all"
+
+	defaultSELinuxType = "container_file_t"
+)
+
+// Container paths of the bind mounts of the hook, relabeled with selinux-relabel = "all".
+var (
+	boundPathsLock sync.Mutex
+	boundPaths     []string
+)
+
+func recordBoundPath(p string) {
+	boundPathsLock.Lock()
+	defer boundPathsLock.Unlock()
+	boundPaths = append(boundPaths, p)
+}
+
+// withSELinuxType replaces the type of a context user:role:type:level, like chcon -t.
+func withSELinuxType(label string, t string) (string, error) {
+	p := strings.SplitN(strings.TrimRight(label, "\x00"), ":", 4)
+	if len(p) < 3 {
+		return "", fmt.Errorf("invalid SELinux context %q", label)
+	}
+	p[2] = t
+	return strings.Join(p, ":"), nil
+}
+
+func relabelFile(p string, t string) {
+	label, err := getFileLabel(p)
+	if err != nil {
+		log.Panicln("could not get the SELinux context of", p, ":", err)
+	}
+	relabeled, err := withSELinuxType(label, t)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if relabeled == strings.TrimRight(label, "\x00") {
+		return
+	}
+	debugf("relabeling %s from %s to %s", p, label, relabeled)
+	if err := setFileLabel(p, relabeled); err != nil {
+		log.Panicln("could not relabel", p, ":", err)
+	}
+}
+
+// relabelContainerFiles gives the SELinux type of the containers to their NVIDIA device nodes, and to the bind mounts
+// of the hook with "all". The bind-mounted device nodes are the ones of the host, they keep the type until reboot.
+func relabelContainerFiles(hook HookConfig, container containerConfig) {
+	switch hook.SELinuxRelabel {
+	case "":
+		return
+	case selinuxRelabelDevices, selinuxRelabelAll:
+	default:
+		fail(exitCodeBadConfig, fmt.Errorf("unknown selinux-relabel mode: %s", hook.SELinuxRelabel))
+	}
+	if !isSELinuxEnabled() {
+		debugf("SELinux is disabled, nothing to relabel")
+		return
+	}
+
+	paths := getContainerDeviceNodes(container)
+	if hook.SELinuxRelabel == selinuxRelabelAll {
+		boundPathsLock.Lock()
+		paths = append(paths, boundPaths...)
+		boundPathsLock.Unlock()
+	}
+	for _, p := range paths {
+		relabelFile(p, hook.SELinuxType)
+	}
+}
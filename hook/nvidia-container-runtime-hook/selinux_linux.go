@@ -0,0 +1,35 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const selinuxXattr = "security.selinux"
+
+func isSELinuxEnabled() bool {
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
+
+func getFileLabel(path string) (string, error) {
+	b := make([]byte, 256)
+	for {
+		n, err := syscall.Getxattr(path, selinuxXattr, b)
+		if err == syscall.ERANGE {
+			b = make([]byte, 2*len(b))
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(b[:n]), nil
+	}
+}
+
+func setFileLabel(path string, label string) error {
+	return syscall.Setxattr(path, selinuxXattr, append([]byte(label), 0), 0)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+// isSELinuxEnabled is false, SELinux only exists on Linux.
+func isSELinuxEnabled() bool {
+	return false
+}
+
+func getFileLabel(path string) (string, error) {
+	return "", fmt.Errorf("SELinux is only supported on Linux")
+}
+
+func setFileLabel(path string, label string) error {
+	return fmt.Errorf("SELinux is only supported on Linux")
+}
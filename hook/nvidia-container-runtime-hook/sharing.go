@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSharingState = "/run/nvidia-container-runtime/shared-gpus.json"
+
+	// Separator of the replica of a shared GPU, e.g. GPU-<UUID>::1 as advertised by the time-slicing
+	// configuration of the device plugin.
+	replicaSeparator = "::"
+)
+
+// sharedReplica is a shared GPU requested by a container.
+type sharedReplica struct {
+	Request string `json:"request"`
+	GPU     string `json:"gpu"`
+	Replica int    `json:"replica"`
+}
+
+// expandSharedDevices maps the replicas and virtual names of a device request to the physical GPUs, once each.
+func expandSharedDevices(devices string, shared []SharedDevice) (string, []sharedReplica, error) {
+	var physical []string
+	var replicas []sharedReplica
+	seen := make(map[string]bool)
+	for _, d := range strings.Split(devices, ",") {
+		gpu, replica := d, 0
+		isReplica := false
+		if i := strings.Index(d, replicaSeparator); i >= 0 {
+			n, err := strconv.Atoi(d[i+len(replicaSeparator):])
+			if err != nil || n < 0 {
+				return "", nil, fmt.Errorf("invalid replica of shared GPU %s", d)
+			}
+			gpu, replica, isReplica = d[:i], n, true
+		}
+		for _, s := range shared {
+			if s.Name != gpu {
+				continue
+			}
+			if s.Replicas > 0 && replica >= s.Replicas {
+				return "", nil, fmt.Errorf("invalid replica of shared GPU %s: %s has %d replicas", d, s.Name, s.Replicas)
+			}
+			gpu, isReplica = s.GPU, true
+			break
+		}
+
+		if isReplica {
+			replicas = append(replicas, sharedReplica{d, gpu, replica})
+		}
+		if !seen[gpu] {
+			seen[gpu] = true
+			physical = append(physical, gpu)
+		}
+	}
+	return strings.Join(physical, ","), replicas, nil
+}
+
+// SharedGPUEntry records a replica of a GPU used by a container.
+type SharedGPUEntry struct {
+	Container string    `json:"container"`
+	Request   string    `json:"request"`
+	UUID      string    `json:"uuid"`
+	Replica   int       `json:"replica"`
+	Since     time.Time `json:"since"`
+}
+
+// sharedGPUs is the node-local record of the containers sharing GPUs, for observability.
+type sharedGPUs struct {
+	file    *os.File
+	Entries []SharedGPUEntry `json:"entries"`
+}
+
+// openSharedGPUs opens and locks the sharing state, it must be closed to release the lock.
+func openSharedGPUs(path string) (*sharedGPUs, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s := &sharedGPUs{file: f}
+	b, err := ioutil.ReadAll(f)
+	if err == nil && len(b) > 0 {
+		err = json.Unmarshal(b, s)
+	}
+	if err != nil {
+		s.close()
+		return nil, fmt.Errorf("invalid sharing state %s: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *sharedGPUs) save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = s.file.WriteAt(b, 0)
+	return err
+}
+
+func (s *sharedGPUs) close() {
+	unlockFile(s.file)
+	s.file.Close()
+}
+
+func (s *sharedGPUs) release(container string) {
+	entries := s.Entries[:0]
+	for _, e := range s.Entries {
+		if e.Container != container {
+			entries = append(entries, e)
+		}
+	}
+	s.Entries = entries
+}
+
+// recordSharedGPUs records the physical GPUs of the replicas used by a container.
+func recordSharedGPUs(hook HookConfig, cli CLIConfig, container containerConfig) {
+	info, err := getDriverInfo(cli)
+	if err != nil {
+		log.Panicln(err)
+	}
+	s, err := openSharedGPUs(hook.SharingState)
+	if err != nil {
+		log.Panicln(err)
+	}
+	defer s.close()
+
+	s.release(container.ID)
+	for _, r := range container.Replicas {
+		uuids := info.RequestedUUIDs(r.GPU)
+		if len(uuids) == 0 {
+			log.Panicf("unknown GPU %s of shared device %s", r.GPU, r.Request)
+		}
+		infof("%s is replica %d of GPU %s", r.Request, r.Replica, uuids[0])
+		s.Entries = append(s.Entries, SharedGPUEntry{container.ID, r.Request, uuids[0], r.Replica, time.Now()})
+	}
+	if err := s.save(); err != nil {
+		log.Panicln(err)
+	}
+}
+
+func releaseSharedGPUs(hook HookConfig, id string) {
+	if _, err := os.Stat(hook.SharingState); os.IsNotExist(err) {
+		return
+	}
+	s, err := openSharedGPUs(hook.SharingState)
+	if err != nil {
+		log.Panicln(err)
+	}
+	defer s.close()
+
+	s.release(id)
+	if err := s.save(); err != nil {
+		log.Panicln(err)
+	}
+}
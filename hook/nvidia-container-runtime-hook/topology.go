@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Policies of the topology requests: the most NVLinks between the GPUs, or the closest PCIe paths.
+const (
+	topologyPolicyNVLink = "nvlink"
+	topologyPolicyPCIe   = "pcie"
+)
+
+var (
+	topologyGPUExp = regexp.MustCompile(`^GPU([0-9]+)$`)
+	ansiEscapeExp  = regexp.MustCompile("\x1b\\[[0-9;]*m")
+)
+
+// topologyRequest is a number of GPUs picked by the hook, e.g. NVIDIA_VISIBLE_DEVICES=count:4,policy:nvlink.
+type topologyRequest struct {
+	Count  int
+	Policy string
+}
+
+func isTopologyRequest(devices string) bool {
+	return strings.HasPrefix(devices, "count:") || strings.HasPrefix(devices, "policy:")
+}
+
+func parseTopologyRequest(devices string) (topologyRequest, error) {
+	r := topologyRequest{Policy: topologyPolicyNVLink}
+	for _, kv := range strings.Split(devices, ",") {
+		p := strings.SplitN(kv, ":", 2)
+		switch {
+		case len(p) != 2:
+			return r, fmt.Errorf("invalid topology request %s, expected count:<n>[,policy:nvlink|pcie]", devices)
+		case p[0] == "count":
+			n, err := strconv.Atoi(p[1])
+			if err != nil || n < 1 {
+				return r, fmt.Errorf("invalid count of GPUs in %s", devices)
+			}
+			r.Count = n
+		case p[0] == "policy":
+			if p[1] != topologyPolicyNVLink && p[1] != topologyPolicyPCIe {
+				return r, fmt.Errorf("unknown topology policy %s, expected nvlink or pcie", p[1])
+			}
+			r.Policy = p[1]
+		default:
+			return r, fmt.Errorf("invalid topology request %s, expected count:<n>[,policy:nvlink|pcie]", devices)
+		}
+	}
+	if r.Count == 0 {
+		return r, fmt.Errorf("no count of GPUs in %s", devices)
+	}
+	return r, nil
+}
+
+// gpuTopology holds the links between the GPUs by index, as printed by nvidia-smi topo -m:
+// X, NV<links>, PIX, PXB, PHB, NODE or SYS.
+type gpuTopology map[string]map[string]string
+
+// getGPUTopology runs nvidia-smi topo -m, which queries the links through NVML, unless cached.
+func getGPUTopology(config CLIConfig) (gpuTopology, error) {
+	var topo gpuTopology
+	err := withDiscoveryCache(config, "topology", &topo, func() error {
+		smi := lookPath(config, "nvidia-smi")
+		out, err := queryDriver(config, smi, "topo", "-m")
+		if err != nil {
+			return fmt.Errorf("nvidia-smi failed: %v", err)
+		}
+		topo, err = parseGPUTopology(string(out))
+		return err
+	})
+	return topo, err
+}
+
+// parseGPUTopology parses the matrix of nvidia-smi topo -m, the GPU columns come first and the legend
+// follows a blank line:
+//
+//		GPU0	GPU1	NIC0	CPU Affinity	NUMA Affinity
+//	GPU0	 X 	NV12	SYS	0-23	0
+//	GPU1	NV12	 X 	SYS	0-23	0
+func parseGPUTopology(out string) (gpuTopology, error) {
+	var columns []string
+	topo := make(gpuTopology)
+	for _, line := range strings.Split(ansiEscapeExp.ReplaceAllString(out, ""), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			if len(columns) > 0 {
+				break
+			}
+			continue
+		}
+		if len(columns) == 0 {
+			for _, f := range fields {
+				m := topologyGPUExp.FindStringSubmatch(f)
+				if m == nil {
+					break
+				}
+				columns = append(columns, m[1])
+			}
+			if len(columns) == 0 {
+				return nil, fmt.Errorf("unexpected nvidia-smi topo output: %s", line)
+			}
+			continue
+		}
+		m := topologyGPUExp.FindStringSubmatch(fields[0])
+		if m == nil || len(fields) < len(columns)+1 {
+			continue
+		}
+		links := make(map[string]string)
+		for i, c := range columns {
+			links[c] = fields[i+1]
+		}
+		topo[m[1]] = links
+	}
+	if len(topo) == 0 {
+		return nil, fmt.Errorf("no GPU in the nvidia-smi topo output")
+	}
+	return topo, nil
+}
+
+// linkScore rates a link between two GPUs: NVLink above any PCIe path with the nvlink policy,
+// then the paths through the fewest PCIe bridges.
+func linkScore(link string, policy string) int {
+	if strings.HasPrefix(link, "NV") {
+		if policy == topologyPolicyPCIe {
+			return 6
+		}
+		n, _ := strconv.Atoi(link[len("NV"):])
+		return 10 + n
+	}
+	switch link {
+	case "PIX":
+		return 5
+	case "PXB":
+		return 4
+	case "PHB":
+		return 3
+	case "NODE":
+		return 2
+	}
+	return 1
+}
+
+// pickGPUs returns count of the candidate GPUs with the best links between them, in the order of the candidates.
+// It adds the GPU with the best links to the picked ones, starting from each candidate in turn:
+// the exact search is exponential in the number of GPUs.
+func pickGPUs(topo gpuTopology, candidates []string, count int, policy string) []string {
+	var best map[string]bool
+	bestScore := -1
+	for _, first := range candidates {
+		picked := map[string]bool{first: true}
+		score := 0
+		for len(picked) < count {
+			next, nextScore := "", -1
+			for _, c := range candidates {
+				if picked[c] {
+					continue
+				}
+				s := 0
+				for p := range picked {
+					s += linkScore(topo[p][c], policy)
+				}
+				if s > nextScore {
+					next, nextScore = c, s
+				}
+			}
+			picked[next] = true
+			score += nextScore
+		}
+		if score > bestScore {
+			best, bestScore = picked, score
+		}
+	}
+
+	var gpus []string
+	for _, c := range candidates {
+		if best[c] {
+			gpus = append(gpus, c)
+		}
+	}
+	return gpus
+}
+
+// selectTopologyDevices picks the GPUs of a topology request among the ones not held by others in the ledger,
+// they're recorded there for the container unless it's a dry run. Without a ledger, the GPUs of the other
+// containers may be picked.
+func selectTopologyDevices(hook HookConfig, container string, devices string, record bool) (string, error) {
+	req, err := parseTopologyRequest(devices)
+	if err != nil {
+		return "", err
+	}
+	cli := hook.NvidiaContainerCLI
+	info, err := getDriverInfo(cli)
+	if err != nil {
+		return "", &hookError{exitCodeCLIFailure, err}
+	}
+	topo, err := getGPUTopology(cli)
+	if err != nil {
+		return "", &hookError{exitCodeCLIFailure, err}
+	}
+
+	var l *ledger
+	if hook.Ledger != nil {
+		if l, err = openLedger(*hook.Ledger); err != nil {
+			return "", &hookError{exitCodeError, err}
+		}
+		defer l.close()
+	}
+	var candidates []string
+	uuids := make(map[string]string)
+	for _, d := range info.Devices {
+		if _, ok := topo[d.Index]; !ok {
+			continue
+		}
+		if l != nil {
+			if o := l.owner(d.UUID); len(o) > 0 && o != container {
+				continue
+			}
+		}
+		candidates = append(candidates, d.Index)
+		uuids[d.Index] = d.UUID
+	}
+	if len(candidates) < req.Count {
+		return "", &hookError{exitCodePolicy, fmt.Errorf("%d GPUs requested, %d available", req.Count, len(candidates))}
+	}
+
+	var picked []string
+	for _, index := range pickGPUs(topo, candidates, req.Count, req.Policy) {
+		picked = append(picked, uuids[index])
+	}
+	if l != nil && record {
+		if err := l.allocate(container, picked); err != nil {
+			return "", &hookError{exitCodePolicy, err}
+		}
+		if err := l.save(); err != nil {
+			return "", &hookError{exitCodeError, err}
+		}
+	}
+	return strings.Join(picked, ","), nil
+}
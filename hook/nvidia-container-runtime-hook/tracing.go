@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The spans of the hook are exported as OTLP/HTTP JSON, configured by the standard OpenTelemetry variables.
+// They must be in the env of the hook entry of the OCI spec, the runtimes don't pass their own environment to the hooks:
+// the nvidia-container-runtime wrapper copies its OTEL_* and TRACEPARENT variables there.
+const (
+	envOTELSDKDisabled    = "OTEL_SDK_DISABLED"
+	envOTELTracesExporter = "OTEL_TRACES_EXPORTER"
+	envOTELServiceName    = "OTEL_SERVICE_NAME"
+	envOTELResourceAttrs  = "OTEL_RESOURCE_ATTRIBUTES"
+	envOTLPEndpoint       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	envOTLPTracesEndpoint = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	envOTLPHeaders        = "OTEL_EXPORTER_OTLP_HEADERS"
+	envOTLPTracesHeaders  = "OTEL_EXPORTER_OTLP_TRACES_HEADERS"
+	envOTLPTimeout        = "OTEL_EXPORTER_OTLP_TIMEOUT"
+	envOTLPTracesTimeout  = "OTEL_EXPORTER_OTLP_TRACES_TIMEOUT"
+	envOTLPProtocol       = "OTEL_EXPORTER_OTLP_PROTOCOL"
+	envOTLPTracesProtocol = "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"
+	// W3C trace context of the caller, e.g. the span of the container creation.
+	envTraceParent = "TRACEPARENT"
+
+	defaultOTELServiceName = "nvidia-container-runtime-hook"
+	defaultOTLPTimeout     = 10 * time.Second
+
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+)
+
+var traceParentExp = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type traceSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+	ended        bool
+}
+
+// hookTracer collects the spans of an invocation, they are exported when the hook exits.
+type hookTracer struct {
+	endpoint string
+	headers  map[string]string
+	timeout  time.Duration
+	resource []otlpAttribute
+	traceID  string
+	root     *traceSpan
+	spans    []*traceSpan
+}
+
+// tracer of the current invocation, nil when tracing is disabled.
+var tracer *hookTracer
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func nowUnixNano() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// parseOTELList parses the key=value,... lists of the OpenTelemetry variables, values are URL-encoded.
+func parseOTELList(s string) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 || len(strings.TrimSpace(p[0])) == 0 {
+			continue
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(p[1]))
+		if err != nil {
+			v = strings.TrimSpace(p[1])
+		}
+		m[strings.TrimSpace(p[0])] = v
+	}
+	return m
+}
+
+// getenvTraces returns the variable specific to the traces, or the generic one.
+func getenvTraces(traces string, generic string) string {
+	if v, ok := os.LookupEnv(traces); ok {
+		return v
+	}
+	return os.Getenv(generic)
+}
+
+// getTracesEndpoint returns the URL the spans are sent to, empty when tracing isn't configured.
+func getTracesEndpoint() string {
+	if e := os.Getenv(envOTLPTracesEndpoint); len(e) > 0 {
+		return e
+	}
+	if e := os.Getenv(envOTLPEndpoint); len(e) > 0 {
+		return strings.TrimSuffix(e, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// startTracing starts the root span of the invocation when an OTLP endpoint is configured.
+func startTracing(name string) {
+	endpoint := getTracesEndpoint()
+	if len(endpoint) == 0 || strings.EqualFold(os.Getenv(envOTELSDKDisabled), "true") {
+		return
+	}
+	if e := os.Getenv(envOTELTracesExporter); len(e) > 0 && e != "otlp" {
+		if e != "none" {
+			warnf("unsupported %s %s, tracing disabled", envOTELTracesExporter, e)
+		}
+		return
+	}
+	if p := getenvTraces(envOTLPTracesProtocol, envOTLPProtocol); strings.HasPrefix(p, "grpc") {
+		warnf("unsupported OTLP protocol %s, only http is, tracing disabled", p)
+		return
+	}
+
+	timeout := defaultOTLPTimeout
+	if ms, err := strconv.Atoi(getenvTraces(envOTLPTracesTimeout, envOTLPTimeout)); err == nil && ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	attrs := parseOTELList(os.Getenv(envOTELResourceAttrs))
+	if s := os.Getenv(envOTELServiceName); len(s) > 0 {
+		attrs["service.name"] = s
+	} else if _, ok := attrs["service.name"]; !ok {
+		attrs["service.name"] = defaultOTELServiceName
+	}
+	t := &hookTracer{
+		endpoint: endpoint,
+		headers:  parseOTELList(getenvTraces(envOTLPTracesHeaders, envOTLPHeaders)),
+		timeout:  timeout,
+		traceID:  randomHex(16),
+	}
+	for k, v := range attrs {
+		t.resource = append(t.resource, otlpAttribute{k, otlpValue{v}})
+	}
+
+	parent := ""
+	if m := traceParentExp.FindStringSubmatch(os.Getenv(envTraceParent)); m != nil {
+		t.traceID, parent = m[1], m[2]
+	}
+	tracer = t
+	t.root = startSpan(name)
+	t.root.ParentSpanID = parent
+}
+
+// startSpan starts a span under the root span of the invocation, nil when tracing is disabled.
+func startSpan(name string) *traceSpan {
+	if tracer == nil {
+		return nil
+	}
+	s := &traceSpan{TraceID: tracer.traceID, SpanID: randomHex(8), Name: name, Kind: otlpSpanKindInternal, Start: nowUnixNano()}
+	if tracer.root != nil {
+		s.ParentSpanID = tracer.root.SpanID
+	}
+	tracer.spans = append(tracer.spans, s)
+	return s
+}
+
+func (s *traceSpan) setAttribute(key string, value string) {
+	if s != nil {
+		s.Attributes = append(s.Attributes, otlpAttribute{key, otlpValue{value}})
+	}
+}
+
+// setTraceAttribute sets an attribute of the root span.
+func setTraceAttribute(key string, value string) {
+	if tracer != nil {
+		tracer.root.setAttribute(key, value)
+	}
+}
+
+func (s *traceSpan) end() {
+	if s != nil && !s.ended {
+		s.End = nowUnixNano()
+		s.Status = otlpStatus{Code: otlpStatusOK}
+		s.ended = true
+	}
+}
+
+// stopTracing ends the spans still open, failed if the hook exits with an error, and exports them.
+// Tracing is best effort, a failed export is only logged.
+func stopTracing(code int, reason string) {
+	t := tracer
+	if t == nil {
+		return
+	}
+	tracer = nil
+
+	for _, s := range t.spans {
+		if s.ended {
+			continue
+		}
+		s.End = nowUnixNano()
+		if code != 0 {
+			s.Status = otlpStatus{otlpStatusError, reason}
+		} else {
+			s.Status = otlpStatus{Code: otlpStatusOK}
+		}
+		s.ended = true
+	}
+	t.root.setAttribute("exit.code", strconv.Itoa(code))
+
+	if err := t.export(); err != nil {
+		warnf("couldn't export the traces: %v", err)
+	}
+}
+
+func (t *hookTracer) export() error {
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []*traceSpan `json:"spans"`
+	}
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	rs := resourceSpans{ScopeSpans: []scopeSpans{{Spans: t.spans}}}
+	rs.Resource.Attributes = t.resource
+	rs.ScopeSpans[0].Scope.Name = defaultOTELServiceName
+
+	b, err := json.Marshal(map[string][]resourceSpans{"resourceSpans": {rs}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := (&http.Client{Timeout: t.timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+const (
+	utilityFilesAll       = "all"
+	utilityFilesLibraries = "libraries"
+	utilityFilesSMI       = "nvidia-smi"
+)
+
+// Binaries injected by nvidia-container-cli for the utility capability.
+var utilityBinaries = []string{"/usr/bin/nvidia-smi", "/usr/bin/nvidia-debugdump", "/usr/bin/nvidia-persistenced"}
+
+// getExcludedUtilityFiles returns the utility files to remove from the container,
+// the NVML libraries are always kept since nvidia-smi needs them.
+func getExcludedUtilityFiles(mode string) []string {
+	switch mode {
+	case utilityFilesAll:
+		return nil
+	case utilityFilesLibraries:
+		return utilityBinaries
+	case utilityFilesSMI:
+		var excluded []string
+		for _, b := range utilityBinaries {
+			if !strings.HasSuffix(b, "/nvidia-smi") {
+				excluded = append(excluded, b)
+			}
+		}
+		return excluded
+	default:
+		log.Panicln("unknown utility-files mode:", mode)
+	}
+	return nil
+}
+
+func hasCapability(capabilities string, cap string) bool {
+	for _, c := range strings.Split(capabilities, ",") {
+		if c == cap {
+			return true
+		}
+	}
+	return false
+}
+
+func filterUtilityFiles(hook HookConfig, container containerConfig) {
+	if !hasCapability(container.Nvidia.Capabilities, "utility") {
+		return
+	}
+	for _, f := range getExcludedUtilityFiles(hook.UtilityFiles) {
+		removeContainerFile(hook.NvidiaContainerCLI, container, f)
+	}
+}
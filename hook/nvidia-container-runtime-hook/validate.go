@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type check struct {
+	Name string
+	Run  func(hook HookConfig) error
+}
+
+// configChecks only need the configuration, e.g. to check a new one before it replaces the current one.
+var configChecks = []check{
+	{"driver-capabilities", func(hook HookConfig) error {
+		_, err := getDriverCapabilities(hook)
+		return err
+	}},
+	{"config", func(hook HookConfig) error {
+		if problems := validateConfig(*configflag); len(problems) > 0 {
+			return fmt.Errorf("%s", strings.Join(problems, "; "))
+		}
+		return nil
+	}},
+}
+
+var checks = append([]check{
+	{"verify-kmods", func(hook HookConfig) error { return verifyKernelModules(hook.KernelModules) }},
+}, configChecks...)
+
+// loadHookConfig returns the configuration, or the defaults with the error of the configuration file.
+func loadHookConfig() (hook HookConfig, err error) {
+	hook = getDefaultHookConfig()
+	err = runCheck(check{"config-file", func(HookConfig) error {
+		hook = getHookConfig()
+		return nil
+	}}, hook)
+	return hook, err
+}
+
+func doValidate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configOnly := flags.Bool("config-only", false, "only check the configuration file, e.g. a new one before it replaces the current one")
+	flags.Parse(args)
+
+	failed := false
+	hook, err := loadHookConfig()
+	if err != nil {
+		fmt.Printf("%-24s FAIL: %v\n", "config-file", err)
+		failed = true
+	}
+	if len(hook.PolicyVersion) > 0 {
+		fmt.Printf("%-24s %s\n", "policy-version", hook.PolicyVersion)
+	}
+
+	list := checks
+	if *configOnly {
+		list = configChecks
+	}
+	if !runChecks(os.Stdout, hook, list) || failed {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// runChecks prints the result of each check, it returns whether they all passed.
+func runChecks(w io.Writer, hook HookConfig, list []check) bool {
+	ok := true
+	for _, c := range list {
+		if err := runCheck(c, hook); err != nil {
+			fmt.Fprintf(w, "%-24s FAIL: %v\n", c.Name, err)
+			ok = false
+		} else {
+			fmt.Fprintf(w, "%-24s OK\n", c.Name)
+		}
+	}
+	return ok
+}
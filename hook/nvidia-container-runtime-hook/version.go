@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build information, set with -ldflags "-X main.version=<version> -X main.gitCommit=<commit> -X main.buildDate=<date>".
+var (
+	version   = "1.3.0"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+const (
+	// version of the layout of config.toml understood by the hook, bumped when options change meaning.
+	configSchemaVersion = 1
+	// nvidia-container-cli versions the hook is tested with: it needs configure --ldconfig and --no-cgroups,
+	// and the devices of cgroup v2 from cgroupV2MinCLIVersion.
+	minCLIVersion  = "1.0.0"
+	nextCLIVersion = "2.0.0"
+)
+
+func versionString() string {
+	return fmt.Sprintf("%s (commit %s, built %s with %s)", version, gitCommit, buildDate, runtime.Version())
+}
+
+func printVersion() {
+	fmt.Printf("nvidia-container-runtime-hook %s\n", version)
+	fmt.Printf("commit: %s\n", gitCommit)
+	fmt.Printf("build date: %s\n", buildDate)
+	fmt.Printf("go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Printf("config schema: %d\n", configSchemaVersion)
+	fmt.Printf("nvidia-container-cli: >= %s, < %s (>= %s on cgroup v2)\n", minCLIVersion, nextCLIVersion, cgroupV2MinCLIVersion)
+}
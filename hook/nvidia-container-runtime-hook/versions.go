@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/oci"
+)
+
+const (
+	versionsFile       = "nvidia-versions.json"
+	versionsAnnotation = "com.nvidia.driver.versions"
+)
+
+// injectedVersions are the driver components made available to a container.
+type injectedVersions struct {
+	Driver string `json:"driver"`
+	CUDA   string `json:"cuda"`
+	// NVML is shipped with the driver, libnvidia-ml.so has the driver version.
+	NVML string `json:"nvml"`
+}
+
+func getInjectedVersions(info *driverInfo) injectedVersions {
+	return injectedVersions{
+		Driver: info.DriverVersion,
+		CUDA:   info.CUDAVersion,
+		NVML:   info.DriverVersion,
+	}
+}
+
+// recordVersions writes the injected versions in the bundle, and optionally as an annotation of the OCI spec,
+// so that they can be audited without entering the container.
+func recordVersions(hook HookConfig, container containerConfig) {
+	info, err := getDriverInfo(hook.NvidiaContainerCLI)
+	if err != nil {
+		log.Panicln("couldn't get the driver versions:", err)
+	}
+	versions := getInjectedVersions(info)
+
+	b, err := json.Marshal(versions)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if err := ioutil.WriteFile(path.Join(container.Bundle, versionsFile), b, 0644); err != nil {
+		log.Panicln("couldn't record the driver versions:", err)
+	}
+
+	if hook.RecordVersionsAnnotation {
+		err := oci.UpdateSpec(path.Join(container.Bundle, "config.json"), func(spec map[string]interface{}) {
+			annotations, _ := spec["annotations"].(map[string]interface{})
+			if annotations == nil {
+				annotations = make(map[string]interface{})
+			}
+			annotations[versionsAnnotation] = string(b)
+			spec["annotations"] = annotations
+		})
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/oci"
+	"github.com/nvidia/nvidia-container-runtime/hook/nvidia-container-runtime-hook/pkg/nvcontainer"
+)
+
+const (
+	// Kata Containers annotates the specs of the containers it runs in a VM.
+	kataAnnotationPrefix = "io.katacontainers."
+	// Kata plugs the VFIO devices of the spec into the VM, on root ports of the PCIe bus for the large BARs of the GPUs.
+	kataHotplugVFIOAnnotation  = "io.katacontainers.config.hypervisor.hotplug_vfio_on_root_bus"
+	kataPCIeRootPortAnnotation = "io.katacontainers.config.hypervisor.pcie_root_port"
+
+	pciDevicesDir   = "/sys/bus/pci/devices"
+	vfioDir         = "/dev/vfio"
+	vfioPCIDriver   = "vfio-pci"
+	nvidiaPCIVendor = "0x10de"
+	// PCI class of the display controllers: VGA compatible (0x0300) or 3D (0x0302).
+	pciDisplayClass = "0x03"
+)
+
+// isVMRuntime tells the containers run in a VM by a runtime like Kata Containers: the GPUs are passed through
+// with VFIO, the libraries of the host are of no use in the VM.
+func isVMRuntime(annotations map[string]string) bool {
+	for k := range annotations {
+		if strings.HasPrefix(k, kataAnnotationPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// vfioGPU is an NVIDIA GPU of the host, with the driver it's bound to and its IOMMU group.
+type vfioGPU struct {
+	BusID  string
+	Driver string
+	Group  string
+}
+
+func readSysfsLink(p string) string {
+	target, err := os.Readlink(p)
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// getVFIOGPUs returns the NVIDIA GPUs found in sysfs, in the order of their bus IDs: the driver of the host,
+// which nvidia-container-cli queries, doesn't drive the GPUs bound to vfio-pci.
+func getVFIOGPUs(sysfs string) ([]vfioGPU, error) {
+	entries, err := ioutil.ReadDir(sysfs)
+	if err != nil {
+		return nil, err
+	}
+	var gpus []vfioGPU
+	for _, e := range entries {
+		dir := filepath.Join(sysfs, e.Name())
+		vendor, _ := ioutil.ReadFile(filepath.Join(dir, "vendor"))
+		class, _ := ioutil.ReadFile(filepath.Join(dir, "class"))
+		if strings.TrimSpace(string(vendor)) != nvidiaPCIVendor || !strings.HasPrefix(strings.TrimSpace(string(class)), pciDisplayClass) {
+			continue
+		}
+		gpus = append(gpus, vfioGPU{
+			BusID:  e.Name(),
+			Driver: readSysfsLink(filepath.Join(dir, "driver")),
+			Group:  readSysfsLink(filepath.Join(dir, "iommu_group")),
+		})
+	}
+	return gpus, nil
+}
+
+// selectVFIOGPUs returns the GPUs of a device request: all, indexes in bus order or PCI bus IDs. The UUIDs are
+// only known to the driver of the host, they can't be passed through.
+func selectVFIOGPUs(gpus []vfioGPU, devices string) ([]vfioGPU, error) {
+	var selected []vfioGPU
+	for _, d := range strings.Split(devices, ",") {
+		switch {
+		case len(d) == 0:
+		case d == "all":
+			selected = append(selected, gpus...)
+		case isPCIBusID(d):
+			found := false
+			for _, g := range gpus {
+				if normalizePCIBusID(g.BusID) == normalizePCIBusID(d) {
+					selected, found = append(selected, g), true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unknown PCI bus ID %s", d)
+			}
+		default:
+			i, err := strconv.Atoi(d)
+			if err != nil {
+				return nil, fmt.Errorf("GPU %s can't be passed through to a VM, request the GPUs by index or PCI bus ID", d)
+			}
+			if i < 0 || i >= len(gpus) {
+				return nil, fmt.Errorf("unknown GPU index %d, the host has %d NVIDIA GPUs", i, len(gpus))
+			}
+			selected = append(selected, gpus[i])
+		}
+	}
+	for _, g := range selected {
+		if g.Driver != vfioPCIDriver {
+			return nil, fmt.Errorf("GPU %s is bound to %s, bind it to %s to pass it through", g.BusID, orDefault(g.Driver, "no driver"), vfioPCIDriver)
+		}
+		if len(g.Group) == 0 {
+			return nil, fmt.Errorf("GPU %s has no IOMMU group, is the IOMMU enabled?", g.BusID)
+		}
+	}
+	return selected, nil
+}
+
+// addVFIODevices adds the VFIO groups of the GPUs to the devices of a spec and to its device cgroup rules, and the
+// annotations Kata needs to plug them unless set.
+func addVFIODevices(spec map[string]interface{}, groups []string) {
+	var edits nvcontainer.ContainerEdits
+	for _, group := range groups {
+		edits.DeviceNodes = append(edits.DeviceNodes, nvcontainer.DeviceNode{Path: filepath.Join(vfioDir, group)})
+	}
+	if err := nvcontainer.ApplyToSpec(spec, edits); err != nil {
+		log.Panicln(err)
+	}
+
+	annotations, _ := spec["annotations"].(map[string]interface{})
+	if annotations == nil {
+		annotations = make(map[string]interface{})
+		spec["annotations"] = annotations
+	}
+	for k, v := range map[string]string{kataHotplugVFIOAnnotation: "true", kataPCIeRootPortAnnotation: strconv.Itoa(len(groups))} {
+		if _, ok := annotations[k]; !ok {
+			annotations[k] = v
+		}
+	}
+}
+
+// doAssignVFIO passes the requested GPUs through to the VM of a container, the nvidia-container-runtime wrapper
+// runs it instead of adding the hook to the containers of a VM-based runtime.
+func doAssignVFIO(args []string) {
+	flags := flag.NewFlagSet("assign-vfio", flag.ExitOnError)
+	bundle := flags.String("bundle", ".", "bundle of the container")
+	id := flags.String("id", "", "ID of the container")
+	flags.Parse(args)
+
+	defer exit()
+	log.SetFlags(0)
+
+	hook := getHookConfig()
+	setupLogger(hook)
+	setLogContext(*id, *bundle)
+	s, err := oci.LoadSpec(path.Join(*bundle, "config.json"))
+	if err != nil {
+		fail(exitCodeBadSpec, err)
+	}
+	env, err := getEnvMap(s.Process.Env, hook.MountGPUOnlyByUUID)
+	if err != nil {
+		fail(exitCodeBadSpec, err)
+	}
+	if _, err := applyRequestSources(env, s, hook.RequestSources, hook.DeviceListMountsRoot); err != nil {
+		fail(exitCodeBadConfig, err)
+	}
+	nvidia, err := getNvidiaConfig(env, hook.MountGPUOnlyByUUID)
+	if err != nil {
+		fail(exitCodeBadSpec, err)
+	}
+	if nvidia == nil || len(nvidia.Devices) == 0 {
+		return
+	}
+
+	gpus, err := getVFIOGPUs(pciDevicesDir)
+	if err != nil {
+		log.Panicln(err)
+	}
+	selected, err := selectVFIOGPUs(gpus, nvidia.Devices)
+	if err != nil {
+		fail(exitCodeBadSpec, err)
+	}
+	var groups []string
+	seen := make(map[string]bool)
+	for _, g := range selected {
+		if !seen[g.Group] {
+			seen[g.Group] = true
+			groups = append(groups, g.Group)
+		}
+		infof("passing GPU %s through with VFIO group %s", g.BusID, g.Group)
+	}
+
+	if hook.DryRun || *dryrunflag {
+		infof("dry run: the VFIO groups %s would be added", strings.Join(groups, ","))
+		return
+	}
+	err = oci.UpdateSpec(path.Join(*bundle, "config.json"), func(spec map[string]interface{}) {
+		addVFIODevices(spec, groups)
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+}
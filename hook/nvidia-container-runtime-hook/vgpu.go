@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// nvmlGpuVirtualizationMode_t as reported by nvidia-smi.
+	virtualizationModeVGPU = "VGPU"
+
+	// Driver capability of the vGPU libraries of the guest driver.
+	vgpuCapability = "vgpu"
+)
+
+var (
+	gridLicenseDir = "/etc/nvidia"
+	// Files read by nvidia-gridd to acquire a license, in the guest and in the container alike.
+	gridLicenseFiles = []string{"gridd.conf", "ClientConfigToken/*.tok"}
+
+	defaultVGPULibraries = []string{
+		"/usr/lib*/libnvidia-vgpu*.so*", "/usr/lib*/*/libnvidia-vgpu*.so*",
+		"/usr/lib*/libnvidia-vgxcfg.so*", "/usr/lib*/*/libnvidia-vgxcfg.so*",
+	}
+)
+
+// isVGPUGuest reports whether the node is a VM with vGPU (GRID) devices rather than passthrough GPUs.
+func isVGPUGuest(config CLIConfig) bool {
+	rows, err := queryGPUs(config, "virtualization_mode")
+	if err != nil {
+		warnf("couldn't query the virtualization mode: %v", err)
+		return false
+	}
+	for _, row := range rows {
+		if row[0] == virtualizationModeVGPU {
+			return true
+		}
+	}
+	return false
+}
+
+// copyLicenseFiles makes the license client configuration of the guest available in the container.
+func copyLicenseFiles(container containerConfig) {
+	for _, pattern := range gridLicenseFiles {
+		matches, err := filepath.Glob(filepath.Join(gridLicenseDir, pattern))
+		if err != nil {
+			log.Panicln(err)
+		}
+		for _, src := range matches {
+			// The license directory of the image may be a symlink, it's resolved in the rootfs.
+			dst, err := resolveContainerPath(container, src)
+			if err != nil {
+				log.Panicln("could not resolve license file in container:", err)
+			}
+			b, err := ioutil.ReadFile(src)
+			if err != nil {
+				log.Panicln("could not read license file:", err)
+			}
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				log.Panicln("could not create license directory in container:", err)
+			}
+			if err := writeTextfile(dst, b); err != nil {
+				log.Panicln("could not copy license file to container:", err)
+			}
+		}
+	}
+}
+
+// checkVGPUDevices explains the requests of UUIDs unknown to a vGPU guest: its vGPUs have their own UUIDs, not the
+// ones of the physical GPUs on the host, which passthrough configurations usually carry over.
+func checkVGPUDevices(config CLIConfig, devices string) {
+	info, err := getDriverInfo(config)
+	if err != nil {
+		fail(exitCodeCLIFailure, err)
+	}
+	var unknown []string
+	for _, d := range info.UnknownDevices(devices, nil) {
+		if strings.HasPrefix(strings.ToUpper(d), "GPU-") {
+			unknown = append(unknown, d)
+		}
+	}
+	if len(unknown) > 0 {
+		fail(exitCodeBadSpec, fmt.Errorf("unknown GPUs %s on this vGPU guest: the UUIDs of its vGPUs differ from the ones "+
+			"of the physical GPUs, request the UUIDs listed by nvidia-smi -L in the guest", strings.Join(unknown, ",")))
+	}
+}
+
+// configureVGPU provides the license client configuration to the container, and the vGPU libraries of the guest
+// driver to the containers requesting the vgpu capability.
+func configureVGPU(hook HookConfig, container containerConfig) {
+	// vGPU devices are unusable until the container acquires a license.
+	copyLicenseFiles(container)
+	if hasCapability(container.Nvidia.Capabilities, vgpuCapability) {
+		mountLibraries(hook.NvidiaContainerCLI, container, "/", hook.VGPULibraries)
+	}
+}
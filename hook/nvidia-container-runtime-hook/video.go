@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Driver capabilities of a part of the video codecs, nvidia-container-cli injects them all with --video and the hook
+// removes the libraries of the parts not requested.
+const (
+	nvencCapability  = "nvenc"
+	nvdecCapability  = "nvdec"
+	nvjpegCapability = "nvjpeg"
+)
+
+var videoCapabilities = []string{nvencCapability, nvdecCapability, nvjpegCapability}
+
+// defaultVideoLibraries returns the libraries of --video kept by each part, the others are kept by all of them.
+func defaultVideoLibraries() map[string][]string {
+	return map[string][]string{
+		nvencCapability:  {"libnvidia-encode.so*", "libnvidia-opticalflow.so*"},
+		nvdecCapability:  {"libnvcuvid.so*", "libvdpau_nvidia.so*"},
+		nvjpegCapability: {"libnvcuvid.so*"},
+	}
+}
+
+func isVideoCapability(name string) bool {
+	for _, c := range videoCapabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// getExcludedVideoLibraries returns the library patterns of the video parts the capabilities don't request, none
+// when they request video or no part of it.
+func getExcludedVideoLibraries(libraries map[string][]string, capabilities string) ([]string, error) {
+	var names []string
+	for name := range libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !isVideoCapability(name) {
+			return nil, fmt.Errorf("video libraries of an unknown video capability: %s, one of %s", name, strings.Join(videoCapabilities, ", "))
+		}
+	}
+
+	requested := false
+	kept := make(map[string]bool)
+	for _, c := range strings.Split(capabilities, ",") {
+		if c == "video" {
+			return nil, nil
+		}
+		if isVideoCapability(c) {
+			requested = true
+			for _, p := range libraries[c] {
+				kept[p] = true
+			}
+		}
+	}
+	if !requested {
+		return nil, nil
+	}
+	var excluded []string
+	for _, name := range names {
+		for _, p := range libraries[name] {
+			if !kept[p] {
+				kept[p] = true
+				excluded = append(excluded, p)
+			}
+		}
+	}
+	return excluded, nil
+}
+
+// filterVideoLibraries removes the video libraries injected by nvidia-container-cli which the containers
+// requesting a part of the video codecs, e.g. nvdec without nvenc, didn't request.
+func filterVideoLibraries(hook HookConfig, container containerConfig) {
+	excluded, err := getExcludedVideoLibraries(hook.VideoLibraries, container.Nvidia.Capabilities)
+	if err != nil {
+		fail(exitCodeBadConfig, err)
+	}
+	if len(excluded) > 0 {
+		infof("removing the video libraries %s", strings.Join(excluded, ", "))
+		excludeLibraries(hook.NvidiaContainerCLI, container, excluded)
+	}
+}
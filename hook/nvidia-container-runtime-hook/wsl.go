@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Under WSL2 the GPUs are paravirtualized through /dev/dxg, the driver is the one of the Windows host,
+// shared with the Linux guest under /usr/lib/wsl.
+const (
+	modeWSL = "wsl"
+
+	dxgDevice     = "/dev/dxg"
+	wslLibDir     = "/usr/lib/wsl/lib"
+	wslDriversDir = "/usr/lib/wsl/drivers"
+
+	wslLdConf = "/etc/ld.so.conf.d/00-nvidia-wsl.conf"
+)
+
+func isWSL() bool {
+	_, err := os.Stat(dxgDevice)
+	return err == nil
+}
+
+// getWSLMounts returns the directories of the driver: the libraries of WSL (libdxcore, libcuda stubs, nvidia-smi)
+// and the directories of the driver store holding the NVIDIA libraries.
+func getWSLMounts(libDir string, driversDir string) []string {
+	mounts := []string{libDir}
+	matches, err := filepath.Glob(filepath.Join(driversDir, "*", "libcuda.so*"))
+	if err != nil {
+		log.Panicln(err)
+	}
+	seen := make(map[string]bool)
+	for _, m := range matches {
+		if dir := filepath.Dir(m); !seen[dir] {
+			seen[dir] = true
+			mounts = append(mounts, dir)
+		}
+	}
+	sort.Strings(mounts[1:])
+	return mounts
+}
+
+// configureWSL injects /dev/dxg and the driver directories of WSL2 instead of nvidia-container-cli,
+// which doesn't know about the paravirtualized GPUs.
+func configureWSL(hook HookConfig, container containerConfig) {
+	if !isWSL() {
+		log.Panicf("%s is missing, this isn't a WSL2 system with GPU paravirtualization", dxgDevice)
+	}
+	infof("injecting device %s", dxgDevice)
+	injectHostDevice(container, dxgDevice)
+
+	for _, dir := range getWSLMounts(wslLibDir, wslDriversDir) {
+		infof("mounting %s", dir)
+		bindContainerMount(hook.NvidiaContainerCLI, container, cdiMount{HostPath: dir, ContainerPath: dir, Options: []string{"ro"}})
+	}
+
+	if len(getMuslArch(container.Rootfs)) > 0 {
+		return
+	}
+	// The config of the image may be a symlink, it's written in the rootfs only.
+	conf, err := resolveContainerPath(container, wslLdConf)
+	if err != nil {
+		log.Panicln("could not resolve", wslLdConf, "in the container:", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(conf), 0755); err != nil {
+		log.Panicln("could not create", filepath.Dir(wslLdConf), "in the container:", err)
+	}
+	if err := writeTextfile(conf, []byte(wslLibDir+"\n")); err != nil {
+		log.Panicln("could not write", wslLdConf, "in the container:", err)
+	}
+	updateLdCache(hook.NvidiaContainerCLI, container)
+}
@@ -28,10 +28,12 @@ mkdir -p %{buildroot}%{_bindir}
 install -m 755 -t %{buildroot}%{_bindir} nvidia-container-runtime-hook
 mkdir -p %{buildroot}/etc/nvidia-container-runtime
 install -m 644 -t %{buildroot}/etc/nvidia-container-runtime config.toml
+mkdir -p %{buildroot}/etc/nvidia-container-runtime/config.toml.d
 
 %files
 %license LICENSE
 %{_bindir}/nvidia-container-runtime-hook
 /etc/nvidia-container-runtime/config.toml
+%dir /etc/nvidia-container-runtime/config.toml.d
 
 %changelog